@@ -0,0 +1,119 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/spidernet-io/plugins/pkg/config"
+	"github.com/spidernet-io/plugins/pkg/webhook"
+)
+
+var (
+	configFile    = flag.String("config", "-", "the CNI config or config list to validate, - reads it from stdin")
+	nodeConfigDir = flag.String("node-config-dir", config.DefaultNodeConfigDir, "the directory of the node config merged into the veth plugins, empty to skip merging")
+)
+
+// veth-validate validates a CNI config on a node the way the plugin sees it, the node config is merged into
+// the veth plugins like the plugin does. The merged config is printed, and it exits with 1 if it's invalid.
+func main() {
+	flag.Parse()
+
+	merged, err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out := bytes.Buffer{}
+	if err = json.Indent(&out, merged, "", "  "); err != nil {
+		out.Write(merged)
+	}
+	fmt.Println(out.String())
+}
+
+func run() ([]byte, error) {
+	data, err := readConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := mergeNodeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	errs, warnings := webhook.ValidateNetworkAttachmentDefinition(&netv1.NetworkAttachmentDefinition{Spec: netv1.NetworkAttachmentDefinitionSpec{Config: string(merged)}})
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("invalid config: %v", errs.ToAggregate())
+	}
+	return merged, nil
+}
+
+func readConfig(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// mergeNodeConfig merges the node config into the config of the veth plugin, or the ones in a config list
+func mergeNodeConfig(data []byte) ([]byte, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %v", err)
+	}
+
+	plugins, ok := raw["plugins"]
+	if !ok {
+		return mergePlugin(data)
+	}
+
+	var pluginList []json.RawMessage
+	if err := json.Unmarshal(plugins, &pluginList); err != nil {
+		return nil, fmt.Errorf("failed to decode plugins: %v", err)
+	}
+	for idx := range pluginList {
+		merged, err := mergePlugin(pluginList[idx])
+		if err != nil {
+			return nil, err
+		}
+		pluginList[idx] = merged
+	}
+
+	var err error
+	if raw["plugins"], err = json.Marshal(pluginList); err != nil {
+		return nil, err
+	}
+	return json.Marshal(raw)
+}
+
+func mergePlugin(data []byte) ([]byte, error) {
+	plugin := struct {
+		Type string `json:"type"`
+	}{}
+	if err := json.Unmarshal(data, &plugin); err != nil {
+		return nil, fmt.Errorf("failed to decode plugin: %v", err)
+	}
+	if plugin.Type != webhook.VethPluginType {
+		return data, nil
+	}
+
+	merged, files, err := config.MergeNodeConfig(data, *nodeConfigDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		fmt.Fprintln(os.Stderr, "merged node config:", file)
+	}
+	return merged, nil
+}
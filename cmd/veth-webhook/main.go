@@ -0,0 +1,91 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned"
+	pVersion "github.com/spidernet-io/plugins/internal/version"
+	"github.com/spidernet-io/plugins/pkg/webhook"
+	"github.com/spidernet-io/spiderpool/pkg/logutils"
+	"go.uber.org/zap"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	listenAddress = flag.String("listen-address", ":9443", "the address the webhook server listens on")
+	tlsCertFile   = flag.String("tls-cert-file", "/etc/veth-webhook/tls.crt", "the x509 certificate for https")
+	tlsKeyFile    = flag.String("tls-private-key-file", "/etc/veth-webhook/tls.key", "the x509 private key matching --tls-cert-file")
+	kubeconfig    = flag.String("kubeconfig", "", "path to a kubeconfig, in-cluster config is used if empty")
+	audit         = flag.Bool("audit", true, "report the existing invalid NetworkAttachmentDefinitions on startup")
+)
+
+func main() {
+	flag.Parse()
+	logger := logutils.Logger.Named("veth-webhook")
+
+	logger.Info("Veth webhook starting", zap.String("Version", pVersion.Version()),
+		zap.String("Branch", pVersion.GitBranch()),
+		zap.String("Commit", pVersion.GitCommit()),
+		zap.String("Build time", pVersion.BuildDate()),
+		zap.String("Go Version", pVersion.GoString()))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if *audit {
+		go runAudit(ctx, logger)
+	}
+
+	server := &http.Server{
+		Addr:              *listenAddress,
+		Handler:           webhook.NewHandler(logger),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to shutdown webhook server", zap.Error(err))
+		}
+	}()
+
+	logger.Info("Serving webhook", zap.String("address", *listenAddress), zap.String("path", webhook.ValidatePath))
+	if err := server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile); err != nil && err != http.ErrServerClosed {
+		logger.Error("failed to serve webhook", zap.Error(err))
+		os.Exit(1)
+	}
+}
+
+// runAudit reports the invalid NetworkAttachmentDefinitions which exist before the webhook is installed,
+// a failure here only be logged and never stops the webhook server.
+func runAudit(ctx context.Context, logger *zap.Logger) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		logger.Error("failed to build kubeconfig, skip auditing", zap.Error(err))
+		return
+	}
+
+	client, err := versioned.NewForConfig(restConfig)
+	if err != nil {
+		logger.Error("failed to create NetworkAttachmentDefinition client, skip auditing", zap.Error(err))
+		return
+	}
+
+	invalid, err := webhook.Audit(ctx, logger, client)
+	if err != nil {
+		logger.Error("failed to audit NetworkAttachmentDefinitions", zap.Error(err))
+		return
+	}
+	logger.Info("Audit NetworkAttachmentDefinitions done", zap.Int("invalid", len(invalid)))
+}
@@ -0,0 +1,13 @@
+package cnierrors_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCNIErrors(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CNIErrors Suite")
+}
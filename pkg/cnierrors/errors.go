@@ -0,0 +1,132 @@
+package cnierrors
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// Plugin specific error codes, the CNI spec reserves 0-99 for the well-known codes
+const (
+	// ErrRuleTableExhausted means no policy routing table is left for the interface
+	ErrRuleTableExhausted uint = 101
+	// ErrUnsupportedFirstInterface means the first interface of the pod isn't created by macvlan or sriov
+	ErrUnsupportedFirstInterface uint = 102
+	// ErrNodeAddressDiscovery means the addresses of the node can't be listed
+	ErrNodeAddressDiscovery uint = 103
+	// ErrUnsupportedDevice means the device type of the pod isn't supported by the kernel
+	ErrUnsupportedDevice uint = 104
+	// ErrUnsupportedBPF means the kernel lacks the eBPF program type or helpers of a feature
+	ErrUnsupportedBPF uint = 105
+	// ErrIPv6Disabled means the pod has IPv6 addresses, but IPv6 is disabled on the node, see strict_dual_stack
+	ErrIPv6Disabled uint = 106
+	// ErrIPv6ForwardingDisabled means the pod has IPv6 addresses, but the node doesn't forward IPv6
+	ErrIPv6ForwardingDisabled uint = 107
+)
+
+// Error is an error of the plugin carrying a CNI error code, it wraps the underlying
+// error so errors.Is and errors.As work on it.
+type Error struct {
+	Code uint
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %v", e.Msg, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// CNIError converts the error into the CNI error result, the underlying error is put into details
+func (e *Error) CNIError() *types.Error {
+	details := ""
+	if e.Err != nil {
+		details = e.Err.Error()
+	}
+	return types.NewError(e.Code, e.Msg, details)
+}
+
+// New returns an error with the given code
+func New(code uint, err error, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...), Err: err}
+}
+
+// InvalidConfig returns an error of ErrInvalidNetworkConfig
+func InvalidConfig(err error, format string, args ...interface{}) *Error {
+	return New(types.ErrInvalidNetworkConfig, err, format, args...)
+}
+
+// DecodingFailure returns an error of ErrDecodingFailure
+func DecodingFailure(err error, format string, args ...interface{}) *Error {
+	return New(types.ErrDecodingFailure, err, format, args...)
+}
+
+// Internal returns an error of ErrInternal
+func Internal(err error, format string, args ...interface{}) *Error {
+	return New(types.ErrInternal, err, format, args...)
+}
+
+// IO classifies the error of a netlink or sysctl operation: a transient error like EBUSY
+// is ErrTryAgainLater so the runtime could retry, others are ErrIOFailure.
+func IO(err error, format string, args ...interface{}) *Error {
+	if IsTransient(err) {
+		return New(types.ErrTryAgainLater, err, format, args...)
+	}
+	return New(types.ErrIOFailure, err, format, args...)
+}
+
+// IsTransient returns true if the error is worth to retry later
+func IsTransient(err error) bool {
+	for _, errno := range []unix.Errno{unix.EBUSY, unix.EAGAIN, unix.EINTR, unix.ENOBUFS} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Code returns the CNI error code of the given error, ErrInternal if it isn't typed
+func Code(err error) uint {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	var cniErr *types.Error
+	if errors.As(err, &cniErr) {
+		return cniErr.Code
+	}
+	return types.ErrInternal
+}
+
+// ToCNIError maps any error to the CNI error result, the outermost message is kept
+// and the code is taken from the first typed error in the chain.
+func ToCNIError(err error) *types.Error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		if e == err {
+			return e.CNIError()
+		}
+		return types.NewError(e.Code, err.Error(), "")
+	}
+
+	var cniErr *types.Error
+	if errors.As(err, &cniErr) {
+		if cniErr == err {
+			return cniErr
+		}
+		return types.NewError(cniErr.Code, err.Error(), "")
+	}
+	return types.NewError(types.ErrInternal, err.Error(), "")
+}
@@ -0,0 +1,48 @@
+package cnierrors
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+var _ = Describe("cnierrors", func() {
+	Context("Test IO", func() {
+		It("transient netlink error is try again later", func() {
+			err := IO(unix.EBUSY, "failed to add route")
+			Expect(err.Code).To(Equal(types.ErrTryAgainLater))
+			Expect(errors.Is(err, unix.EBUSY)).To(BeTrue())
+		})
+
+		It("other netlink error is io failure", func() {
+			err := IO(unix.EPERM, "failed to add route")
+			Expect(err.Code).To(Equal(types.ErrIOFailure))
+		})
+	})
+
+	Context("Test ToCNIError", func() {
+		It("typed error keeps the underlying error in details", func() {
+			cniErr := ToCNIError(InvalidConfig(errors.New("bad cidr"), "invalid veth config"))
+			Expect(cniErr.Code).To(Equal(types.ErrInvalidNetworkConfig))
+			Expect(cniErr.Msg).To(Equal("invalid veth config"))
+			Expect(cniErr.Details).To(Equal("bad cidr"))
+		})
+
+		It("wrapped typed error keeps the outermost message", func() {
+			err := fmt.Errorf("failed to setup routes: %w", New(ErrRuleTableExhausted, nil, "no table"))
+			cniErr := ToCNIError(err)
+			Expect(cniErr.Code).To(Equal(ErrRuleTableExhausted))
+			Expect(cniErr.Msg).To(Equal("failed to setup routes: no table"))
+			Expect(Code(err)).To(Equal(ErrRuleTableExhausted))
+		})
+
+		It("untyped error is internal", func() {
+			Expect(ToCNIError(errors.New("unknown")).Code).To(Equal(types.ErrInternal))
+			Expect(ToCNIError(nil)).To(BeNil())
+		})
+	})
+})
@@ -8,47 +8,50 @@ import (
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
 	"github.com/spidernet-io/plugins/pkg/logging"
+	"github.com/spidernet-io/plugins/pkg/networking"
 	"github.com/spidernet-io/plugins/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/utils/pointer"
 )
 
 // ParseVethConfig parses the supplied configuration (and prevResult) from stdin.
 func ParseVethConfig(stdin []byte) (*types.Veth, error) {
-	var err error
 	conf := types.Veth{}
 
 	if err := json.Unmarshal(stdin, &conf); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %v", err)
+		return nil, cnierrors.DecodingFailure(err, "failed to parse config")
 	}
 
 	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
-		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+		return nil, cnierrors.DecodingFailure(err, "failed to parse prevResult")
 	}
 
 	if conf.PrevResult == nil {
-		return nil, fmt.Errorf("failed to find PrevResult, must be called as chained plugin")
+		return nil, cnierrors.InvalidConfig(nil, "failed to find PrevResult, must be called as chained plugin")
 	}
 
-	if err = validateHwPrefix(conf.HwPrefix); err != nil {
-		return nil, err
+	allErrs := ValidateKnownFields(stdin, nil)
+	allErrs = append(allErrs, ValidateVethConfig(&conf, nil)...)
+	if !conf.OnlyHardware {
+		errs, err := validatePrevResultFamily(&conf)
+		if err != nil {
+			return nil, err
+		}
+		allErrs = append(allErrs, errs...)
 	}
-
-	conf.LogOptions = logging.InitLogOptions(conf.LogOptions)
-	if conf.LogOptions.LogFilePath == "" {
-		conf.LogOptions.LogFilePath = types.VethLogDefaultFilePath
+	if len(allErrs) != 0 {
+		return nil, cnierrors.InvalidConfig(allErrs.ToAggregate(), "invalid veth config")
 	}
 
+	conf.LogOptions = VethLogOptions(conf.LogOptions)
+
 	if conf.OnlyHardware {
 		return &conf, nil
 	}
 
-	if err = ValidateRoutes(conf.ClusterCIDR, conf.ServiceCIDR, conf.AdditionalCIDR); err != nil {
-		return nil, err
-	}
-
-	// value must be 0/1/2
-	// If not, giving default value: RPFilter_Loose(2) to it
+	// value has been validated to be 0/1/2
 	if conf.RPFilter == nil {
 		conf.RPFilter = &types.RPFilter{
 			Enable: pointer.Bool(true),
@@ -61,6 +64,142 @@ func ParseVethConfig(stdin []byte) (*types.Veth, error) {
 	return &conf, nil
 }
 
+// ValidateVethConfig validates the fields of veth config which don't depend on
+// prevResult, every error is reported with the json path of the invalid field.
+// It is shared by ParseVethConfig and the admission webhook.
+func ValidateVethConfig(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if err := validateHwPrefix(conf.HwPrefix); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("hardware_prefix"), conf.HwPrefix, err.Error()))
+	}
+
+	allErrs = append(allErrs, validateLogOptions(conf.LogOptions, fldPath.Child("log_options"))...)
+	if conf.LockTimeout != nil && *conf.LockTimeout < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("lock_timeout"), *conf.LockTimeout, "must be greater than or equal to 0"))
+	}
+	allErrs = append(allErrs, validatePodOverrides(conf.PodOverrides, fldPath.Child("pod_overrides"))...)
+	allErrs = append(allErrs, validateNodeOverrides(conf.NodeOverrides, fldPath.Child("node_overrides"))...)
+	if conf.RuntimeConfig != nil && conf.RuntimeConfig.Mac != "" {
+		if _, err := ParseMAC(conf.RuntimeConfig.Mac); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("runtimeConfig", "mac"), conf.RuntimeConfig.Mac, err.Error()))
+		}
+	}
+
+	if conf.OnlyHardware {
+		return allErrs
+	}
+
+	allErrs = append(allErrs, validateCIDRs(conf.ClusterCIDR, fldPath.Child("cluster_cidr"))...)
+	allErrs = append(allErrs, validateCIDRs(conf.ServiceCIDR, fldPath.Child("service_cidr"))...)
+	allErrs = append(allErrs, validateCIDRs(conf.AdditionalCIDR, fldPath.Child("additional_cidr"))...)
+	allErrs = append(allErrs, validateCIDROverlaps(conf, fldPath)...)
+	allErrs = append(allErrs, validateRPFilterValue(conf.RPFilter, fldPath.Child("rp_filter"))...)
+	allErrs = append(allErrs, validateCustomRoutes(conf.Routes, fldPath.Child("routes"))...)
+	allErrs = append(allErrs, validateRuntimeRoutes(conf, fldPath.Child("runtimeConfig", "routes"))...)
+	allErrs = append(allErrs, validateRouteSource(conf.RouteSource, fldPath.Child("route_source"))...)
+	allErrs = append(allErrs, validateHostGateway(conf.HostGateway, fldPath.Child("host_gateway"))...)
+	allErrs = append(allErrs, validateEgressViaHost(conf.EgressViaHost, fldPath.Child("egress_via_host"))...)
+	allErrs = append(allErrs, validateReplyViaVeth(conf, fldPath.Child("reply_via_veth"))...)
+	allErrs = append(allErrs, validateHostFilter(conf, fldPath.Child("host_filter"))...)
+	allErrs = append(allErrs, validateConntrackCleanup(conf.ConntrackCleanup, fldPath.Child("conntrack_cleanup"))...)
+	allErrs = append(allErrs, validateDeviceType(conf.DeviceType, fldPath.Child("device_type"))...)
+	allErrs = append(allErrs, validateIPv6(conf.IPv6, fldPath.Child("ipv6"))...)
+	allErrs = append(allErrs, validateOffload(conf, fldPath.Child("offload"))...)
+	allErrs = append(allErrs, validateEBPFRedirect(conf, fldPath.Child("ebpf_redirect"))...)
+	allErrs = append(allErrs, validateBandwidth(conf, fldPath)...)
+	allErrs = append(allErrs, validateFirewallBackend(conf.FirewallBackend, fldPath.Child("firewall_backend"))...)
+	return allErrs
+}
+
+// validatePrevResultFamily checks the CIDRs against the family of the addresses in prevResult. It's skipped if
+// prevResult has no addresses, the family is unknown then.
+func validatePrevResultFamily(conf *types.Veth) (field.ErrorList, error) {
+	ips, err := networking.GetIPs(conf.PrevResult)
+	if err != nil || len(ips) == 0 {
+		return nil, err
+	}
+	ipFamily, err := networking.GetIPFamily(conf.PrevResult)
+	if err != nil {
+		return nil, err
+	}
+	return ValidateCIDRFamily(conf, ipFamily, nil), nil
+}
+
+// RuntimeRoutes returns the routes of runtimeConfig as the custom routes via veth0
+func RuntimeRoutes(conf *types.Veth) []types.Route {
+	if conf.RuntimeConfig == nil {
+		return nil
+	}
+
+	routes := make([]types.Route, 0, len(conf.RuntimeConfig.Routes))
+	for _, r := range conf.RuntimeConfig.Routes {
+		route := types.Route{Dst: r.Dst.String(), Dev: types.RouteDevVeth}
+		if r.GW != nil {
+			route.Via = r.GW.String()
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// DropIPv6 removes the IPv6 CIDRs, routes and addresses from the parsed config, so only IPv4 of a dual-stack
+// pod is set up. prevResult is kept, it's passed on to the runtime as is.
+func DropIPv6(conf *types.Veth) {
+	conf.ClusterCIDR = ipv4CIDRs(conf.ClusterCIDR)
+	conf.ServiceCIDR = ipv4CIDRs(conf.ServiceCIDR)
+	conf.AdditionalCIDR = ipv4CIDRs(conf.AdditionalCIDR)
+
+	routes := conf.Routes[:0:0]
+	for _, route := range conf.Routes {
+		if !isIPv6CIDR(route.Dst) {
+			routes = append(routes, route)
+		}
+	}
+	conf.Routes = routes
+
+	if conf.RuntimeConfig != nil {
+		runtimeRoutes := conf.RuntimeConfig.Routes[:0:0]
+		for _, route := range conf.RuntimeConfig.Routes {
+			if route.Dst.IP.To4() != nil {
+				runtimeRoutes = append(runtimeRoutes, route)
+			}
+		}
+		conf.RuntimeConfig.Routes = runtimeRoutes
+	}
+	if conf.RouteSource != nil {
+		conf.RouteSource.IPv6CIDR = ""
+	}
+	if conf.HostGateway != nil {
+		conf.HostGateway.IPv6 = ""
+	}
+}
+
+func ipv4CIDRs(cidrs []string) []string {
+	var ipv4 []string
+	for _, cidr := range cidrs {
+		if !isIPv6CIDR(cidr) {
+			ipv4 = append(ipv4, cidr)
+		}
+	}
+	return ipv4
+}
+
+func isIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	return err == nil && ip.To4() == nil
+}
+
+// validateCIDRs is the field-level variant of validateRoutes
+func validateCIDRs(cidrs []string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for idx, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(idx), cidr, err.Error()))
+		}
+	}
+	return allErrs
+}
+
 func validateHwPrefix(prefix string) error {
 	if prefix == "" {
 		return nil
@@ -113,17 +252,13 @@ func validateRPFilterConfig(rpfilter *types.RPFilter) {
 		rpfilter.Enable = pointer.Bool(true)
 		rpfilter.Value = 0
 	}
+}
 
-	if *rpfilter.Enable {
-		found := false
-		for _, value := range []int32{0, 1, 2} {
-			if rpfilter.Value == value {
-				found = true
-				break
-			}
-		}
-		if !found {
-			rpfilter.Value = 0
-		}
+// VethLogOptions fills the defaults of the log options, the log file is the one of veth by default
+func VethLogOptions(logOptions *types.LogOptions) *types.LogOptions {
+	logOptions = logging.InitLogOptions(logOptions)
+	if logOptions.LogFilePath == "" {
+		logOptions.LogFilePath = types.VethLogDefaultFilePath
 	}
+	return logOptions
 }
@@ -1,9 +1,15 @@
 package config
 
 import (
+	"math"
+	"net"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	ty "github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/utils/pointer"
 )
 
@@ -60,17 +66,18 @@ var _ = Describe("config", func() {
 			Expect(config).To(Equal(want))
 		})
 
-		It("value must be 0/1/2, if not we set it to 0", func() {
+		It("value must be 0/1/2, if not we return err", func() {
 			var config = &ty.RPFilter{
 				Enable: pointer.Bool(true),
 				Value:  10,
 			}
-			var want = &ty.RPFilter{
-				Enable: pointer.Bool(true),
-				Value:  0,
-			}
-			validateRPFilterConfig(config)
-			Expect(config).To(Equal(want))
+			errs := validateRPFilterValue(config, field.NewPath("rp_filter"))
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("rp_filter.value"))
+		})
+
+		It("ignore the value if rp_filter is disabled", func() {
+			Expect(validateRPFilterValue(&ty.RPFilter{Enable: pointer.Bool(false), Value: 10}, field.NewPath("rp_filter"))).To(BeEmpty())
 		})
 
 		It("correct rp_filter config", func() {
@@ -101,4 +108,401 @@ var _ = Describe("config", func() {
 			Expect(err).To(BeNil())
 		})
 	})
+
+	Context("Test ValidateKnownFields", func() {
+		It("reject unknown keys", func() {
+			errs := ValidateKnownFields([]byte(`{"cniVersion": "0.3.1", "type": "veth", "service_cidrs": ["10.233.0.0/18"]}`), nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("service_cidrs"))
+		})
+
+		It("reject unknown keys of nested objects", func() {
+			errs := ValidateKnownFields([]byte(`{"type": "veth", "rp_filter": {"enable": true}}`), nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("rp_filter.enable"))
+		})
+
+		It("accept the keys of NetConf and the well-known keys", func() {
+			errs := ValidateKnownFields([]byte(`{"cniVersion": "0.3.1", "name": "macvlan", "type": "veth", "ipam": {"type": "spiderpool", "pool": "default"},
+				"prevResult": {}, "runtimeConfig": {}, "args": {}, "cluster_cidr": [], "log_options": {"log_level": "info"}}`), nil)
+			Expect(errs).To(BeEmpty())
+		})
+	})
+
+	Context("Test VethLogOptions", func() {
+		It("log to the file of veth by default", func() {
+			opts := VethLogOptions(nil)
+			Expect(opts.LogFilePath).To(Equal(ty.VethLogDefaultFilePath))
+			Expect(opts.LogLevel).NotTo(BeEmpty())
+		})
+
+		It("keep the given log file", func() {
+			opts := VethLogOptions(&ty.LogOptions{LogFilePath: "/tmp/veth.log"})
+			Expect(opts.LogFilePath).To(Equal("/tmp/veth.log"))
+		})
+	})
+
+	Context("Test validateCIDROverlaps", func() {
+		It("report duplicate and overlapping cidrs across lists", func() {
+			conf := &ty.Veth{
+				ClusterCIDR:    []string{"10.233.64.0/18"},
+				ServiceCIDR:    []string{"10.233.0.0/18", "10.233.64.0/18"},
+				AdditionalCIDR: []string{"10.233.1.0/24"},
+			}
+			errs := validateCIDROverlaps(conf, nil)
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Type).To(Equal(field.ErrorTypeDuplicate))
+			Expect(errs[0].Field).To(Equal("service_cidr[1]"))
+			Expect(errs[1].Field).To(Equal("additional_cidr[0]"))
+		})
+
+		It("no overlap", func() {
+			conf := &ty.Veth{
+				ClusterCIDR: []string{"10.233.64.0/18", "fd00:10:244::/112"},
+				ServiceCIDR: []string{"10.233.0.0/18", "fd00:10:96::/112"},
+			}
+			Expect(validateCIDROverlaps(conf, nil)).To(BeEmpty())
+		})
+	})
+
+	Context("Test ValidateCIDRFamily", func() {
+		conf := &ty.Veth{
+			ClusterCIDR: []string{"10.233.64.0/18", "fd00:10:244::/112"},
+		}
+
+		It("ipv6 cidr for ipv4-only prevResult", func() {
+			errs := ValidateCIDRFamily(conf, netlink.FAMILY_V4, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("cluster_cidr[1]"))
+		})
+
+		It("ipv4 cidr for ipv6-only prevResult", func() {
+			errs := ValidateCIDRFamily(conf, netlink.FAMILY_V6, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("cluster_cidr[0]"))
+		})
+
+		It("dual-stack prevResult", func() {
+			Expect(ValidateCIDRFamily(conf, netlink.FAMILY_ALL, nil)).To(BeEmpty())
+		})
+
+		It("prevResult without addresses", func() {
+			_, err := ParseVethConfig([]byte(`{
+				"cniVersion": "1.0.0", "name": "macvlan", "type": "veth",
+				"cluster_cidr": ["10.233.64.0/18", "fd00:10:244::/112"],
+				"prevResult": {"cniVersion": "1.0.0", "interfaces": [{"name": "net1"}]}
+			}`))
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("Test VethConfigWarnings", func() {
+		It("warn routing fields with only_hardware", func() {
+			conf := &ty.Veth{OnlyHardware: true, ClusterCIDR: []string{"10.233.64.0/18"}}
+			Expect(VethConfigWarnings(conf)).To(HaveLen(1))
+		})
+
+		It("no warning without only_hardware", func() {
+			conf := &ty.Veth{ClusterCIDR: []string{"10.233.64.0/18"}}
+			Expect(VethConfigWarnings(conf)).To(BeEmpty())
+		})
+	})
+	Context("Test ValidateVethConfig", func() {
+		It("reject negative lock_timeout", func() {
+			conf := &ty.Veth{LockTimeout: pointer.Int(-1)}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("lock_timeout"))
+		})
+
+		It("zero lock_timeout means the default", func() {
+			Expect(ValidateVethConfig(&ty.Veth{LockTimeout: pointer.Int(0)}, nil)).To(BeEmpty())
+		})
+	})
+	Context("Test route_source and host_gateway", func() {
+		It("reject invalid cidrs and addresses of wrong family", func() {
+			conf := &ty.Veth{
+				RouteSource: &ty.RouteSource{IPv4CIDR: "fd00::/64", IPv6CIDR: "invalid"},
+				HostGateway: &ty.HostGateway{IPv4: "10.6.0.1", IPv6: "10.6.0.1"},
+			}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0].Field).To(Equal("route_source.ipv4_cidr"))
+			Expect(errs[1].Field).To(Equal("route_source.ipv6_cidr"))
+			Expect(errs[2].Field).To(Equal("host_gateway.ipv6"))
+		})
+
+		It("warn host_gateway with link_local_gateway", func() {
+			conf := &ty.Veth{LinkLocalGateway: true, HostGateway: &ty.HostGateway{IPv4: "10.6.0.1"}, ReplyViaVeth: &ty.ReplyViaVeth{Enable: true}}
+			Expect(VethConfigWarnings(conf)).To(HaveLen(1))
+		})
+
+		It("warn link_local_gateway without the replies to the node via veth0", func() {
+			conf := &ty.Veth{LinkLocalGateway: true}
+			Expect(VethConfigWarnings(conf)).To(ConsistOf(ContainSubstring("reply_via_veth or egress_via_host")))
+			conf.EgressViaHost = &ty.EgressViaHost{Enable: true}
+			Expect(VethConfigWarnings(conf)).To(BeEmpty())
+		})
+	})
+	Context("Test validateCustomRoutes", func() {
+		It("accept valid routes", func() {
+			table := 100
+			routes := []ty.Route{
+				{Dst: "169.254.20.10/32", Metric: 10},
+				{Dst: "10.233.100.0/24", Exclude: true},
+				{Dst: "10.8.0.0/16", Dev: ty.RouteDevChained, Via: "10.6.0.1", MTU: 1400, Table: &table},
+			}
+			Expect(validateCustomRoutes(routes, field.NewPath("routes"))).To(BeEmpty())
+		})
+
+		It("reject invalid routes", func() {
+			table := 255
+			routes := []ty.Route{
+				{Dst: "10.8.0.0/33"},
+				{Dst: "10.8.0.0/16", Dev: "eth0"},
+				{Dst: "10.8.0.0/16", Dev: ty.RouteDevVeth, Exclude: true},
+				{Dst: "10.9.0.0/16", Via: "fd00::1", Metric: -1, MTU: 10, Table: &table},
+				{Dst: "fd00:9::/64", MTU: 1280},
+				{Dst: "fd00:8::/64", MTU: 1200},
+			}
+			errs := validateCustomRoutes(routes, field.NewPath("routes"))
+			var fields []string
+			for _, err := range errs {
+				fields = append(fields, err.Field)
+			}
+			Expect(fields).To(Equal([]string{
+				"routes[0].dst",
+				"routes[1].dev",
+				"routes[2].dev",
+				"routes[2].dst",
+				"routes[3].via",
+				"routes[3].metric",
+				"routes[3].mtu",
+				"routes[3].table",
+				"routes[5].mtu",
+			}))
+		})
+	})
+	Context("Test egress_via_host", func() {
+		It("reject reserved tables and marks out of 32 bits", func() {
+			conf := &ty.Veth{EgressViaHost: &ty.EgressViaHost{Enable: true, Table: pointer.Int(254), Mark: pointer.Int(0)}}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Field).To(Equal("egress_via_host.table"))
+			Expect(errs[1].Field).To(Equal("egress_via_host.mark"))
+		})
+
+		It("accept the defaults", func() {
+			Expect(ValidateVethConfig(&ty.Veth{EgressViaHost: &ty.EgressViaHost{Enable: true}}, nil)).To(BeEmpty())
+		})
+	})
+	Context("Test reply_via_veth", func() {
+		It("reject the table and mark shared with egress_via_host", func() {
+			conf := &ty.Veth{
+				EgressViaHost: &ty.EgressViaHost{Enable: true, Table: pointer.Int(100), Mark: pointer.Int(0x30000)},
+				ReplyViaVeth:  &ty.ReplyViaVeth{Enable: true, Table: pointer.Int(100)},
+			}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Field).To(Equal("reply_via_veth.table"))
+			Expect(errs[1].Field).To(Equal("reply_via_veth.mark"))
+		})
+
+		It("accept the defaults with egress_via_host", func() {
+			conf := &ty.Veth{
+				EgressViaHost: &ty.EgressViaHost{Enable: true},
+				ReplyViaVeth:  &ty.ReplyViaVeth{Enable: true},
+			}
+			Expect(ValidateVethConfig(conf, nil)).To(BeEmpty())
+		})
+
+		It("reject unknown firewall backend", func() {
+			errs := ValidateVethConfig(&ty.Veth{FirewallBackend: "ebtables"}, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("firewall_backend"))
+		})
+	})
+	Context("Test conntrack_cleanup", func() {
+		It("reject invalid zones and protocols", func() {
+			conf := &ty.Veth{ConntrackCleanup: &ty.ConntrackCleanup{Enable: true, Zones: []int{0, 65536}, Protocols: []string{"UDP", "gre"}}}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Field).To(Equal("conntrack_cleanup.zones[1]"))
+			Expect(errs[1].Field).To(Equal("conntrack_cleanup.protocols[1]"))
+		})
+	})
+	Context("Test device_type", func() {
+		It("reject unknown device type", func() {
+			Expect(ValidateVethConfig(&ty.Veth{DeviceType: "netkit"}, nil)).To(BeEmpty())
+			errs := ValidateVethConfig(&ty.Veth{DeviceType: "macvtap"}, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("device_type"))
+		})
+	})
+	Context("Test ipv6", func() {
+		It("reject unknown host_forwarding", func() {
+			Expect(ValidateVethConfig(&ty.Veth{IPv6: &ty.IPv6{HostForwarding: ty.HostForwardingEnable}}, nil)).To(BeEmpty())
+			errs := ValidateVethConfig(&ty.Veth{IPv6: &ty.IPv6{HostForwarding: "on"}}, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("ipv6.host_forwarding"))
+			Expect(errs[0].Type).To(Equal(field.ErrorTypeNotSupported))
+		})
+
+		It("drop the IPv6 of a dual-stack config", func() {
+			conf := &ty.Veth{
+				ClusterCIDR:    []string{"10.233.64.0/18", "fd00:233::/64"},
+				ServiceCIDR:    []string{"fd00:234::/112"},
+				AdditionalCIDR: []string{"10.7.0.0/16"},
+				Routes:         []ty.Route{{Dst: "fd00:7::/64"}, {Dst: "10.8.0.0/16", Dev: ty.RouteDevChained}},
+				RouteSource:    &ty.RouteSource{IPv4CIDR: "10.6.0.0/16", IPv6CIDR: "fd00:6::/64"},
+				HostGateway:    &ty.HostGateway{IPv4: "10.6.0.1", IPv6: "fd00:6::1"},
+				RuntimeConfig: &ty.RuntimeConfig{Routes: []cnitypes.Route{
+					{Dst: mustParseCIDR("fd00:8::/64")}, {Dst: mustParseCIDR("10.9.0.0/16")},
+				}},
+			}
+			DropIPv6(conf)
+			Expect(conf.ClusterCIDR).To(Equal([]string{"10.233.64.0/18"}))
+			Expect(conf.ServiceCIDR).To(BeEmpty())
+			Expect(conf.AdditionalCIDR).To(Equal([]string{"10.7.0.0/16"}))
+			Expect(conf.Routes).To(Equal([]ty.Route{{Dst: "10.8.0.0/16", Dev: ty.RouteDevChained}}))
+			Expect(*conf.RouteSource).To(Equal(ty.RouteSource{IPv4CIDR: "10.6.0.0/16"}))
+			Expect(*conf.HostGateway).To(Equal(ty.HostGateway{IPv4: "10.6.0.1"}))
+			Expect(RuntimeRoutes(conf)).To(Equal([]ty.Route{{Dst: "10.9.0.0/16", Dev: ty.RouteDevVeth}}))
+			Expect(ValidateCIDRFamily(conf, netlink.FAMILY_V4, nil)).To(BeEmpty())
+		})
+	})
+	Context("Test offload", func() {
+		It("reject the features turned off by the kernel", func() {
+			conf := &ty.Veth{Offload: &ty.Offload{Checksum: pointer.Bool(true), TSO: pointer.Bool(true), GRO: pointer.Bool(true), XDPGRO: true}}
+			Expect(ValidateVethConfig(conf, nil)).To(BeEmpty())
+
+			conf = &ty.Veth{
+				Offload:    &ty.Offload{Checksum: pointer.Bool(false), TSO: pointer.Bool(true), GRO: pointer.Bool(false), XDPGRO: true},
+				DeviceType: ty.DeviceTypeNetkit,
+			}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0].Field).To(Equal("offload.tso"))
+			Expect(errs[1].Field).To(Equal("offload.xdp_gro"))
+			Expect(errs[2].Type).To(Equal(field.ErrorTypeForbidden))
+		})
+	})
+	Context("Test ebpf_redirect", func() {
+		It("reject invalid interfaces and the conflicting options", func() {
+			conf := &ty.Veth{EBPFRedirect: &ty.EBPFRedirect{Enable: true, Interfaces: []string{"eth0", "", "bond0.100:1"}}}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Field).To(Equal("ebpf_redirect.interfaces[1]"))
+			Expect(errs[1].Field).To(Equal("ebpf_redirect.interfaces[2]"))
+
+			conf = &ty.Veth{
+				EBPFRedirect: &ty.EBPFRedirect{Enable: true},
+				DeviceType:   ty.DeviceTypeNetkit,
+				HostFilter:   &ty.HostFilter{Enable: true, RestrictDestinations: true},
+				Bandwidth:    &ty.Bandwidth{IngressRate: 8000, IngressBurst: 8000},
+			}
+			errs = ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0].Type).To(Equal(field.ErrorTypeForbidden))
+			Expect(errs[0].Detail).To(ContainSubstring("netkit"))
+			Expect(errs[1].Detail).To(ContainSubstring("host_filter"))
+			Expect(errs[2].Detail).To(ContainSubstring("bandwidth"))
+
+			conf.DeviceType = ""
+			conf.HostFilter.RestrictDestinations = false
+			conf.Bandwidth = nil
+			Expect(ValidateVethConfig(conf, nil)).To(BeEmpty())
+		})
+	})
+	Context("Test bandwidth", func() {
+		It("reject a rate without burst and the reverse", func() {
+			conf := &ty.Veth{
+				Bandwidth: &ty.Bandwidth{IngressRate: 1000000, IngressBurst: 100000},
+				RuntimeConfig: &ty.RuntimeConfig{
+					Bandwidth: &ty.RuntimeBandwidth{EgressRate: 1000000, EgressBurst: math.MaxUint32},
+				},
+			}
+			Expect(ValidateVethConfig(conf, nil)).To(BeEmpty())
+
+			conf.Bandwidth = &ty.Bandwidth{IngressRate: 1000000, EgressRate: 4, EgressBurst: 100000}
+			conf.RuntimeConfig.Bandwidth = &ty.RuntimeBandwidth{IngressBurst: 100000}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0].Field).To(Equal("bandwidth.ingress_burst"))
+			Expect(errs[1].Field).To(Equal("bandwidth.egress_rate"))
+			Expect(errs[2].Field).To(Equal("runtimeConfig.bandwidth.ingressRate"))
+		})
+
+		It("reject the bandwidth of runtimeConfig with ebpf_redirect", func() {
+			conf := &ty.Veth{
+				EBPFRedirect: &ty.EBPFRedirect{Enable: true},
+				RuntimeConfig: &ty.RuntimeConfig{
+					Bandwidth: &ty.RuntimeBandwidth{EgressRate: 1000000, EgressBurst: 100000},
+				},
+			}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Type).To(Equal(field.ErrorTypeForbidden))
+			Expect(errs[0].Field).To(Equal("runtimeConfig.bandwidth"))
+
+			conf.EBPFRedirect.Enable = false
+			Expect(ValidateVethConfig(conf, nil)).To(BeEmpty())
+		})
+	})
+	Context("Test runtimeConfig", func() {
+		It("reject an invalid mac and routes", func() {
+			conf := &ty.Veth{
+				Routes: []ty.Route{{Dst: "10.7.0.0/16"}},
+				RuntimeConfig: &ty.RuntimeConfig{
+					Mac:    "0a:1b:0a:06:01:02",
+					Routes: []cnitypes.Route{{Dst: mustParseCIDR("10.8.0.0/16"), GW: net.ParseIP("10.6.0.1")}},
+				},
+			}
+			Expect(ValidateVethConfig(conf, nil)).To(BeEmpty())
+			Expect(RuntimeRoutes(conf)).To(Equal([]ty.Route{{Dst: "10.8.0.0/16", Dev: ty.RouteDevVeth, Via: "10.6.0.1"}}))
+
+			conf.RuntimeConfig.Mac = "01:1b:0a:06:01:02"
+			conf.RuntimeConfig.Routes = append(conf.RuntimeConfig.Routes,
+				cnitypes.Route{Dst: mustParseCIDR("10.9.0.0/16"), GW: net.ParseIP("fd00::1")},
+				cnitypes.Route{Dst: mustParseCIDR("10.7.0.0/16")})
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0].Field).To(Equal("runtimeConfig.mac"))
+			Expect(errs[1].Field).To(Equal("runtimeConfig.routes[1].via"))
+			Expect(errs[2].Field).To(Equal("runtimeConfig.routes[2].dst"))
+		})
+
+		It("reject the routes of the wrong family", func() {
+			conf := &ty.Veth{RuntimeConfig: &ty.RuntimeConfig{Routes: []cnitypes.Route{{Dst: mustParseCIDR("fd00:8::/64")}}}}
+			errs := ValidateCIDRFamily(conf, netlink.FAMILY_V4, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("runtimeConfig.routes[0].dst"))
+		})
+	})
+	Context("Test host_filter", func() {
+		It("reject invalid ports", func() {
+			conf := &ty.Veth{HostFilter: &ty.HostFilter{Enable: true, AllowedPorts: []string{"tcp/10250", "udp/30000-32767", "icmp/1", "tcp/0", "udp/2-1", "53"}}}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(4))
+			Expect(errs[0].Field).To(Equal("host_filter.allowed_ports[2]"))
+			Expect(errs[3].Field).To(Equal("host_filter.allowed_ports[5]"))
+		})
+
+		It("reject restrict_destinations with egress_via_host", func() {
+			conf := &ty.Veth{
+				EgressViaHost: &ty.EgressViaHost{Enable: true},
+				HostFilter:    &ty.HostFilter{Enable: true, RestrictDestinations: true},
+			}
+			errs := ValidateVethConfig(conf, nil)
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("host_filter.restrict_destinations"))
+		})
+	})
 })
+
+// mustParseCIDR returns the network of the CIDR
+func mustParseCIDR(s string) net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	Expect(err).NotTo(HaveOccurred())
+	return *ipNet
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// DefaultNodeConfigDir is the directory of the node config files merged on top of the config
+const DefaultNodeConfigDir = "/etc/spider-plugins/veth.d"
+
+// NodeConfigAnnotation is the annotation of the node merged on top of the config like a node config file
+const NodeConfigAnnotation = "veth.spidernet.io/node-config"
+
+// DefaultNodeCacheTTL is the default seconds the annotations of the node are cached
+const DefaultNodeCacheTTL = 60
+
+// netConfKeys are the keys of the CNI spec, they belong to the network and can't be set by a node
+var netConfKeys = jsonFields(reflect.TypeOf(cnitypes.NetConf{}))
+
+// MergeNodeConfig merges the *.json files in dir on top of the config in lexical order of the file names,
+// so a key of a node file wins over the one of the config, and a later file wins over an earlier one. The
+// files are merged as JSON merge patches(RFC 7386): objects are merged key by key, other values like lists
+// are replaced and null removes the key. It returns the merged config and the files merged, the config is
+// returned as is if there is no file.
+func MergeNodeConfig(stdin []byte, dir string) ([]byte, []string, error) {
+	if dir == "" {
+		return stdin, nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, cnierrors.Internal(err, "failed to list node config files in %s", dir)
+	}
+	if len(files) == 0 {
+		return stdin, nil, nil
+	}
+	sort.Strings(files)
+
+	conf, err := decodeObject(stdin)
+	if err != nil {
+		return nil, nil, cnierrors.DecodingFailure(err, "failed to parse config")
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, cnierrors.IO(err, "failed to read node config %s", file)
+		}
+		if err = mergeNodeConfig(conf, data, nil); err != nil {
+			return nil, nil, cnierrors.InvalidConfig(err, "invalid node config %s", file)
+		}
+	}
+
+	merged, err := json.Marshal(conf)
+	if err != nil {
+		return nil, nil, cnierrors.Internal(err, "failed to encode the config merged with node config")
+	}
+	return merged, files, nil
+}
+
+// MergeNodeAnnotation merges the annotation veth.spidernet.io/node-config of the node on top of the config,
+// the same as a node config file. It returns the config as is without the annotation.
+func MergeNodeAnnotation(stdin []byte, annotations map[string]string) ([]byte, error) {
+	value, ok := annotations[NodeConfigAnnotation]
+	if !ok {
+		return stdin, nil
+	}
+
+	conf, err := decodeObject(stdin)
+	if err != nil {
+		return nil, cnierrors.DecodingFailure(err, "failed to parse config")
+	}
+	if err = mergeNodeConfig(conf, []byte(value), field.NewPath("metadata", "annotations").Key(NodeConfigAnnotation)); err != nil {
+		return nil, cnierrors.InvalidConfig(err, "invalid node annotation %s", NodeConfigAnnotation)
+	}
+
+	merged, err := json.Marshal(conf)
+	if err != nil {
+		return nil, cnierrors.Internal(err, "failed to encode the config merged with node annotation")
+	}
+	return merged, nil
+}
+
+// mergeNodeConfig validates a node config and merges it into the config
+func mergeNodeConfig(conf map[string]interface{}, data []byte, fldPath *field.Path) error {
+	if allErrs := ValidateNodeConfigFields(data, fldPath); len(allErrs) != 0 {
+		return allErrs.ToAggregate()
+	}
+	patch, err := decodeObject(data)
+	if err != nil {
+		return err
+	}
+	mergePatch(conf, patch)
+	return nil
+}
+
+// validateNodeOverrides requires the kubeconfig to get the node
+func validateNodeOverrides(overrides *types.NodeOverrides, fldPath *field.Path) field.ErrorList {
+	if overrides == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	if overrides.Kubeconfig == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("kubeconfig"), "the node is got from the API server by it"))
+	}
+	if overrides.CacheTTL != nil && *overrides.CacheTTL < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("cache_ttl"), *overrides.CacheTTL, "must be greater than or equal to 0"))
+	}
+	return allErrs
+}
+
+// ValidateNodeConfigFields rejects the keys of a node config which aren't defined by veth, and the ones of
+// the CNI spec like name or ipam.
+func ValidateNodeConfigFields(data []byte, fldPath *field.Path) field.ErrorList {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, string(data), "must be a JSON object")}
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var allErrs field.ErrorList
+	for _, key := range keys {
+		if _, ok := netConfKeys[key]; ok || contains(wellKnownFields, key) {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child(key), "the keys of the CNI spec can't be set by node config"))
+		}
+	}
+	return append(allErrs, validateKnownFields(data, reflect.TypeOf(types.Veth{}), fldPath)...)
+}
+
+// decodeObject decodes a JSON object, the numbers are kept as is so the large ones like the rates of
+// bandwidth don't lose precision.
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	obj := map[string]interface{}{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// mergePatch applies a JSON merge patch to the object
+func mergePatch(obj, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(obj, key)
+			continue
+		}
+
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			obj[key] = value
+			continue
+		}
+		target, ok := obj[key].(map[string]interface{})
+		if !ok {
+			target = map[string]interface{}{}
+			obj[key] = target
+		}
+		mergePatch(target, nested)
+	}
+}
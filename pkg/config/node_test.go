@@ -0,0 +1,106 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	ty "github.com/spidernet-io/plugins/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/pointer"
+)
+
+var _ = Describe("node config", func() {
+	const stdin = `{
+		"cniVersion": "1.0.0", "name": "macvlan", "type": "veth",
+		"cluster_cidr": ["10.233.64.0/18"],
+		"additional_cidr": ["10.7.0.0/16"],
+		"rp_filter": {"enabled": true, "value": 1},
+		"bandwidth": {"ingress_rate": 18446744073709551615, "ingress_burst": 800000},
+		"prevResult": {"cniVersion": "1.0.0", "interfaces": [{"name": "net1"}], "ips": [{"address": "10.6.1.10/16", "interface": 0}]}
+	}`
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	writeFile := func(name, data string) {
+		Expect(os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644)).To(Succeed())
+	}
+
+	It("merge the files in lexical order", func() {
+		writeFile("20-dns.json", `{"additional_cidr": ["169.254.20.10/32"], "rp_filter": {"value": 0}}`)
+		writeFile("10-storage.json", `{"additional_cidr": ["10.8.0.0/16"], "rp_filter": {"value": 2}, "move_routes": 2}`)
+		writeFile("30-noop.yaml", `{"name": "ignored"}`)
+
+		merged, files, err := MergeNodeConfig([]byte(stdin), dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(Equal([]string{filepath.Join(dir, "10-storage.json"), filepath.Join(dir, "20-dns.json")}))
+
+		conf, err := ParseVethConfig(merged)
+		Expect(err).NotTo(HaveOccurred())
+		// lists are replaced, objects are merged
+		Expect(conf.AdditionalCIDR).To(Equal([]string{"169.254.20.10/32"}))
+		Expect(*conf.RPFilter.Enable).To(BeTrue())
+		Expect(conf.RPFilter.Value).To(Equal(int32(0)))
+		Expect(int(conf.MoveRoutes)).To(Equal(2))
+		// large numbers are kept
+		Expect(conf.Bandwidth.IngressRate).To(Equal(uint64(18446744073709551615)))
+	})
+
+	It("remove the keys set to null", func() {
+		writeFile("veth.json", `{"bandwidth": null}`)
+		merged, _, err := MergeNodeConfig([]byte(stdin), dir)
+		Expect(err).NotTo(HaveOccurred())
+		conf, err := ParseVethConfig(merged)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Bandwidth).To(BeNil())
+	})
+
+	It("return the config as is without node config", func() {
+		merged, files, err := MergeNodeConfig([]byte(stdin), filepath.Join(dir, "nonexistent"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+		Expect(string(merged)).To(Equal(stdin))
+	})
+
+	It("merge the annotation of the node", func() {
+		merged, err := MergeNodeAnnotation([]byte(stdin), map[string]string{NodeConfigAnnotation: `{"additional_cidr": ["10.8.0.0/16"]}`})
+		Expect(err).NotTo(HaveOccurred())
+		conf, err := ParseVethConfig(merged)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.AdditionalCIDR).To(Equal([]string{"10.8.0.0/16"}))
+
+		merged, err = MergeNodeAnnotation([]byte(stdin), map[string]string{"kubernetes.io/hostname": "worker1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(merged)).To(Equal(stdin))
+
+		_, err = MergeNodeAnnotation([]byte(stdin), map[string]string{NodeConfigAnnotation: `{"additional_cidrs": ["10.8.0.0/16"]}`})
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrInvalidNetworkConfig))
+		Expect(err.Error()).To(ContainSubstring("metadata.annotations[veth.spidernet.io/node-config].additional_cidrs"))
+	})
+
+	It("require the kubeconfig of node_overrides", func() {
+		errs := validateNodeOverrides(&ty.NodeOverrides{CacheTTL: pointer.Int(-1)}, field.NewPath("node_overrides"))
+		Expect(errs).To(HaveLen(2))
+		Expect(errs[0].Field).To(Equal("node_overrides.kubeconfig"))
+		Expect(errs[1].Field).To(Equal("node_overrides.cache_ttl"))
+	})
+
+	DescribeTable("reject invalid node config",
+		func(data string) {
+			writeFile("veth.json", data)
+			_, _, err := MergeNodeConfig([]byte(stdin), dir)
+			Expect(cnierrors.Code(err)).To(Equal(types.ErrInvalidNetworkConfig))
+		},
+		Entry("unknown key", `{"service_cidrs": ["10.233.0.0/18"]}`),
+		Entry("unknown nested key", `{"rp_filter": {"valu": 2}}`),
+		Entry("key of CNI spec", `{"ipam": {"type": "host-local"}}`),
+		Entry("key passed by runtime", `{"runtimeConfig": {"mac": "0a:1b:0a:06:01:0a"}}`),
+		Entry("not an object", `["10.8.0.0/16"]`),
+	)
+})
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/pointer"
+)
+
+// AnnotationPrefix is the prefix of the pod annotations overriding the config, followed by the option
+const AnnotationPrefix = "veth.spidernet.io/"
+
+// The options the pods may override, listed in allowed of pod_overrides
+const (
+	// OverrideDisabled opts the pod out of veth, only the hardware address is changed, e.g. "true"
+	OverrideDisabled = "disabled"
+	// OverrideAdditionalCIDR adds the comma-separated CIDRs to additional_cidr, e.g. "10.7.0.0/16,fd00:7::/64"
+	OverrideAdditionalCIDR = "additional_cidr"
+	// OverrideMoveRoutes replaces move_routes, e.g. "2"
+	OverrideMoveRoutes = "move_routes"
+	// OverrideMAC pins the hardware address of the chained interface, it wins over hardware_prefix, e.g. "0a:1b:0a:06:01:0a"
+	OverrideMAC = "mac"
+	// OverrideRPFilter replaces the value of rp_filter, e.g. "1"
+	OverrideRPFilter = "rp_filter"
+)
+
+// PodOverrideOptions are the options the pods may override
+var PodOverrideOptions = []string{OverrideDisabled, OverrideAdditionalCIDR, OverrideMoveRoutes, OverrideMAC, OverrideRPFilter}
+
+// PodOverrides is the result of applying the annotations of a pod to the config
+type PodOverrides struct {
+	// Disabled skips veth for the pod
+	Disabled bool
+	// MAC is the hardware address of the chained interface, nil if it isn't pinned
+	MAC net.HardwareAddr
+	// Applied are the annotations applied
+	Applied map[string]string
+	// Ignored are the annotations of the options not allowed by the config
+	Ignored []string
+}
+
+// ApplyPodOverrides applies the annotations of the options allowed by pod_overrides to the parsed config, the
+// others are ignored. The config is validated again afterwards, so an invalid annotation fails like an invalid
+// config.
+func ApplyPodOverrides(conf *types.Veth, annotations map[string]string) (*PodOverrides, error) {
+	overrides := &PodOverrides{Applied: make(map[string]string)}
+	var allowed []string
+	if conf.PodOverrides != nil {
+		allowed = conf.PodOverrides.Allowed
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		if strings.HasPrefix(key, AnnotationPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var allErrs field.ErrorList
+	for _, key := range keys {
+		option, value := strings.TrimPrefix(key, AnnotationPrefix), strings.TrimSpace(annotations[key])
+		if !contains(allowed, option) {
+			overrides.Ignored = append(overrides.Ignored, key)
+			continue
+		}
+		fldPath := field.NewPath("metadata", "annotations").Key(key)
+
+		switch option {
+		case OverrideDisabled:
+			disabled, err := strconv.ParseBool(value)
+			if err != nil {
+				allErrs = append(allErrs, field.Invalid(fldPath, value, "must be true or false"))
+				continue
+			}
+			overrides.Disabled = disabled
+		case OverrideAdditionalCIDR:
+			for _, cidr := range strings.Split(value, ",") {
+				if cidr = strings.TrimSpace(cidr); cidr != "" {
+					conf.AdditionalCIDR = append(conf.AdditionalCIDR, cidr)
+				}
+			}
+		case OverrideMoveRoutes:
+			move, err := strconv.Atoi(value)
+			if err != nil || move < int(types.MoveValueDirectly) || move > int(types.MoveValueNever) {
+				allErrs = append(allErrs, field.Invalid(fldPath, value, "must be 0, 1 or 2"))
+				continue
+			}
+			conf.MoveRoutes = types.MoveRouteValue(move)
+		case OverrideMAC:
+			mac, err := ParseMAC(value)
+			if err != nil {
+				allErrs = append(allErrs, field.Invalid(fldPath, value, err.Error()))
+				continue
+			}
+			overrides.MAC = mac
+		case OverrideRPFilter:
+			rpFilter, err := strconv.Atoi(value)
+			if err != nil {
+				allErrs = append(allErrs, field.Invalid(fldPath, value, "must be 0, 1 or 2"))
+				continue
+			}
+			conf.RPFilter = &types.RPFilter{Enable: pointer.Bool(true), Value: int32(rpFilter)}
+		}
+		overrides.Applied[key] = value
+	}
+	if len(allErrs) != 0 {
+		return nil, cnierrors.InvalidConfig(allErrs.ToAggregate(), "invalid pod annotations")
+	}
+	if len(overrides.Applied) == 0 || overrides.Disabled {
+		return overrides, nil
+	}
+
+	allErrs = ValidateVethConfig(conf, nil)
+	if !conf.OnlyHardware {
+		errs, err := validatePrevResultFamily(conf)
+		if err != nil {
+			return nil, err
+		}
+		allErrs = append(allErrs, errs...)
+	}
+	if len(allErrs) != 0 {
+		return nil, cnierrors.InvalidConfig(allErrs.ToAggregate(), "invalid veth config overridden by pod annotations")
+	}
+	return overrides, nil
+}
+
+// validatePodOverrides rejects the unknown options
+func validatePodOverrides(overrides *types.PodOverrides, fldPath *field.Path) field.ErrorList {
+	if overrides == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	for idx, option := range overrides.Allowed {
+		if !contains(PodOverrideOptions, option) {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("allowed").Index(idx), option, PodOverrideOptions))
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	ty "github.com/spidernet-io/plugins/pkg/types"
+)
+
+var _ = Describe("pod overrides", func() {
+	var conf *ty.Veth
+
+	BeforeEach(func() {
+		var err error
+		conf, err = ParseVethConfig([]byte(`{
+			"cniVersion": "1.0.0", "name": "macvlan", "type": "veth",
+			"cluster_cidr": ["10.233.64.0/18"],
+			"pod_overrides": {"allowed": ["additional_cidr", "move_routes", "mac", "rp_filter"]},
+			"prevResult": {"cniVersion": "1.0.0", "interfaces": [{"name": "net1"}], "ips": [{"address": "10.6.1.10/16", "interface": 0}]}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("apply the allowed annotations and ignore the others", func() {
+		overrides, err := ApplyPodOverrides(conf, map[string]string{
+			"veth.spidernet.io/additional_cidr": "10.7.0.0/16, 10.8.0.0/16",
+			"veth.spidernet.io/move_routes":     "2",
+			"veth.spidernet.io/mac":             "0a:1b:0a:06:01:0a",
+			"veth.spidernet.io/rp_filter":       "1",
+			"veth.spidernet.io/disabled":        "true",
+			"kubernetes.io/ingress-bandwidth":   "10M",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(overrides.Disabled).To(BeFalse())
+		Expect(overrides.MAC).To(Equal(net.HardwareAddr{0x0a, 0x1b, 0x0a, 0x06, 0x01, 0x0a}))
+		Expect(overrides.Applied).To(HaveLen(4))
+		Expect(overrides.Ignored).To(Equal([]string{"veth.spidernet.io/disabled"}))
+
+		Expect(conf.AdditionalCIDR).To(Equal([]string{"10.7.0.0/16", "10.8.0.0/16"}))
+		Expect(conf.MoveRoutes).To(Equal(ty.MoveValueNever))
+		Expect(*conf.RPFilter.Enable).To(BeTrue())
+		Expect(conf.RPFilter.Value).To(Equal(int32(1)))
+	})
+
+	It("opt out of veth", func() {
+		conf.PodOverrides.Allowed = append(conf.PodOverrides.Allowed, OverrideDisabled)
+		overrides, err := ApplyPodOverrides(conf, map[string]string{"veth.spidernet.io/disabled": "true"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(overrides.Disabled).To(BeTrue())
+	})
+
+	DescribeTable("reject invalid annotations",
+		func(key, value string) {
+			_, err := ApplyPodOverrides(conf, map[string]string{key: value})
+			Expect(cnierrors.Code(err)).To(Equal(types.ErrInvalidNetworkConfig))
+		},
+		Entry("invalid cidr", "veth.spidernet.io/additional_cidr", "10.7.0.0/33"),
+		Entry("overlapping cidr", "veth.spidernet.io/additional_cidr", "10.233.64.0/24"),
+		Entry("cidr of the wrong family", "veth.spidernet.io/additional_cidr", "fd00:7::/64"),
+		Entry("unknown move_routes", "veth.spidernet.io/move_routes", "3"),
+		Entry("multicast mac", "veth.spidernet.io/mac", "01:1b:0a:06:01:0a"),
+		Entry("rp_filter out of 0/1/2", "veth.spidernet.io/rp_filter", "3"),
+	)
+
+	It("reject unknown options of allowed", func() {
+		errs := ValidateVethConfig(&ty.Veth{PodOverrides: &ty.PodOverrides{Allowed: []string{"mac", "routes"}}}, nil)
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Field).To(Equal("pod_overrides.allowed[1]"))
+	})
+})
@@ -0,0 +1,684 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spidernet-io/plugins/pkg/logging"
+	"github.com/spidernet-io/plugins/pkg/networking"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/spidernet-io/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// wellKnownFields are injected into the plugin config by the runtime, see CNI spec
+var wellKnownFields = []string{"runtimeConfig", "args"}
+
+// typesPkgPath is used to only check the nested objects defined by ourselves,
+// others like ipam may carry keys of other plugins.
+var typesPkgPath = reflect.TypeOf(types.Veth{}).PkgPath()
+
+// ValidateKnownFields rejects the keys of the given config which aren't defined by veth,
+// so a typo like `service_cidrs` isn't silently ignored.
+func ValidateKnownFields(data []byte, fldPath *field.Path) field.ErrorList {
+	return validateKnownFields(data, reflect.TypeOf(types.Veth{}), fldPath, wellKnownFields...)
+}
+
+func validateKnownFields(data []byte, t reflect.Type, fldPath *field.Path, extra ...string) field.ErrorList {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		// not an object, the type error is reported by json.Unmarshal of the config
+		return nil
+	}
+
+	known := jsonFields(t)
+	for _, key := range extra {
+		known[key] = nil
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var allErrs field.ErrorList
+	for _, key := range keys {
+		nested, ok := known[key]
+		if !ok {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child(key), key, knownKeys(known)))
+			continue
+		}
+		if nested != nil {
+			allErrs = append(allErrs, validateKnownFields(raw[key], nested, fldPath.Child(key))...)
+		}
+	}
+	return allErrs
+}
+
+// jsonFields returns the json keys of the given struct, including the ones of embedded structs.
+// The value is the type of nested object which need to be checked too, or nil.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for k, v := range jsonFields(ft) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		if ft.Kind() == reflect.Struct && ft.PkgPath() == typesPkgPath {
+			fields[name] = ft
+		} else {
+			fields[name] = nil
+		}
+	}
+	return fields
+}
+
+func knownKeys(known map[string]reflect.Type) []string {
+	keys := make([]string, 0, len(known))
+	for key := range known {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type cidrEntry struct {
+	path  *field.Path
+	value string
+	ipNet *net.IPNet
+}
+
+// validateCIDROverlaps reports duplicate or overlapping CIDRs across cluster_cidr,
+// service_cidr and additional_cidr. Invalid CIDRs are skipped, they are reported by validateCIDRs.
+func validateCIDROverlaps(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	var entries []cidrEntry
+	for _, list := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{"cluster_cidr", conf.ClusterCIDR},
+		{"service_cidr", conf.ServiceCIDR},
+		{"additional_cidr", conf.AdditionalCIDR},
+	} {
+		for idx, cidr := range list.cidrs {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				continue
+			}
+			entries = append(entries, cidrEntry{path: fldPath.Child(list.name).Index(idx), value: cidr, ipNet: ipNet})
+		}
+	}
+
+	var allErrs field.ErrorList
+	for i := range entries {
+		for j := 0; j < i; j++ {
+			a, b := entries[j], entries[i]
+			if a.ipNet.String() == b.ipNet.String() {
+				allErrs = append(allErrs, field.Duplicate(b.path, b.value))
+				continue
+			}
+			if a.ipNet.Contains(b.ipNet.IP) || b.ipNet.Contains(a.ipNet.IP) {
+				allErrs = append(allErrs, field.Invalid(b.path, b.value, fmt.Sprintf("overlaps with %s(%s)", a.path.String(), a.value)))
+			}
+		}
+	}
+	return allErrs
+}
+
+// ValidateCIDRFamily reports the CIDRs whose family isn't enabled by prevResult, for
+// example an IPv6 CIDR is configured but the pod only has IPv4 addresses.
+func ValidateCIDRFamily(conf *types.Veth, ipFamily int, fldPath *field.Path) field.ErrorList {
+	if ipFamily == netlink.FAMILY_ALL {
+		return nil
+	}
+
+	routeDsts := func(routes []types.Route) []string {
+		dsts := make([]string, 0, len(routes))
+		for _, route := range routes {
+			dsts = append(dsts, route.Dst)
+		}
+		return dsts
+	}
+
+	var allErrs field.ErrorList
+	for _, list := range []struct {
+		path *field.Path
+		// child is the field of the CIDR in an element of the list, empty if the element is the CIDR
+		child string
+		cidrs []string
+	}{
+		{fldPath.Child("cluster_cidr"), "", conf.ClusterCIDR},
+		{fldPath.Child("service_cidr"), "", conf.ServiceCIDR},
+		{fldPath.Child("additional_cidr"), "", conf.AdditionalCIDR},
+		{fldPath.Child("routes"), "dst", routeDsts(conf.Routes)},
+		{fldPath.Child("runtimeConfig", "routes"), "dst", routeDsts(RuntimeRoutes(conf))},
+	} {
+		for idx, cidr := range list.cidrs {
+			ip, _, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				continue
+			}
+			path := list.path.Index(idx)
+			if list.child != "" {
+				path = path.Child(list.child)
+			}
+			if ip.To4() == nil && ipFamily == netlink.FAMILY_V4 {
+				allErrs = append(allErrs, field.Invalid(path, cidr, "IPv6 CIDR is configured, but prevResult only has IPv4 addresses"))
+			}
+			if ip.To4() != nil && ipFamily == netlink.FAMILY_V6 {
+				allErrs = append(allErrs, field.Invalid(path, cidr, "IPv4 CIDR is configured, but prevResult only has IPv6 addresses"))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateRPFilterValue rejects the rp_filter value out of 0/1/2, the value is only used if rp_filter is enabled
+func validateRPFilterValue(rpfilter *types.RPFilter, fldPath *field.Path) field.ErrorList {
+	if rpfilter == nil || rpfilter.Enable == nil || !*rpfilter.Enable {
+		return nil
+	}
+	switch rpfilter.Value {
+	case 0, 1, 2:
+		return nil
+	}
+	return field.ErrorList{field.NotSupported(fldPath.Child("value"), rpfilter.Value, []string{"0", "1", "2"})}
+}
+
+// The minimum MTU of the routes, see RFC 791 and RFC 8200
+const (
+	minRouteMTUv4 = 68
+	minRouteMTUv6 = 1280
+)
+
+// validateCustomRoutes validates the custom routes, the destinations must be unique in a table
+func validateCustomRoutes(routes []types.Route, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	seen := make(map[string]struct{})
+	for idx, route := range routes {
+		idxPath := fldPath.Index(idx)
+		_, dst, err := net.ParseCIDR(strings.TrimSpace(route.Dst))
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("dst"), route.Dst, err.Error()))
+		}
+
+		switch route.Dev {
+		case "", types.RouteDevVeth, types.RouteDevChained:
+		default:
+			allErrs = append(allErrs, field.NotSupported(idxPath.Child("dev"), route.Dev, []string{types.RouteDevVeth, types.RouteDevChained}))
+		}
+		if route.Exclude && route.Dev == types.RouteDevVeth {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("dev"), route.Dev, "an excluded route stays on the chained interface"))
+		}
+
+		if route.Via != "" {
+			via := net.ParseIP(route.Via)
+			if via == nil {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("via"), route.Via, "invalid IP address"))
+			} else if dst != nil && (via.To4() != nil) != (dst.IP.To4() != nil) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("via"), route.Via, "the family is different from dst"))
+			}
+		}
+
+		if route.Metric < 0 {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("metric"), route.Metric, "must be greater than or equal to 0"))
+		}
+		minMTU := minRouteMTUv4
+		if dst != nil && dst.IP.To4() == nil {
+			minMTU = minRouteMTUv6
+		}
+		if route.MTU != 0 && route.MTU < minMTU {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("mtu"), route.MTU, fmt.Sprintf("must be 0 or at least %d", minMTU)))
+		}
+
+		table := 0
+		if route.Table != nil {
+			table = *route.Table
+			if table <= 0 || (utils.IsReservedTable(table) && table != unix.RT_TABLE_MAIN) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("table"), table, "must be main(254) or a table not reserved by kernel"))
+			}
+		}
+
+		if dst != nil {
+			key := fmt.Sprintf("%d/%s", table, dst.String())
+			if _, ok := seen[key]; ok {
+				allErrs = append(allErrs, field.Duplicate(idxPath.Child("dst"), route.Dst))
+			}
+			seen[key] = struct{}{}
+		}
+	}
+	return allErrs
+}
+
+// validateRuntimeRoutes rejects the routes of runtimeConfig whose gw is of the other family, or whose dst
+// is already routed by the routes of the config in the default table
+func validateRuntimeRoutes(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	routes := RuntimeRoutes(conf)
+	if len(routes) == 0 {
+		return nil
+	}
+
+	configured := make(map[string]struct{})
+	for _, route := range conf.Routes {
+		if _, dst, err := net.ParseCIDR(strings.TrimSpace(route.Dst)); err == nil && route.Table == nil {
+			configured[dst.String()] = struct{}{}
+		}
+	}
+
+	allErrs := validateCustomRoutes(routes, fldPath)
+	for idx, route := range routes {
+		if _, ok := configured[route.Dst]; ok {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(idx).Child("dst"), route.Dst))
+		}
+	}
+	return allErrs
+}
+
+// ParseMAC parses a unicast ethernet address
+func ParseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 || mac[0]&1 == 1 {
+		return nil, fmt.Errorf("must be a unicast ethernet address")
+	}
+	return mac, nil
+}
+
+// validateRouteSource rejects the invalid source CIDRs or the ones of the wrong family
+func validateRouteSource(source *types.RouteSource, fldPath *field.Path) field.ErrorList {
+	if source == nil {
+		return nil
+	}
+	return validateFamilyPair(fldPath.Child("ipv4_cidr"), source.IPv4CIDR, fldPath.Child("ipv6_cidr"), source.IPv6CIDR, func(value string) (net.IP, error) {
+		ip, _, err := net.ParseCIDR(value)
+		return ip, err
+	})
+}
+
+// validateHostGateway rejects the invalid gateway addresses or the ones of the wrong family
+func validateHostGateway(gateway *types.HostGateway, fldPath *field.Path) field.ErrorList {
+	if gateway == nil {
+		return nil
+	}
+	return validateFamilyPair(fldPath.Child("ipv4"), gateway.IPv4, fldPath.Child("ipv6"), gateway.IPv6, func(value string) (net.IP, error) {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address")
+		}
+		return ip, nil
+	})
+}
+
+// validateFamilyPair validates the optional IPv4 and IPv6 values of an option, parse returns the IP of a value
+func validateFamilyPair(v4Path *field.Path, v4 string, v6Path *field.Path, v6 string, parse func(string) (net.IP, error)) field.ErrorList {
+	var allErrs field.ErrorList
+	for _, f := range []struct {
+		path  *field.Path
+		value string
+		ipv4  bool
+	}{
+		{v4Path, v4, true},
+		{v6Path, v6, false},
+	} {
+		if f.value == "" {
+			continue
+		}
+		ip, err := parse(f.value)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(f.path, f.value, err.Error()))
+			continue
+		}
+		if (ip.To4() != nil) != f.ipv4 {
+			allErrs = append(allErrs, field.Invalid(f.path, f.value, "wrong IP family"))
+		}
+	}
+	return allErrs
+}
+
+// validateEgressViaHost rejects the reserved tables and the marks out of 32 bits
+func validateEgressViaHost(egress *types.EgressViaHost, fldPath *field.Path) field.ErrorList {
+	if egress == nil {
+		return nil
+	}
+	return validateTableAndMark(egress.Table, egress.Mark, fldPath)
+}
+
+// validateReplyViaVeth rejects the reserved tables and the marks out of 32 bits, and the ones
+// shared with egress_via_host
+func validateReplyViaVeth(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	reply := conf.ReplyViaVeth
+	if reply == nil {
+		return nil
+	}
+
+	allErrs := validateTableAndMark(reply.Table, reply.Mark, fldPath)
+	if reply.Enable && conf.EgressViaHost != nil && conf.EgressViaHost.Enable {
+		table, mark := types.ReplyDefaultTable, types.ReplyDefaultMark
+		if reply.Table != nil {
+			table = *reply.Table
+		}
+		if reply.Mark != nil {
+			mark = *reply.Mark
+		}
+		egressTable, egressMark := types.EgressDefaultTable, types.EgressDefaultMark
+		if conf.EgressViaHost.Table != nil {
+			egressTable = *conf.EgressViaHost.Table
+		}
+		if conf.EgressViaHost.Mark != nil {
+			egressMark = *conf.EgressViaHost.Mark
+		}
+		if table == egressTable {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("table"), table, "must be different from the table of egress_via_host"))
+		}
+		if mark&egressMark != 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("mark"), mark, "must not share bits with the mark of egress_via_host"))
+		}
+	}
+	return allErrs
+}
+
+// validateHostFilter rejects the invalid ports, and restrict_destinations with egress_via_host,
+// which sends the traffic to any destination via the host
+func validateHostFilter(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	filter := conf.HostFilter
+	if filter == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	for idx, port := range filter.AllowedPorts {
+		if _, err := networking.ParsePortRange(port); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("allowed_ports").Index(idx), port, err.Error()))
+		}
+	}
+	if filter.Enable && filter.RestrictDestinations && conf.EgressViaHost != nil && conf.EgressViaHost.Enable {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("restrict_destinations"), "conflicts with egress_via_host"))
+	}
+	return allErrs
+}
+
+// validateConntrackCleanup rejects the zones out of 16 bits and the unknown protocols
+func validateConntrackCleanup(cleanup *types.ConntrackCleanup, fldPath *field.Path) field.ErrorList {
+	if cleanup == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	for idx, zone := range cleanup.Zones {
+		if zone < 0 || zone > math.MaxUint16 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("zones").Index(idx), zone, "must be a 16 bits value"))
+		}
+	}
+	for idx, proto := range cleanup.Protocols {
+		if _, ok := networking.ConntrackProtocols[strings.ToLower(proto)]; !ok {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("protocols").Index(idx), proto, []string{"tcp", "udp", "sctp", "icmp", "icmpv6"}))
+		}
+	}
+	return allErrs
+}
+
+// validateDeviceType rejects unknown device types
+func validateDeviceType(deviceType string, fldPath *field.Path) field.ErrorList {
+	switch deviceType {
+	case "", types.DeviceTypeVeth, types.DeviceTypeNetkit:
+		return nil
+	}
+	return field.ErrorList{field.NotSupported(fldPath, deviceType, []string{types.DeviceTypeVeth, types.DeviceTypeNetkit})}
+}
+
+func validateIPv6(ipv6 *types.IPv6, fldPath *field.Path) field.ErrorList {
+	if ipv6 == nil {
+		return nil
+	}
+	switch ipv6.HostForwarding {
+	case "", types.HostForwardingWarn, types.HostForwardingFail, types.HostForwardingEnable:
+		return nil
+	}
+	return field.ErrorList{field.NotSupported(fldPath.Child("host_forwarding"), ipv6.HostForwarding, []string{types.HostForwardingWarn, types.HostForwardingFail, types.HostForwardingEnable})}
+}
+
+// validateOffload rejects the features which the kernel would turn off again: TSO without the checksum
+// offload, and xdp_gro without GRO. xdp_gro doesn't apply to netkit.
+func validateOffload(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	offload := conf.Offload
+	if offload == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	if offload.TSO != nil && *offload.TSO && offload.Checksum != nil && !*offload.Checksum {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("tso"), true, "requires the checksum offload"))
+	}
+	if offload.XDPGRO {
+		if offload.GRO != nil && !*offload.GRO {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("xdp_gro"), true, "requires gro"))
+		}
+		if conf.DeviceType == types.DeviceTypeNetkit {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("xdp_gro"), "conflicts with device_type netkit"))
+		}
+	}
+	return allErrs
+}
+
+// validateEBPFRedirect rejects invalid interface names, and the options whose traffic the redirected packets
+// break: netkit has no L2 header to redirect into, host_filter restrict_destinations drops the replies
+// of the connections the netfilter of the node doesn't see, and the qdiscs of bandwidth on the host veth
+// never see the redirected packets.
+func validateEBPFRedirect(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	redirect := conf.EBPFRedirect
+	if redirect == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	for idx, name := range redirect.Interfaces {
+		if len(name) == 0 || len(name) > 15 || strings.ContainsAny(name, "/: \t\n") {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("interfaces").Index(idx), name, "invalid interface name"))
+		}
+	}
+	if !redirect.Enable {
+		return allErrs
+	}
+	if conf.DeviceType == types.DeviceTypeNetkit {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("enabled"), "conflicts with device_type netkit"))
+	}
+	if conf.HostFilter != nil && conf.HostFilter.Enable && conf.HostFilter.RestrictDestinations {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("enabled"), "conflicts with host_filter restrict_destinations"))
+	}
+	if conf.Bandwidth != nil {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("enabled"), "conflicts with bandwidth"))
+	}
+	return allErrs
+}
+
+// validateBandwidth rejects a rate without a burst or the reverse, and the ones less than a byte, both in the
+// config and in the bandwidth capability of runtimeConfig, which conflicts with ebpf_redirect too
+func validateBandwidth(conf *types.Veth, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if b := conf.Bandwidth; b != nil {
+		allErrs = append(allErrs, validateRateAndBurst(b.IngressRate, b.IngressBurst, fldPath.Child("bandwidth"), "ingress_rate", "ingress_burst")...)
+		allErrs = append(allErrs, validateRateAndBurst(b.EgressRate, b.EgressBurst, fldPath.Child("bandwidth"), "egress_rate", "egress_burst")...)
+	}
+	if conf.RuntimeConfig != nil && conf.RuntimeConfig.Bandwidth != nil {
+		b := conf.RuntimeConfig.Bandwidth
+		path := fldPath.Child("runtimeConfig", "bandwidth")
+		allErrs = append(allErrs, validateRateAndBurst(b.IngressRate, b.IngressBurst, path, "ingressRate", "ingressBurst")...)
+		allErrs = append(allErrs, validateRateAndBurst(b.EgressRate, b.EgressBurst, path, "egressRate", "egressBurst")...)
+		// the packets redirected by ebpf_redirect skip the qdiscs of the host veth, the one of the config
+		// is rejected by validateEBPFRedirect
+		if conf.EBPFRedirect != nil && conf.EBPFRedirect.Enable {
+			allErrs = append(allErrs, field.Forbidden(path, "conflicts with ebpf_redirect"))
+		}
+	}
+	return allErrs
+}
+
+func validateRateAndBurst(rate, burst uint64, fldPath *field.Path, rateKey, burstKey string) field.ErrorList {
+	var allErrs field.ErrorList
+	switch {
+	case rate == 0 && burst != 0:
+		allErrs = append(allErrs, field.Required(fldPath.Child(rateKey), "required by "+burstKey))
+	case rate != 0 && burst == 0:
+		allErrs = append(allErrs, field.Required(fldPath.Child(burstKey), "required by "+rateKey))
+	}
+	// tc shapes the traffic in bytes
+	if rate != 0 && rate < 8 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child(rateKey), rate, "must be at least 8 bits per second"))
+	}
+	if burst != 0 && burst < 8 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child(burstKey), burst, "must be at least 8 bits"))
+	}
+	return allErrs
+}
+
+// validateFirewallBackend rejects unknown firewall backends
+func validateFirewallBackend(backend string, fldPath *field.Path) field.ErrorList {
+	switch backend {
+	case "", types.FirewallBackendAuto, types.FirewallBackendIPTables, types.FirewallBackendNFTables:
+		return nil
+	}
+	return field.ErrorList{field.NotSupported(fldPath, backend, []string{types.FirewallBackendAuto, types.FirewallBackendIPTables, types.FirewallBackendNFTables})}
+}
+
+func validateTableAndMark(table, mark *int, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if table != nil && (*table <= 0 || utils.IsReservedTable(*table)) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("table"), *table, "must be a table not reserved by kernel"))
+	}
+	if mark != nil && (*mark <= 0 || *mark > math.MaxUint32) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("mark"), *mark, "must be a non-zero 32 bits value"))
+	}
+	return allErrs
+}
+
+// validateLogOptions rejects unsupported log sinks and formats
+func validateLogOptions(logOptions *types.LogOptions, fldPath *field.Path) field.ErrorList {
+	if logOptions == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	for idx, sink := range logOptions.LogSinks {
+		if !contains(logging.SupportedSinks, sink) {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("log_sinks").Index(idx), sink, logging.SupportedSinks))
+		}
+	}
+	if logOptions.LogFormat != "" && !contains(logging.SupportedFormats, logOptions.LogFormat) {
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("log_format"), logOptions.LogFormat, logging.SupportedFormats))
+	}
+	return allErrs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// VethConfigWarnings returns the options which are ignored by the given config,
+// they don't fail the validation but are worth telling the user.
+func VethConfigWarnings(conf *types.Veth) []string {
+	if !conf.OnlyHardware {
+		var warnings []string
+		if conf.LinkLocalGateway && conf.HostGateway != nil {
+			warnings = append(warnings, "link_local_gateway is set, host_gateway is ignored")
+		}
+		replyViaVeth := conf.ReplyViaVeth != nil && conf.ReplyViaVeth.Enable
+		egressViaHost := conf.EgressViaHost != nil && conf.EgressViaHost.Enable
+		if conf.LinkLocalGateway && !replyViaVeth && !egressViaHost {
+			warnings = append(warnings, "link_local_gateway routes no node address via veth0, the replies to the node, like kubelet probes, need reply_via_veth or egress_via_host")
+		}
+		return warnings
+	}
+
+	var ignored []string
+	if len(conf.ClusterCIDR) != 0 {
+		ignored = append(ignored, "cluster_cidr")
+	}
+	if len(conf.ServiceCIDR) != 0 {
+		ignored = append(ignored, "service_cidr")
+	}
+	if len(conf.AdditionalCIDR) != 0 {
+		ignored = append(ignored, "additional_cidr")
+	}
+	if conf.MoveRoutes != types.MoveValueDirectly {
+		ignored = append(ignored, "move_routes")
+	}
+	if conf.RPFilter != nil {
+		ignored = append(ignored, "rp_filter")
+	}
+	if conf.LinkLocalGateway {
+		ignored = append(ignored, "link_local_gateway")
+	}
+	if len(conf.Routes) != 0 {
+		ignored = append(ignored, "routes")
+	}
+	if conf.RouteSource != nil {
+		ignored = append(ignored, "route_source")
+	}
+	if conf.HostGateway != nil {
+		ignored = append(ignored, "host_gateway")
+	}
+	if conf.EgressViaHost != nil {
+		ignored = append(ignored, "egress_via_host")
+	}
+	if conf.ReplyViaVeth != nil {
+		ignored = append(ignored, "reply_via_veth")
+	}
+	if conf.HostFilter != nil {
+		ignored = append(ignored, "host_filter")
+	}
+	if conf.ConntrackCleanup != nil {
+		ignored = append(ignored, "conntrack_cleanup")
+	}
+	if conf.DeviceType != "" {
+		ignored = append(ignored, "device_type")
+	}
+	if conf.Offload != nil {
+		ignored = append(ignored, "offload")
+	}
+	if conf.EBPFRedirect != nil {
+		ignored = append(ignored, "ebpf_redirect")
+	}
+	if conf.Bandwidth != nil {
+		ignored = append(ignored, "bandwidth")
+	}
+	if conf.IPv6 != nil {
+		ignored = append(ignored, "ipv6")
+	}
+	if conf.StrictDualStack {
+		ignored = append(ignored, "strict_dual_stack")
+	}
+
+	if len(ignored) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("only_hardware is set, routing options %s are ignored", strings.Join(ignored, ", "))}
+}
@@ -0,0 +1,93 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// NodeCache caches the annotations of the node in a file. The plugin is a process per invocation, the file
+// is shared by the invocations on the node, so they don't all cost a request to the API server.
+type NodeCache struct {
+	// Path is the file of the cache
+	Path string
+	// TTL is how long the cache is used without asking the API server
+	TTL time.Duration
+}
+
+type nodeCacheEntry struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	UpdateTime  time.Time         `json:"updateTime"`
+}
+
+// Load returns the cached annotations of the node however old they are, and the time they were cached.
+// It returns false if the node isn't cached.
+func (c *NodeCache) Load(name string) (map[string]string, time.Time, bool) {
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	entry := nodeCacheEntry{}
+	if err = json.Unmarshal(data, &entry); err != nil || entry.Name != name {
+		return nil, time.Time{}, false
+	}
+	return entry.Annotations, entry.UpdateTime, true
+}
+
+// Annotations returns the annotations of the node, from the cache if it's within TTL, otherwise from the API
+// server by the client of newClient, and the cache is refreshed. If the API server fails, the cached annotations
+// are returned along with the error however old they are, or nil if the node isn't cached.
+func (c *NodeCache) Annotations(ctx context.Context, name string, newClient func() (corev1.NodesGetter, error)) (map[string]string, error) {
+	cached, updateTime, ok := c.Load(name)
+	if ok && time.Since(updateTime) < c.TTL {
+		return cached, nil
+	}
+
+	client, err := newClient()
+	if err != nil {
+		return cached, err
+	}
+	annotations, err := NodeAnnotations(ctx, client, name)
+	if err != nil {
+		return cached, err
+	}
+
+	// the cache only saves the requests, a failure to refresh it doesn't matter
+	_ = c.store(&nodeCacheEntry{Name: name, Annotations: annotations, UpdateTime: time.Now()})
+	return annotations, nil
+}
+
+func (c *NodeCache) store(entry *nodeCacheEntry) error {
+	dir := filepath.Dir(c.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return cnierrors.IO(err, "failed to create cache directory %s", dir)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return cnierrors.Internal(err, "failed to encode node cache")
+	}
+
+	// the invocations may refresh it at the same time, each writes its own temporary file and renames it
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.Path)+".*")
+	if err != nil {
+		return cnierrors.IO(err, "failed to write node cache")
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close() // nolint: errcheck
+		return cnierrors.IO(err, "failed to write node cache")
+	}
+	if err = tmp.Close(); err != nil {
+		return cnierrors.IO(err, "failed to write node cache")
+	}
+	if err = os.Rename(tmp.Name(), c.Path); err != nil {
+		return cnierrors.IO(err, "failed to write node cache")
+	}
+	return nil
+}
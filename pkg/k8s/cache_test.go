@@ -0,0 +1,95 @@
+package k8s_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/k8s"
+	"github.com/spidernet-io/plugins/pkg/k8s/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+var _ = Describe("node cache", func() {
+	var server *fake.APIServer
+	var newClient func() (typedcorev1.NodesGetter, error)
+	var cache *k8s.NodeCache
+
+	BeforeEach(func() {
+		server = fake.NewAPIServer()
+		DeferCleanup(server.Close)
+		tmpDir := GinkgoT().TempDir()
+		kubeconfig := filepath.Join(tmpDir, "kubeconfig")
+		Expect(server.WriteKubeconfig(kubeconfig)).To(Succeed())
+		newClient = func() (typedcorev1.NodesGetter, error) {
+			return k8s.NewClient(kubeconfig)
+		}
+		cache = &k8s.NodeCache{Path: filepath.Join(tmpDir, "state", "node-worker1.json"), TTL: time.Minute}
+
+		server.AddNode(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:        "worker1",
+			Annotations: map[string]string{"veth.spidernet.io/node-config": `{"additional_cidr": ["10.7.0.0/16"]}`},
+		}})
+	})
+
+	It("get the annotations of the node", func() {
+		client, err := newClient()
+		Expect(err).NotTo(HaveOccurred())
+		annotations, err := k8s.NodeAnnotations(context.TODO(), client, "worker1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(annotations).To(HaveKey("veth.spidernet.io/node-config"))
+
+		_, err = k8s.NodeAnnotations(context.TODO(), client, "worker2")
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrTryAgainLater))
+	})
+
+	It("only ask the API server when the cache expires", func() {
+		for i := 0; i < 3; i++ {
+			annotations, err := cache.Annotations(context.TODO(), "worker1", newClient)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(annotations).To(HaveKey("veth.spidernet.io/node-config"))
+		}
+		Expect(server.Requests()).To(Equal(1))
+
+		cache.TTL = 0
+		_, err := cache.Annotations(context.TODO(), "worker1", newClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.Requests()).To(Equal(2))
+
+		// the cache of another node isn't used
+		_, _, ok := cache.Load("worker2")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("fall back to the cache however old it is", func() {
+		annotations, err := cache.Annotations(context.TODO(), "worker1", newClient)
+		Expect(err).NotTo(HaveOccurred())
+
+		cache.TTL = 0
+		server.SetStatus(http.StatusServiceUnavailable)
+		cached, err := cache.Annotations(context.TODO(), "worker1", newClient)
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrTryAgainLater))
+		Expect(cached).To(Equal(annotations))
+
+		cached, err = cache.Annotations(context.TODO(), "worker1", func() (typedcorev1.NodesGetter, error) {
+			return nil, errors.New("no kubeconfig")
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(cached).To(Equal(annotations))
+	})
+
+	It("return nothing without cache if the API server fails", func() {
+		server.SetStatus(http.StatusServiceUnavailable)
+		annotations, err := cache.Annotations(context.TODO(), "worker1", newClient)
+		Expect(err).To(HaveOccurred())
+		Expect(annotations).To(BeNil())
+	})
+})
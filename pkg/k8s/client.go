@@ -0,0 +1,57 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// DefaultTimeout bounds a request to the API server, an invocation must not hang on it
+const DefaultTimeout = 10 * time.Second
+
+// NewClient returns the client of the core API group by the kubeconfig, only the core group is
+// built in to keep the plugin small.
+func NewClient(kubeconfig string) (corev1.CoreV1Interface, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, cnierrors.InvalidConfig(err, "failed to load kubeconfig %s", kubeconfig)
+	}
+	restConfig.Timeout = DefaultTimeout
+
+	client, err := corev1.NewForConfig(restConfig)
+	if err != nil {
+		return nil, cnierrors.InvalidConfig(err, "failed to create client by kubeconfig %s", kubeconfig)
+	}
+	return client, nil
+}
+
+// PodAnnotations returns the annotations of the pod. A failure is ErrTryAgainLater, as the API server
+// may be unreachable for a while or the pod isn't in the cache of it yet.
+func PodAnnotations(ctx context.Context, client corev1.PodsGetter, namespace, name string) (map[string]string, error) {
+	pod, err := client.Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+			return nil, cnierrors.InvalidConfig(err, "no permission to get pod %s/%s", namespace, name)
+		}
+		return nil, cnierrors.New(types.ErrTryAgainLater, err, "failed to get pod %s/%s", namespace, name)
+	}
+	return pod.Annotations, nil
+}
+
+// NodeAnnotations returns the annotations of the node, a failure is ErrTryAgainLater like PodAnnotations
+func NodeAnnotations(ctx context.Context, client corev1.NodesGetter, name string) (map[string]string, error) {
+	node, err := client.Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+			return nil, cnierrors.InvalidConfig(err, "no permission to get node %s", name)
+		}
+		return nil, cnierrors.New(types.ErrTryAgainLater, err, "failed to get node %s", name)
+	}
+	return node.Annotations, nil
+}
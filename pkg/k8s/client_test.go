@@ -0,0 +1,64 @@
+package k8s_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/k8s"
+	"github.com/spidernet-io/plugins/pkg/k8s/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("client", func() {
+	var server *fake.APIServer
+	var kubeconfig string
+
+	BeforeEach(func() {
+		server = fake.NewAPIServer()
+		DeferCleanup(server.Close)
+		kubeconfig = filepath.Join(GinkgoT().TempDir(), "kubeconfig")
+		Expect(server.WriteKubeconfig(kubeconfig)).To(Succeed())
+
+		server.AddPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "nginx",
+			Annotations: map[string]string{"veth.spidernet.io/disabled": "true"},
+		}})
+	})
+
+	It("get the annotations of the pod", func() {
+		client, err := k8s.NewClient(kubeconfig)
+		Expect(err).NotTo(HaveOccurred())
+
+		annotations, err := k8s.PodAnnotations(context.TODO(), client, "default", "nginx")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(annotations).To(Equal(map[string]string{"veth.spidernet.io/disabled": "true"}))
+	})
+
+	It("try again later if the pod isn't found or the server fails", func() {
+		client, err := k8s.NewClient(kubeconfig)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = k8s.PodAnnotations(context.TODO(), client, "default", "redis")
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrTryAgainLater))
+
+		server.SetStatus(http.StatusServiceUnavailable)
+		_, err = k8s.PodAnnotations(context.TODO(), client, "default", "nginx")
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrTryAgainLater))
+
+		server.SetStatus(http.StatusForbidden)
+		_, err = k8s.PodAnnotations(context.TODO(), client, "default", "nginx")
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrInvalidNetworkConfig))
+	})
+
+	It("reject an invalid kubeconfig", func() {
+		_, err := k8s.NewClient(filepath.Join(GinkgoT().TempDir(), "missing"))
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrInvalidNetworkConfig))
+	})
+})
@@ -0,0 +1,148 @@
+// Package fake provides a fake API server for the tests of package k8s and the plugins,
+// they are given a kubeconfig of it instead of a cluster.
+package fake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// APIServer serves the GET requests of the pods and nodes added to it, the others are not found
+type APIServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	pods     map[string]*corev1.Pod
+	nodes    map[string]*corev1.Node
+	status   int
+	requests int
+}
+
+// NewAPIServer starts an APIServer, it's stopped by Close
+func NewAPIServer() *APIServer {
+	s := &APIServer{pods: make(map[string]*corev1.Pod), nodes: make(map[string]*corev1.Node)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddPod adds or replaces the pod
+func (s *APIServer) AddPod(pod *corev1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pods[pod.Namespace+"/"+pod.Name] = pod.DeepCopy()
+}
+
+// AddNode adds or replaces the node
+func (s *APIServer) AddNode(node *corev1.Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[node.Name] = node.DeepCopy()
+}
+
+// SetStatus makes the server fail every request with the http status, 0 restores it
+func (s *APIServer) SetStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Requests returns the number of requests served
+func (s *APIServer) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// WriteKubeconfig writes a kubeconfig of the server to the path
+func (s *APIServer) WriteKubeconfig(path string) error {
+	kubeconfig := `apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: ` + s.URL + `
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+users:
+- name: fake
+  user:
+    token: fake
+current-context: fake
+`
+	return os.WriteFile(path, []byte(kubeconfig), 0600)
+}
+
+func (s *APIServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	if s.status != 0 {
+		writeStatus(w, s.status, "injected failure")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodGet || len(parts) < 2 || parts[0] != "api" || parts[1] != "v1" {
+		writeStatus(w, http.StatusNotFound, "the server could not find the requested resource")
+		return
+	}
+
+	var obj interface{}
+	switch {
+	// /api/v1/namespaces/<namespace>/pods/<name>
+	case len(parts) == 6 && parts[2] == "namespaces" && parts[4] == "pods":
+		pod, ok := s.pods[parts[3]+"/"+parts[5]]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, `pods "`+parts[5]+`" not found`)
+			return
+		}
+		pod = pod.DeepCopy()
+		pod.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+		obj = pod
+	// /api/v1/nodes/<name>
+	case len(parts) == 4 && parts[2] == "nodes":
+		node, ok := s.nodes[parts[3]]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, `nodes "`+parts[3]+`" not found`)
+			return
+		}
+		node = node.DeepCopy()
+		node.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Node"}
+		obj = node
+	default:
+		writeStatus(w, http.StatusNotFound, "the server could not find the requested resource")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	status := &metav1.Status{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Code:     int32(code),
+	}
+	switch code {
+	case http.StatusNotFound:
+		status.Reason = metav1.StatusReasonNotFound
+	case http.StatusForbidden:
+		status.Reason = metav1.StatusReasonForbidden
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
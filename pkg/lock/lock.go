@@ -0,0 +1,88 @@
+package lock
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultLockDir is where the lock files are created
+	DefaultLockDir = "/var/run/spider-plugins/locks"
+	// DefaultTimeout is how long an invocation waits for a lock
+	DefaultTimeout = 30 * time.Second
+
+	hostLockName = "host.lock"
+	pollInterval = 10 * time.Millisecond
+)
+
+// FileLock is an exclusive flock(2) lock, it's released automatically if the process exits.
+type FileLock struct {
+	f *os.File
+}
+
+// Acquire waits for the exclusive lock of the given file until ctx is done,
+// ErrTryAgainLater is returned on timeout so that the runtime could retry.
+func Acquire(ctx context.Context, path string) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, cnierrors.IO(err, "failed to create lock directory %s", filepath.Dir(path))
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to open lock file %s", path)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return &FileLock{f: f}, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			f.Close()
+			return nil, cnierrors.IO(err, "failed to lock %s", path)
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, cnierrors.New(types.ErrTryAgainLater, ctx.Err(), "timed out waiting for lock %s, another invocation holds it", path)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Release releases the lock
+func (l *FileLock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	defer func() {
+		l.f.Close()
+		l.f = nil
+	}()
+	return unix.Flock(int(l.f.Fd()), unix.LOCK_UN)
+}
+
+// NetnsLockPath returns the lock file of the given pod netns, it serializes the invocations
+// for different interfaces of the same pod. The netns are hashed into 256 files by the first byte of
+// the hash, so the files don't grow with the pods ever created, the pods sharing a file are only serialized.
+func NetnsLockPath(dir, netns string) string {
+	sum := sha256.Sum256([]byte(netns))
+	return filepath.Join(dir, fmt.Sprintf("netns-%02x.lock", sum[0]))
+}
+
+// HostLockPath returns the lock file of the host-scope state, like host-wide sysctl,
+// the main table routes and neighbor entries of the host.
+func HostLockPath(dir string) string {
+	return filepath.Join(dir, hostLockName)
+}
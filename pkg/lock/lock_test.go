@@ -0,0 +1,79 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+)
+
+var _ = Describe("lock", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("time out with try again later", func() {
+		held, err := Acquire(context.TODO(), HostLockPath(dir))
+		Expect(err).NotTo(HaveOccurred())
+		defer held.Release() // nolint: errcheck
+
+		ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+		defer cancel()
+		_, err = Acquire(ctx, HostLockPath(dir))
+		Expect(err).To(HaveOccurred())
+		Expect(cnierrors.Code(err)).To(Equal(types.ErrTryAgainLater))
+	})
+
+	It("acquire after release", func() {
+		held, err := Acquire(context.TODO(), HostLockPath(dir))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(held.Release()).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+		defer cancel()
+		l, err := Acquire(ctx, HostLockPath(dir))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Release()).To(Succeed())
+	})
+
+	It("serialize the holders", func() {
+		const n = 10
+		path := NetnsLockPath(dir, "/var/run/netns/cni-1234")
+		var holders int32
+		wg := sync.WaitGroup{}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				l, err := Acquire(context.TODO(), path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(atomic.AddInt32(&holders, 1)).To(Equal(int32(1)))
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				Expect(l.Release()).To(Succeed())
+			}()
+		}
+		wg.Wait()
+	})
+
+	It("different netns have different locks", func() {
+		Expect(NetnsLockPath(dir, "/var/run/netns/a")).NotTo(Equal(NetnsLockPath(dir, "/var/run/netns/b")))
+	})
+
+	It("the lock files don't grow with the netns", func() {
+		paths := make(map[string]struct{})
+		for i := 0; i < 10000; i++ {
+			paths[NetnsLockPath(dir, fmt.Sprintf("/var/run/netns/cni-%d", i))] = struct{}{}
+		}
+		Expect(len(paths)).To(Equal(256))
+	})
+})
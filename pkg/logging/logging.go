@@ -1,11 +1,22 @@
 package logging
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/spidernet-io/cni-plugins/pkg/constant"
 	"github.com/spidernet-io/plugins/pkg/types"
 	"github.com/spidernet-io/spiderpool/pkg/logutils"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 	"k8s.io/utils/pointer"
 )
 
@@ -38,7 +49,31 @@ const (
 	FatalLevel = zapcore.FatalLevel
 )
 
-// InitLogger set the logger from LoggingOptions
+// Log sinks
+const (
+	SinkFile   = "file"
+	SinkStderr = "stderr"
+	// SinkSyslog writes to the local syslog socket, which is also read by journald
+	SinkSyslog = "syslog"
+)
+
+// Log formats
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+var (
+	SupportedSinks   = []string{SinkFile, SinkStderr, SinkSyslog}
+	SupportedFormats = []string{FormatJSON, FormatConsole}
+)
+
+// logDirPerm only allows root and its group to read the log directory
+const logDirPerm = 0750
+
+// InitLogger set the logger from LoggingOptions. Every sink is independent, a sink failing to init
+// is returned as error but LoggerFile is still set with the others, so the caller could go on logging.
+// A write failure of a sink is discarded, it never breaks the CNI call.
 func InitLogger(options *types.LogOptions, pluginName string) error {
 	v := logutils.ConvertLogLevel(options.LogLevel)
 	if v == nil {
@@ -47,39 +82,97 @@ func InitLogger(options *types.LogOptions, pluginName string) error {
 		v = &logLevel
 	}
 
-	var err error
-	LoggerFile, err = logutils.InitFileLogger(*v, options.LogFilePath, *options.LogFileMaxSize, *options.LogFileMaxAge, *options.LogFileMaxCount)
-	if err != nil {
-		return err
+	encoder := newEncoder(options.LogFormat)
+
+	var cores []zapcore.Core
+	var errs error
+	for _, sink := range options.LogSinks {
+		level := zap.NewAtomicLevelAt(*v)
+		if sink == SinkSyslog {
+			w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, pluginName)
+			if err != nil {
+				errs = multierr.Append(errs, fmt.Errorf("failed to connect to syslog: %v", err))
+				continue
+			}
+			cores = append(cores, newSyslogCore(encoder, w, level))
+			continue
+		}
+		ws, err := newWriteSyncer(sink, options)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		cores = append(cores, zapcore.NewCore(encoder, ws, level))
+	}
+
+	LoggerFile = zap.New(zapcore.NewTee(cores...), zap.AddCaller(), zap.ErrorOutput(zapcore.AddSync(io.Discard))).Named(pluginName)
+	return errs
+}
+
+func newEncoder(format string) zapcore.Encoder {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	encoderConfig.EncodeCaller = zapcore.ShortCallerEncoder
+	encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+
+	if format == FormatConsole {
+		return zapcore.NewConsoleEncoder(encoderConfig)
+	}
+	return zapcore.NewJSONEncoder(encoderConfig)
+}
+
+func newWriteSyncer(sink string, options *types.LogOptions) (zapcore.WriteSyncer, error) {
+	switch sink {
+	case SinkFile:
+		if err := os.MkdirAll(filepath.Dir(options.LogFilePath), logDirPerm); err != nil {
+			return nil, fmt.Errorf("failed to create directory for log file %s: %v", options.LogFilePath, err)
+		}
+		return zapcore.AddSync(&lumberjack.Logger{
+			Filename:   options.LogFilePath,
+			MaxSize:    *options.LogFileMaxSize,
+			MaxAge:     *options.LogFileMaxAge,
+			MaxBackups: *options.LogFileMaxCount,
+		}), nil
+	case SinkStderr:
+		// stdout is reserved for the CNI result
+		return zapcore.Lock(os.Stderr), nil
 	}
+	return nil, fmt.Errorf("unsupported log sink %q", sink)
+}
 
-	LoggerFile.Named(pluginName)
-	return nil
+// NewTraceID generates an ID for the invocation, it's added to every log line
+// so that the lines of a CNI call could be grouped.
+func NewTraceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
 }
 
 // InitLogOptions init log options from config file
 func InitLogOptions(logOptions *types.LogOptions) *types.LogOptions {
 	// validate logging config
-	if logOptions != nil {
-		if logOptions.LogLevel == "" {
-			logOptions.LogLevel = constant.LogDebugLevelStr
-		}
-		if logOptions.LogFileMaxSize == nil {
-			logOptions.LogFileMaxSize = pointer.Int(constant.LogDefaultMaxSize)
-		}
-		if logOptions.LogFileMaxAge == nil {
-			logOptions.LogFileMaxAge = pointer.Int(constant.LogDefaultMaxAge)
-		}
-		if logOptions.LogFileMaxCount == nil {
-			logOptions.LogFileMaxCount = pointer.Int(constant.LogDefaultMaxAge)
-		}
-		return logOptions
+	if logOptions == nil {
+		logOptions = &types.LogOptions{}
 	}
-
-	return &types.LogOptions{
-		LogLevel:        constant.LogDebugLevelStr,
-		LogFileMaxSize:  pointer.Int(constant.LogDefaultMaxSize),
-		LogFileMaxAge:   pointer.Int(constant.LogDefaultMaxAge),
-		LogFileMaxCount: pointer.Int(constant.LogDefaultMaxAge),
+	if logOptions.LogLevel == "" {
+		logOptions.LogLevel = constant.LogInfoLevelStr
+	}
+	if logOptions.LogFileMaxSize == nil {
+		logOptions.LogFileMaxSize = pointer.Int(constant.LogDefaultMaxSize)
+	}
+	if logOptions.LogFileMaxAge == nil {
+		logOptions.LogFileMaxAge = pointer.Int(constant.LogDefaultMaxAge)
+	}
+	if logOptions.LogFileMaxCount == nil {
+		logOptions.LogFileMaxCount = pointer.Int(constant.LogDefaultMaxBackups)
+	}
+	if len(logOptions.LogSinks) == 0 {
+		logOptions.LogSinks = []string{SinkFile}
+	}
+	if logOptions.LogFormat == "" {
+		logOptions.LogFormat = FormatJSON
 	}
+	return logOptions
 }
@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/cni-plugins/pkg/constant"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("logging", func() {
+	Context("Test InitLogOptions", func() {
+		It("give default values", func() {
+			options := InitLogOptions(nil)
+			Expect(options.LogLevel).To(Equal(constant.LogInfoLevelStr))
+			Expect(*options.LogFileMaxCount).To(Equal(constant.LogDefaultMaxBackups))
+			Expect(options.LogSinks).To(Equal([]string{SinkFile}))
+			Expect(options.LogFormat).To(Equal(FormatJSON))
+		})
+
+		It("keep the given values", func() {
+			options := InitLogOptions(&types.LogOptions{LogLevel: "debug", LogSinks: []string{SinkStderr}, LogFormat: FormatConsole})
+			Expect(options.LogLevel).To(Equal("debug"))
+			Expect(options.LogSinks).To(Equal([]string{SinkStderr}))
+			Expect(options.LogFormat).To(Equal(FormatConsole))
+		})
+	})
+
+	Context("Test InitLogger", func() {
+		It("create the log directory with safe permissions", func() {
+			logFile := filepath.Join(GinkgoT().TempDir(), "spider-io", "veth.log")
+			options := InitLogOptions(&types.LogOptions{LogFilePath: logFile})
+			Expect(InitLogger(options, "veth")).To(Succeed())
+
+			LoggerFile.Info("hello")
+			Expect(LoggerFile.Sync()).To(Succeed())
+
+			info, err := os.Stat(filepath.Dir(logFile))
+			Expect(err).NotTo(HaveOccurred())
+			// no access for others, whatever the umask is
+			Expect(info.Mode().Perm() & 0007).To(BeZero())
+
+			content, err := os.ReadFile(logFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(ContainSubstring("hello"))
+		})
+
+		It("a failed sink doesn't stop the others", func() {
+			logFile := filepath.Join(GinkgoT().TempDir(), "veth.log")
+			options := InitLogOptions(&types.LogOptions{LogFilePath: logFile, LogSinks: []string{"unknown", SinkFile}})
+			Expect(InitLogger(options, "veth")).NotTo(Succeed())
+			Expect(LoggerFile).NotTo(BeNil())
+
+			LoggerFile.Info("hello")
+			content, err := os.ReadFile(logFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(ContainSubstring("hello"))
+		})
+	})
+
+	Context("Test syslogCore", func() {
+		It("write the entries at the priority of their level", func() {
+			w := &fakeSyslog{}
+			logger := zap.New(newSyslogCore(newEncoder(FormatJSON), w, zap.NewAtomicLevelAt(zap.DebugLevel))).
+				With(zap.String("ContainerID", "00000000000"))
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			logger.Error("error")
+			logger.DPanic("dpanic")
+
+			Expect(w.priorities).To(Equal([]string{"debug", "info", "warning", "err", "crit"}))
+			Expect(w.messages[3]).To(ContainSubstring(`"msg":"error"`))
+			Expect(w.messages[3]).To(ContainSubstring(`"ContainerID":"00000000000"`))
+			Expect(w.messages[3]).NotTo(HaveSuffix("\n"))
+		})
+
+		It("drop the entries below the level", func() {
+			w := &fakeSyslog{}
+			logger := zap.New(newSyslogCore(newEncoder(FormatJSON), w, zap.NewAtomicLevelAt(zap.WarnLevel)))
+			logger.Info("info")
+			logger.Error("error")
+			Expect(w.priorities).To(Equal([]string{"err"}))
+		})
+	})
+
+	Context("Test NewTraceID", func() {
+		It("generate different ids", func() {
+			Expect(NewTraceID()).NotTo(Equal(NewTraceID()))
+		})
+	})
+})
+
+// fakeSyslog records the priority and the message of every write
+type fakeSyslog struct {
+	priorities []string
+	messages   []string
+}
+
+func (f *fakeSyslog) write(priority, m string) error {
+	f.priorities = append(f.priorities, priority)
+	f.messages = append(f.messages, m)
+	return nil
+}
+
+func (f *fakeSyslog) Debug(m string) error   { return f.write("debug", m) }
+func (f *fakeSyslog) Info(m string) error    { return f.write("info", m) }
+func (f *fakeSyslog) Warning(m string) error { return f.write("warning", m) }
+func (f *fakeSyslog) Err(m string) error     { return f.write("err", m) }
+func (f *fakeSyslog) Crit(m string) error    { return f.write("crit", m) }
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogWriter writes a message at a syslog priority, it's implemented by *syslog.Writer
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+	Crit(m string) error
+}
+
+// syslogCore writes the entries to syslog at the priority of their level, so filters like
+// `journalctl -p err` see the errors of the plugin. The priority given to syslog.New is only
+// the default of the writer, every entry overrides it.
+type syslogCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	writer  syslogWriter
+}
+
+func newSyslogCore(encoder zapcore.Encoder, writer syslogWriter, enab zapcore.LevelEnabler) zapcore.Core {
+	return &syslogCore{LevelEnabler: enab, encoder: encoder, writer: writer}
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &syslogCore{LevelEnabler: c.LevelEnabler, encoder: c.encoder.Clone(), writer: c.writer}
+	for _, field := range fields {
+		field.AddTo(clone.encoder)
+	}
+	return clone
+}
+
+func (c *syslogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *syslogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return err
+	}
+	// syslog adds the line end itself
+	msg := strings.TrimSuffix(buf.String(), "\n")
+	buf.Free()
+
+	switch entry.Level {
+	case zapcore.DebugLevel:
+		return c.writer.Debug(msg)
+	case zapcore.InfoLevel:
+		return c.writer.Info(msg)
+	case zapcore.WarnLevel:
+		return c.writer.Warning(msg)
+	case zapcore.ErrorLevel:
+		return c.writer.Err(msg)
+	default:
+		// dpanic, panic and fatal
+		return c.writer.Crit(msg)
+	}
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spidernet-io/plugins/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// Commands
+const (
+	CommandAdd = "ADD"
+	CommandDel = "DEL"
+)
+
+// Results
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Phases of ADD
+const (
+	PhaseVethSetup  = "veth_setup"
+	PhaseOffload    = "offload"
+	PhaseBandwidth  = "bandwidth"
+	PhaseNeighbor   = "neighbor"
+	PhaseRoutes     = "routes"
+	PhaseMoveRoutes = "move_routes"
+	PhaseSysctl     = "sysctl"
+	PhaseEgress     = "egress"
+	PhaseHostFilter = "host_filter"
+	PhaseConntrack  = "conntrack"
+	PhaseRedirect   = "ebpf_redirect"
+)
+
+const (
+	// DefaultTextfileDir is the default directory of node-exporter textfile collector
+	DefaultTextfileDir = "/var/lib/node_exporter/textfile_collector"
+	// textfileName is the file read by node-exporter, only *.prom is collected
+	textfileName = "spider_veth.prom"
+	// stateFileName keeps the accumulated values between invocations, it's also the lock file
+	stateFileName = ".spider_veth_metrics.json"
+)
+
+// DefaultBuckets are the upper bounds in seconds of duration histograms
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram is a prometheus histogram, Counts[i] is the number of observations in (Buckets[i-1], Buckets[i]],
+// the last one is for +Inf.
+type Histogram struct {
+	Counts []uint64 `json:"counts"`
+	Count  uint64   `json:"count"`
+	Sum    float64  `json:"sum"`
+}
+
+func (h *Histogram) observe(v float64) {
+	if len(h.Counts) != len(DefaultBuckets)+1 {
+		h.Counts = make([]uint64, len(DefaultBuckets)+1)
+	}
+	idx := sort.SearchFloat64s(DefaultBuckets, v)
+	h.Counts[idx]++
+	h.Count++
+	h.Sum += v
+}
+
+// State is the accumulated metrics of all invocations on the node
+type State struct {
+	// Invocations is keyed by command and result
+	Invocations map[string]map[string]uint64 `json:"invocations"`
+	// CommandDurations is keyed by command
+	CommandDurations map[string]*Histogram `json:"command_durations"`
+	// PhaseDurations is keyed by phase
+	PhaseDurations map[string]*Histogram `json:"phase_durations"`
+	// PolicyTables is the policy routing tables allocated by the last successful ADD of each
+	// attachment, keyed by container id and interface name
+	PolicyTables map[string][]int `json:"attachment_policy_tables"`
+	// HostPodRoutes is the number of pod routes via the host veths, from the last invocation
+	HostPodRoutes int `json:"host_pod_routes"`
+}
+
+func newState() *State {
+	return &State{
+		Invocations:      make(map[string]map[string]uint64),
+		CommandDurations: make(map[string]*Histogram),
+		PhaseDurations:   make(map[string]*Histogram),
+		PolicyTables:     make(map[string][]int),
+	}
+}
+
+type phase struct {
+	name     string
+	duration time.Duration
+}
+
+// Recorder collects the metrics of one invocation in memory, they are written to
+// the textfile by Flush at the end of the invocation.
+type Recorder struct {
+	command       string
+	attachment    string
+	start         time.Time
+	phases        []phase
+	policyTables  []int
+	hostPodRoutes *int
+}
+
+// NewRecorder starts recording the given command of the attachment
+func NewRecorder(command, containerID, ifName string) *Recorder {
+	return &Recorder{command: command, attachment: containerID + "/" + ifName, start: time.Now()}
+}
+
+// ObservePhase records the duration of a phase since the given start time
+func (r *Recorder) ObservePhase(name string, start time.Time) {
+	r.phases = append(r.phases, phase{name: name, duration: time.Since(start)})
+}
+
+// SetPolicyTables records the policy routing tables allocated for the attachment
+func (r *Recorder) SetPolicyTables(tables []int) {
+	r.policyTables = tables
+}
+
+// SetHostPodRoutes records the number of pod routes via the host veths
+func (r *Recorder) SetHostPodRoutes(n int) {
+	r.hostPodRoutes = &n
+}
+
+// Flush merges the recorded metrics into the node state and rewrites the textfile atomically.
+// The state is updated under an exclusive file lock, so it's safe to be called by many plugin
+// processes at the same time. Nothing is done if metrics is disabled.
+func (r *Recorder) Flush(options *types.MetricsOptions, err error) error {
+	if options == nil || !options.Enable {
+		return nil
+	}
+
+	dir := options.TextfileDir
+	if dir == "" {
+		dir = DefaultTextfileDir
+	}
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return fmt.Errorf("failed to create textfile directory %s: %v", dir, e)
+	}
+
+	lock, e := os.OpenFile(filepath.Join(dir, stateFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return fmt.Errorf("failed to open metrics state: %v", e)
+	}
+	defer lock.Close()
+
+	if e := unix.Flock(int(lock.Fd()), unix.LOCK_EX); e != nil {
+		return fmt.Errorf("failed to lock metrics state: %v", e)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN) // nolint: errcheck
+
+	state, e := readState(lock)
+	if e != nil {
+		return e
+	}
+	r.merge(state, err)
+
+	if e := writeState(lock, state); e != nil {
+		return e
+	}
+	return writeTextfile(dir, state)
+}
+
+func (r *Recorder) merge(state *State, err error) {
+	result := ResultSuccess
+	if err != nil {
+		result = ResultFailure
+	}
+	if state.Invocations[r.command] == nil {
+		state.Invocations[r.command] = make(map[string]uint64)
+	}
+	state.Invocations[r.command][result]++
+
+	if state.CommandDurations[r.command] == nil {
+		state.CommandDurations[r.command] = &Histogram{}
+	}
+	state.CommandDurations[r.command].observe(time.Since(r.start).Seconds())
+
+	for _, p := range r.phases {
+		if state.PhaseDurations[p.name] == nil {
+			state.PhaseDurations[p.name] = &Histogram{}
+		}
+		state.PhaseDurations[p.name].observe(p.duration.Seconds())
+	}
+
+	// a repeated ADD replaces the tables of the attachment instead of adding up
+	switch {
+	case r.command == CommandDel:
+		delete(state.PolicyTables, r.attachment)
+	case err != nil:
+	case len(r.policyTables) > 0:
+		state.PolicyTables[r.attachment] = r.policyTables
+	default:
+		delete(state.PolicyTables, r.attachment)
+	}
+
+	if r.hostPodRoutes != nil {
+		state.HostPodRoutes = *r.hostPodRoutes
+	}
+}
+
+func readState(f *os.File) (*State, error) {
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics state: %v", err)
+	}
+
+	state := newState()
+	if len(data) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		// a broken state only loses the history, start over
+		return newState(), nil
+	}
+	if state.Invocations == nil {
+		state.Invocations = make(map[string]map[string]uint64)
+	}
+	if state.CommandDurations == nil {
+		state.CommandDurations = make(map[string]*Histogram)
+	}
+	if state.PhaseDurations == nil {
+		state.PhaseDurations = make(map[string]*Histogram)
+	}
+	if state.PolicyTables == nil {
+		state.PolicyTables = make(map[string][]int)
+	}
+	return state, nil
+}
+
+func writeState(f *os.File, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics state: %v", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate metrics state: %v", err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to write metrics state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/types"
+)
+
+var _ = Describe("metrics", func() {
+	var dir string
+	var options *types.MetricsOptions
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		options = &types.MetricsOptions{Enable: true, TextfileDir: dir}
+	})
+
+	readTextfile := func() string {
+		content, err := os.ReadFile(filepath.Join(dir, textfileName))
+		Expect(err).NotTo(HaveOccurred())
+		return string(content)
+	}
+
+	It("do nothing if metrics is disabled", func() {
+		Expect(NewRecorder(CommandAdd, "c1", "eth0").Flush(&types.MetricsOptions{TextfileDir: dir}, nil)).To(Succeed())
+		Expect(NewRecorder(CommandAdd, "c1", "eth0").Flush(nil, nil)).To(Succeed())
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("write counters, histograms and gauges", func() {
+		rec := NewRecorder(CommandAdd, "c1", "net1")
+		rec.ObservePhase(PhaseVethSetup, time.Now().Add(-3*time.Millisecond))
+		rec.SetPolicyTables([]int{101})
+		rec.SetHostPodRoutes(4)
+		Expect(rec.Flush(options, nil)).To(Succeed())
+		Expect(NewRecorder(CommandAdd, "c2", "net1").Flush(options, errors.New("failed"))).To(Succeed())
+
+		content := readTextfile()
+		Expect(content).To(ContainSubstring(`spider_veth_invocations_total{command="ADD",result="success"} 1`))
+		Expect(content).To(ContainSubstring(`spider_veth_invocations_total{command="ADD",result="failure"} 1`))
+		Expect(content).To(ContainSubstring(`spider_veth_phase_duration_seconds_bucket{phase="veth_setup",le="0.001"} 0`))
+		Expect(content).To(ContainSubstring(`spider_veth_phase_duration_seconds_bucket{phase="veth_setup",le="0.005"} 1`))
+		Expect(content).To(ContainSubstring(`spider_veth_phase_duration_seconds_count{phase="veth_setup"} 1`))
+		Expect(content).To(ContainSubstring(`spider_veth_command_duration_seconds_count{command="ADD"} 2`))
+		Expect(content).To(ContainSubstring("spider_veth_policy_tables_allocated 1\n"))
+		Expect(content).To(ContainSubstring("spider_veth_host_pod_routes 4\n"))
+
+		// DEL releases the policy tables of the container
+		Expect(NewRecorder(CommandDel, "c1", "net1").Flush(options, nil)).To(Succeed())
+		Expect(readTextfile()).To(ContainSubstring("spider_veth_policy_tables_allocated 0\n"))
+	})
+
+	It("keep the policy tables of each attachment", func() {
+		first := NewRecorder(CommandAdd, "c1", "eth0")
+		first.SetPolicyTables([]int{99, 98})
+		Expect(first.Flush(options, nil)).To(Succeed())
+		second := NewRecorder(CommandAdd, "c1", "net1")
+		second.SetPolicyTables([]int{101})
+		Expect(second.Flush(options, nil)).To(Succeed())
+		Expect(readTextfile()).To(ContainSubstring("spider_veth_policy_tables_allocated 3\n"))
+
+		// a repeated ADD doesn't count the tables again
+		again := NewRecorder(CommandAdd, "c1", "net1")
+		again.SetPolicyTables([]int{101})
+		Expect(again.Flush(options, nil)).To(Succeed())
+		Expect(readTextfile()).To(ContainSubstring("spider_veth_policy_tables_allocated 3\n"))
+
+		// DEL of one attachment keeps the tables of the others
+		del := NewRecorder(CommandDel, "c1", "net1")
+		del.SetHostPodRoutes(2)
+		Expect(del.Flush(options, nil)).To(Succeed())
+		content := readTextfile()
+		Expect(content).To(ContainSubstring("spider_veth_policy_tables_allocated 2\n"))
+		Expect(content).To(ContainSubstring("spider_veth_host_pod_routes 2\n"))
+
+		Expect(NewRecorder(CommandDel, "c1", "eth0").Flush(options, nil)).To(Succeed())
+		Expect(readTextfile()).To(ContainSubstring("spider_veth_policy_tables_allocated 0\n"))
+	})
+
+	It("safe for concurrent invocations", func() {
+		const n = 20
+		wg := sync.WaitGroup{}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				rec := NewRecorder(CommandAdd, fmt.Sprintf("c%d", i), "net1")
+				rec.SetPolicyTables([]int{101})
+				Expect(rec.Flush(options, nil)).To(Succeed())
+			}(i)
+		}
+		wg.Wait()
+
+		content := readTextfile()
+		Expect(content).To(ContainSubstring(fmt.Sprintf(`spider_veth_invocations_total{command="ADD",result="success"} %d`, n)))
+		Expect(content).To(ContainSubstring(fmt.Sprintf("spider_veth_policy_tables_allocated %d\n", n)))
+
+		// no temporary file is left
+		matches, err := filepath.Glob(filepath.Join(dir, "."+textfileName+".*"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(matches).To(BeEmpty())
+	})
+})
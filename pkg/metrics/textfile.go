@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const namespace = "spider_veth"
+
+// writeTextfile renders the state in the prometheus text format, it's written to a temporary
+// file and renamed, so node-exporter never reads a partial file.
+func writeTextfile(dir string, state *State) error {
+	tmp, err := os.CreateTemp(dir, "."+textfileName+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary textfile: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+
+	if _, err := tmp.Write(Render(state)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary textfile: %v", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to chmod temporary textfile: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary textfile: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, textfileName)); err != nil {
+		return fmt.Errorf("failed to rename textfile: %v", err)
+	}
+	return nil
+}
+
+// Render returns the state in the prometheus text format
+func Render(state *State) []byte {
+	buf := &bytes.Buffer{}
+
+	name := namespace + "_invocations_total"
+	fmt.Fprintf(buf, "# HELP %s The number of CNI invocations, by command and result.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+	for _, command := range sortedKeys(state.Invocations) {
+		for _, result := range sortedKeys(state.Invocations[command]) {
+			fmt.Fprintf(buf, "%s{command=%q,result=%q} %d\n", name, command, result, state.Invocations[command][result])
+		}
+	}
+
+	renderHistograms(buf, namespace+"_command_duration_seconds", "The duration of CNI invocations, by command.", "command", state.CommandDurations)
+	renderHistograms(buf, namespace+"_phase_duration_seconds", "The duration of the phases of ADD.", "phase", state.PhaseDurations)
+
+	tables := 0
+	for _, t := range state.PolicyTables {
+		tables += len(t)
+	}
+	name = namespace + "_policy_tables_allocated"
+	fmt.Fprintf(buf, "# HELP %s The number of policy routing tables allocated for pods.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(buf, "%s %d\n", name, tables)
+
+	name = namespace + "_host_pod_routes"
+	fmt.Fprintf(buf, "# HELP %s The number of pod routes via the host veths.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(buf, "%s %d\n", name, state.HostPodRoutes)
+
+	return buf.Bytes()
+}
+
+func renderHistograms(buf *bytes.Buffer, name, help, label string, histograms map[string]*Histogram) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+	for _, key := range sortedKeys(histograms) {
+		h := histograms[key]
+		var cumulative uint64
+		for idx, upper := range DefaultBuckets {
+			if idx < len(h.Counts) {
+				cumulative += h.Counts[idx]
+			}
+			fmt.Fprintf(buf, "%s_bucket{%s=%q,le=%q} %d\n", name, label, key, strconv.FormatFloat(upper, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, key, h.Count)
+		fmt.Fprintf(buf, "%s_sum{%s=%q} %s\n", name, label, key, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count{%s=%q} %d\n", name, label, key, h.Count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
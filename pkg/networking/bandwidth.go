@@ -0,0 +1,178 @@
+package networking
+
+import (
+	"errors"
+	"math"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// bandwidthPriority is the priority of the tc filter redirecting the traffic from the pod to its ifb
+	bandwidthPriority = 0xa001
+	// bandwidthLatency is the seconds a packet could wait in the tbf queue, like the bandwidth plugin
+	bandwidthLatency = 0.025
+)
+
+// SetupBandwidth shapes the traffic of the pod on its host veth in the current netns, like the bandwidth plugin.
+// The traffic to the pod is shaped by a tbf qdisc on the host veth. The traffic from the pod enters the node
+// on the ingress of the host veth, where no qdisc queues, so it's redirected to the ifb device of the pod and
+// shaped by the tbf qdisc on it. The directions without a rate are left untouched, a retry replaces the qdiscs.
+func SetupBandwidth(hostVeth, ifb string, bandwidth *types.Bandwidth) error {
+	link, err := netlink.LinkByName(hostVeth)
+	if err != nil {
+		return cnierrors.IO(err, "failed to find %s", hostVeth)
+	}
+
+	if bandwidth.IngressRate > 0 {
+		if err = replaceTBF(link, bandwidth.IngressRate, bandwidth.IngressBurst); err != nil {
+			return err
+		}
+	}
+	if bandwidth.EgressRate == 0 {
+		return nil
+	}
+
+	ifbLink, err := ensureIfb(ifb, link.Attrs().MTU)
+	if err != nil {
+		return err
+	}
+	if err = replaceTBF(ifbLink, bandwidth.EgressRate, bandwidth.EgressBurst); err != nil {
+		return err
+	}
+	if err = ensureClsact(link); err != nil {
+		return err
+	}
+	if err = deleteBandwidthFilter(link); err != nil {
+		return err
+	}
+
+	// eq: tc filter add dev <hostVeth> ingress prio <priority> protocol all u32 match u32 0 0
+	//     action mirred egress redirect dev <ifb>
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  bandwidthPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		RedirIndex: ifbLink.Attrs().Index,
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return cnierrors.IO(err, "failed to redirect the traffic of %s to %s", hostVeth, ifb)
+	}
+	return nil
+}
+
+// TeardownBandwidth removes the shaping of the pod in the current netns. The ifb device outlives the host veth,
+// while the qdiscs and filter on the host veth are only removed if it still exists.
+func TeardownBandwidth(hostVeth, ifb string) error {
+	link, err := netlink.LinkByName(hostVeth)
+	if err != nil && !errors.As(err, &netlink.LinkNotFoundError{}) {
+		return cnierrors.IO(err, "failed to find %s", hostVeth)
+	}
+	if err == nil {
+		// the filter is removed before the ifb, a redirect to a missing device drops the packets
+		if err = deleteBandwidthFilter(link); err != nil {
+			return err
+		}
+		qdiscs, err := netlink.QdiscList(link)
+		if err != nil {
+			return cnierrors.IO(err, "failed to list qdiscs of %s", hostVeth)
+		}
+		for _, qdisc := range qdiscs {
+			if _, ok := qdisc.(*netlink.Tbf); !ok || qdisc.Attrs().Parent != netlink.HANDLE_ROOT {
+				continue
+			}
+			// eq: tc qdisc del dev <hostVeth> root
+			if err = netlink.QdiscDel(qdisc); err != nil && !errors.Is(err, unix.ENOENT) {
+				return cnierrors.IO(err, "failed to delete tbf qdisc of %s", hostVeth)
+			}
+		}
+	}
+
+	ifbLink, err := netlink.LinkByName(ifb)
+	if err != nil {
+		if errors.As(err, &netlink.LinkNotFoundError{}) {
+			return nil
+		}
+		return cnierrors.IO(err, "failed to find %s", ifb)
+	}
+	// eq: ip link del <ifb>
+	if err = netlink.LinkDel(ifbLink); err != nil && !errors.Is(err, unix.ENODEV) {
+		return cnierrors.IO(err, "failed to delete %s", ifb)
+	}
+	return nil
+}
+
+// ensureIfb creates the ifb device with the mtu if it doesn't exist, and sets it up
+func ensureIfb(name string, mtu int) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if !errors.As(err, &netlink.LinkNotFoundError{}) {
+			return nil, cnierrors.IO(err, "failed to find %s", name)
+		}
+		// eq: ip link add <name> mtu <mtu> type ifb
+		ifb := &netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu, Flags: unix.IFF_UP}}
+		if err = netlink.LinkAdd(ifb); err != nil && !errors.Is(err, unix.EEXIST) {
+			return nil, cnierrors.IO(err, "failed to add ifb %s", name)
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return nil, cnierrors.IO(err, "failed to find %s", name)
+		}
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return nil, cnierrors.IO(err, "failed to set %s up", name)
+	}
+	return link, nil
+}
+
+// replaceTBF replaces the root qdisc of the link with a tbf qdisc of the rate in bits per second
+// and the burst in bits.
+func replaceTBF(link netlink.Link, rate, burst uint64) error {
+	rateInBytes, burstInBytes := rate/8, burst/8
+	if rateInBytes == 0 || burstInBytes == 0 {
+		return cnierrors.InvalidConfig(nil, "the rate and burst of %s must be at least 8 bits", link.Attrs().Name)
+	}
+
+	// the runtime may pass a burst of 4Gbits, the buffer and limit are capped rather than overflowed
+	buffer := math.Min(float64(burstInBytes)*netlink.TIME_UNITS_PER_SEC/float64(rateInBytes)*netlink.TickInUsec(), math.MaxUint32)
+	limit := math.Min(float64(rateInBytes)*bandwidthLatency+float64(burstInBytes), math.MaxUint32)
+
+	// eq: tc qdisc replace dev <link> root handle 1: tbf rate <rate> burst <burst> latency 25ms
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateInBytes,
+		Buffer: uint32(buffer),
+		Limit:  uint32(limit),
+	}
+	if err := netlink.QdiscReplace(qdisc); err != nil {
+		return cnierrors.IO(err, "failed to add tbf qdisc to %s", link.Attrs().Name)
+	}
+	return nil
+}
+
+// deleteBandwidthFilter deletes the filter redirecting to the ifb from the ingress of the link
+func deleteBandwidthFilter(link netlink.Link) error {
+	// the links without clsact have no filter
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+	if err != nil {
+		return nil
+	}
+	for _, filter := range filters {
+		if _, ok := filter.(*netlink.U32); !ok || filter.Attrs().Priority != bandwidthPriority {
+			continue
+		}
+		if err = netlink.FilterDel(filter); err != nil && !errors.Is(err, unix.ENOENT) {
+			return cnierrors.IO(err, "failed to delete the bandwidth filter of %s", link.Attrs().Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package networking
+
+import (
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+var _ = Describe("bandwidth", func() {
+	var podNS, hostNS ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		podNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(podNS)
+			closeTestNS(hostNS)
+		})
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			_, _, err := ip.SetupVethWithName("veth0", "veth12345678901", 1500, "", hostNS)
+			return err
+		})).To(Succeed())
+	})
+
+	// rootTBF returns the rate in bytes of the root tbf qdisc of the link, 0 if there is none
+	rootTBF := func(name string) uint64 {
+		link, err := netlink.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		qdiscs, err := netlink.QdiscList(link)
+		Expect(err).NotTo(HaveOccurred())
+		for _, qdisc := range qdiscs {
+			if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+				return tbf.Rate
+			}
+		}
+		return 0
+	}
+
+	// redirectedTo returns the index of the device the ingress of the link is redirected to, 0 if it isn't
+	redirectedTo := func(name string) int {
+		link, err := netlink.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+		if err != nil {
+			return 0
+		}
+		index := 0
+		for _, filter := range filters {
+			if u32, ok := filter.(*netlink.U32); ok && u32.Priority == bandwidthPriority {
+				for _, action := range u32.Actions {
+					if mirred, ok := action.(*netlink.MirredAction); ok {
+						Expect(index).To(BeZero(), "only one filter is expected")
+						index = mirred.Ifindex
+					}
+				}
+			}
+		}
+		return index
+	}
+
+	It("shape both directions and remove them", func() {
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			bandwidth := &types.Bandwidth{IngressRate: 8000000, IngressBurst: 800000, EgressRate: 4000000, EgressBurst: 1 << 32}
+			Expect(SetupBandwidth("veth12345678901", "bwp12345678901", bandwidth)).To(Succeed())
+			// a retry replaces them
+			bandwidth.IngressRate = 16000000
+			Expect(SetupBandwidth("veth12345678901", "bwp12345678901", bandwidth)).To(Succeed())
+
+			Expect(rootTBF("veth12345678901")).To(Equal(uint64(2000000)))
+			Expect(rootTBF("bwp12345678901")).To(Equal(uint64(500000)))
+			ifb, err := netlink.LinkByName("bwp12345678901")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ifb.Attrs().MTU).To(Equal(1500))
+			Expect(redirectedTo("veth12345678901")).To(Equal(ifb.Attrs().Index))
+
+			Expect(TeardownBandwidth("veth12345678901", "bwp12345678901")).To(Succeed())
+			Expect(rootTBF("veth12345678901")).To(BeZero())
+			Expect(redirectedTo("veth12345678901")).To(BeZero())
+			_, err = netlink.LinkByName("bwp12345678901")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+
+			// nothing left to remove
+			Expect(TeardownBandwidth("veth12345678901", "bwp12345678901")).To(Succeed())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("only shape the directions with a rate", func() {
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(SetupBandwidth("veth12345678901", "bwp12345678901", &types.Bandwidth{EgressRate: 8000000, EgressBurst: 800000})).To(Succeed())
+			Expect(rootTBF("veth12345678901")).To(BeZero())
+			Expect(rootTBF("bwp12345678901")).To(Equal(uint64(1000000)))
+			return nil
+		})).To(Succeed())
+
+		// the ifb outlives the host veth
+		Expect(podNS.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName("veth0")
+			if err != nil {
+				return err
+			}
+			return netlink.LinkDel(link)
+		})).To(Succeed())
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(TeardownBandwidth("veth12345678901", "bwp12345678901")).To(Succeed())
+			_, err := netlink.LinkByName("bwp12345678901")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			return nil
+		})).To(Succeed())
+	})
+})
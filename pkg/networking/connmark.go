@@ -0,0 +1,132 @@
+package networking
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// connmarkChain restores the connmark on the packets in the pod
+	connmarkChain   = "SPIDER-CONNMARK"
+	connmarkComment = "spider-veth-connmark"
+	// mangle priority of nftables
+	nftMangle = -150
+)
+
+// Connmark marks the connections entering the pod from Iface, the packets of them carry the mark,
+// so their replies could be routed by a fwmark rule.
+type Connmark struct {
+	Iface string
+	Mark  int
+}
+
+func (c Connmark) markSpec() string {
+	return fmt.Sprintf("0x%x/0x%x", c.Mark, c.Mark)
+}
+
+// SetupConnmarks installs the connmarks into the netns by the firewall backend, the ones installed
+// before are replaced. src_valid_mark is enabled, so the reverse path of the marked packets is
+// checked with the mark too.
+func SetupConnmarks(netns ns.NetNS, backend string, connmarks []Connmark, ipFamily int) error {
+	if len(connmarks) == 0 {
+		return nil
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		var err error
+		if backend == types.FirewallBackendNFTables {
+			err = setupConnmarksNFT(connmarks)
+		} else {
+			err = setupConnmarksIPTables(connmarks, ipFamily)
+		}
+		if err != nil {
+			return err
+		}
+
+		if ipFamily != netlink.FAMILY_V6 {
+			if _, err = sysctl.Sysctl("net/ipv4/conf/all/src_valid_mark", "1"); err != nil {
+				return cnierrors.IO(err, "failed to set sysctl src_valid_mark")
+			}
+		}
+		return nil
+	})
+}
+
+// eq:
+//
+//	table inet spider-veth {
+//		chain prerouting {
+//			iifname <iface> ct state new ct mark set ct mark or <mark>
+//			ct mark and <mark> == <mark> meta mark set meta mark or <mark>
+//		}
+//		chain output {
+//			ct mark and <mark> == <mark> meta mark set meta mark or <mark>
+//		}
+//	}
+func setupConnmarksNFT(connmarks []Connmark) error {
+	var prerouting, restore []string
+	for _, c := range connmarks {
+		prerouting = append(prerouting, fmt.Sprintf("iifname %q ct state new ct mark set ct mark or 0x%x", c.Iface, c.Mark))
+		restore = append(restore, fmt.Sprintf("ct mark and 0x%x == 0x%x meta mark set meta mark or 0x%x", c.Mark, c.Mark, c.Mark))
+	}
+	prerouting = append(prerouting, restore...)
+
+	// the output chain is of type route, so the marked replies are routed again
+	script := nftReplaceTable(
+		nftChain("prerouting", "filter", "prerouting", nftMangle, prerouting),
+		nftChain("output", "route", "output", nftMangle, restore),
+	)
+	if err := NftRun(script); err != nil {
+		return cnierrors.IO(err, "failed to apply the connmark rules by nftables")
+	}
+	return nil
+}
+
+// eq:
+//
+//	iptables -t mangle -I PREROUTING -i <iface> -m conntrack --ctstate NEW -j CONNMARK --set-mark <mark>
+//	iptables -t mangle -A SPIDER-CONNMARK -m connmark --mark <mark> -j MARK --set-mark <mark>
+//	iptables -t mangle -A PREROUTING -j SPIDER-CONNMARK
+//	iptables -t mangle -A OUTPUT -j SPIDER-CONNMARK
+func setupConnmarksIPTables(connmarks []Connmark, ipFamily int) error {
+	ipts, err := iptablesOfFamily(ipFamily)
+	if err != nil {
+		return err
+	}
+	for proto, ipt := range ipts {
+		if err = ipt.ClearChain("mangle", connmarkChain); err != nil {
+			return cnierrors.IO(err, "failed to create chain %s of %s", connmarkChain, protocolName(proto))
+		}
+		for _, c := range connmarks {
+			if err = ipt.AppendUnique("mangle", connmarkChain, "-m", "connmark", "--mark", c.markSpec(), "-j", "MARK", "--set-mark", c.markSpec()); err != nil {
+				return cnierrors.IO(err, "failed to add the restore rule of %s", protocolName(proto))
+			}
+		}
+		for _, parent := range []string{"PREROUTING", "OUTPUT"} {
+			if err = ensureJump(ipt, "mangle", parent, connmarkChain); err != nil {
+				return err
+			}
+		}
+
+		// the new connections are marked before the restore
+		for _, c := range connmarks {
+			rulespec := []string{"-i", c.Iface, "-m", "conntrack", "--ctstate", "NEW", "-m", "comment", "--comment", connmarkComment,
+				"-j", "CONNMARK", "--set-mark", c.markSpec()}
+			exists, err := ipt.Exists("mangle", "PREROUTING", rulespec...)
+			if err != nil {
+				return cnierrors.IO(err, "failed to check the connmark rule of %s", protocolName(proto))
+			}
+			if !exists {
+				if err = ipt.Insert("mangle", "PREROUTING", 1, rulespec...); err != nil {
+					return cnierrors.IO(err, "failed to add the connmark rule of %s", protocolName(proto))
+				}
+			}
+		}
+	}
+	return nil
+}
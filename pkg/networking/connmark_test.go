@@ -0,0 +1,198 @@
+package networking
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var _ = Describe("connmark", func() {
+	connmarks := []Connmark{{Iface: "net1", Mark: 0x20000}, {Iface: "veth0", Mark: 0x10000}}
+	var netns ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		netns, err = newTestNS("10.6.0.10/16")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(netns)
+		})
+	})
+
+	It("mark the connections by iptables", func() {
+		fakes := useFakeIPTables()
+		Expect(SetupConnmarks(netns, types.FirewallBackendIPTables, connmarks, netlink.FAMILY_V4)).To(Succeed())
+		// it's idempotent
+		Expect(SetupConnmarks(netns, types.FirewallBackendIPTables, connmarks, netlink.FAMILY_V4)).To(Succeed())
+
+		ipt := fakes[iptables.ProtocolIPv4]
+		Expect(ipt.Rules("mangle", "PREROUTING")).To(Equal([]string{
+			"-i veth0 -m conntrack --ctstate NEW -m comment --comment spider-veth-connmark -j CONNMARK --set-mark 0x10000/0x10000",
+			"-i net1 -m conntrack --ctstate NEW -m comment --comment spider-veth-connmark -j CONNMARK --set-mark 0x20000/0x20000",
+			"-j SPIDER-CONNMARK",
+		}))
+		Expect(ipt.Rules("mangle", "OUTPUT")).To(Equal([]string{"-j SPIDER-CONNMARK"}))
+		Expect(ipt.Rules("mangle", "SPIDER-CONNMARK")).To(Equal([]string{
+			"-m connmark --mark 0x20000/0x20000 -j MARK --set-mark 0x20000/0x20000",
+			"-m connmark --mark 0x10000/0x10000 -j MARK --set-mark 0x10000/0x10000",
+		}))
+		Expect(fakes[iptables.ProtocolIPv6].Rules("mangle", "PREROUTING")).To(BeEmpty())
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			value, err := sysctl.Sysctl("net/ipv4/conf/all/src_valid_mark")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal("1"))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("mark the connections by nftables", func() {
+		var scripts []string
+		origin := NftRun
+		NftRun = func(script string) error {
+			scripts = append(scripts, script)
+			return nil
+		}
+		DeferCleanup(func() {
+			NftRun = origin
+		})
+
+		Expect(SetupConnmarks(netns, types.FirewallBackendNFTables, connmarks, netlink.FAMILY_ALL)).To(Succeed())
+		Expect(scripts).To(Equal([]string{`table inet spider-veth
+delete table inet spider-veth
+table inet spider-veth {
+	chain prerouting {
+		type filter hook prerouting priority -150; policy accept;
+		iifname "net1" ct state new ct mark set ct mark or 0x20000
+		iifname "veth0" ct state new ct mark set ct mark or 0x10000
+		ct mark and 0x20000 == 0x20000 meta mark set meta mark or 0x20000
+		ct mark and 0x10000 == 0x10000 meta mark set meta mark or 0x10000
+	}
+	chain output {
+		type route hook output priority -150; policy accept;
+		ct mark and 0x20000 == 0x20000 meta mark set meta mark or 0x20000
+		ct mark and 0x10000 == 0x10000 meta mark set meta mark or 0x10000
+	}
+}
+`}))
+	})
+})
+
+var _ = Describe("ResolveFirewallBackend", func() {
+	var found map[string]bool
+
+	BeforeEach(func() {
+		found = map[string]bool{}
+		origin := lookPath
+		lookPath = func(file string) (string, error) {
+			if found[file] {
+				return "/usr/sbin/" + file, nil
+			}
+			return "", errors.New("not found")
+		}
+		DeferCleanup(func() {
+			lookPath = origin
+		})
+	})
+
+	It("prefer nftables", func() {
+		found["nft"], found["iptables"] = true, true
+		backend, err := ResolveFirewallBackend(types.FirewallBackendAuto)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend).To(Equal(types.FirewallBackendNFTables))
+	})
+
+	It("fall back to iptables", func() {
+		found["iptables"] = true
+		backend, err := ResolveFirewallBackend("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend).To(Equal(types.FirewallBackendIPTables))
+	})
+
+	It("keep the configured backend", func() {
+		backend, err := ResolveFirewallBackend(types.FirewallBackendIPTables)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend).To(Equal(types.FirewallBackendIPTables))
+
+		_, err = ResolveFirewallBackend("")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("reply via veth", func() {
+	var netns ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		netns, err = newTestNS("10.6.0.10/16")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(netns)
+		})
+	})
+
+	It("route the marked replies via veth0", func() {
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}})).To(Succeed())
+			link, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.LinkSetUp(link)
+		})).To(Succeed())
+
+		h, err := NewHandle(nil, netns)
+		Expect(err).NotTo(HaveOccurred())
+		defer h.Close()
+
+		ctx := context.TODO()
+		Expect(h.AddRouteTable(ctx, unix.RT_TABLE_MAIN, netlink.SCOPE_LINK, "veth0", []string{"10.7.0.1/32", "fd00:7::1/128"}, Nexthop{})).To(Succeed())
+		nexthop := Nexthop{V4Gw: net.ParseIP("10.7.0.1"), V6Gw: net.ParseIP("fd00:7::1")}
+		Expect(h.SetupReplyViaVeth(ctx, "veth0", nexthop, 98, 0x10000, netlink.FAMILY_ALL)).To(Succeed())
+		Expect(h.SetupReplyViaVeth(ctx, "veth0", nexthop, 98, 0x10000, netlink.FAMILY_ALL)).To(Succeed())
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			veth0, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: 98}, netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(2))
+			for _, route := range routes {
+				Expect(route.LinkIndex).To(Equal(veth0.Attrs().Index))
+			}
+
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				rules, err := netlink.RuleList(family)
+				Expect(err).NotTo(HaveOccurred())
+				found := 0
+				for _, rule := range rules {
+					if rule.Table == 98 {
+						Expect(rule.Mark).To(BeEquivalentTo(0x10000))
+						found++
+					}
+				}
+				Expect(found).To(Equal(1))
+			}
+			return nil
+		})).To(Succeed())
+	})
+})
@@ -0,0 +1,105 @@
+package networking
+
+import (
+	"net"
+	"strings"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ConntrackProtocols are the protocols the conntrack flush could be scoped to
+var ConntrackProtocols = map[string]uint8{
+	"tcp":    unix.IPPROTO_TCP,
+	"udp":    unix.IPPROTO_UDP,
+	"sctp":   unix.IPPROTO_SCTP,
+	"icmp":   unix.IPPROTO_ICMP,
+	"icmpv6": unix.IPPROTO_ICMPV6,
+}
+
+// ConntrackScope limits the conntrack entries to flush, an empty field matches all
+type ConntrackScope struct {
+	Zones     []uint16
+	Protocols []string
+}
+
+// FlushConntrack deletes the conntrack entries of the current netns whose original or reply tuple
+// has any of the addresses, so the flows of the pod which used the addresses before are not steered
+// by the stale entries. It returns the number of the deleted entries.
+func FlushConntrack(ips []net.IP, scope ConntrackScope) (int, error) {
+	if len(ips) == 0 {
+		return 0, nil
+	}
+
+	// 0 matches any protocol, nil any zone
+	protos := []uint8{0}
+	if len(scope.Protocols) != 0 {
+		protos = protos[:0]
+		for _, name := range scope.Protocols {
+			proto, ok := ConntrackProtocols[strings.ToLower(name)]
+			if !ok {
+				return 0, cnierrors.InvalidConfig(nil, "unsupported conntrack protocol %s", name)
+			}
+			protos = append(protos, proto)
+		}
+	}
+	zones := []*uint16{nil}
+	if len(scope.Zones) != 0 {
+		zones = zones[:0]
+		for idx := range scope.Zones {
+			zones = append(zones, &scope.Zones[idx])
+		}
+	}
+
+	deleted := 0
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		// the filters are ORed, an entry matches if any address is in its original or reply tuple
+		// eq: conntrack -D -s <ip>, conntrack -D -d <ip> and so on
+		var filters []netlink.CustomConntrackFilter
+		for _, ip := range ips {
+			if (ip.To4() != nil) != (family == unix.AF_INET) {
+				continue
+			}
+			for _, tp := range []netlink.ConntrackFilterType{netlink.ConntrackOrigSrcIP, netlink.ConntrackOrigDstIP, netlink.ConntrackReplyAnyIP} {
+				for _, proto := range protos {
+					for _, zone := range zones {
+						filter, err := newConntrackFilter(tp, ip, proto, zone)
+						if err != nil {
+							return deleted, cnierrors.Internal(err, "failed to build conntrack filter")
+						}
+						filters = append(filters, filter)
+					}
+				}
+			}
+		}
+		if len(filters) == 0 {
+			continue
+		}
+
+		n, err := netlink.ConntrackDeleteFilters(netlink.ConntrackTable, family, filters...)
+		deleted += int(n)
+		if err != nil {
+			return deleted, cnierrors.IO(err, "failed to delete conntrack entries")
+		}
+	}
+	return deleted, nil
+}
+
+func newConntrackFilter(tp netlink.ConntrackFilterType, ip net.IP, proto uint8, zone *uint16) (*netlink.ConntrackFilter, error) {
+	filter := &netlink.ConntrackFilter{}
+	if err := filter.AddIP(tp, ip); err != nil {
+		return nil, err
+	}
+	if proto != 0 {
+		if err := filter.AddProtocol(proto); err != nil {
+			return nil, err
+		}
+	}
+	if zone != nil {
+		if err := filter.AddZone(*zone); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,93 @@
+package networking
+
+import (
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// addConntrack creates an entry of udp from src:sport to dst:dport in the zone of the current netns,
+// eq: conntrack -I -p udp -s <src> -d <dst> --sport <sport> --dport <dport> -w <zone> -t 60
+// netlink.ConntrackCreate doesn't set the zone, so the request is built with the attributes of nl
+func addConntrack(src, dst string, sport, dport, zone uint16) {
+	tuple := func(attrType int, src, dst net.IP, sport, dport uint16) *nl.RtAttr {
+		t := nl.NewRtAttr(attrType|unix.NLA_F_NESTED, nil)
+		ip := t.AddRtAttr(nl.CTA_TUPLE_IP|unix.NLA_F_NESTED, nil)
+		ip.AddRtAttr(nl.CTA_IP_V4_SRC, src.To4())
+		ip.AddRtAttr(nl.CTA_IP_V4_DST, dst.To4())
+		proto := t.AddRtAttr(nl.CTA_TUPLE_PROTO|unix.NLA_F_NESTED, nil)
+		proto.AddRtAttr(nl.CTA_PROTO_NUM, []byte{unix.IPPROTO_UDP})
+		proto.AddRtAttr(nl.CTA_PROTO_SRC_PORT, nl.BEUint16Attr(sport))
+		proto.AddRtAttr(nl.CTA_PROTO_DST_PORT, nl.BEUint16Attr(dport))
+		return t
+	}
+
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	req := nl.NewNetlinkRequest((int(netlink.ConntrackTable)<<8)|nl.IPCTNL_MSG_CT_NEW, unix.NLM_F_ACK|unix.NLM_F_CREATE)
+	req.AddData(&nl.Nfgenmsg{NfgenFamily: unix.AF_INET, Version: nl.NFNETLINK_V0})
+	req.AddData(tuple(nl.CTA_TUPLE_ORIG, srcIP, dstIP, sport, dport))
+	req.AddData(tuple(nl.CTA_TUPLE_REPLY, dstIP, srcIP, dport, sport))
+	req.AddData(nl.NewRtAttr(nl.CTA_TIMEOUT, nl.BEUint32Attr(60)))
+	req.AddData(nl.NewRtAttr(nl.CTA_ZONE, nl.BEUint16Attr(zone)))
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	Expect(err).NotTo(HaveOccurred())
+}
+
+var _ = Describe("conntrack", func() {
+	var netns ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		netns, err = newTestNS("10.6.0.10/16")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(netns)
+		})
+	})
+
+	count := func() int {
+		flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, unix.AF_INET)
+		Expect(err).NotTo(HaveOccurred())
+		return len(flows)
+	}
+
+	It("flush the entries of the addresses in the scope", func() {
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			addConntrack("10.6.1.1", "10.233.0.10", 40000, 53, 0)
+			addConntrack("10.233.0.10", "10.6.1.1", 40001, 53, 0)
+			addConntrack("10.6.1.1", "10.233.0.10", 40002, 53, 1)
+			addConntrack("10.6.1.2", "10.233.0.10", 40003, 53, 0)
+			Expect(count()).To(Equal(4))
+
+			ips := []net.IP{net.ParseIP("10.6.1.1")}
+			n, err := FlushConntrack(ips, ConntrackScope{Protocols: []string{"tcp"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(0))
+
+			n, err = FlushConntrack(ips, ConntrackScope{Zones: []uint16{1}, Protocols: []string{"udp"}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(1))
+			Expect(count()).To(Equal(3))
+
+			n, err = FlushConntrack(ips, ConntrackScope{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2))
+			Expect(count()).To(Equal(1))
+
+			_, err = FlushConntrack(ips, ConntrackScope{Protocols: []string{"gre"}})
+			Expect(err).To(HaveOccurred())
+			return nil
+		})).To(Succeed())
+	})
+})
@@ -0,0 +1,28 @@
+// Package networking is the netlink and sysctl library shared by the meta plugins.
+//
+// The netlink operations are methods of Handle, a handle is opened once per network
+// namespace and all requests are sent through its netlink socket, so the calling thread
+// never switches namespace for them:
+//
+//	hostHandle, err := networking.NewHandle(logger, nil)
+//	...
+//	defer hostHandle.Close()
+//	podHandle, err := networking.NewHandle(logger, netns)
+//	...
+//	defer podHandle.Close()
+//
+//	addrs, err := podHandle.IPAddressByName(ctx, "net1", netlink.FAMILY_ALL)
+//	err = hostHandle.AddRouteTable(ctx, unix.RT_TABLE_MAIN, netlink.SCOPE_UNIVERSE, hostVeth, networking.AddrsToString(addrs), networking.Nexthop{})
+//
+// Every method takes a context, a request isn't sent once the context is done and the
+// socket timeout follows the deadline of the context. The operations taking a list, like
+// AddRouteTable and AddNeighborTable, look up the link once and apply all the entries.
+// Links found by name are cached by the handle, so a handle is meant to live for one
+// invocation and isn't safe for concurrent use.
+//
+// The errors are typed by package cnierrors: a canceled request or a transient netlink
+// error is ErrTryAgainLater, other netlink errors are ErrIOFailure.
+//
+// The sysctl helpers still enter the namespace, since /proc/sys/net follows the
+// namespace of the calling thread.
+package networking
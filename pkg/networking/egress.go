@@ -0,0 +1,190 @@
+package networking
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultStateDir keeps the host-wide state shared by the invocations
+	DefaultStateDir = "/var/run/spider-plugins/state"
+
+	// egressMasqChainPrefix is the prefix of the chain masquerading a pod on the host
+	egressMasqChainPrefix = "SPIDER-EGRESS-"
+	egressComment         = "spider-veth-egress"
+)
+
+// SetupEgressViaHost sends the default egress of the pod via veth: the default routes of the chained
+// interface are moved from main into the table, and the default route via veth is added into main.
+// The replies of the connections from the chained interface, which carry the mark, lookup the table
+// by the rule `from <addr> fwmark <mark> lookup <table>`.
+func (h *Handle) SetupEgressViaHost(ctx context.Context, veth, chained string, addrs []netlink.Addr, nexthop Nexthop, table, mark, ipFamily int) error {
+	link, err := h.LinkByName(ctx, chained)
+	if err != nil {
+		return err
+	}
+
+	if err = h.begin(ctx); err != nil {
+		return err
+	}
+	routes, err := h.nl.RouteListFiltered(ipFamily, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return cnierrors.IO(err, "failed to list routes")
+	}
+	for idx := range routes {
+		route := routes[idx]
+		if (route.Dst != nil && !isDefaultDst(route.Dst)) || !routeVia(&route, link.Attrs().Index) {
+			continue
+		}
+
+		// eq: ip route del default via <gw> dev <chained>; ip route add default via <gw> dev <chained> table <table>
+		if err = h.begin(ctx); err != nil {
+			return err
+		}
+		if err = h.nl.RouteDel(&route); err != nil {
+			return cnierrors.IO(err, "failed to RouteDel %s in main table", route.String())
+		}
+		route.Table = table
+		if err = h.nl.RouteAdd(&route); err != nil && !os.IsExist(err) {
+			return cnierrors.IO(err, "failed to RouteAdd %s", route.String())
+		}
+		h.logger.Debug("Move default route of the chained interface", zap.String("route", route.String()))
+	}
+
+	// eq: ip route add default via <gw> dev veth0 src <addr>
+	if err = h.AddRouteTable(ctx, unix.RT_TABLE_MAIN, netlink.SCOPE_UNIVERSE, veth, defaultDsts(ipFamily), nexthop); err != nil {
+		return err
+	}
+
+	// eq: ip rule add from <addr> fwmark <mark>/<mark> lookup <table>
+	var rules []*netlink.Rule
+	for _, addr := range addrs {
+		rule := markRule(mark, table, familyOf(addr.IP))
+		rule.Src = hostNet(addr.IP)
+		rules = append(rules, rule)
+	}
+	return h.addRulesOnce(ctx, rules)
+}
+
+// SetupReplyViaVeth adds the default route via veth into the table and the rule `fwmark <mark> lookup <table>`,
+// so the replies of the connections entering the pod via veth, which carry the mark, are sent back via veth.
+func (h *Handle) SetupReplyViaVeth(ctx context.Context, veth string, nexthop Nexthop, table, mark, ipFamily int) error {
+	// eq: ip route add default via <gw> dev veth0 table <table>
+	if err := h.AddRouteTable(ctx, table, netlink.SCOPE_UNIVERSE, veth, defaultDsts(ipFamily), nexthop); err != nil {
+		return err
+	}
+
+	// eq: ip rule add fwmark <mark>/<mark> lookup <table>
+	var rules []*netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if ipFamily == netlink.FAMILY_ALL || ipFamily == family {
+			rules = append(rules, markRule(mark, table, family))
+		}
+	}
+	return h.addRulesOnce(ctx, rules)
+}
+
+// routeVia returns true if the route is sent via the link, including the multipath routes of IPv6
+func routeVia(route *netlink.Route, index int) bool {
+	if route.LinkIndex == index {
+		return true
+	}
+	for _, nh := range route.MultiPath {
+		if nh.LinkIndex == index {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultDsts(ipFamily int) []string {
+	switch ipFamily {
+	case netlink.FAMILY_V4:
+		return []string{"0.0.0.0/0"}
+	case netlink.FAMILY_V6:
+		return []string{"::/0"}
+	}
+	return []string{"0.0.0.0/0", "::/0"}
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// EgressChainName returns the chain masquerading the pod of the container on the host
+func EgressChainName(containerID string) string {
+	sum := sha256.Sum256([]byte(containerID))
+	return egressMasqChainPrefix + strings.ToUpper(fmt.Sprintf("%x", sum[:6]))
+}
+
+// SetupEgressMasquerade masquerades the traffic from the pod addresses in the current netns, except
+// the one to the excluded CIDRs, like the cluster and service CIDRs.
+func SetupEgressMasquerade(containerID string, addrs []netlink.Addr, excluded []string, ipFamily int) error {
+	ipts, err := iptablesOfFamily(ipFamily)
+	if err != nil {
+		return err
+	}
+
+	chain := EgressChainName(containerID)
+	for proto, ipt := range ipts {
+		isV4 := proto == iptables.ProtocolIPv4
+		// eq: iptables -t nat -A <chain> -d <excluded> -j RETURN; iptables -t nat -A <chain> -j MASQUERADE
+		if err = ipt.ClearChain("nat", chain); err != nil {
+			return cnierrors.IO(err, "failed to create chain %s of %s", chain, protocolName(proto))
+		}
+		for _, cidr := range excluded {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return cnierrors.InvalidConfig(err, "invalid CIDR %s", cidr)
+			}
+			if (ipNet.IP.To4() != nil) != isV4 {
+				continue
+			}
+			if err = ipt.AppendUnique("nat", chain, "-d", ipNet.String(), "-j", "RETURN"); err != nil {
+				return cnierrors.IO(err, "failed to add the excluded CIDR %s", cidr)
+			}
+		}
+		if err = ipt.AppendUnique("nat", chain, "-j", "MASQUERADE"); err != nil {
+			return cnierrors.IO(err, "failed to add the masquerade rule of %s", protocolName(proto))
+		}
+
+		// eq: iptables -t nat -A POSTROUTING -s <addr> -j <chain>
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) != isV4 {
+				continue
+			}
+			if err = ipt.AppendUnique("nat", "POSTROUTING", "-s", hostNet(addr.IP).String(), "-m", "comment", "--comment", egressComment, "-j", chain); err != nil {
+				return cnierrors.IO(err, "failed to add the jump to %s", chain)
+			}
+		}
+	}
+	return nil
+}
+
+// TeardownEgressMasquerade removes the masquerade of the pod from the current netns, nothing is
+// done if it isn't found.
+func TeardownEgressMasquerade(containerID string, ipFamily int) error {
+	ipts, err := iptablesOfFamily(ipFamily)
+	if err != nil {
+		return err
+	}
+	for _, ipt := range ipts {
+		if err = deleteJumps(ipt, "nat", "POSTROUTING", EgressChainName(containerID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
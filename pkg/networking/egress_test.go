@@ -0,0 +1,170 @@
+package networking
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/networking/fake"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// useFakeIPTables replaces the iptables by fakes until the end of the spec
+func useFakeIPTables() map[iptables.Protocol]*fake.IPTables {
+	fakes := map[iptables.Protocol]*fake.IPTables{
+		iptables.ProtocolIPv4: fake.NewIPTables(),
+		iptables.ProtocolIPv6: fake.NewIPTables(),
+	}
+	origin := NewIPTables
+	NewIPTables = func(proto iptables.Protocol) (IPTables, error) {
+		return fakes[proto], nil
+	}
+	DeferCleanup(func() {
+		NewIPTables = origin
+	})
+	return fakes
+}
+
+var _ = Describe("egress via host", func() {
+	var netns ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		netns, err = newTestNS("10.6.0.10/16")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(netns)
+		})
+	})
+
+	It("move the default route into the table and route the default egress via veth0", func() {
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}})).To(Succeed())
+			link, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			link, err = netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("10.6.0.254")})
+		})).To(Succeed())
+
+		h, err := NewHandle(nil, netns)
+		Expect(err).NotTo(HaveOccurred())
+		defer h.Close()
+
+		ctx := context.TODO()
+		// the node address is reachable via veth0
+		Expect(h.AddRouteTable(ctx, unix.RT_TABLE_MAIN, netlink.SCOPE_LINK, "veth0", []string{"10.7.0.1/32"}, Nexthop{})).To(Succeed())
+		addrs, err := h.IPAddressByName(ctx, "net1", netlink.FAMILY_V4)
+		Expect(err).NotTo(HaveOccurred())
+		nexthop := Nexthop{V4Gw: net.ParseIP("10.7.0.1"), V4Src: net.ParseIP("10.6.0.10")}
+		Expect(h.SetupEgressViaHost(ctx, "veth0", "net1", addrs, nexthop, 99, 0x20000, netlink.FAMILY_V4)).To(Succeed())
+		// it's idempotent
+		Expect(h.SetupEgressViaHost(ctx, "veth0", "net1", addrs, nexthop, 99, 0x20000, netlink.FAMILY_V4)).To(Succeed())
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			veth0, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			net1, err := netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			defaults := map[int]netlink.Route{}
+			for _, route := range routes {
+				if route.Dst == nil || isDefaultDst(route.Dst) {
+					defaults[route.Table] = route
+				}
+			}
+			Expect(defaults).To(HaveLen(2))
+			Expect(defaults[unix.RT_TABLE_MAIN].LinkIndex).To(Equal(veth0.Attrs().Index))
+			Expect(defaults[unix.RT_TABLE_MAIN].Gw.String()).To(Equal("10.7.0.1"))
+			Expect(defaults[unix.RT_TABLE_MAIN].Src.String()).To(Equal("10.6.0.10"))
+			Expect(defaults[99].LinkIndex).To(Equal(net1.Attrs().Index))
+			Expect(defaults[99].Gw.String()).To(Equal("10.6.0.254"))
+
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			found := 0
+			for _, rule := range rules {
+				if rule.Table == 99 {
+					Expect(rule.Src.String()).To(Equal("10.6.0.10/32"))
+					Expect(rule.Mark).To(BeEquivalentTo(0x20000))
+					Expect(*rule.Mask).To(BeEquivalentTo(0x20000))
+					found++
+				}
+			}
+			Expect(found).To(Equal(1))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("masquerade the pod addresses on the host and remove it", func() {
+		fakes := useFakeIPTables()
+		addrs := []netlink.Addr{
+			{IPNet: &net.IPNet{IP: net.ParseIP("10.6.0.10"), Mask: net.CIDRMask(16, 32)}},
+			{IPNet: &net.IPNet{IP: net.ParseIP("fd00::10"), Mask: net.CIDRMask(64, 128)}},
+		}
+		excluded := []string{"10.233.64.0/18", "fd00:10:233::/64"}
+		Expect(SetupEgressMasquerade("abc", addrs, excluded, netlink.FAMILY_ALL)).To(Succeed())
+
+		chain := EgressChainName("abc")
+		ipv4, ipv6 := fakes[iptables.ProtocolIPv4], fakes[iptables.ProtocolIPv6]
+		Expect(ipv4.Rules("nat", "POSTROUTING")).To(Equal([]string{"-s 10.6.0.10/32 -m comment --comment spider-veth-egress -j " + chain}))
+		Expect(ipv4.Rules("nat", chain)).To(Equal([]string{"-d 10.233.64.0/18 -j RETURN", "-j MASQUERADE"}))
+		Expect(ipv6.Rules("nat", "POSTROUTING")).To(Equal([]string{"-s fd00::10/128 -m comment --comment spider-veth-egress -j " + chain}))
+		Expect(ipv6.Rules("nat", chain)).To(Equal([]string{"-d fd00:10:233::/64 -j RETURN", "-j MASQUERADE"}))
+
+		Expect(TeardownEgressMasquerade("abc", netlink.FAMILY_ALL)).To(Succeed())
+		// nothing left to remove
+		Expect(TeardownEgressMasquerade("abc", netlink.FAMILY_ALL)).To(Succeed())
+		for _, ipt := range fakes {
+			Expect(ipt.Rules("nat", "POSTROUTING")).To(BeEmpty())
+			exists, err := ipt.ChainExists("nat", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		}
+	})
+
+	It("restore forwarding when the last user is released", func() {
+		stateDir := GinkgoT().TempDir()
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(AcquireForwarding(stateDir, "a", netlink.FAMILY_V4)).To(Succeed())
+			Expect(AcquireForwarding(stateDir, "b", netlink.FAMILY_ALL)).To(Succeed())
+			Expect(sysctl.Sysctl("net/ipv4/ip_forward")).To(Equal("1"))
+			Expect(sysctl.Sysctl("net/ipv6/conf/all/forwarding")).To(Equal("1"))
+
+			Expect(ReleaseForwarding(stateDir, "a")).To(Succeed())
+			Expect(sysctl.Sysctl("net/ipv4/ip_forward")).To(Equal("1"))
+			Expect(sysctl.Sysctl("net/ipv6/conf/all/forwarding")).To(Equal("1"))
+
+			Expect(ReleaseForwarding(stateDir, "b")).To(Succeed())
+			Expect(sysctl.Sysctl("net/ipv4/ip_forward")).To(Equal("0"))
+			Expect(sysctl.Sysctl("net/ipv6/conf/all/forwarding")).To(Equal("0"))
+			// releasing again is a no-op
+			Expect(ReleaseForwarding(stateDir, "b")).To(Succeed())
+
+			// forwarding enabled by others is kept
+			_, err := sysctl.Sysctl("net/ipv4/ip_forward", "1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(AcquireForwarding(stateDir, "c", netlink.FAMILY_V4)).To(Succeed())
+			Expect(ReleaseForwarding(stateDir, "c")).To(Succeed())
+			Expect(sysctl.Sysctl("net/ipv4/ip_forward")).To(Equal("1"))
+			return nil
+		})).To(Succeed())
+	})
+})
@@ -0,0 +1,171 @@
+// Package fake provides in-memory fakes of the system interfaces used by package networking,
+// so the tests run on the hosts without the iptables binaries.
+package fake
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// builtinChains exist in every table, they can't be created or deleted
+var builtinChains = map[string]struct{}{
+	"PREROUTING": {}, "INPUT": {}, "FORWARD": {}, "OUTPUT": {}, "POSTROUTING": {},
+}
+
+// IPTables is an in-memory iptables of one protocol, the rules are kept as the joined rulespec
+type IPTables struct {
+	mu     sync.Mutex
+	chains map[string][]string
+}
+
+// NewIPTables returns an empty IPTables
+func NewIPTables() *IPTables {
+	return &IPTables{chains: make(map[string][]string)}
+}
+
+func key(table, chain string) string {
+	return table + "/" + chain
+}
+
+func (f *IPTables) exists(table, chain string) bool {
+	if _, ok := builtinChains[chain]; ok {
+		return true
+	}
+	_, ok := f.chains[key(table, chain)]
+	return ok
+}
+
+func (f *IPTables) index(table, chain string, rulespec []string) int {
+	rule := strings.Join(rulespec, " ")
+	for idx, r := range f.chains[key(table, chain)] {
+		if r == rule {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Rules returns the rules of the chain
+func (f *IPTables) Rules(table, chain string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.chains[key(table, chain)]...)
+}
+
+func (f *IPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.index(table, chain, rulespec) >= 0, nil
+}
+
+func (f *IPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.exists(table, chain) {
+		return fmt.Errorf("chain %s/%s doesn't exist", table, chain)
+	}
+	rules := f.chains[key(table, chain)]
+	if pos < 1 || pos > len(rules)+1 {
+		return fmt.Errorf("index %d out of range", pos)
+	}
+	rules = append(rules[:pos-1], append([]string{strings.Join(rulespec, " ")}, rules[pos-1:]...)...)
+	f.chains[key(table, chain)] = rules
+	return nil
+}
+
+func (f *IPTables) Append(table, chain string, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.exists(table, chain) {
+		return fmt.Errorf("chain %s/%s doesn't exist", table, chain)
+	}
+	f.chains[key(table, chain)] = append(f.chains[key(table, chain)], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *IPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	if ok, _ := f.Exists(table, chain, rulespec...); ok {
+		return nil
+	}
+	return f.Append(table, chain, rulespec...)
+}
+
+func (f *IPTables) Delete(table, chain string, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	idx := f.index(table, chain, rulespec)
+	if idx < 0 {
+		return fmt.Errorf("rule %q doesn't exist in %s/%s", strings.Join(rulespec, " "), table, chain)
+	}
+	rules := f.chains[key(table, chain)]
+	f.chains[key(table, chain)] = append(rules[:idx], rules[idx+1:]...)
+	return nil
+}
+
+func (f *IPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	if ok, _ := f.Exists(table, chain, rulespec...); !ok {
+		return nil
+	}
+	return f.Delete(table, chain, rulespec...)
+}
+
+// List returns the rules in the format of `iptables -S`, the creation of the chain first
+func (f *IPTables) List(table, chain string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.exists(table, chain) {
+		return nil, fmt.Errorf("chain %s/%s doesn't exist", table, chain)
+	}
+	list := []string{"-N " + chain}
+	if _, ok := builtinChains[chain]; ok {
+		list = []string{"-P " + chain + " ACCEPT"}
+	}
+	for _, rule := range f.chains[key(table, chain)] {
+		list = append(list, "-A "+chain+" "+rule)
+	}
+	return list, nil
+}
+
+func (f *IPTables) ChainExists(table, chain string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.exists(table, chain), nil
+}
+
+func (f *IPTables) NewChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.exists(table, chain) {
+		return fmt.Errorf("chain %s/%s already exists", table, chain)
+	}
+	f.chains[key(table, chain)] = nil
+	return nil
+}
+
+func (f *IPTables) ClearChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chains[key(table, chain)] = nil
+	return nil
+}
+
+func (f *IPTables) ClearAndDeleteChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := builtinChains[chain]; ok {
+		return fmt.Errorf("can't delete built-in chain %s", chain)
+	}
+	for k, rules := range f.chains {
+		if !strings.HasPrefix(k, table+"/") {
+			continue
+		}
+		for _, rule := range rules {
+			if strings.HasSuffix(rule, "-j "+chain) {
+				return fmt.Errorf("chain %s/%s is referenced by %s", table, chain, k)
+			}
+		}
+	}
+	delete(f.chains, key(table, chain))
+	return nil
+}
@@ -0,0 +1,76 @@
+package networking
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+)
+
+// nftTable is the nftables table of the rules installed by veth, in the pod and on the host
+const nftTable = "spider-veth"
+
+// lookPath is replaced in tests
+var lookPath = exec.LookPath
+
+// NftRun applies the nftables script by `nft -f -` in the netns of the calling thread.
+// It's replaced by a fake in tests.
+var NftRun = func(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// ResolveFirewallBackend returns the backend of the firewall rules, nftables or iptables.
+// auto prefers nftables if the nft binary is found, and falls back to iptables.
+func ResolveFirewallBackend(backend string) (string, error) {
+	switch backend {
+	case types.FirewallBackendIPTables, types.FirewallBackendNFTables:
+		return backend, nil
+	case "", types.FirewallBackendAuto:
+	default:
+		return "", cnierrors.InvalidConfig(nil, "unknown firewall backend %s", backend)
+	}
+
+	if _, err := lookPath("nft"); err == nil {
+		return types.FirewallBackendNFTables, nil
+	}
+	if _, err := lookPath("iptables"); err == nil {
+		return types.FirewallBackendIPTables, nil
+	}
+	return "", cnierrors.Internal(nil, "neither nft nor iptables is found")
+}
+
+// nftReplaceTable returns the script replacing the table of veth by the given chains atomically,
+// the table is created first so the delete never fails.
+func nftReplaceTable(chains ...string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "table inet %s\n", nftTable)
+	fmt.Fprintf(b, "delete table inet %s\n", nftTable)
+	fmt.Fprintf(b, "table inet %s {\n", nftTable)
+	for _, chain := range chains {
+		b.WriteString(chain)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// nftChain returns a base chain of the given type and hook, with the given rules
+func nftChain(name, chainType, hook string, priority int, rules []string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "\tchain %s {\n", name)
+	fmt.Fprintf(b, "\t\ttype %s hook %s priority %d; policy accept;\n", chainType, hook, priority)
+	for _, rule := range rules {
+		fmt.Fprintf(b, "\t\t%s\n", rule)
+	}
+	b.WriteString("\t}\n")
+	return b.String()
+}
@@ -0,0 +1,130 @@
+package networking
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	forwardingStateName  = "forwarding.json"
+	ipv6ForwardingSysctl = "net/ipv6/conf/all/forwarding"
+)
+
+// forwardingState records the containers which need forwarding of the host, and the values of
+// the forwarding sysctl before they were enabled, which are restored when no container is left.
+type forwardingState struct {
+	Users   map[string]int    `json:"users"`
+	Restore map[string]string `json:"restore"`
+}
+
+func forwardingSysctls(ipFamily int) []string {
+	switch ipFamily {
+	case netlink.FAMILY_V4:
+		return []string{"net/ipv4/ip_forward"}
+	case netlink.FAMILY_V6:
+		return []string{ipv6ForwardingSysctl}
+	}
+	return []string{"net/ipv4/ip_forward", ipv6ForwardingSysctl}
+}
+
+// AcquireForwarding enables the forwarding of the current netns for the container, it's host-wide
+// state so the caller should serialize it with the other invocations.
+func AcquireForwarding(stateDir, containerID string, ipFamily int) error {
+	state, err := readForwardingState(stateDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range forwardingSysctls(ipFamily) {
+		value, err := sysctl.Sysctl(name)
+		if err != nil {
+			return cnierrors.IO(err, "failed to read sysctl %s", name)
+		}
+		if value == "1" {
+			continue
+		}
+		if _, ok := state.Restore[name]; !ok {
+			state.Restore[name] = value
+		}
+		if name == ipv6ForwardingSysctl {
+			// the interfaces learning from router advertisements keep them, see keepAcceptRA
+			if err = EnableIPv6Forwarding(); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = sysctl.Sysctl(name, "1"); err != nil {
+			return cnierrors.IO(err, "failed to set sysctl %s", name)
+		}
+	}
+	state.Users[containerID] = ipFamily
+	return writeForwardingState(stateDir, state)
+}
+
+// ReleaseForwarding drops the container from the users of forwarding, the forwarding enabled
+// by AcquireForwarding is disabled again when no user is left. The one enabled by others is kept.
+func ReleaseForwarding(stateDir, containerID string) error {
+	state, err := readForwardingState(stateDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := state.Users[containerID]; !ok {
+		return nil
+	}
+
+	delete(state.Users, containerID)
+	if len(state.Users) == 0 {
+		for name, value := range state.Restore {
+			if _, err = sysctl.Sysctl(name, value); err != nil {
+				return cnierrors.IO(err, "failed to restore sysctl %s", name)
+			}
+			delete(state.Restore, name)
+		}
+	}
+	return writeForwardingState(stateDir, state)
+}
+
+func readForwardingState(stateDir string) (*forwardingState, error) {
+	state := &forwardingState{}
+	data, err := os.ReadFile(filepath.Join(stateDir, forwardingStateName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, cnierrors.IO(err, "failed to read forwarding state")
+	}
+	if len(data) != 0 {
+		if err = json.Unmarshal(data, state); err != nil {
+			return nil, cnierrors.DecodingFailure(err, "failed to decode forwarding state")
+		}
+	}
+	if state.Users == nil {
+		state.Users = make(map[string]int)
+	}
+	if state.Restore == nil {
+		state.Restore = make(map[string]string)
+	}
+	return state, nil
+}
+
+func writeForwardingState(stateDir string, state *forwardingState) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return cnierrors.IO(err, "failed to create state directory %s", stateDir)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return cnierrors.Internal(err, "failed to encode forwarding state")
+	}
+
+	// write to a temporary file and rename, so a crash never leaves a partial state
+	path := filepath.Join(stateDir, forwardingStateName)
+	if err = os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return cnierrors.IO(err, "failed to write forwarding state")
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return cnierrors.IO(err, "failed to write forwarding state")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package networking
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// Handle is a netlink handle opened in a network namespace. The operations are sent through
+// the netlink socket of the namespace, so the thread never switches namespace for them.
+// A Handle isn't safe for concurrent use.
+type Handle struct {
+	nl     *netlink.Handle
+	netns  ns.NetNS
+	logger *zap.Logger
+	// links caches the links found by name, it's dropped when a link is changed
+	links map[string]netlink.Link
+}
+
+// NewHandle opens a handle in the given netns, or in the current netns if netns is nil.
+// The netns must stay open until the handle is closed.
+func NewHandle(logger *zap.Logger, netNS ns.NetNS) (*Handle, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	var h *netlink.Handle
+	var err error
+	if netNS == nil {
+		h, err = netlink.NewHandle(unix.NETLINK_ROUTE)
+	} else {
+		h, err = netlink.NewHandleAt(netns.NsHandle(netNS.Fd()), unix.NETLINK_ROUTE)
+	}
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to open netlink handle")
+	}
+
+	return &Handle{
+		nl:     h,
+		netns:  netNS,
+		logger: logger,
+		links:  make(map[string]netlink.Link),
+	}, nil
+}
+
+// NetNS returns the netns of the handle, nil for the current netns
+func (h *Handle) NetNS() ns.NetNS {
+	return h.netns
+}
+
+// Close closes the netlink socket of the handle
+func (h *Handle) Close() {
+	h.nl.Close()
+}
+
+// begin is called before every netlink request, it bounds the request by the deadline of ctx.
+func (h *Handle) begin(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return cnierrors.New(cnitypes.ErrTryAgainLater, err, "netlink request is canceled")
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	timeout := time.Until(deadline)
+	if timeout < time.Microsecond {
+		return cnierrors.New(cnitypes.ErrTryAgainLater, context.DeadlineExceeded, "netlink request is canceled")
+	}
+	if err := h.nl.SetSocketTimeout(timeout); err != nil {
+		return cnierrors.Internal(err, "failed to set netlink socket timeout")
+	}
+	return nil
+}
+
+// LinkByName returns the link of the given name
+func (h *Handle) LinkByName(ctx context.Context, name string) (netlink.Link, error) {
+	if link, ok := h.links[name]; ok {
+		return link, nil
+	}
+
+	if err := h.begin(ctx); err != nil {
+		return nil, err
+	}
+	link, err := h.nl.LinkByName(name)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get link %s", name)
+	}
+	h.links[name] = link
+	return link, nil
+}
+
+// LinkByIndex returns the link of the given index
+func (h *Handle) LinkByIndex(ctx context.Context, index int) (netlink.Link, error) {
+	if err := h.begin(ctx); err != nil {
+		return nil, err
+	}
+	link, err := h.nl.LinkByIndex(index)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get link of index %d", index)
+	}
+	return link, nil
+}
+
+// LinkExists returns true if the link of the given name exists
+func (h *Handle) LinkExists(ctx context.Context, name string) (bool, error) {
+	_, err := h.LinkByName(ctx, name)
+	if err == nil {
+		return true, nil
+	}
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// HwAddressByName returns the hardware address of the given link
+func (h *Handle) HwAddressByName(ctx context.Context, name string) (net.HardwareAddr, error) {
+	link, err := h.LinkByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return link.Attrs().HardwareAddr, nil
+}
@@ -0,0 +1,431 @@
+package networking
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// newTestNS returns a netns with a link net1 holding the given address, it's a bridge
+// rather than dummy which may not be built into the kernel
+func newTestNS(addr string) (ns.NetNS, error) {
+	netns, err := testutils.NewNS()
+	if err != nil {
+		return nil, err
+	}
+	err = netns.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "net1"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("net1")
+		if err != nil {
+			return err
+		}
+		ipNet, err := netlink.ParseIPNet(addr)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet}); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+	if err != nil {
+		netns.Close()
+		testutils.UnmountNS(netns) // nolint: errcheck
+		return nil, err
+	}
+	return netns, nil
+}
+
+// addVeths adds n veth pairs into the netns, like the host veths of pods
+func addVeths(netns ns.NetNS, n int) error {
+	return netns.Do(func(ns.NetNS) error {
+		for i := 0; i < n; i++ {
+			veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("veth%d", i)}, PeerName: fmt.Sprintf("vethp%d", i)}
+			if err := netlink.LinkAdd(veth); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func closeTestNS(netns ns.NetNS) {
+	netns.Close()
+	testutils.UnmountNS(netns) // nolint: errcheck
+}
+
+var _ = Describe("Handle", func() {
+	var netns ns.NetNS
+	var h *Handle
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		netns, err = newTestNS("10.6.0.10/16")
+		Expect(err).NotTo(HaveOccurred())
+		h, err = NewHandle(nil, netns)
+		Expect(err).NotTo(HaveOccurred())
+
+		DeferCleanup(func() {
+			h.Close()
+			closeTestNS(netns)
+		})
+	})
+
+	It("works on the netns without entering it", func() {
+		ctx := context.TODO()
+		exists, err := h.LinkExists(ctx, "net1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeTrue())
+
+		exists, err = h.LinkExists(ctx, "veth0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeFalse())
+
+		addrs, err := h.IPAddressByName(ctx, "net1", netlink.FAMILY_ALL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addrs).To(HaveLen(1))
+		Expect(addrs[0].IP.String()).To(Equal("10.6.0.10"))
+	})
+
+	It("add routes and neighbors in batch", func() {
+		ctx := context.TODO()
+		Expect(h.AddRouteTable(ctx, unix.RT_TABLE_MAIN, netlink.SCOPE_LINK, "net1", []string{"10.233.0.0/18", "10.233.64.0/18"}, Nexthop{V4Src: net.ParseIP("10.6.0.10")})).To(Succeed())
+		// existing routes are ignored
+		Expect(h.AddRouteTable(ctx, unix.RT_TABLE_MAIN, netlink.SCOPE_LINK, "net1", []string{"10.233.0.0/18"}, Nexthop{})).To(Succeed())
+
+		hwAddr, err := net.ParseMAC("0a:58:0a:06:00:01")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(h.AddNeighborTable(ctx, "net1", []net.IP{net.ParseIP("10.6.0.1"), net.ParseIP("10.6.0.2")}, hwAddr)).To(Succeed())
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			// with the connected route of 10.6.0.0/16
+			Expect(routes).To(HaveLen(3))
+			for _, route := range routes {
+				if route.Dst.String() == "10.233.64.0/18" {
+					Expect(route.Src.String()).To(Equal("10.6.0.10"))
+				}
+			}
+
+			neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(neighs).To(HaveLen(2))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("add custom routes via veth0 and the chained interface", func() {
+		ctx := context.TODO()
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}})).To(Succeed())
+			link, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			// the excluded CIDR is routed via veth0 already, like an additional CIDR
+			_, excluded, _ := net.ParseCIDR("10.233.100.0/24")
+			Expect(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: excluded})).To(Succeed())
+
+			link, err = netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("10.6.0.1")})
+		})).To(Succeed())
+
+		table := 100
+		routes := []types.Route{
+			{Dst: "169.254.20.10/32", Metric: 10},
+			{Dst: "10.233.100.0/24", Exclude: true},
+			{Dst: "10.8.0.0/16", Dev: types.RouteDevChained, Via: "10.6.0.2", MTU: 1400, Table: &table},
+		}
+		Expect(h.AddCustomRoutes(ctx, routes, unix.RT_TABLE_MAIN, "veth0", "net1", Nexthop{V4Src: net.ParseIP("10.6.0.10")})).To(Succeed())
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			found := map[string]netlink.Route{}
+			for _, route := range routes {
+				if route.Dst != nil {
+					found[route.Dst.String()] = route
+				}
+			}
+
+			veth0, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			net1, err := netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(found).To(HaveKey("169.254.20.10/32"))
+			Expect(found["169.254.20.10/32"].LinkIndex).To(Equal(veth0.Attrs().Index))
+			Expect(found["169.254.20.10/32"].Priority).To(Equal(10))
+			Expect(found["169.254.20.10/32"].Src.String()).To(Equal("10.6.0.10"))
+
+			// the excluded route replaces the one via veth0
+			Expect(found).To(HaveKey("10.233.100.0/24"))
+			Expect(found["10.233.100.0/24"].LinkIndex).To(Equal(net1.Attrs().Index))
+			Expect(found["10.233.100.0/24"].Gw.String()).To(Equal("10.6.0.1"))
+
+			Expect(found).To(HaveKey("10.8.0.0/16"))
+			Expect(found["10.8.0.0/16"].Table).To(Equal(table))
+			Expect(found["10.8.0.0/16"].MTU).To(Equal(1400))
+			Expect(found["10.8.0.0/16"].Gw.String()).To(Equal("10.6.0.2"))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("move the routes into the table holding them already", func() {
+		ctx := context.TODO()
+		table := 100
+		_, dst, _ := net.ParseCIDR("10.8.0.0/16")
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.ParseIP("10.6.0.1")})).To(Succeed())
+			// left by a previous ADD
+			return netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.ParseIP("10.6.0.1"), Table: table})
+		})).To(Succeed())
+
+		Expect(h.moveRouteTable(ctx, "net1", table, netlink.FAMILY_V4)).To(Succeed())
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst, Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+			Expect(routes[0].Table).To(Equal(table))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("refresh the cached link after overriding hardware address", func() {
+		ctx := context.TODO()
+		_, err := h.HwAddressByName(ctx, "net1")
+		Expect(err).NotTo(HaveOccurred())
+
+		hwAddr, err := h.OverrideHwAddress(ctx, "0a:58", "net1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hwAddr).To(Equal("0a:58:0a:06:00:0a"))
+
+		got, err := h.HwAddressByName(ctx, "net1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.String()).To(Equal(hwAddr))
+	})
+
+	It("don't send requests with a done context", func() {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		_, err := h.IPAddressByName(ctx, "net1", netlink.FAMILY_ALL)
+		Expect(err).To(HaveOccurred())
+		Expect(cnierrors.Code(err)).To(Equal(cnitypes.ErrTryAgainLater))
+	})
+})
+
+var _ = Describe("IPAddressOnNode", func() {
+	var netns ns.NetNS
+	var h *Handle
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		netns, err = newTestNS("10.6.0.10/16")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addVeths(netns, 2)).To(Succeed())
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			ipNet, err := netlink.ParseIPNet("10.7.0.1/16")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet})).To(Succeed())
+
+			link, err = netlink.LinkByName("net1")
+			Expect(err).NotTo(HaveOccurred())
+			ipNet, err = netlink.ParseIPNet("fd00:6::10/64")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet, Flags: unix.IFA_F_NODAD})
+		})).To(Succeed())
+
+		h, err = NewHandle(nil, netns)
+		Expect(err).NotTo(HaveOccurred())
+
+		DeferCleanup(func() {
+			h.Close()
+			closeTestNS(netns)
+		})
+	})
+
+	It("skip the excluded interfaces", func() {
+		addrs, err := h.IPAddressOnNode(context.TODO(), netlink.FAMILY_ALL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(AddrsToString(addrs)).To(ConsistOf("10.6.0.10/32", "fd00:6::10/128"))
+	})
+
+	It("filter by family", func() {
+		addrs, err := h.IPAddressOnNode(context.TODO(), netlink.FAMILY_V4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(AddrsToString(addrs)).To(ConsistOf("10.6.0.10/32"))
+
+		addrs, err = h.IPAddressOnNode(context.TODO(), netlink.FAMILY_V6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(AddrsToString(addrs)).To(ConsistOf("fd00:6::10/128"))
+	})
+})
+
+var _ = Describe("SelectSourceIPs", func() {
+	addrs := []netlink.Addr{}
+	for _, cidr := range []string{"10.6.0.10/16", "fd00:6::10/64", "10.7.0.10/16", "fd00:7::10/64"} {
+		ipNet, err := netlink.ParseIPNet(cidr)
+		if err != nil {
+			panic(err)
+		}
+		addrs = append(addrs, netlink.Addr{IPNet: ipNet})
+	}
+
+	It("the first address of each family by default", func() {
+		v4Src, v6Src, err := SelectSourceIPs(addrs, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4Src.String()).To(Equal("10.6.0.10"))
+		Expect(v6Src.String()).To(Equal("fd00:6::10"))
+	})
+
+	It("the first address in the given CIDR", func() {
+		v4Src, v6Src, err := SelectSourceIPs(addrs, "10.7.0.0/16", "fd00:7::/64")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4Src.String()).To(Equal("10.7.0.10"))
+		Expect(v6Src.String()).To(Equal("fd00:7::10"))
+	})
+
+	It("no address in the given CIDR", func() {
+		_, _, err := SelectSourceIPs(addrs, "10.8.0.0/16", "")
+		Expect(err).To(HaveOccurred())
+		Expect(cnierrors.Code(err)).To(Equal(cnitypes.ErrInvalidNetworkConfig))
+	})
+})
+
+// BenchmarkIPAddressOnNode shows the cost of IPAddressOnNode stays flat as the number of pod
+// veths grows, compared with listing the addresses link by link.
+func BenchmarkIPAddressOnNode(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("requires root to create network namespaces")
+	}
+
+	for _, veths := range []int{0, 100, 400} {
+		netns, err := newTestNS("10.6.0.10/16")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := addVeths(netns, veths); err != nil {
+			closeTestNS(netns)
+			b.Fatal(err)
+		}
+		h, err := NewHandle(nil, netns)
+		if err != nil {
+			closeTestNS(netns)
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("dump/veths=%d", veths), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := h.IPAddressOnNode(context.TODO(), netlink.FAMILY_ALL); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("per-link/veths=%d", veths), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				excludeRegexp, err := interfacesToExclude()
+				if err != nil {
+					b.Fatal(err)
+				}
+				links, err := h.nl.LinkList()
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, link := range links {
+					if excludeRegexp.MatchString(link.Attrs().Name) {
+						continue
+					}
+					if _, err := getAddrs(h.nl, link, netlink.FAMILY_ALL); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		h.Close()
+		closeTestNS(netns)
+	}
+}
+
+// BenchmarkIPAddressByName compares a handle with entering the netns for every request,
+// which is what the helpers did before Handle.
+func BenchmarkIPAddressByName(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("requires root to create network namespaces")
+	}
+	netns, err := newTestNS("10.6.0.10/16")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer closeTestNS(netns)
+
+	b.Run("handle", func(b *testing.B) {
+		h, err := NewHandle(nil, netns)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer h.Close()
+		for i := 0; i < b.N; i++ {
+			// the cached link is dropped, so both ways send the same requests
+			delete(h.links, "net1")
+			if _, err := h.IPAddressByName(context.TODO(), "net1", netlink.FAMILY_ALL); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("netns.Do", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := netns.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName("net1")
+				if err != nil {
+					return err
+				}
+				_, err = netlink.AddrList(link, netlink.FAMILY_ALL)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
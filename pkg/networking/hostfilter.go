@@ -0,0 +1,375 @@
+package networking
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+)
+
+// The protocols of allowed ports
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolSCTP = "sctp"
+)
+
+var portProtocols = []string{ProtocolTCP, ProtocolUDP, ProtocolSCTP}
+
+// the maps of nftables dispatching the traffic from the host veths to the chains of pods
+const (
+	nftSpoofMap   = "spoof"
+	nftForwardMap = "forward-filter"
+	nftInputMap   = "input-filter"
+	// raw priority of nftables, before conntrack
+	nftRaw = -300
+)
+
+// PortRange is a range of ports of a protocol
+type PortRange struct {
+	Protocol string
+	From, To int
+}
+
+// ParsePortRange parses <protocol>/<port> or <protocol>/<from>-<to>, like tcp/10250 or udp/30000-32767
+func ParsePortRange(s string) (PortRange, error) {
+	proto, ports, ok := strings.Cut(s, "/")
+	if !ok {
+		return PortRange{}, fmt.Errorf("must be <protocol>/<port> or <protocol>/<from>-<to>")
+	}
+	proto = strings.ToLower(proto)
+	valid := false
+	for _, p := range portProtocols {
+		valid = valid || p == proto
+	}
+	if !valid {
+		return PortRange{}, fmt.Errorf("unsupported protocol %s, must be one of %s", proto, strings.Join(portProtocols, ", "))
+	}
+
+	from, to, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		to = from
+	}
+	r := PortRange{Protocol: proto}
+	var err error
+	if r.From, err = strconv.Atoi(from); err != nil || r.From < 1 || r.From > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %s", from)
+	}
+	if r.To, err = strconv.Atoi(to); err != nil || r.To < 1 || r.To > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %s", to)
+	}
+	if r.From > r.To {
+		return PortRange{}, fmt.Errorf("invalid port range %s", ports)
+	}
+	return r, nil
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(r.From)
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// HostFilter filters the traffic from a pod on its host veth
+type HostFilter struct {
+	HostVeth string
+	// Sources are the addresses of the pod, the traffic from others is dropped
+	Sources []net.IP
+	// Destinations are the CIDRs the pod could reach via the host, if RestrictDestinations is set
+	Destinations         []string
+	RestrictDestinations bool
+	// Ports are the ports of the node the pod could reach, the node is not restricted if it's empty
+	Ports []PortRange
+}
+
+// SetupHostFilter installs the filter of the host veth into the current netns by the firewall backend.
+// The sources and destinations are added to the ones installed before, so a pod with several
+// interfaces is allowed to use the addresses of all of them.
+func SetupHostFilter(backend string, filter *HostFilter, ipFamily int) error {
+	if backend == types.FirewallBackendNFTables {
+		if err := NftRun(nftHostFilter(filter)); err != nil {
+			return cnierrors.IO(err, "failed to apply the host filter of %s by nftables", filter.HostVeth)
+		}
+		return nil
+	}
+	return setupHostFilterIPTables(filter, ipFamily)
+}
+
+// TeardownHostFilter removes the filter of the host veth from the current netns, nothing is done
+// if it isn't found.
+func TeardownHostFilter(backend, hostVeth string, ipFamily int) error {
+	if backend == types.FirewallBackendNFTables {
+		// the chains and the elements of the pod are added in a transaction, so they are gone if the chain is
+		if err := NftRun(fmt.Sprintf("list chain inet %s %s\n", nftTable, hostVeth+"-spoof")); err != nil {
+			return nil
+		}
+		if err := NftRun(nftTeardownHostFilter(hostVeth)); err != nil {
+			return cnierrors.IO(err, "failed to remove the host filter of %s by nftables", hostVeth)
+		}
+		return nil
+	}
+
+	ipts, err := iptablesOfFamily(ipFamily)
+	if err != nil {
+		return err
+	}
+	spoof, forward, input := hostFilterChains(hostVeth)
+	for _, ipt := range ipts {
+		if err = deleteJumps(ipt, "raw", "PREROUTING", spoof); err != nil {
+			return err
+		}
+		if err = deleteJumps(ipt, "filter", "FORWARD", forward); err != nil {
+			return err
+		}
+		if err = deleteJumps(ipt, "filter", "INPUT", input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nftHostFilter returns the script of the filter, the base chains dispatch the traffic by the
+// name of the host veth to the chains of the pod:
+//
+//	table inet spider-veth {
+//		chain prerouting { iifname vmap @spoof }
+//		chain forward { iifname vmap @forward-filter }
+//		chain input { iifname vmap @input-filter }
+//	}
+func nftHostFilter(f *HostFilter) string {
+	b := &strings.Builder{}
+	v := f.HostVeth
+	fmt.Fprintf(b, "table inet %s {\n", nftTable)
+	for _, m := range []string{nftSpoofMap, nftForwardMap, nftInputMap} {
+		fmt.Fprintf(b, "\tmap %s { type ifname : verdict; }\n", m)
+	}
+	fmt.Fprintf(b, "\tchain prerouting { type filter hook prerouting priority %d; policy accept; }\n", nftRaw)
+	b.WriteString("\tchain forward { type filter hook forward priority 0; policy accept; }\n")
+	b.WriteString("\tchain input { type filter hook input priority 0; policy accept; }\n")
+	for _, set := range []struct{ name, typ string }{
+		{v + "-src4", "ipv4_addr"}, {v + "-src6", "ipv6_addr"},
+		{v + "-dst4", "ipv4_addr"}, {v + "-dst6", "ipv6_addr"},
+		{v + "-tcp", "inet_service"}, {v + "-udp", "inet_service"}, {v + "-sctp", "inet_service"},
+	} {
+		fmt.Fprintf(b, "\tset %s { type %s; flags interval; auto-merge; }\n", set.name, set.typ)
+	}
+	for _, chain := range []string{v + "-spoof", v + "-forward", v + "-input"} {
+		fmt.Fprintf(b, "\tchain %s { }\n", chain)
+	}
+	b.WriteString("}\n")
+
+	rules := func(chain string, rules ...string) {
+		fmt.Fprintf(b, "flush chain inet %s %s\n", nftTable, chain)
+		for _, rule := range rules {
+			fmt.Fprintf(b, "add rule inet %s %s %s\n", nftTable, chain, rule)
+		}
+	}
+	elements := func(set string, elems []string) {
+		if len(elems) != 0 {
+			fmt.Fprintf(b, "add element inet %s %s { %s }\n", nftTable, set, strings.Join(elems, ", "))
+		}
+	}
+
+	// the base chains are rebuilt in the transaction, so the rules are never duplicated
+	rules("prerouting", "iifname vmap @"+nftSpoofMap)
+	rules("forward", "iifname vmap @"+nftForwardMap)
+	rules("input", "iifname vmap @"+nftInputMap)
+
+	var src4, src6 []string
+	for _, ip := range f.Sources {
+		if ip.To4() != nil {
+			src4 = append(src4, ip.String())
+		} else {
+			src6 = append(src6, ip.String())
+		}
+	}
+	elements(v+"-src4", src4)
+	elements(v+"-src6", src6)
+	rules(v+"-spoof",
+		"ip saddr @"+v+"-src4 return",
+		"ip6 saddr @"+v+"-src6 return",
+		// neighbor discovery and DAD of the pod
+		"ip6 saddr { fe80::/10, :: } return",
+		"counter drop")
+
+	forward := []string{"ct state established,related return"}
+	if f.RestrictDestinations {
+		var dst4, dst6 []string
+		for _, cidr := range f.Destinations {
+			if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr)); err == nil {
+				if ipNet.IP.To4() != nil {
+					dst4 = append(dst4, ipNet.String())
+				} else {
+					dst6 = append(dst6, ipNet.String())
+				}
+			}
+		}
+		elements(v+"-dst4", dst4)
+		elements(v+"-dst6", dst6)
+		forward = append(forward, "ip daddr @"+v+"-dst4 return", "ip6 daddr @"+v+"-dst6 return", "counter drop")
+	}
+	rules(v+"-forward", forward...)
+
+	input := []string{"ct state established,related return"}
+	if len(f.Ports) != 0 {
+		ports := make(map[string][]string)
+		for _, r := range f.Ports {
+			ports[r.Protocol] = append(ports[r.Protocol], r.String())
+		}
+		input = append(input, "meta l4proto { icmp, ipv6-icmp } return")
+		for _, proto := range portProtocols {
+			elements(v+"-"+proto, ports[proto])
+			input = append(input, fmt.Sprintf("%s dport @%s-%s return", proto, v, proto))
+		}
+		input = append(input, "counter drop")
+	}
+	rules(v+"-input", input...)
+
+	fmt.Fprintf(b, "add element inet %s %s { %q : jump %s }\n", nftTable, nftSpoofMap, v, v+"-spoof")
+	fmt.Fprintf(b, "add element inet %s %s { %q : jump %s }\n", nftTable, nftForwardMap, v, v+"-forward")
+	fmt.Fprintf(b, "add element inet %s %s { %q : jump %s }\n", nftTable, nftInputMap, v, v+"-input")
+	return b.String()
+}
+
+func nftTeardownHostFilter(v string) string {
+	b := &strings.Builder{}
+	for _, m := range []string{nftSpoofMap, nftForwardMap, nftInputMap} {
+		fmt.Fprintf(b, "delete element inet %s %s { %q }\n", nftTable, m, v)
+	}
+	for _, chain := range []string{v + "-spoof", v + "-forward", v + "-input"} {
+		fmt.Fprintf(b, "delete chain inet %s %s\n", nftTable, chain)
+	}
+	for _, set := range []string{"-src4", "-src6", "-dst4", "-dst6", "-tcp", "-udp", "-sctp"} {
+		fmt.Fprintf(b, "delete set inet %s %s\n", nftTable, v+set)
+	}
+	return b.String()
+}
+
+// hostFilterChains returns the iptables chains of the host veth
+func hostFilterChains(hostVeth string) (spoof, forward, input string) {
+	sum := sha256.Sum256([]byte(hostVeth))
+	id := strings.ToUpper(fmt.Sprintf("%x", sum[:6]))
+	return "SPIDER-SPOOF-" + id, "SPIDER-FWD-" + id, "SPIDER-IN-" + id
+}
+
+// setupHostFilterIPTables installs the filter by iptables, the chains of the pod are jumped from
+// raw PREROUTING, filter FORWARD and INPUT for the traffic from the host veth. The RETURN rules
+// are inserted before the DROP at the end of the chains, so they are added to the existing ones.
+func setupHostFilterIPTables(f *HostFilter, ipFamily int) error {
+	ipts, err := iptablesOfFamily(ipFamily)
+	if err != nil {
+		return err
+	}
+	spoof, forward, input := hostFilterChains(f.HostVeth)
+	for proto, ipt := range ipts {
+		isV4 := proto == iptables.ProtocolIPv4
+
+		// eq: iptables -t raw -A SPIDER-SPOOF-<id> -s <ip> -j RETURN; iptables -t raw -A SPIDER-SPOOF-<id> -j DROP
+		if err = ensureJump(ipt, "raw", "PREROUTING", spoof, "-i", f.HostVeth); err != nil {
+			return err
+		}
+		var allowed []string
+		for _, ip := range f.Sources {
+			if (ip.To4() != nil) == isV4 {
+				allowed = append(allowed, hostNet(ip).String())
+			}
+		}
+		if !isV4 {
+			// neighbor discovery and DAD of the pod
+			allowed = append(allowed, "fe80::/10", "::/128")
+		}
+		for _, src := range allowed {
+			if err = insertOnce(ipt, "raw", spoof, "-s", src, "-j", "RETURN"); err != nil {
+				return err
+			}
+		}
+		if err = ipt.AppendUnique("raw", spoof, "-j", "DROP"); err != nil {
+			return cnierrors.IO(err, "failed to add rule to %s", spoof)
+		}
+
+		// eq: iptables -A SPIDER-FWD-<id> -d <cidr> -j RETURN; iptables -A SPIDER-FWD-<id> -j DROP
+		if err = ensureJump(ipt, "filter", "FORWARD", forward, "-i", f.HostVeth); err != nil {
+			return err
+		}
+		if err = insertOnce(ipt, "filter", forward, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"); err != nil {
+			return err
+		}
+		if f.RestrictDestinations {
+			for _, cidr := range f.Destinations {
+				_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+				if err != nil || (ipNet.IP.To4() != nil) != isV4 {
+					continue
+				}
+				if err = insertOnce(ipt, "filter", forward, "-d", ipNet.String(), "-j", "RETURN"); err != nil {
+					return err
+				}
+			}
+		}
+		if err = setDrop(ipt, forward, f.RestrictDestinations); err != nil {
+			return err
+		}
+
+		// eq: iptables -A SPIDER-IN-<id> -p tcp --dport <port> -j RETURN; iptables -A SPIDER-IN-<id> -j DROP
+		if err = ensureJump(ipt, "filter", "INPUT", input, "-i", f.HostVeth); err != nil {
+			return err
+		}
+		if len(f.Ports) != 0 {
+			icmp := "icmp"
+			if !isV4 {
+				icmp = "ipv6-icmp"
+			}
+			for _, rulespec := range [][]string{
+				{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+				{"-p", icmp, "-j", "RETURN"},
+			} {
+				if err = insertOnce(ipt, "filter", input, rulespec...); err != nil {
+					return err
+				}
+			}
+			for _, r := range f.Ports {
+				if err = insertOnce(ipt, "filter", input, "-p", r.Protocol, "--dport", fmt.Sprintf("%d:%d", r.From, r.To), "-j", "RETURN"); err != nil {
+					return err
+				}
+			}
+		}
+		if err = setDrop(ipt, input, len(f.Ports) != 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertOnce inserts the rule at the beginning of the chain if it doesn't exist
+func insertOnce(ipt IPTables, table, chain string, rulespec ...string) error {
+	exists, err := ipt.Exists(table, chain, rulespec...)
+	if err != nil {
+		return cnierrors.IO(err, "failed to check rule of %s", chain)
+	}
+	if exists {
+		return nil
+	}
+	if err = ipt.Insert(table, chain, 1, rulespec...); err != nil {
+		return cnierrors.IO(err, "failed to add rule to %s", chain)
+	}
+	return nil
+}
+
+// setDrop adds or removes the DROP at the end of the filter chain
+func setDrop(ipt IPTables, chain string, drop bool) error {
+	var err error
+	if drop {
+		err = ipt.AppendUnique("filter", chain, "-j", "DROP")
+	} else {
+		err = ipt.DeleteIfExists("filter", chain, "-j", "DROP")
+	}
+	if err != nil {
+		return cnierrors.IO(err, "failed to update the DROP of %s", chain)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package networking
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+)
+
+var _ = Describe("host filter", func() {
+	filter := &HostFilter{
+		HostVeth:             "veth12345678901",
+		Sources:              []net.IP{net.ParseIP("10.6.0.10"), net.ParseIP("fd00::10")},
+		Destinations:         []string{"10.233.64.0/18", "fd00:10:233::/64", "10.6.0.1/32"},
+		RestrictDestinations: true,
+		Ports:                []PortRange{{Protocol: ProtocolTCP, From: 10250, To: 10250}, {Protocol: ProtocolUDP, From: 30000, To: 32767}},
+	}
+
+	It("parse port ranges", func() {
+		r, err := ParsePortRange("TCP/10250")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r).To(Equal(PortRange{Protocol: ProtocolTCP, From: 10250, To: 10250}))
+		r, err = ParsePortRange("sctp/100-200")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.String()).To(Equal("100-200"))
+
+		for _, invalid := range []string{"10250", "icmp/1", "tcp/0", "udp/65536", "tcp/2-1", "tcp/a"} {
+			_, err = ParsePortRange(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("filter the host veth by iptables and remove it", func() {
+		fakes := useFakeIPTables()
+		Expect(SetupHostFilter(types.FirewallBackendIPTables, filter, netlink.FAMILY_ALL)).To(Succeed())
+		// it's idempotent
+		Expect(SetupHostFilter(types.FirewallBackendIPTables, filter, netlink.FAMILY_ALL)).To(Succeed())
+
+		spoof, forward, input := hostFilterChains(filter.HostVeth)
+		ipv4, ipv6 := fakes[iptables.ProtocolIPv4], fakes[iptables.ProtocolIPv6]
+		Expect(ipv4.Rules("raw", "PREROUTING")).To(Equal([]string{"-i veth12345678901 -j " + spoof}))
+		Expect(ipv4.Rules("raw", spoof)).To(Equal([]string{"-s 10.6.0.10/32 -j RETURN", "-j DROP"}))
+		Expect(ipv6.Rules("raw", spoof)).To(Equal([]string{"-s ::/128 -j RETURN", "-s fe80::/10 -j RETURN", "-s fd00::10/128 -j RETURN", "-j DROP"}))
+		Expect(ipv4.Rules("filter", "FORWARD")).To(Equal([]string{"-i veth12345678901 -j " + forward}))
+		Expect(ipv4.Rules("filter", forward)).To(Equal([]string{
+			"-d 10.6.0.1/32 -j RETURN",
+			"-d 10.233.64.0/18 -j RETURN",
+			"-m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+			"-j DROP",
+		}))
+		Expect(ipv4.Rules("filter", input)).To(Equal([]string{
+			"-p udp --dport 30000:32767 -j RETURN",
+			"-p tcp --dport 10250:10250 -j RETURN",
+			"-p icmp -j RETURN",
+			"-m conntrack --ctstate RELATED,ESTABLISHED -j RETURN",
+			"-j DROP",
+		}))
+
+		// the sources of another interface are added, the destinations aren't restricted anymore
+		another := &HostFilter{HostVeth: filter.HostVeth, Sources: []net.IP{net.ParseIP("10.7.0.10")}}
+		Expect(SetupHostFilter(types.FirewallBackendIPTables, another, netlink.FAMILY_V4)).To(Succeed())
+		Expect(ipv4.Rules("raw", spoof)).To(Equal([]string{"-s 10.7.0.10/32 -j RETURN", "-s 10.6.0.10/32 -j RETURN", "-j DROP"}))
+		Expect(ipv4.Rules("filter", forward)).NotTo(ContainElement("-j DROP"))
+		Expect(ipv4.Rules("filter", input)).NotTo(ContainElement("-j DROP"))
+
+		Expect(TeardownHostFilter(types.FirewallBackendIPTables, filter.HostVeth, netlink.FAMILY_ALL)).To(Succeed())
+		// nothing left to remove
+		Expect(TeardownHostFilter(types.FirewallBackendIPTables, filter.HostVeth, netlink.FAMILY_ALL)).To(Succeed())
+		for _, ipt := range fakes {
+			Expect(ipt.Rules("raw", "PREROUTING")).To(BeEmpty())
+			Expect(ipt.Rules("filter", "FORWARD")).To(BeEmpty())
+			Expect(ipt.Rules("filter", "INPUT")).To(BeEmpty())
+			for table, chains := range map[string][]string{"raw": {spoof}, "filter": {forward, input}} {
+				for _, chain := range chains {
+					exists, err := ipt.ChainExists(table, chain)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeFalse())
+				}
+			}
+		}
+	})
+
+	It("filter the host veth by nftables and remove it", func() {
+		var scripts []string
+		installed := false
+		origin := NftRun
+		NftRun = func(script string) error {
+			scripts = append(scripts, script)
+			if strings.HasPrefix(script, "list ") && !installed {
+				return errors.New("No such file or directory")
+			}
+			return nil
+		}
+		DeferCleanup(func() {
+			NftRun = origin
+		})
+
+		// nothing to remove before the setup
+		Expect(TeardownHostFilter(types.FirewallBackendNFTables, filter.HostVeth, netlink.FAMILY_ALL)).To(Succeed())
+		Expect(scripts).To(HaveLen(1))
+
+		Expect(SetupHostFilter(types.FirewallBackendNFTables, filter, netlink.FAMILY_ALL)).To(Succeed())
+		installed = true
+		Expect(scripts).To(HaveLen(2))
+		script := scripts[1]
+		// the table isn't replaced, the ones of other pods are kept
+		Expect(script).NotTo(ContainSubstring("delete"))
+		for _, line := range []string{
+			"\tchain prerouting { type filter hook prerouting priority -300; policy accept; }\n",
+			"flush chain inet spider-veth prerouting\nadd rule inet spider-veth prerouting iifname vmap @spoof\n",
+			"add element inet spider-veth veth12345678901-src4 { 10.6.0.10 }\n",
+			"add element inet spider-veth veth12345678901-src6 { fd00::10 }\n",
+			"add rule inet spider-veth veth12345678901-spoof ip saddr @veth12345678901-src4 return\n",
+			"add rule inet spider-veth veth12345678901-spoof counter drop\n",
+			"add element inet spider-veth veth12345678901-dst4 { 10.233.64.0/18, 10.6.0.1/32 }\n",
+			"add rule inet spider-veth veth12345678901-forward ip daddr @veth12345678901-dst4 return\n",
+			"add element inet spider-veth veth12345678901-tcp { 10250 }\n",
+			"add element inet spider-veth veth12345678901-udp { 30000-32767 }\n",
+			"add rule inet spider-veth veth12345678901-input tcp dport @veth12345678901-tcp return\n",
+			"add element inet spider-veth spoof { \"veth12345678901\" : jump veth12345678901-spoof }\n",
+		} {
+			Expect(script).To(ContainSubstring(line))
+		}
+		Expect(script).NotTo(ContainSubstring("veth12345678901-sctp {  }"))
+
+		Expect(TeardownHostFilter(types.FirewallBackendNFTables, filter.HostVeth, netlink.FAMILY_ALL)).To(Succeed())
+		Expect(scripts).To(HaveLen(4))
+		Expect(scripts[3]).To(ContainSubstring("delete element inet spider-veth spoof { \"veth12345678901\" }\n"))
+		Expect(scripts[3]).To(ContainSubstring("delete chain inet spider-veth veth12345678901-spoof\n"))
+		Expect(scripts[3]).To(ContainSubstring("delete set inet spider-veth veth12345678901-src4\n"))
+	})
+})
@@ -0,0 +1,113 @@
+package networking
+
+import (
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+)
+
+// IPTables is the subset of go-iptables used by the package
+type IPTables interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+	ChainExists(table, chain string) (bool, error)
+	ClearChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
+}
+
+// NewIPTables returns the iptables of the given protocol, it runs the iptables binaries
+// in the netns of the calling thread. It's replaced by a fake in tests.
+var NewIPTables = func(proto iptables.Protocol) (IPTables, error) {
+	return iptables.NewWithProtocol(proto)
+}
+
+// iptablesOfFamily returns the iptables of each protocol enabled by ipFamily
+func iptablesOfFamily(ipFamily int) (map[iptables.Protocol]IPTables, error) {
+	ipts := make(map[iptables.Protocol]IPTables)
+	for _, proto := range protocolsOfFamily(ipFamily) {
+		ipt, err := NewIPTables(proto)
+		if err != nil {
+			return nil, cnierrors.Internal(err, "failed to locate iptables of %s", protocolName(proto))
+		}
+		ipts[proto] = ipt
+	}
+	return ipts, nil
+}
+
+func protocolsOfFamily(ipFamily int) []iptables.Protocol {
+	switch ipFamily {
+	case netlink.FAMILY_V4:
+		return []iptables.Protocol{iptables.ProtocolIPv4}
+	case netlink.FAMILY_V6:
+		return []iptables.Protocol{iptables.ProtocolIPv6}
+	}
+	return []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6}
+}
+
+func protocolName(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// ensureJump makes sure that the chain exists and the parent chain jumps to it at first
+func ensureJump(ipt IPTables, table, parent, chain string, match ...string) error {
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return cnierrors.IO(err, "failed to check chain %s/%s", table, chain)
+	}
+	if !exists {
+		if err = ipt.ClearChain(table, chain); err != nil {
+			return cnierrors.IO(err, "failed to create chain %s/%s", table, chain)
+		}
+	}
+
+	rulespec := append(append([]string{}, match...), "-j", chain)
+	exists, err = ipt.Exists(table, parent, rulespec...)
+	if err != nil {
+		return cnierrors.IO(err, "failed to check the jump from %s/%s to %s", table, parent, chain)
+	}
+	if !exists {
+		if err = ipt.Insert(table, parent, 1, rulespec...); err != nil {
+			return cnierrors.IO(err, "failed to add the jump from %s/%s to %s", table, parent, chain)
+		}
+	}
+	return nil
+}
+
+// deleteJumps deletes the rules of the parent chain which jump to the chain, and the chain
+func deleteJumps(ipt IPTables, table, parent, chain string) error {
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return cnierrors.IO(err, "failed to check chain %s/%s", table, chain)
+	}
+	if !exists {
+		return nil
+	}
+
+	rules, err := ipt.List(table, parent)
+	if err != nil {
+		return cnierrors.IO(err, "failed to list chain %s/%s", table, parent)
+	}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		// -A <parent> <rulespec> -j <chain>
+		if len(fields) < 4 || fields[0] != "-A" || fields[len(fields)-2] != "-j" || fields[len(fields)-1] != chain {
+			continue
+		}
+		if err = ipt.DeleteIfExists(table, parent, fields[2:]...); err != nil {
+			return cnierrors.IO(err, "failed to delete rule %s", rule)
+		}
+	}
+
+	if err = ipt.ClearAndDeleteChain(table, chain); err != nil {
+		return cnierrors.IO(err, "failed to delete chain %s/%s", table, chain)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package networking
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ipv6SysctlDir is missing if IPv6 is disabled by the kernel, like the boot parameter ipv6.disable=1
+var ipv6SysctlDir = "/proc/sys/net/ipv6"
+
+// CheckIPv6 returns ErrIPv6Disabled if IPv6 is disabled by the kernel of the current netns, or by
+// net.ipv6.conf.{all,default}.disable_ipv6, so the new host veth wouldn't get IPv6.
+func CheckIPv6() error {
+	if _, err := os.Stat(ipv6SysctlDir); err != nil {
+		if os.IsNotExist(err) {
+			return cnierrors.New(cnierrors.ErrIPv6Disabled, nil, "IPv6 is disabled by the kernel of the node, like the boot parameter ipv6.disable=1")
+		}
+		return cnierrors.IO(err, "failed to check IPv6 of the node")
+	}
+
+	for _, name := range []string{"net/ipv6/conf/all/disable_ipv6", "net/ipv6/conf/default/disable_ipv6"} {
+		value, err := sysctl.Sysctl(name)
+		if err != nil {
+			return cnierrors.IO(err, "failed to read sysctl %s", name)
+		}
+		if value != "0" {
+			return cnierrors.New(cnierrors.ErrIPv6Disabled, nil, "IPv6 is disabled on the node by %s=%s", strings.ReplaceAll(name, "/", "."), value)
+		}
+	}
+	return nil
+}
+
+// IPv6Supported reports whether the kernel supports IPv6, it doesn't with the boot parameter ipv6.disable=1
+func IPv6Supported() bool {
+	_, err := os.Stat(ipv6SysctlDir)
+	return err == nil
+}
+
+// IPv6ForwardingEnabled reports whether net.ipv6.conf.all.forwarding of the current netns is on
+func IPv6ForwardingEnabled() (bool, error) {
+	name := "net/ipv6/conf/all/forwarding"
+	value, err := sysctl.Sysctl(name)
+	if err != nil {
+		return false, cnierrors.IO(err, "failed to read sysctl %s", name)
+	}
+	return value == "1", nil
+}
+
+// EnableIPv6Forwarding turns on net.ipv6.conf.all.forwarding of the current netns, see keepAcceptRA
+func EnableIPv6Forwarding() error {
+	if err := keepAcceptRA(); err != nil {
+		return err
+	}
+	name := "net/ipv6/conf/all/forwarding"
+	if _, err := sysctl.Sysctl(name, "1"); err != nil {
+		return cnierrors.IO(err, "failed to set sysctl %s", name)
+	}
+	return nil
+}
+
+// keepAcceptRA sets accept_ra to 2 on the interfaces whose forwarding is turned on with all.forwarding and which
+// learned routes from router advertisements. The kernel ignores them with accept_ra=1 once forwarding is on, and
+// the node would lose those routes. The other interfaces and the default of the new ones, like the host veths,
+// are never changed, so the pods can't feed router advertisements to the node. It makes no difference while
+// forwarding is off, so it isn't restored.
+func keepAcceptRA() error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return cnierrors.IO(err, "failed to list links")
+	}
+	for _, link := range links {
+		iface := link.Attrs().Name
+		// the interface may be removed meanwhile
+		if forwarding, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/forwarding", iface)); err != nil || forwarding != "0" {
+			continue
+		}
+		name := fmt.Sprintf("net/ipv6/conf/%s/accept_ra", iface)
+		if value, err := sysctl.Sysctl(name); err != nil || value != "1" {
+			continue
+		}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{LinkIndex: link.Attrs().Index, Protocol: unix.RTPROT_RA},
+			netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			return cnierrors.IO(err, "failed to list routes of %s", iface)
+		}
+		if len(routes) == 0 {
+			continue
+		}
+		if _, err = sysctl.Sysctl(name, "2"); err != nil {
+			return cnierrors.IO(err, "failed to set sysctl %s", name)
+		}
+	}
+	return nil
+}
+
+// EnableProxyNDP makes the interface answer the neighbor solicitations for the addresses of AddNeighborProxy,
+// the node only answers them for the addresses on the interface otherwise, unlike ARP.
+func EnableProxyNDP(iface string) error {
+	name := fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", iface)
+	if _, err := sysctl.Sysctl(name, "1"); err != nil {
+		return cnierrors.IO(err, "failed to set sysctl %s", name)
+	}
+	return nil
+}
+
+// AddNeighborProxy adds the proxy entries of the IPv6 addresses on the interface, the IPv4 ones are skipped.
+// eq: ip -6 neigh add proxy <ip> dev <iface>
+func (h *Handle) AddNeighborProxy(ctx context.Context, iface string, ips []net.IP) error {
+	link, err := h.LinkByName(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			continue
+		}
+		if err = h.begin(ctx); err != nil {
+			return err
+		}
+		neigh := &netlink.Neigh{LinkIndex: link.Attrs().Index, Family: netlink.FAMILY_V6, Flags: netlink.NTF_PROXY, IP: ip}
+		if err = h.nl.NeighAdd(neigh); err != nil && !os.IsExist(err) {
+			return cnierrors.IO(err, "failed to add neighbor proxy %s on %s", ip, iface)
+		}
+	}
+	return nil
+}
+
+// SuppressRADefaultRoute stops the interface of the current netns from learning default routes from router
+// advertisements, and removes the ones learned in the main table.
+func SuppressRADefaultRoute(iface string) error {
+	name := fmt.Sprintf("net/ipv6/conf/%s/accept_ra_defrtr", iface)
+	if _, err := sysctl.Sysctl(name, "0"); err != nil {
+		return cnierrors.IO(err, "failed to set sysctl %s", name)
+	}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return cnierrors.IO(err, "failed to find %s", iface)
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_MAIN, Protocol: unix.RTPROT_RA},
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return cnierrors.IO(err, "failed to list routes of %s", iface)
+	}
+	for idx := range routes {
+		if routes[idx].Dst != nil && !isDefaultDst(routes[idx].Dst) {
+			continue
+		}
+		if err = netlink.RouteDel(&routes[idx]); err != nil && !os.IsNotExist(err) {
+			return cnierrors.IO(err, "failed to RouteDel %s", routes[idx].String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package networking
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var _ = Describe("ipv6", func() {
+	var netns ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		netns, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(netns)
+		})
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}})).To(Succeed())
+			link, err := netlink.LinkByName("br0")
+			Expect(err).NotTo(HaveOccurred())
+			return netlink.LinkSetUp(link)
+		})).To(Succeed())
+	})
+
+	It("tell which sysctl disables IPv6", func() {
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(CheckIPv6()).To(Succeed())
+
+			_, err := sysctl.Sysctl("net/ipv6/conf/all/disable_ipv6", "1")
+			Expect(err).NotTo(HaveOccurred())
+			err = CheckIPv6()
+			Expect(cnierrors.Code(err)).To(Equal(cnierrors.ErrIPv6Disabled))
+			Expect(err.Error()).To(ContainSubstring("net.ipv6.conf.all.disable_ipv6=1"))
+			return nil
+		})).To(Succeed())
+
+		ipv6SysctlDir = filepath.Join(GinkgoT().TempDir(), "ipv6")
+		DeferCleanup(func() {
+			ipv6SysctlDir = "/proc/sys/net/ipv6"
+		})
+		err := CheckIPv6()
+		Expect(cnierrors.Code(err)).To(Equal(cnierrors.ErrIPv6Disabled))
+		Expect(err.Error()).To(ContainSubstring("ipv6.disable=1"))
+	})
+
+	It("keep accepting router advertisements with forwarding on the interfaces learning from them", func() {
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			// br0 learned a default route from router advertisements, br1 didn't
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br1"}})).To(Succeed())
+			link, err := netlink.LinkByName("br0")
+			Expect(err).NotTo(HaveOccurred())
+			ipNet, err := netlink.ParseIPNet("fd00:6::10/64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet, Flags: unix.IFA_F_NODAD})).To(Succeed())
+			_, defaultDst, _ := net.ParseCIDR("::/0")
+			Expect(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: defaultDst, Gw: net.ParseIP("fd00:6::1"), Protocol: unix.RTPROT_RA})).To(Succeed())
+
+			for _, iface := range []string{"br0", "br1", "default"} {
+				_, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", iface), "1")
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			Expect(IPv6ForwardingEnabled()).To(BeFalse())
+			Expect(EnableIPv6Forwarding()).To(Succeed())
+			Expect(IPv6ForwardingEnabled()).To(BeTrue())
+			Expect(sysctl.Sysctl("net/ipv6/conf/br0/accept_ra")).To(Equal("2"))
+			Expect(sysctl.Sysctl("net/ipv6/conf/br1/accept_ra")).To(Equal("1"))
+			// the new interfaces like the host veths don't accept router advertisements
+			Expect(sysctl.Sysctl("net/ipv6/conf/default/accept_ra")).To(Equal("1"))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("add the neighbor proxies of IPv6 addresses", func() {
+		h, err := NewHandle(nil, netns)
+		Expect(err).NotTo(HaveOccurred())
+		defer h.Close()
+
+		ips := []net.IP{net.ParseIP("10.6.0.1"), net.ParseIP("fd00:6::1")}
+		Expect(h.AddNeighborProxy(context.TODO(), "br0", ips)).To(Succeed())
+		// it's idempotent
+		Expect(h.AddNeighborProxy(context.TODO(), "br0", ips)).To(Succeed())
+
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			Expect(EnableProxyNDP("br0")).To(Succeed())
+			Expect(sysctl.Sysctl("net/ipv6/conf/br0/proxy_ndp")).To(Equal("1"))
+
+			link, err := netlink.LinkByName("br0")
+			Expect(err).NotTo(HaveOccurred())
+			proxies, err := netlink.NeighProxyList(link.Attrs().Index, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(proxies).To(HaveLen(1))
+			Expect(proxies[0].IP.String()).To(Equal("fd00:6::1"))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("remove the default routes learned from router advertisements", func() {
+		Expect(netns.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("br0")
+			Expect(err).NotTo(HaveOccurred())
+			ipNet, err := netlink.ParseIPNet("fd00:6::10/64")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet, Flags: unix.IFA_F_NODAD})).To(Succeed())
+
+			_, defaultDst, _ := net.ParseCIDR("::/0")
+			_, staticDst, _ := net.ParseCIDR("fd00:7::/64")
+			gw := net.ParseIP("fd00:6::1")
+			Expect(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: defaultDst, Gw: gw, Protocol: unix.RTPROT_RA})).To(Succeed())
+			Expect(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: staticDst, Gw: gw})).To(Succeed())
+
+			Expect(SuppressRADefaultRoute("br0")).To(Succeed())
+			Expect(sysctl.Sysctl("net/ipv6/conf/br0/accept_ra_defrtr")).To(Equal("0"))
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var dsts []string
+			for _, route := range routes {
+				if route.Dst == nil || isDefaultDst(route.Dst) {
+					dsts = append(dsts, "default")
+					continue
+				}
+				dsts = append(dsts, route.Dst.String())
+			}
+			Expect(dsts).NotTo(ContainElement("default"))
+			Expect(dsts).To(ContainElement("fd00:7::/64"))
+			return nil
+		})).To(Succeed())
+	})
+})
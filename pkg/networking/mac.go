@@ -2,79 +2,96 @@ package networking
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
-	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/vishvananda/netlink"
-	"go.uber.org/zap"
 	"math/big"
 	"net"
 	"net/netip"
 	"os"
 	"regexp"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
 )
 
-// AddNeighborTable add static neighborhood table
-func AddNeighborTable(iface string, dstIP net.IP, hwAddress net.HardwareAddr) error {
-	link, err := netlink.LinkByName(iface)
+// AddNeighborTable add static neighborhood entries of the given addresses on iface
+func (h *Handle) AddNeighborTable(ctx context.Context, iface string, dstIPs []net.IP, hwAddress net.HardwareAddr) error {
+	link, err := h.LinkByName(ctx, iface)
 	if err != nil {
-		return fmt.Errorf("failed to get link: %v", err)
+		return err
 	}
 
-	neigh := &netlink.Neigh{
-		LinkIndex:    link.Attrs().Index,
-		State:        netlink.NUD_PERMANENT,
-		Type:         netlink.NDA_LLADDR,
-		IP:           dstIP,
-		HardwareAddr: hwAddress,
-	}
+	for _, dstIP := range dstIPs {
+		neigh := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			Type:         netlink.NDA_LLADDR,
+			IP:           dstIP,
+			HardwareAddr: hwAddress,
+		}
 
-	if err := netlink.NeighAdd(neigh); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("failed to add neigh table: %v ", err)
+		if err := h.begin(ctx); err != nil {
+			return err
+		}
+		if err := h.nl.NeighAdd(neigh); err != nil && !os.IsExist(err) {
+			return cnierrors.IO(err, "failed to add neigh table")
+		}
 	}
-
 	return nil
 }
 
 // OverrideHwAddress override the hardware address of the specified interface.
-func OverrideHwAddress(logger *zap.Logger, netns ns.NetNS, macPrefix, iface string) (string, error) {
-	ips, err := IPAddressByName(netns, iface, netlink.FAMILY_ALL)
+func (h *Handle) OverrideHwAddress(ctx context.Context, macPrefix, iface string) (string, error) {
+	ips, err := h.IPAddressByName(ctx, iface, netlink.FAMILY_ALL)
 	if err != nil {
-		logger.Error("failed to get IPAddressByName", zap.String("interface", iface), zap.Error(err))
+		h.logger.Error("failed to get IPAddressByName", zap.String("interface", iface), zap.Error(err))
 		return "", err
 	}
+	if len(ips) == 0 {
+		return "", cnierrors.InvalidConfig(nil, "no ip address is found on %s", iface)
+	}
 
 	// we only focus on first element
-	nAddr, err := netip.ParsePrefix(ips[0].IP.String())
+	nAddr, err := netip.ParseAddr(ips[0].IP.String())
 	if err != nil {
-		logger.Error("failed to ParsePrefix", zap.Error(err))
-		return "", err
+		h.logger.Error("failed to ParseAddr", zap.Error(err))
+		return "", cnierrors.Internal(err, "failed to parse %s", ips[0].IP.String())
 	}
 
-	suffix, err := inetAton(nAddr.Addr())
+	suffix, err := inetAton(nAddr)
 	if err != nil {
-		logger.Error("failed to inetAton", zap.Error(err))
-		return "", err
+		h.logger.Error("failed to inetAton", zap.Error(err))
+		return "", cnierrors.Internal(err, "failed to convert %s to hardware address", nAddr.String())
 	}
 
 	// newmac = xx:xx + xx:xx:xx:xx
 	hwAddr := macPrefix + ":" + suffix
-	err = netns.Do(func(netNS ns.NetNS) error {
-		link, err := netlink.LinkByName(iface)
-		if err != nil {
-			logger.Error(err.Error())
-			return err
-		}
-		return netlink.LinkSetHardwareAddr(link, parseMac(hwAddr))
-	})
-
-	if err != nil {
-		logger.Error("failed to OverrideHwAddress", zap.String("hardware address", hwAddr), zap.Error(err))
+	if err = h.SetHwAddress(ctx, iface, parseMac(hwAddr)); err != nil {
 		return "", err
 	}
 	return hwAddr, nil
 }
 
+// SetHwAddress sets the hardware address of the specified interface.
+func (h *Handle) SetHwAddress(ctx context.Context, iface string, hwAddr net.HardwareAddr) error {
+	link, err := h.LinkByName(ctx, iface)
+	if err != nil {
+		return err
+	}
+	if err = h.begin(ctx); err != nil {
+		return err
+	}
+	// the cached link has the old hardware address
+	delete(h.links, iface)
+	if err = h.nl.LinkSetHardwareAddr(link, hwAddr); err != nil {
+		h.logger.Error("failed to SetHwAddress", zap.String("hardware address", hwAddr.String()), zap.Error(err))
+		return cnierrors.IO(err, "failed to set hardware address %s", hwAddr)
+	}
+	return nil
+}
+
 // parseMac parse hardware addr from given string
 func parseMac(s string) net.HardwareAddr {
 	hardwareAddr, err := net.ParseMAC(s)
@@ -114,22 +131,3 @@ func convertHex2Mac(hexCode []byte) string {
 	}
 	return string(bytes.Join(regexSpilt.FindAll(hexCode, 4), []byte(":")))
 }
-
-func HwAddressByName(netns ns.NetNS, hostVethPairName string) (net.HardwareAddr, net.HardwareAddr, error) {
-	hostVethLink, err := netlink.LinkByName(hostVethPairName)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var containerVethHwAddree net.HardwareAddr
-	err = netns.Do(func(netNS ns.NetNS) error {
-		containerVethLink, err := netlink.LinkByName("veth0")
-		if err != nil {
-			return err
-		}
-		containerVethHwAddree = containerVethLink.Attrs().HardwareAddr
-		return nil
-	})
-	return hostVethLink.Attrs().HardwareAddr, containerVethHwAddree, nil
-
-}
@@ -0,0 +1,60 @@
+package networking
+
+import (
+	"errors"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// SetupNetkitWithName creates the netkit pair in L3 mode in the current netns, like SetupVethWithName,
+// the peer is moved into hostNS and both of them are set up. A netkit device has no L2 header, the
+// traffic is routed to the peer without neighbor resolution.
+// It returns cnierrors.ErrUnsupportedDevice if the kernel doesn't support netkit, which needs 6.7 or later.
+func SetupNetkitWithName(name, peerName string, mtu int, hostNS ns.NetNS) (hostInterface, containerInterface net.Interface, err error) {
+	nk := &netlink.Netkit{
+		LinkAttrs:  netlink.LinkAttrs{Name: name, MTU: mtu},
+		Mode:       netlink.NETKIT_MODE_L3,
+		Policy:     netlink.NETKIT_POLICY_FORWARD,
+		PeerPolicy: netlink.NETKIT_POLICY_FORWARD,
+	}
+	nk.SetPeerAttrs(&netlink.LinkAttrs{Name: peerName, MTU: mtu, Namespace: netlink.NsFd(int(hostNS.Fd()))})
+
+	// eq: ip link add <name> mtu <mtu> type netkit mode l3 peer name <peerName> netns <host>
+	if err = netlink.LinkAdd(nk); err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			return hostInterface, containerInterface, cnierrors.New(cnierrors.ErrUnsupportedDevice, err, "netkit isn't supported by the kernel")
+		}
+		return hostInterface, containerInterface, cnierrors.IO(err, "failed to add netkit %s", name)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return hostInterface, containerInterface, cnierrors.IO(err, "failed to find netkit %s", name)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return hostInterface, containerInterface, cnierrors.IO(err, "failed to set %s up", name)
+	}
+	containerInterface = net.Interface{Name: name, Index: link.Attrs().Index, MTU: link.Attrs().MTU}
+
+	err = hostNS.Do(func(ns.NetNS) error {
+		peer, err := netlink.LinkByName(peerName)
+		if err != nil {
+			return cnierrors.IO(err, "failed to find netkit peer %s", peerName)
+		}
+		if err = netlink.LinkSetUp(peer); err != nil {
+			return cnierrors.IO(err, "failed to set %s up", peerName)
+		}
+		hostInterface = net.Interface{Name: peerName, Index: peer.Attrs().Index, MTU: peer.Attrs().MTU}
+		return nil
+	})
+	return hostInterface, containerInterface, err
+}
+
+// IsNetkit returns true if the link is a netkit device
+func IsNetkit(link netlink.Link) bool {
+	return link.Type() == "netkit"
+}
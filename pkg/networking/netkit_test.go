@@ -0,0 +1,62 @@
+package networking
+
+import (
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+)
+
+var _ = Describe("netkit", func() {
+	var podNS, hostNS ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		podNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(podNS)
+			closeTestNS(hostNS)
+		})
+	})
+
+	It("create the netkit pair in L3 mode with the peer in host", func() {
+		err := podNS.Do(func(ns.NetNS) error {
+			_, _, err := SetupNetkitWithName("veth0", "veth12345678901", 1500, hostNS)
+			return err
+		})
+		if cnierrors.Code(err) == cnierrors.ErrUnsupportedDevice {
+			Skip("netkit isn't supported by the kernel")
+		}
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(IsNetkit(link)).To(BeTrue())
+			Expect(link.(*netlink.Netkit).Mode).To(Equal(netlink.NETKIT_MODE_L3))
+			Expect(link.Attrs().MTU).To(Equal(1500))
+			return nil
+		})).To(Succeed())
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("veth12345678901")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(IsNetkit(link)).To(BeTrue())
+			Expect(link.Attrs().RawFlags & 0x1).To(BeEquivalentTo(0x1))
+			return nil
+		})).To(Succeed())
+	})
+})
@@ -1,16 +1,20 @@
 package networking
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
 	"github.com/spidernet-io/plugins/pkg/types"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
@@ -26,11 +30,11 @@ var DefaultInterfacesToExclude = []string{
 func GetIPFamily(prevResult cnitypes.Result) (int, error) {
 	result, err := current.GetResult(prevResult)
 	if err != nil {
-		return netlink.FAMILY_ALL, fmt.Errorf("failed to convert prevResult: %v", err)
+		return netlink.FAMILY_ALL, cnierrors.DecodingFailure(err, "failed to convert prevResult")
 	}
 
 	if len(result.Interfaces) == 0 {
-		return netlink.FAMILY_ALL, fmt.Errorf("can't found any interface from prevResult")
+		return netlink.FAMILY_ALL, cnierrors.InvalidConfig(nil, "can't found any interface from prevResult")
 	}
 
 	ipFamily := netlink.FAMILY_V4
@@ -51,67 +55,130 @@ func GetIPFamily(prevResult cnitypes.Result) (int, error) {
 	return ipFamily, nil
 }
 
-// IPAddressByName returns all IP addresses of the given interface
-// group by ipFamily
-func IPAddressByName(netns ns.NetNS, interfacenName string, ipFamily int) ([]netlink.Addr, error) {
-	var err error
-	ipAddress := make([]netlink.Addr, 0, 2)
-	err = netns.Do(func(_ ns.NetNS) error {
-		link, err := netlink.LinkByName(interfacenName)
-		if err != nil {
-			return err
+// GetIPs returns the addresses in prevResult
+func GetIPs(prevResult cnitypes.Result) ([]net.IP, error) {
+	result, err := current.GetResult(prevResult)
+	if err != nil {
+		return nil, cnierrors.DecodingFailure(err, "failed to convert prevResult")
+	}
+
+	ips := make([]net.IP, 0, len(result.IPs))
+	for _, v := range result.IPs {
+		ips = append(ips, v.Address.IP)
+	}
+	return ips, nil
+}
+
+// SetResultHwAddress returns prevResult with the hardware address of the interface in the pod updated, so the
+// runtime sees the address the interface ends up with
+func SetResultHwAddress(prevResult cnitypes.Result, iface string, hwAddr net.HardwareAddr) (cnitypes.Result, error) {
+	result, err := current.GetResult(prevResult)
+	if err != nil {
+		return nil, cnierrors.DecodingFailure(err, "failed to convert prevResult")
+	}
+
+	for _, v := range result.Interfaces {
+		if v.Name == iface && v.Sandbox != "" {
+			v.Mac = hwAddr.String()
 		}
-		ipAddress, err = getAddrs(link, ipFamily)
-		return err
-	})
+	}
+	return result, nil
+}
 
+// IPAddressByName returns all IP addresses of the given interface
+// group by ipFamily
+func (h *Handle) IPAddressByName(ctx context.Context, interfacenName string, ipFamily int) ([]netlink.Addr, error) {
+	link, err := h.LinkByName(ctx, interfacenName)
 	if err != nil {
 		return nil, err
 	}
+
+	if err = h.begin(ctx); err != nil {
+		return nil, err
+	}
+	ipAddress, err := getAddrs(h.nl, link, ipFamily)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get ip addresses of %s", interfacenName)
+	}
 	return ipAddress, nil
 }
 
 // IPAddressOnNode return all ip addresses on the node, filter by ipFamily
-// skipping any interfaces whose name matches any of the exclusion list regexes
-func IPAddressOnNode(logger *zap.Logger, ipFamily int) ([]netlink.Addr, error) {
-	var err error
-	var excludeRegexp *regexp.Regexp
-	if excludeRegexp, err = regexp.Compile("(" + strings.Join(DefaultInterfacesToExclude, ")|(") + ")"); err != nil {
-		logger.Error(err.Error())
-		return nil, err
+// skipping any interfaces whose name matches any of the exclusion list regexes.
+// The addresses are listed by a single netlink dump, and only the links holding
+// them are looked up, so the cost doesn't grow with the pod veths on the node.
+func (h *Handle) IPAddressOnNode(ctx context.Context, ipFamily int) ([]netlink.Addr, error) {
+	excludeRegexp, err := interfacesToExclude()
+	if err != nil {
+		h.logger.Error(err.Error())
+		return nil, cnierrors.Internal(err, "failed to compile the exclusion regex")
 	}
 
-	links, err := netlink.LinkList()
-	if err != nil {
-		logger.Error(err.Error())
+	if err = h.begin(ctx); err != nil {
 		return nil, err
 	}
+	addrs, err := h.nl.AddrList(nil, ipFamily)
+	if err != nil {
+		h.logger.Error(err.Error())
+		return nil, cnierrors.New(cnierrors.ErrNodeAddressDiscovery, err, "failed to list addresses on the node")
+	}
 
 	var allIPAddress []netlink.Addr
-	for idx, _ := range links {
-		iLink := links[idx]
-		if excludeRegexp.MatchString(iLink.Attrs().Name) {
-			continue
+	names := make(map[int]string)
+	for _, addr := range filterAddrs(addrs, ipFamily) {
+		name, ok := names[addr.LinkIndex]
+		if !ok {
+			if err = h.begin(ctx); err != nil {
+				return nil, err
+			}
+			link, err := h.nl.LinkByIndex(addr.LinkIndex)
+			if err != nil {
+				var notFound netlink.LinkNotFoundError
+				if errors.As(err, &notFound) {
+					// the link is removed after the dump
+					continue
+				}
+				h.logger.Error(err.Error())
+				return nil, cnierrors.New(cnierrors.ErrNodeAddressDiscovery, err, "failed to get link of index %d", addr.LinkIndex)
+			}
+			name = link.Attrs().Name
+			names[addr.LinkIndex] = name
 		}
 
-		ipAddress, err := getAddrs(iLink, ipFamily)
-		if err != nil {
-			logger.Error(err.Error())
-			return nil, err
+		if excludeRegexp.MatchString(name) {
+			continue
 		}
-		allIPAddress = append(allIPAddress, ipAddress...)
+		allIPAddress = append(allIPAddress, addr)
 	}
-	logger.Debug("Get IPAddressOnNode", zap.Any("allIPAddress", allIPAddress))
+	h.logger.Debug("Get IPAddressOnNode", zap.Any("allIPAddress", allIPAddress))
 	return allIPAddress, nil
 }
 
-func getAddrs(link netlink.Link, ipfamily int) ([]netlink.Addr, error) {
-	var ipAddress []netlink.Addr
-	addrs, err := netlink.AddrList(link, ipfamily)
+var (
+	excludeOnce   sync.Once
+	excludeRegexp *regexp.Regexp
+	excludeErr    error
+)
+
+// interfacesToExclude compiles DefaultInterfacesToExclude once
+func interfacesToExclude() (*regexp.Regexp, error) {
+	excludeOnce.Do(func() {
+		excludeRegexp, excludeErr = regexp.Compile("(" + strings.Join(DefaultInterfacesToExclude, ")|(") + ")")
+	})
+	return excludeRegexp, excludeErr
+}
+
+func getAddrs(nl *netlink.Handle, link netlink.Link, ipfamily int) ([]netlink.Addr, error) {
+	addrs, err := nl.AddrList(link, ipfamily)
 	if err != nil {
 		return nil, err
 	}
+	return filterAddrs(addrs, ipfamily), nil
+}
 
+// filterAddrs skips multicast and link-local addresses, and the ones not in ipfamily
+func filterAddrs(addrs []netlink.Addr, ipfamily int) []netlink.Addr {
+	var ipAddress []netlink.Addr
 	for _, addr := range addrs {
 		if addr.IP.IsMulticast() || addr.IP.IsLinkLocalUnicast() {
 			continue
@@ -123,7 +190,7 @@ func getAddrs(link netlink.Link, ipfamily int) ([]netlink.Addr, error) {
 			ipAddress = append(ipAddress, addr)
 		}
 	}
-	return ipAddress, nil
+	return ipAddress
 }
 
 // AddrsToString convert addr to
@@ -140,28 +207,31 @@ func AddrsToString(addrs []netlink.Addr) []string {
 	return addrStrings
 }
 
-func EnableIpv6Sysctl(logger *zap.Logger, netns ns.NetNS) error {
-	logger.Debug("Setting all interface sysctl 'disable_ipv6' to 0 ", zap.String("NetNs Path", netns.Path()))
+// EnableIpv6Sysctl sets disable_ipv6 to 0 on the given interfaces of the netns, the others are left alone.
+// It returns ErrIPv6Disabled if IPv6 is disabled by the kernel.
+func EnableIpv6Sysctl(logger *zap.Logger, netns ns.NetNS, ifaces ...string) error {
+	logger.Debug("Setting sysctl 'disable_ipv6' to 0", zap.String("NetNs Path", netns.Path()), zap.Strings("interfaces", ifaces))
 	err := netns.Do(func(_ ns.NetNS) error {
-		dirs, err := os.ReadDir("/proc/sys/net/ipv6/conf")
-		if err != nil {
-			logger.Error(err.Error())
-			return err
+		if _, err := os.Stat(ipv6SysctlDir); err != nil {
+			if os.IsNotExist(err) {
+				return cnierrors.New(cnierrors.ErrIPv6Disabled, nil, "IPv6 is disabled by the kernel, like the boot parameter ipv6.disable=1")
+			}
+			return cnierrors.IO(err, "failed to check IPv6 of the pod")
 		}
 
-		for _, dir := range dirs {
+		for _, iface := range ifaces {
 			// Read current sysctl value
-			name := fmt.Sprintf("/net/ipv6/conf/%s/disable_ipv6", dir.Name())
+			name := fmt.Sprintf("/net/ipv6/conf/%s/disable_ipv6", iface)
 			value, err := sysctl.Sysctl(name)
 			if err != nil {
 				logger.Error("failed to read current sysctl value", zap.String("name", name), zap.Error(err))
-				return fmt.Errorf("failed to read current sysctl %+v value: %v", name, err)
+				return cnierrors.IO(err, "failed to read current sysctl %+v value", name)
 			}
 			// make sure value=0
 			if value != "0" {
 				if _, err = sysctl.Sysctl(name, "0"); err != nil {
 					logger.Error("failed to set sysctl value to 0 ", zap.String("name", name), zap.Error(err))
-					return fmt.Errorf("failed to read current sysctl %+v value: %v ", name, err)
+					return cnierrors.IO(err, "failed to set sysctl %+v value to 0", name)
 				}
 			}
 		}
@@ -171,7 +241,7 @@ func EnableIpv6Sysctl(logger *zap.Logger, netns ns.NetNS) error {
 }
 
 // MoveRoutes make sure that the reply packets accessing the overlay interface are still sent from the overlay interface.
-func MoveRoutes(logger *zap.Logger, netns ns.NetNS, routeMoveInterface string, currentInterfaceIPAddress []netlink.Addr, moveValue types.MoveRouteValue, ruleTable, ipFamily int) error {
+func (h *Handle) MoveRoutes(ctx context.Context, routeMoveInterface string, currentInterfaceIPAddress []netlink.Addr, moveValue types.MoveRouteValue, ruleTable, ipFamily int) error {
 	/*
 			1. if moveValue = 0, do migrate directly
 			2. if moveValue = 1, auto migrate route by interface name, if current_interface > last_interface by directory order, do migrate else nothing to do
@@ -186,18 +256,14 @@ func MoveRoutes(logger *zap.Logger, netns ns.NetNS, routeMoveInterface string, c
 
 	// make sure that traffic sent from current interface to lookup table <ruleTable>
 	// eq: ip rule add from <currentInterfaceIPAddress> lookup <ruleTable>
-	err := netns.Do(func(_ ns.NetNS) error {
-		if err := AddFromRuleTable(logger, currentInterfaceIPAddress, ruleTable); err != nil {
-			logger.Error("failed to AddFromRuleTable for currentInterfaceIPAddress", zap.Error(err))
-			return fmt.Errorf("failed to AddFromRuleTable for currentInterfaceIPAddress: %v", err)
-		}
-		// move all routes of the specified interface to a new route table
-		return moveRouteTable(logger, routeMoveInterface, ruleTable, ipFamily)
-
-	})
+	if err := h.AddFromRuleTable(ctx, currentInterfaceIPAddress, ruleTable); err != nil {
+		h.logger.Error("failed to AddFromRuleTable for currentInterfaceIPAddress", zap.Error(err))
+		return fmt.Errorf("failed to AddFromRuleTable for currentInterfaceIPAddress: %w", err)
+	}
 
-	if err != nil {
-		logger.Error("failed to moveRouteTable for routeMoveInterface", zap.String("routeMoveInterface", routeMoveInterface), zap.Error(err))
+	// move all routes of the specified interface to a new route table
+	if err := h.moveRouteTable(ctx, routeMoveInterface, ruleTable, ipFamily); err != nil {
+		h.logger.Error("failed to moveRouteTable for routeMoveInterface", zap.String("routeMoveInterface", routeMoveInterface), zap.Error(err))
 		return err
 	}
 
@@ -206,18 +272,21 @@ func MoveRoutes(logger *zap.Logger, netns ns.NetNS, routeMoveInterface string, c
 
 // moveRouteTable move all routes of the specified interface to a new route table
 // Equivalent: `ip route del <route>` and `ip r route add <route> <table>`
-func moveRouteTable(logger *zap.Logger, iface string, ruleTable, ipfamily int) error {
-	link, err := netlink.LinkByName(iface)
+func (h *Handle) moveRouteTable(ctx context.Context, iface string, ruleTable, ipfamily int) error {
+	link, err := h.LinkByName(ctx, iface)
 	if err != nil {
-		logger.Error(err.Error())
+		h.logger.Error(err.Error())
 		return err
 	}
 
-	routes, err := netlink.RouteList(nil, ipfamily)
-	if err != nil {
-		logger.Error(err.Error())
+	if err = h.begin(ctx); err != nil {
 		return err
 	}
+	routes, err := h.nl.RouteList(nil, ipfamily)
+	if err != nil {
+		h.logger.Error(err.Error())
+		return cnierrors.IO(err, "failed to list routes")
+	}
 
 	for _, route := range routes {
 
@@ -226,26 +295,29 @@ func moveRouteTable(logger *zap.Logger, iface string, ruleTable, ipfamily int) e
 			continue
 		}
 
-		// ingore local link route
-		if route.Dst.String() == "fe80::/64" {
+		// the link-local routes stay for the neighbor discovery on the interface
+		if route.Dst != nil && route.Dst.IP.IsLinkLocalUnicast() {
 			continue
 		}
 
-		logger.Debug("Found Route", zap.String("Route", route.String()))
+		h.logger.Debug("Found Route", zap.String("Route", route.String()))
 
 		if route.LinkIndex == link.Attrs().Index {
-			if err = netlink.RouteDel(&route); err != nil {
-				logger.Error("failed to RouteDel in main", zap.String("route", route.String()), zap.Error(err))
-				return fmt.Errorf("failed to RouteDel %s in main table: %+v", route.String(), err)
+			if err = h.begin(ctx); err != nil {
+				return err
 			}
-			logger.Debug("Del the route from main successfully", zap.String("Route", route.String()))
+			if err = h.nl.RouteDel(&route); err != nil {
+				h.logger.Error("failed to RouteDel in main", zap.String("route", route.String()), zap.Error(err))
+				return cnierrors.IO(err, "failed to RouteDel %s in main table", route.String())
+			}
+			h.logger.Debug("Del the route from main successfully", zap.String("Route", route.String()))
 
 			route.Table = ruleTable
-			if err = netlink.RouteAdd(&route); err != nil && os.IsExist(err) {
-				logger.Error("failed to RouteAdd in new table ", zap.String("route", route.String()), zap.Error(err))
-				return fmt.Errorf("failed to RouteAdd (%+v) to new table: %+v", route, err)
+			if err = h.nl.RouteAdd(&route); err != nil && !os.IsExist(err) {
+				h.logger.Error("failed to RouteAdd in new table ", zap.String("route", route.String()), zap.Error(err))
+				return cnierrors.IO(err, "failed to RouteAdd (%+v) to new table", route)
 			}
-			logger.Debug("MoveRoute to new table successfully", zap.String("Route", route.String()))
+			h.logger.Debug("MoveRoute to new table successfully", zap.String("Route", route.String()))
 		} else {
 			// especially for ipv6 default route
 			if len(route.MultiPath) == 0 {
@@ -255,16 +327,19 @@ func moveRouteTable(logger *zap.Logger, iface string, ruleTable, ipfamily int) e
 			// get generated default Route for new table
 			for _, v := range route.MultiPath {
 				if v.LinkIndex == link.Attrs().Index {
-					logger.Debug("Found IPv6 Default Route", zap.String("Route", route.String()))
-					if err := netlink.RouteDel(&route); err != nil {
-						logger.Error("failed to RouteDel for IPv6", zap.String("Route", route.String()), zap.Error(err))
-						return fmt.Errorf("failed to RouteDel %v for IPv6: %+v", route.String(), err)
+					h.logger.Debug("Found IPv6 Default Route", zap.String("Route", route.String()))
+					if err := h.begin(ctx); err != nil {
+						return err
+					}
+					if err := h.nl.RouteDel(&route); err != nil {
+						h.logger.Error("failed to RouteDel for IPv6", zap.String("Route", route.String()), zap.Error(err))
+						return cnierrors.IO(err, "failed to RouteDel %v for IPv6", route.String())
 					}
 
 					route.Table = ruleTable
-					if err = netlink.RouteAdd(&route); err != nil && !os.IsExist(err) {
-						logger.Error("failed to RouteAdd for IPv6 to new table", zap.String("route", route.String()), zap.Error(err))
-						return fmt.Errorf("failed to RouteAdd for IPv6 (%+v) to new table: %+v", route.String(), err)
+					if err = h.nl.RouteAdd(&route); err != nil && !os.IsExist(err) {
+						h.logger.Error("failed to RouteAdd for IPv6 to new table", zap.String("route", route.String()), zap.Error(err))
+						return cnierrors.IO(err, "failed to RouteAdd for IPv6 (%+v) to new table", route.String())
 					}
 					break
 				}
@@ -274,23 +349,33 @@ func moveRouteTable(logger *zap.Logger, iface string, ruleTable, ipfamily int) e
 	return nil
 }
 
-// SysctlRPFilter set rp_filter value
-func SysctlRPFilter(netns ns.NetNS, rp *types.RPFilter) error {
-	var err error
+// SysctlHostRPFilter set rp_filter value of the host if it's enabled, it's host-wide state
+// so the caller should serialize it with the other invocations.
+func SysctlHostRPFilter(rp *types.RPFilter) error {
 	if rp.Enable != nil && *rp.Enable {
-		if err = setRPFilter(rp.Value); err != nil {
-			return fmt.Errorf("failed to set rp_filter in host : %v", err)
+		if err := setRPFilter(rp.Value); err != nil {
+			return cnierrors.IO(err, "failed to set rp_filter in host")
 		}
 	}
-	// set pod rp_filter
-	err = netns.Do(func(_ ns.NetNS) error {
+	return nil
+}
+
+// SysctlPodRPFilter set rp_filter value of the pod
+func SysctlPodRPFilter(netns ns.NetNS, rp *types.RPFilter) error {
+	return netns.Do(func(_ ns.NetNS) error {
 		if err := setRPFilter(rp.Value); err != nil {
-			return fmt.Errorf("failed to set rp_filter in pod : %v", err)
+			return cnierrors.IO(err, "failed to set rp_filter in pod")
 		}
 		return nil
 	})
-	if err != nil {
-		return err
+}
+
+// EnableProxyARP enables proxy_arp of the given interface in the current netns, so it answers
+// the ARP requests for the addresses which aren't on it, like the link-local gateway of pods.
+func EnableProxyARP(iface string) error {
+	name := fmt.Sprintf("/net/ipv4/conf/%s/proxy_arp", iface)
+	if _, err := sysctl.Sysctl(name, "1"); err != nil {
+		return cnierrors.IO(err, "failed to set sysctl %s", name)
 	}
 	return nil
 }
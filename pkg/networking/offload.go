@@ -0,0 +1,244 @@
+package networking
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/safchain/ethtool"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// offloadStateDir keeps the features of the veth pairs before they were changed, under DefaultStateDir
+const offloadStateDir = "offload"
+
+// xdpPass is the return code of XDP to pass the packet to the stack
+const xdpPass = 2
+
+// OffloadFeatures returns the ethtool features of the offload options which are set
+func OffloadFeatures(offload *types.Offload) map[string]bool {
+	features := make(map[string]bool)
+	if offload == nil {
+		return features
+	}
+	for _, option := range []struct {
+		value *bool
+		names []string
+	}{
+		{offload.Checksum, []string{"tx-checksum-ip-generic", "rx-checksum"}},
+		{offload.TSO, []string{"tx-tcp-segmentation", "tx-tcp6-segmentation"}},
+		{offload.GSO, []string{"tx-generic-segmentation"}},
+		{offload.GRO, []string{"rx-gro"}},
+		{offload.UDPGROForwarding, []string{"rx-udp-gro-forwarding"}},
+	} {
+		if option.value == nil {
+			continue
+		}
+		for _, name := range option.names {
+			features[name] = *option.value
+		}
+	}
+	return features
+}
+
+// OffloadFeatureNames are the features logged after the offloads are changed
+var OffloadFeatureNames = []string{
+	"tx-checksum-ip-generic", "rx-checksum", "tx-tcp-segmentation", "tx-tcp6-segmentation",
+	"tx-generic-segmentation", "rx-gro", "rx-udp-gro-forwarding",
+}
+
+// SetFeatures changes the ethtool features of the link in the current netns, like `ethtool -K`.
+// It returns the values of the features before the change.
+func SetFeatures(iface string, features map[string]bool) (map[string]bool, error) {
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to open ethtool socket")
+	}
+	defer e.Close()
+
+	current, err := e.Features(iface)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get features of %s", iface)
+	}
+	previous := make(map[string]bool, len(features))
+	for name := range features {
+		value, ok := current[name]
+		if !ok {
+			return nil, cnierrors.InvalidConfig(nil, "feature %s isn't supported by %s", name, iface)
+		}
+		previous[name] = value
+	}
+
+	if len(features) != 0 {
+		// eq: ethtool -K <iface> <feature> on|off ...
+		if err = e.Change(iface, features); err != nil {
+			return nil, cnierrors.IO(err, "failed to change features of %s", iface)
+		}
+	}
+	return previous, nil
+}
+
+// GetFeatures returns the values of the ethtool features of the link in the current netns,
+// the features unknown to the link are skipped.
+func GetFeatures(iface string, names []string) (map[string]bool, error) {
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to open ethtool socket")
+	}
+	defer e.Close()
+
+	current, err := e.Features(iface)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get features of %s", iface)
+	}
+	features := make(map[string]bool, len(names))
+	for _, name := range names {
+		if value, ok := current[name]; ok {
+			features[name] = value
+		}
+	}
+	return features, nil
+}
+
+// AttachXDPPass attaches an XDP program passing every packet to the link in the current netns.
+// A veth with an XDP program receives the packets by NAPI, so they are aggregated by GRO.
+func AttachXDPPass(iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return cnierrors.IO(err, "failed to find %s", iface)
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name: "spider_xdp_pass",
+		Type: ebpf.XDP,
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, xdpPass),
+			asm.Return(),
+		},
+		License: "Apache-2.0",
+	})
+	if unsupportedXDP(err) {
+		return cnierrors.New(cnierrors.ErrUnsupportedBPF, err, "failed to load the XDP program")
+	}
+	if err != nil {
+		return cnierrors.Internal(err, "failed to load the XDP program")
+	}
+	// the link holds the program
+	defer prog.Close()
+
+	// eq: ip link set dev <iface> xdpdrv fd <prog>
+	err = netlink.LinkSetXdpFd(link, prog.FD())
+	if unsupportedXDP(err) {
+		return cnierrors.New(cnierrors.ErrUnsupportedBPF, err, "failed to attach the XDP program to %s", iface)
+	}
+	if err != nil {
+		return cnierrors.IO(err, "failed to attach the XDP program to %s", iface)
+	}
+	return nil
+}
+
+// unsupportedXDP returns whether the error is the kernel or the driver lacking XDP, the others like
+// EPERM or ENOMEM are real failures. cilium/ebpf reports a program type the kernel lacks as ErrNotSupported.
+func unsupportedXDP(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL) || errors.Is(err, ebpf.ErrNotSupported)
+}
+
+// DetachXDP detaches the XDP program from the link in the current netns
+func DetachXDP(iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return cnierrors.IO(err, "failed to find %s", iface)
+	}
+	if err = netlink.LinkSetXdpFd(link, -1); err != nil {
+		return cnierrors.IO(err, "failed to detach the XDP program from %s", iface)
+	}
+	return nil
+}
+
+// OffloadState is the features of both ends of a veth pair before they were changed,
+// it's saved on ADD to restore them on DEL.
+type OffloadState struct {
+	Host map[string]bool `json:"host"`
+	Pod  map[string]bool `json:"pod"`
+	// XDP is whether the XDP programs were attached
+	XDP bool `json:"xdp"`
+}
+
+// SaveOffloadState saves the state of the container, the first one saved is kept,
+// so the features are restored to the ones before the pod.
+func SaveOffloadState(stateDir, containerID string, state *OffloadState) error {
+	path := filepath.Join(stateDir, offloadStateDir, containerID+".json")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return cnierrors.IO(err, "failed to create state directory %s", filepath.Dir(path))
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return cnierrors.Internal(err, "failed to encode offload state")
+	}
+
+	// write to a temporary file and rename, so a crash never leaves a partial state
+	if err = os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return cnierrors.IO(err, "failed to write offload state")
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return cnierrors.IO(err, "failed to write offload state")
+	}
+	return nil
+}
+
+// RestoreOffload restores the features saved for the container on the ends of the veth pair which
+// still exist, the pod end is skipped if netns is nil. The state is removed afterwards.
+func RestoreOffload(stateDir, containerID, hostVeth, podVeth string, netns ns.NetNS) error {
+	path := filepath.Join(stateDir, offloadStateDir, containerID+".json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return cnierrors.IO(err, "failed to read offload state")
+	}
+	state := &OffloadState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return cnierrors.DecodingFailure(err, "failed to decode offload state")
+	}
+
+	restore := func(iface string, features map[string]bool) error {
+		if _, err := netlink.LinkByName(iface); err != nil {
+			// it's gone with the pod
+			return nil
+		}
+		if _, err := SetFeatures(iface, features); err != nil {
+			return err
+		}
+		if state.XDP {
+			return DetachXDP(iface)
+		}
+		return nil
+	}
+	if err = restore(hostVeth, state.Host); err != nil {
+		return err
+	}
+	if netns != nil {
+		err = netns.Do(func(ns.NetNS) error {
+			return restore(podVeth, state.Pod)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return cnierrors.IO(err, "failed to remove offload state")
+	}
+	return nil
+}
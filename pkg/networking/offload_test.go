@@ -0,0 +1,124 @@
+package networking
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/utils/pointer"
+)
+
+var _ = Describe("offload", func() {
+	var podNS, hostNS ns.NetNS
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		podNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		hostNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func() {
+			closeTestNS(podNS)
+			closeTestNS(hostNS)
+		})
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			_, _, err := ip.SetupVethWithName("veth0", "veth12345678901", 1500, "", hostNS)
+			return err
+		})).To(Succeed())
+	})
+
+	It("map the options to the features", func() {
+		Expect(OffloadFeatures(nil)).To(BeEmpty())
+		Expect(OffloadFeatures(&types.Offload{Checksum: pointer.Bool(true), GRO: pointer.Bool(false)})).To(Equal(map[string]bool{
+			"tx-checksum-ip-generic": true,
+			"rx-checksum":            true,
+			"rx-gro":                 false,
+		}))
+	})
+
+	It("classify only the errors of lacking XDP as unsupported", func() {
+		Expect(unsupportedXDP(fmt.Errorf("attach: %w", unix.EOPNOTSUPP))).To(BeTrue())
+		Expect(unsupportedXDP(unix.EINVAL)).To(BeTrue())
+		Expect(unsupportedXDP(fmt.Errorf("load: %w", ebpf.ErrNotSupported))).To(BeTrue())
+		Expect(unsupportedXDP(unix.EPERM)).To(BeFalse())
+		Expect(unsupportedXDP(unix.ENOMEM)).To(BeFalse())
+		Expect(unsupportedXDP(nil)).To(BeFalse())
+	})
+
+	It("change the features and restore them", func() {
+		stateDir := GinkgoT().TempDir()
+		features := OffloadFeatures(&types.Offload{Checksum: pointer.Bool(false), GRO: pointer.Bool(true)})
+
+		state := &OffloadState{}
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			var err error
+			state.Host, err = SetFeatures("veth12345678901", features)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Host).To(HaveKeyWithValue("rx-gro", false))
+			Expect(state.Host).To(HaveKeyWithValue("tx-checksum-ip-generic", true))
+
+			current, err := GetFeatures("veth12345678901", append(OffloadFeatureNames, "unknown"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(current).To(HaveKeyWithValue("rx-gro", true))
+			Expect(current).To(HaveKeyWithValue("tx-checksum-ip-generic", false))
+			// the kernel turns off TSO without the checksum offload
+			Expect(current).To(HaveKeyWithValue("tx-tcp-segmentation", false))
+			Expect(current).NotTo(HaveKey("unknown"))
+
+			_, err = SetFeatures("veth12345678901", map[string]bool{"unknown": true})
+			Expect(err).To(HaveOccurred())
+			return nil
+		})).To(Succeed())
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			var err error
+			state.Pod, err = SetFeatures("veth0", features)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(AttachXDPPass("veth0")).To(Succeed())
+			state.XDP = true
+			link, err := netlink.LinkByName("veth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Xdp.Attached).To(BeTrue())
+			return nil
+		})).To(Succeed())
+
+		Expect(SaveOffloadState(stateDir, "00000000000", state)).To(Succeed())
+		// the first state is kept
+		Expect(SaveOffloadState(stateDir, "00000000000", &OffloadState{})).To(Succeed())
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			return RestoreOffload(stateDir, "00000000000", "veth12345678901", "veth0", podNS)
+		})).To(Succeed())
+		for netns, iface := range map[ns.NetNS]string{hostNS: "veth12345678901", podNS: "veth0"} {
+			Expect(netns.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				current, err := GetFeatures(iface, OffloadFeatureNames)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(current).To(HaveKeyWithValue("rx-gro", false))
+				Expect(current).To(HaveKeyWithValue("tx-checksum-ip-generic", true))
+				link, err := netlink.LinkByName(iface)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Xdp == nil || !link.Attrs().Xdp.Attached).To(BeTrue())
+				return nil
+			})).To(Succeed())
+		}
+
+		// nothing left to restore
+		Expect(RestoreOffload(stateDir, "00000000000", "veth12345678901", "veth0", nil)).To(Succeed())
+	})
+})
@@ -0,0 +1,731 @@
+package networking
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// redirectFilterPrefix is the prefix of the names of the tc filters of the plugin
+	redirectFilterPrefix = "spider-veth:"
+	// toPodFilter is the name of the filter on the ingress of a node device, it's shared by all pods
+	toPodFilter = redirectFilterPrefix + "to-pod"
+	// toHostFilter is the name of the filter on the ingress of the host veth of a pod
+	toHostFilter = redirectFilterPrefix + "to-host"
+	// redirectPriority is the priority of the tc filters
+	redirectPriority = 0xa000
+
+	// the offsets of the fields of struct __sk_buff
+	skbPktType = 4
+	skbProto   = 16
+	skbData    = 76
+	skbDataEnd = 80
+
+	// the return code of tc to continue with the next filter
+	tcActUnspec = -1
+
+	// podMapMaxEntries is the number of the pod addresses a node device redirects
+	podMapMaxEntries = 16384
+	// the key of the pod map is the address, an IPv4 one is mapped to IPv6 as ::ffff:a.b.c.d
+	podKeySize = 16
+	// the value of the pod map, the first fields are read by the program:
+	//   ifindex  u32, the host veth
+	//   flags    u32, podFlagPeer to redirect by bpf_redirect_peer
+	//   pod_mac  [6], the destination of the packets redirected by bpf_redirect_peer
+	//   host_mac [6], their source
+	//   host_veth, interface [16], the owner of the entry
+	podValueSize = 52
+	podFlagPeer  = 1
+)
+
+// The helpers redirecting the packets into the pod
+const (
+	RedirectHelperPeer  = "bpf_redirect_peer"
+	RedirectHelperNeigh = "bpf_redirect_neigh"
+)
+
+// nativeEndian is the byte order of the words loaded from the packets and the context
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	v := uint16(1)
+	if *(*byte)(unsafe.Pointer(&v)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// PodRedirect redirects the packets between the node and a chained interface of the pod, skipping the routing
+// and the netfilter of the node on the way to the pod. The packets the node routes to the addresses of the
+// chained interface are redirected by the program on the ingress of the node devices, which is shared by all
+// pods and looks the destination up in its map, straight into veth0 by bpf_redirect_peer, or onto HostVeth by
+// bpf_redirect_neigh if the kernel or the device doesn't allow the former. The packets from veth0 to NodeIPs
+// are redirected by the program on the ingress of HostVeth into the ingress of the device holding the address,
+// as if they were received by it.
+type PodRedirect struct {
+	// HostVeth is the host peer of veth0
+	HostVeth string
+	// Interface is the chained interface owning the IPs
+	Interface string
+	IPs       []net.IP
+	// PodMAC is the hardware address of veth0, the destination of the packets redirected by bpf_redirect_peer
+	PodMAC net.HardwareAddr
+	// NodeIPs are the addresses of the node the pod reaches through the devices, none skips the direction
+	NodeIPs []net.IP
+}
+
+// SetupPodRedirect adds the addresses of the pod to the maps of the programs on the ingress of the devices,
+// attaching the program to a device at the first time, and replaces the addresses added for the same chained
+// interface before. It attaches the program redirecting the packets to NodeIPs to the host veth.
+// It returns the helper used on each device, or cnierrors.ErrUnsupportedBPF if the kernel lacks both helpers.
+func SetupPodRedirect(r *PodRedirect, devices []string) (map[string]string, error) {
+	peer, neigh, err := probeRedirectHelpers()
+	if err != nil {
+		return nil, err
+	}
+
+	hostVeth, err := netlink.LinkByName(r.HostVeth)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to find host veth %s", r.HostVeth)
+	}
+
+	helpers, err := attachPodRedirect(r, hostVeth, peer, neigh, devices)
+	if err == nil {
+		err = attachHostRedirect(r, hostVeth, devices)
+	}
+	if err != nil {
+		// don't leave the pod redirected on part of the devices
+		_ = deletePodEntries(func(owner, iface string) bool { return owner == r.HostVeth && iface == r.Interface })
+		return nil, err
+	}
+	return helpers, nil
+}
+
+func attachPodRedirect(r *PodRedirect, hostVeth netlink.Link, peer, neigh bool, devices []string) (map[string]string, error) {
+	helpers := make(map[string]string, len(devices))
+	for _, device := range devices {
+		link, err := netlink.LinkByName(device)
+		if err != nil {
+			return helpers, cnierrors.IO(err, "failed to find device %s", device)
+		}
+
+		// bpf_redirect_peer keeps the L2 header, it's rewritten to the one of veth0,
+		// the packets of the devices without L2 header go through the neighbor of the host veth
+		l2 := len(link.Attrs().HardwareAddr) == 6
+		helper := RedirectHelperNeigh
+		if peer && l2 && len(r.PodMAC) == 6 {
+			helper = RedirectHelperPeer
+		} else if !neigh {
+			return helpers, cnierrors.New(cnierrors.ErrUnsupportedBPF, nil, "bpf_redirect_neigh isn't supported by the kernel, the packets of %s can't be redirected", device)
+		}
+
+		podMap, err := devicePodMap(link, l2, peer, neigh)
+		if err != nil {
+			return helpers, err
+		}
+		err = updatePodEntries(podMap, r, hostVeth, helper)
+		podMap.Close()
+		if err != nil {
+			return helpers, cnierrors.IO(err, "failed to update the pod addresses of %s", device)
+		}
+		helpers[device] = helper
+	}
+	return helpers, nil
+}
+
+// devicePodMap returns the map of the program on the ingress of the link, the program is attached at the first time
+func devicePodMap(link netlink.Link, l2, peer, neigh bool) (*ebpf.Map, error) {
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+	if err == nil {
+		for _, filter := range filters {
+			if bpf, ok := filter.(*netlink.BpfFilter); ok && bpf.Name == toPodFilter {
+				return filterMap(bpf)
+			}
+		}
+	}
+
+	podMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "spider_pods",
+		Type:       ebpf.Hash,
+		KeySize:    podKeySize,
+		ValueSize:  podValueSize,
+		MaxEntries: podMapMaxEntries,
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	})
+	if err != nil {
+		return nil, cnierrors.Internal(err, "failed to create the pod map of %s", link.Attrs().Name)
+	}
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "spider_to_pod",
+		Type:         ebpf.SchedCLS,
+		License:      "Apache-2.0",
+		Instructions: toPodInstructions(podMap.FD(), l2, peer, neigh),
+	})
+	if err != nil {
+		podMap.Close()
+		return nil, cnierrors.Internal(err, "failed to load the redirect program of %s", link.Attrs().Name)
+	}
+	err = attachIngress(link, prog, toPodFilter)
+	// the filter holds the program, which holds the map
+	prog.Close()
+	if err != nil {
+		podMap.Close()
+		return nil, err
+	}
+	return podMap, nil
+}
+
+// filterMap returns the map of the program of the filter
+func filterMap(filter *netlink.BpfFilter) (*ebpf.Map, error) {
+	prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(filter.Id))
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get the program of filter %s", filter.Name)
+	}
+	defer prog.Close()
+	info, err := prog.Info()
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get the info of the program of filter %s", filter.Name)
+	}
+	ids, ok := info.MapIDs()
+	if !ok || len(ids) != 1 {
+		return nil, cnierrors.Internal(nil, "the program of filter %s has no pod map", filter.Name)
+	}
+	podMap, err := ebpf.NewMapFromID(ids[0])
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to get the map of filter %s", filter.Name)
+	}
+	return podMap, nil
+}
+
+// updatePodEntries replaces the entries of the chained interface with the addresses of the pod
+func updatePodEntries(podMap *ebpf.Map, r *PodRedirect, hostVeth netlink.Link, helper string) error {
+	keep := make(map[string]bool, len(r.IPs))
+	for _, ip := range r.IPs {
+		keep[string(podKey(ip))] = true
+	}
+	err := deleteMapEntries(podMap, func(key []byte, owner, iface string) bool {
+		return owner == r.HostVeth && iface == r.Interface && !keep[string(key)]
+	})
+	if err != nil {
+		return err
+	}
+
+	value := make([]byte, podValueSize)
+	nativeEndian.PutUint32(value[0:], uint32(hostVeth.Attrs().Index))
+	if helper == RedirectHelperPeer {
+		nativeEndian.PutUint32(value[4:], podFlagPeer)
+		copy(value[8:14], r.PodMAC)
+		copy(value[14:20], hostVeth.Attrs().HardwareAddr)
+	}
+	copy(value[20:36], r.HostVeth)
+	copy(value[36:52], r.Interface)
+	for _, ip := range r.IPs {
+		if err = podMap.Update(podKey(ip), value, ebpf.UpdateAny); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMapEntries deletes the entries of the pod map whose key and owner match
+func deleteMapEntries(podMap *ebpf.Map, match func(key []byte, owner, iface string) bool) error {
+	var keys [][]byte
+	key, value := make([]byte, podKeySize), make([]byte, podValueSize)
+	iter := podMap.Iterate()
+	for iter.Next(&key, &value) {
+		if match(key, cString(value[20:36]), cString(value[36:52])) {
+			keys = append(keys, append([]byte{}, key...))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := podMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// podKey returns the key of the address in the pod map
+func podKey(ip net.IP) []byte {
+	return append([]byte{}, ip.To16()...)
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// attachHostRedirect attaches the program redirecting the packets from veth0 to the node addresses on the devices
+// to the host veth, replacing the one before. The packets to the devices without L2 header keep the normal path,
+// as well as the IPv4 ones of the devices with strict rp_filter, which would drop them for the source of the pod
+// isn't routed via the device.
+func attachHostRedirect(r *PodRedirect, hostVeth netlink.Link, devices []string) error {
+	if err := deleteHostRedirect(hostVeth); err != nil {
+		return err
+	}
+
+	var targets []redirectTarget
+	for _, device := range devices {
+		link, err := netlink.LinkByName(device)
+		if err != nil {
+			return cnierrors.IO(err, "failed to find device %s", device)
+		}
+		if len(link.Attrs().HardwareAddr) != 6 {
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return cnierrors.IO(err, "failed to list addresses of %s", device)
+		}
+		strict := strictRPFilter(device)
+		for _, addr := range addrs {
+			if !containsIP(r.NodeIPs, addr.IP) || (strict && addr.IP.To4() != nil) {
+				continue
+			}
+			targets = append(targets, redirectTarget{ip: addr.IP, index: link.Attrs().Index, mac: link.Attrs().HardwareAddr})
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "spider_to_host",
+		Type:         ebpf.SchedCLS,
+		License:      "Apache-2.0",
+		Instructions: toHostInstructions(targets),
+	})
+	if err != nil {
+		return cnierrors.Internal(err, "failed to load the redirect program of %s", r.HostVeth)
+	}
+	defer prog.Close()
+	return attachIngress(hostVeth, prog, toHostFilter)
+}
+
+// redirectTarget is a node address and the device holding it
+type redirectTarget struct {
+	ip    net.IP
+	index int
+	mac   net.HardwareAddr
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// strictRPFilter returns whether the IPv4 rp_filter of the device is strict, the max of all and the device wins
+func strictRPFilter(device string) bool {
+	value := 0
+	for _, conf := range []string{"all", device} {
+		v, err := sysctl.Sysctl(fmt.Sprintf("/net/ipv4/conf/%s/rp_filter", conf))
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n > value {
+			value = n
+		}
+	}
+	return value == 1
+}
+
+// TeardownPodRedirect deletes the addresses of the pod from the maps of all devices of the node, and the program
+// of the host veth. The program of a device is detached when its map is empty.
+func TeardownPodRedirect(hostVeth string) error {
+	if link, err := netlink.LinkByName(hostVeth); err == nil {
+		if err = deleteHostRedirect(link); err != nil {
+			return err
+		}
+	}
+	if err := deletePodEntries(func(owner, _ string) bool { return owner == hostVeth }); err != nil {
+		return err
+	}
+	// the filters of a pod on each device before the programs are shared
+	prefix := redirectFilterPrefix + hostVeth + ":"
+	return deleteRedirectFilters(func(filter string) bool { return strings.HasPrefix(filter, prefix) })
+}
+
+// deletePodEntries deletes the entries whose owner matches from the maps of all devices
+func deletePodEntries(match func(owner, iface string) bool) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return cnierrors.IO(err, "failed to list links")
+	}
+	for _, link := range links {
+		// the links without clsact have no filter
+		filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+		if err != nil {
+			continue
+		}
+		for _, filter := range filters {
+			bpf, ok := filter.(*netlink.BpfFilter)
+			if !ok || bpf.Name != toPodFilter {
+				continue
+			}
+			if err = deleteDeviceEntries(link, bpf, match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deleteDeviceEntries(link netlink.Link, filter *netlink.BpfFilter, match func(owner, iface string) bool) error {
+	podMap, err := filterMap(filter)
+	if err != nil {
+		return err
+	}
+	defer podMap.Close()
+
+	err = deleteMapEntries(podMap, func(_ []byte, owner, iface string) bool { return match(owner, iface) })
+	if err != nil {
+		return cnierrors.IO(err, "failed to delete the pod addresses of %s", link.Attrs().Name)
+	}
+
+	// the packets of the device don't run the program for nothing
+	if key, err := podMap.NextKeyBytes(nil); err != nil || key != nil {
+		return nil
+	}
+	if err = netlink.FilterDel(filter); err != nil && !errors.Is(err, unix.ENOENT) {
+		return cnierrors.IO(err, "failed to detach %s from %s", filter.Name, link.Attrs().Name)
+	}
+	return nil
+}
+
+func deleteHostRedirect(hostVeth netlink.Link) error {
+	filters, err := netlink.FilterList(hostVeth, netlink.HANDLE_MIN_INGRESS)
+	if err != nil {
+		return nil
+	}
+	for _, filter := range filters {
+		if bpf, ok := filter.(*netlink.BpfFilter); ok && bpf.Name == toHostFilter {
+			if err = netlink.FilterDel(bpf); err != nil && !errors.Is(err, unix.ENOENT) {
+				return cnierrors.IO(err, "failed to detach %s from %s", bpf.Name, hostVeth.Attrs().Name)
+			}
+		}
+	}
+	return nil
+}
+
+// probeRedirectHelpers returns whether bpf_redirect_peer and bpf_redirect_neigh are supported by the kernel
+func probeRedirectHelpers() (peer, neigh bool, err error) {
+	if err = features.HaveProgramType(ebpf.SchedCLS); err != nil {
+		return false, false, cnierrors.New(cnierrors.ErrUnsupportedBPF, err, "tc programs aren't supported by the kernel")
+	}
+	for helper, supported := range map[asm.BuiltinFunc]*bool{asm.FnRedirectPeer: &peer, asm.FnRedirectNeigh: &neigh} {
+		err = features.HaveProgramHelper(ebpf.SchedCLS, helper)
+		switch {
+		case err == nil:
+			*supported = true
+		case !errors.Is(err, ebpf.ErrNotSupported):
+			return false, false, cnierrors.Internal(err, "failed to probe %s", helper)
+		}
+	}
+	if !peer && !neigh {
+		return false, false, cnierrors.New(cnierrors.ErrUnsupportedBPF, nil, "bpf_redirect_peer and bpf_redirect_neigh aren't supported by the kernel")
+	}
+	return peer, neigh, nil
+}
+
+// toPodInstructions builds the program looking the destination up in the pod map of fd and redirecting the packets
+// of the found ones through their host veth, l2 is whether the packets have the ethernet header. A helper the
+// kernel lacks isn't called. The other packets continue with the next filter.
+func toPodInstructions(fd int, l2 bool, peer, neigh bool) asm.Instructions {
+	l2Len := l2Length(l2)
+	insns := ipHeaderInstructions(l2)
+
+	// the key is the destination on the stack, ipv4 is mapped to ipv6
+	insns = append(insns, checkedHeader("ipv4", l2Len+20)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R5, asm.R2, l2Len+16, asm.Word),
+		asm.StoreImm(asm.RFP, -16, 0, asm.Word),
+		asm.StoreImm(asm.RFP, -12, 0, asm.Word),
+		asm.StoreImm(asm.RFP, -8, int64(word([]byte{0, 0, 0xff, 0xff})), asm.Word),
+		asm.StoreMem(asm.RFP, -4, asm.R5, asm.Word),
+		asm.Ja.Label("lookup"),
+	)
+	insns = append(insns, checkedHeader("ipv6", l2Len+40)...)
+	for i := int16(0); i < 4; i++ {
+		insns = append(insns,
+			asm.LoadMem(asm.R5, asm.R2, l2Len+24+i*4, asm.Word),
+			asm.StoreMem(asm.RFP, -16+i*4, asm.R5, asm.Word),
+		)
+	}
+
+	insns = append(insns,
+		asm.LoadMapPtr(asm.R1, fd).WithSymbol("lookup"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -16),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+		asm.Mov.Reg(asm.R7, asm.R0),
+	)
+	if peer {
+		next := "pass"
+		if neigh {
+			next = "neigh"
+		}
+		// eq: the destination is the mac of veth0 and the source is the one of the host veth
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R7, 4, asm.Word),
+			asm.JNE.Imm(asm.R2, podFlagPeer, next),
+			asm.Mov.Reg(asm.R1, asm.R6),
+			asm.Mov.Imm(asm.R2, 0),
+			asm.Mov.Reg(asm.R3, asm.R7),
+			asm.Add.Imm(asm.R3, 8),
+			asm.Mov.Imm(asm.R4, 12),
+			asm.Mov.Imm(asm.R5, 0),
+			asm.FnSkbStoreBytes.Call(),
+			asm.JNE.Imm(asm.R0, 0, "pass"),
+			asm.LoadMem(asm.R1, asm.R7, 0, asm.Word),
+			asm.Mov.Imm(asm.R2, 0),
+			asm.FnRedirectPeer.Call(),
+			asm.Return(),
+		)
+	}
+	if neigh {
+		// the neighbor of the destination on the host veth fills the L2 header
+		insns = append(insns,
+			asm.LoadMem(asm.R1, asm.R7, 0, asm.Word).WithSymbol("neigh"),
+			asm.Mov.Imm(asm.R2, 0),
+			asm.Mov.Imm(asm.R3, 0),
+			asm.Mov.Imm(asm.R4, 0),
+			asm.FnRedirectNeigh.Call(),
+			asm.Return(),
+		)
+	}
+
+	return append(insns,
+		asm.Mov.Imm(asm.R0, tcActUnspec).WithSymbol("pass"),
+		asm.Return(),
+	)
+}
+
+// toHostInstructions builds the program redirecting the packets to the addresses of the targets into the ingress
+// of their devices, with the destination mac rewritten to the one of the device. The other packets continue with
+// the next filter.
+func toHostInstructions(targets []redirectTarget) asm.Instructions {
+	insns := ipHeaderInstructions(true)
+
+	var v4, v6 []net.IP
+	var v4Labels, v6Labels []string
+	for idx, target := range targets {
+		if target.ip.To4() != nil {
+			v4 = append(v4, target.ip)
+			v4Labels = append(v4Labels, fmt.Sprintf("target_%d", idx))
+		} else {
+			v6 = append(v6, target.ip)
+			v6Labels = append(v6Labels, fmt.Sprintf("target_%d", idx))
+		}
+	}
+	insns = append(insns, matchDestination(true, v4, v4Labels, v6, v6Labels)...)
+
+	for idx, target := range targets {
+		addr := append(append([]byte{}, target.mac...), 0, 0)
+		insns = append(insns,
+			asm.StoreImm(asm.RFP, -8, int64(word(addr[0:])), asm.Word).WithSymbol(fmt.Sprintf("target_%d", idx)),
+			asm.StoreImm(asm.RFP, -4, int64(word(addr[4:])), asm.Word),
+			asm.Mov.Reg(asm.R1, asm.R6),
+			asm.Mov.Imm(asm.R2, 0),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, -8),
+			asm.Mov.Imm(asm.R4, 6),
+			asm.Mov.Imm(asm.R5, 0),
+			asm.FnSkbStoreBytes.Call(),
+			asm.JNE.Imm(asm.R0, 0, "pass"),
+			asm.Mov.Imm(asm.R1, int32(target.index)),
+			asm.Mov.Imm(asm.R2, unix.BPF_F_INGRESS),
+			asm.FnRedirect.Call(),
+			asm.Return(),
+		)
+	}
+
+	return append(insns,
+		asm.Mov.Imm(asm.R0, tcActUnspec).WithSymbol("pass"),
+		asm.Return(),
+	)
+}
+
+func l2Length(l2 bool) int16 {
+	if l2 {
+		return 14
+	}
+	return 0
+}
+
+// ipHeaderInstructions saves the context in R6, and jumps to ipv4 or ipv6 by the protocol of the packet
+func ipHeaderInstructions(l2 bool) asm.Instructions {
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+	}
+	if l2 {
+		// the packets to other hosts, like the ones of macvlan, are not touched
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R6, skbPktType, asm.Word),
+			asm.JNE.Imm(asm.R2, unix.PACKET_HOST, "pass"),
+		)
+	}
+	return append(insns,
+		asm.LoadMem(asm.R2, asm.R6, skbProto, asm.Word),
+		asm.JEq.Imm(asm.R2, int32(htons(unix.ETH_P_IP)), "ipv4"),
+		asm.JEq.Imm(asm.R2, int32(htons(unix.ETH_P_IPV6)), "ipv6"),
+		asm.Ja.Label("pass"),
+	)
+}
+
+// matchDestination jumps to the label of the address the destination equals, or to pass
+func matchDestination(l2 bool, v4 []net.IP, v4Labels []string, v6 []net.IP, v6Labels []string) asm.Instructions {
+	l2Len := l2Length(l2)
+
+	// the destination of ipv4 is at offset 16 of the header
+	insns := checkedHeader("ipv4", l2Len+20)
+	insns = append(insns, asm.LoadMem(asm.R5, asm.R2, l2Len+16, asm.Word))
+	for idx, ip := range v4 {
+		insns = append(insns, asm.JEq.Imm32(asm.R5, word(ip.To4()), v4Labels[idx]))
+	}
+	insns = append(insns, asm.Ja.Label("pass"))
+
+	// the destination of ipv6 is at offset 24 of the header, it's compared word by word
+	insns = append(insns, checkedHeader("ipv6", l2Len+40)...)
+	regs := []asm.Register{asm.R5, asm.R7, asm.R8, asm.R9}
+	for i, reg := range regs {
+		insns = append(insns, asm.LoadMem(reg, asm.R2, l2Len+24+int16(i)*4, asm.Word))
+	}
+	for idx, ip := range v6 {
+		ip = ip.To16()
+		for i, reg := range regs {
+			var insn asm.Instruction
+			if i == len(regs)-1 {
+				insn = asm.JEq.Imm32(reg, word(ip[i*4:]), v6Labels[idx])
+			} else {
+				insn = asm.JNE.Imm32(reg, word(ip[i*4:]), fmt.Sprintf("ipv6_%d", idx+1))
+			}
+			if i == 0 {
+				insn = insn.WithSymbol(fmt.Sprintf("ipv6_%d", idx))
+			}
+			insns = append(insns, insn)
+		}
+	}
+	return append(insns, asm.Ja.Label("pass").WithSymbol(fmt.Sprintf("ipv6_%d", len(v6))))
+}
+
+// checkedHeader loads the start of the packet into R2 and continues with the next filter
+// if the packet is shorter than size.
+func checkedHeader(symbol string, size int16) asm.Instructions {
+	return asm.Instructions{
+		asm.LoadMem(asm.R2, asm.R6, skbData, asm.Word).WithSymbol(symbol),
+		asm.LoadMem(asm.R3, asm.R6, skbDataEnd, asm.Word),
+		asm.Mov.Reg(asm.R4, asm.R2),
+		asm.Add.Imm(asm.R4, int32(size)),
+		asm.JGT.Reg(asm.R4, asm.R3, "pass"),
+	}
+}
+
+// word returns the first 4 bytes as the value loaded by the program
+func word(b []byte) int32 {
+	return int32(nativeEndian.Uint32(b[:4]))
+}
+
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return nativeEndian.Uint16(b)
+}
+
+// ensureClsact adds the clsact qdisc to the link if it has none, the filters of others on it are kept
+func ensureClsact(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return cnierrors.IO(err, "failed to list qdiscs of %s", link.Attrs().Name)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			return nil
+		}
+	}
+
+	// eq: tc qdisc add dev <link> clsact
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err = netlink.QdiscAdd(qdisc); err != nil && !errors.Is(err, unix.EEXIST) {
+		return cnierrors.IO(err, "failed to add clsact qdisc to %s", link.Attrs().Name)
+	}
+	return nil
+}
+
+// attachIngress attaches the program to the ingress of the link by a tc filter of the name
+func attachIngress(link netlink.Link, prog *ebpf.Program, name string) error {
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+
+	// eq: tc filter add dev <link> ingress prio <priority> bpf direct-action fd <prog> name <name>
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  redirectPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           prog.FD(),
+		Name:         name,
+		DirectAction: true,
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return cnierrors.IO(err, "failed to attach %s to %s", name, link.Attrs().Name)
+	}
+	return nil
+}
+
+// deleteRedirectFilters deletes the redirect filters whose name matches on the ingress of all links
+func deleteRedirectFilters(match func(name string) bool) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return cnierrors.IO(err, "failed to list links")
+	}
+	for _, link := range links {
+		// the links without clsact have no filter
+		filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+		if err != nil {
+			continue
+		}
+		for _, filter := range filters {
+			bpf, ok := filter.(*netlink.BpfFilter)
+			if !ok || !strings.HasPrefix(bpf.Name, redirectFilterPrefix) || !match(bpf.Name) {
+				continue
+			}
+			if err = netlink.FilterDel(bpf); err != nil && !errors.Is(err, unix.ENOENT) {
+				return cnierrors.IO(err, "failed to detach %s from %s", bpf.Name, link.Attrs().Name)
+			}
+		}
+	}
+	return nil
+}
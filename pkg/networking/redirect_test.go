@@ -0,0 +1,270 @@
+package networking
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var _ = Describe("pod redirect", func() {
+	var clientNS, hostNS, podNS ns.NetNS
+	var podMAC net.HardwareAddr
+	var conn net.PacketConn
+
+	addAddr := func(name, addr string) {
+		link, err := netlink.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		ipNet, err := netlink.ParseIPNet(addr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet})).To(Succeed())
+		Expect(netlink.LinkSetUp(link)).To(Succeed())
+	}
+
+	addRoute := func(name, dst string, gw net.IP) {
+		link, err := netlink.LinkByName(name)
+		Expect(err).NotTo(HaveOccurred())
+		_, ipNet, err := net.ParseCIDR(dst)
+		Expect(err).NotTo(HaveOccurred())
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: ipNet, Gw: gw}
+		if gw == nil {
+			route.Scope = netlink.SCOPE_LINK
+		}
+		Expect(netlink.RouteAdd(route)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("requires root to create network namespaces")
+		}
+
+		var err error
+		for _, netns := range []*ns.NetNS{&clientNS, &hostNS, &podNS} {
+			*netns, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		DeferCleanup(func() {
+			if conn != nil {
+				conn.Close()
+			}
+			for _, netns := range []ns.NetNS{clientNS, hostNS, podNS} {
+				closeTestNS(netns)
+			}
+		})
+
+		// the client reaches the pod via node0 of the host, whose forwarding is disabled,
+		// so the packets only reach the pod if they are redirected
+		Expect(clientNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := ip.SetupVethWithName("eth0", "node0", 1500, "", hostNS)
+			Expect(err).NotTo(HaveOccurred())
+			addAddr("eth0", "10.9.0.2/24")
+			addRoute("eth0", "10.6.1.0/24", net.ParseIP("10.9.0.1"))
+			return nil
+		})).To(Succeed())
+
+		Expect(podNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, contVeth, err := ip.SetupVethWithName("veth0", "veth12345678901", 1500, "", hostNS)
+			Expect(err).NotTo(HaveOccurred())
+			podMAC = contVeth.HardwareAddr
+			addAddr("veth0", "10.6.1.10/32")
+			addRoute("veth0", "10.9.0.0/24", nil)
+
+			conn, err = net.ListenPacket("udp4", "10.6.1.10:9000")
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})).To(Succeed())
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			addAddr("node0", "10.9.0.1/24")
+			link, err := netlink.LinkByName("veth12345678901")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			addRoute("veth12345678901", "10.6.1.10/32", nil)
+			return nil
+		})).To(Succeed())
+	})
+
+	// received sends a packet from the client to the pod and returns whether the pod receives it
+	received := func() bool {
+		Expect(clientNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			c, err := net.Dial("udp4", "10.6.1.10:9000")
+			Expect(err).NotTo(HaveOccurred())
+			defer c.Close()
+			_, err = c.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})).To(Succeed())
+
+		Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		buf := make([]byte, 16)
+		_, _, err := conn.ReadFrom(buf)
+		return err == nil
+	}
+
+	redirect := func(r *PodRedirect) map[string]string {
+		var helpers map[string]string
+		err := hostNS.Do(func(ns.NetNS) error {
+			var err error
+			helpers, err = SetupPodRedirect(r, []string{"node0"})
+			return err
+		})
+		if cnierrors.Code(err) == cnierrors.ErrUnsupportedBPF {
+			Skip("the redirect helpers aren't supported by the kernel")
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return helpers
+	}
+
+	filtersOf := func(device string) []string {
+		var names []string
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(device)
+			if err != nil {
+				return err
+			}
+			list, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+			if err != nil {
+				return err
+			}
+			for _, filter := range list {
+				if bpf, ok := filter.(*netlink.BpfFilter); ok {
+					names = append(names, bpf.Name)
+				}
+			}
+			return nil
+		})).To(Succeed())
+		return names
+	}
+	filters := func() []string { return filtersOf("node0") }
+	hostFilters := func() []string { return filtersOf("veth12345678901") }
+
+	// podKeys returns the addresses in the pod map of node0
+	podKeys := func() []string {
+		var ips []string
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName("node0")
+			Expect(err).NotTo(HaveOccurred())
+			list, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(list).To(HaveLen(1))
+			podMap, err := filterMap(list[0].(*netlink.BpfFilter))
+			Expect(err).NotTo(HaveOccurred())
+			defer podMap.Close()
+
+			var key, value []byte
+			iter := podMap.Iterate()
+			for iter.Next(&key, &value) {
+				ips = append(ips, net.IP(key).String())
+			}
+			return iter.Err()
+		})).To(Succeed())
+		return ips
+	}
+
+	DescribeTable("redirect the packets routed to the pod and detach the program",
+		func(withMAC bool, helper string) {
+			Expect(received()).To(BeFalse())
+
+			r := &PodRedirect{
+				HostVeth:  "veth12345678901",
+				Interface: "net1",
+				// it isn't redirected
+				IPs: []net.IP{net.ParseIP("10.6.1.11"), net.ParseIP("fd00::10")},
+			}
+			if withMAC {
+				r.PodMAC = podMAC
+			}
+			redirect(r)
+			Expect(received()).To(BeFalse())
+
+			// the addresses of the interface are replaced
+			r.IPs = []net.IP{net.ParseIP("10.6.1.10")}
+			Expect(redirect(r)).To(Equal(map[string]string{"node0": helper}))
+			Expect(received()).To(BeTrue())
+			Expect(podKeys()).To(ConsistOf("10.6.1.10"))
+
+			// the other interfaces share the program of the device
+			redirect(&PodRedirect{HostVeth: "veth12345678901", Interface: "net2", IPs: []net.IP{net.ParseIP("10.6.1.12")}, PodMAC: r.PodMAC})
+			Expect(filters()).To(Equal([]string{"spider-veth:to-pod"}))
+			Expect(podKeys()).To(ConsistOf("10.6.1.10", "10.6.1.12"))
+
+			Expect(hostNS.Do(func(ns.NetNS) error {
+				return TeardownPodRedirect("veth12345678901")
+			})).To(Succeed())
+			Expect(filters()).To(BeEmpty())
+			Expect(received()).To(BeFalse())
+		},
+		Entry("by bpf_redirect_peer", true, RedirectHelperPeer),
+		Entry("by bpf_redirect_neigh without the mac of veth0", false, RedirectHelperNeigh),
+	)
+
+	It("redirect the packets from veth0 to the node addresses into the device holding them", func() {
+		// the socket bound to node0 only receives the packets from node0
+		var host net.PacketConn
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			var err error
+			lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+				var e error
+				err := c.Control(func(fd uintptr) {
+					e = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, "node0")
+				})
+				if err != nil {
+					return err
+				}
+				return e
+			}}
+			host, err = lc.ListenPacket(context.Background(), "udp4", "10.9.0.1:9001")
+			return err
+		})).To(Succeed())
+		defer host.Close()
+
+		toHost := func() bool {
+			Expect(podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				c, err := net.Dial("udp4", "10.9.0.1:9001")
+				Expect(err).NotTo(HaveOccurred())
+				defer c.Close()
+				_, err = c.Write([]byte("ping"))
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})).To(Succeed())
+
+			Expect(host.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			buf := make([]byte, 16)
+			_, _, err := host.ReadFrom(buf)
+			return err == nil
+		}
+		Expect(toHost()).To(BeFalse())
+
+		redirect(&PodRedirect{
+			HostVeth:  "veth12345678901",
+			Interface: "net1",
+			IPs:       []net.IP{net.ParseIP("10.6.1.10")},
+			PodMAC:    podMAC,
+			NodeIPs:   []net.IP{net.ParseIP("10.9.0.1")},
+		})
+		Expect(hostFilters()).To(Equal([]string{"spider-veth:to-host"}))
+		Expect(toHost()).To(BeTrue())
+
+		Expect(hostNS.Do(func(ns.NetNS) error {
+			return TeardownPodRedirect("veth12345678901")
+		})).To(Succeed())
+		Expect(hostFilters()).To(BeEmpty())
+		Expect(toHost()).To(BeFalse())
+	})
+})
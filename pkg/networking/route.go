@@ -1,25 +1,37 @@
 package networking
 
 import (
-	"fmt"
-	"github.com/vishvananda/netlink"
-	"go.uber.org/zap"
+	"context"
 	"net"
 	"os"
+	"strings"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
-func AddRouteTable(logger *zap.Logger, ruleTable int, scope netlink.Scope, device string, destinations []string, v4Gw, v6Gw net.IP) error {
-	link, err := netlink.LinkByName(device)
+// Nexthop is the gateway and the source address of routes by family, a nil address is unset
+type Nexthop struct {
+	V4Gw, V6Gw   net.IP
+	V4Src, V6Src net.IP
+}
+
+// AddRouteTable adds the routes to the destinations via the given device into the table
+func (h *Handle) AddRouteTable(ctx context.Context, ruleTable int, scope netlink.Scope, device string, destinations []string, nexthop Nexthop) error {
+	link, err := h.LinkByName(ctx, device)
 	if err != nil {
-		logger.Error(err.Error())
+		h.logger.Error(err.Error())
 		return err
 	}
 
 	for _, dst := range destinations {
 		_, ipNet, err := net.ParseCIDR(dst)
 		if err != nil {
-			logger.Error(err.Error())
-			return err
+			h.logger.Error(err.Error())
+			return cnierrors.InvalidConfig(err, "invalid route destination %s", dst)
 		}
 
 		route := &netlink.Route{
@@ -29,27 +41,210 @@ func AddRouteTable(logger *zap.Logger, ruleTable int, scope netlink.Scope, devic
 			Table:     ruleTable,
 		}
 
-		if ipNet.IP.To4() != nil && v4Gw != nil {
-			route.Gw = v4Gw
+		if ipNet.IP.To4() != nil {
+			route.Gw, route.Src = nexthop.V4Gw, nexthop.V4Src
+		} else {
+			route.Gw, route.Src = nexthop.V6Gw, nexthop.V6Src
+		}
+
+		if err = h.begin(ctx); err != nil {
+			return err
+		}
+		if err = h.nl.RouteAdd(route); err != nil && !os.IsExist(err) {
+			h.logger.Error("failed to RouteAdd", zap.String("route", route.String()), zap.Error(err))
+			return cnierrors.IO(err, "failed to RouteAdd %s", route.String())
+		}
+	}
+	return nil
+}
+
+// AddCustomRoutes adds the custom routes into the table, unless a route has its own table.
+// The routes via veth use the nexthop of veth if via isn't given, the excluded routes stay on
+// the chained interface via its default gateway.
+func (h *Handle) AddCustomRoutes(ctx context.Context, routes []types.Route, ruleTable int, veth, chained string, nexthop Nexthop) error {
+	for idx := range routes {
+		r := routes[idx]
+		_, dst, err := net.ParseCIDR(strings.TrimSpace(r.Dst))
+		if err != nil {
+			return cnierrors.InvalidConfig(err, "invalid route destination %s", r.Dst)
+		}
+		isV4 := dst.IP.To4() != nil
+
+		device := veth
+		if r.Exclude || r.Dev == types.RouteDevChained {
+			device = chained
+		}
+		link, err := h.LinkByName(ctx, device)
+		if err != nil {
+			return err
+		}
+
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       dst,
+			Table:     ruleTable,
+			Priority:  r.Metric,
+			MTU:       r.MTU,
+		}
+		if r.Table != nil {
+			route.Table = *r.Table
+		}
+		if r.Via != "" {
+			route.Gw = net.ParseIP(r.Via)
 		}
 
-		if ipNet.IP.To4() == nil && v6Gw != nil {
-			route.Gw = v6Gw
+		switch {
+		case device == veth && isV4:
+			if route.Gw == nil {
+				route.Gw = nexthop.V4Gw
+			}
+			route.Src = nexthop.V4Src
+		case device == veth:
+			if route.Gw == nil {
+				route.Gw = nexthop.V6Gw
+			}
+			route.Src = nexthop.V6Src
+		case r.Exclude && route.Gw == nil:
+			family := netlink.FAMILY_V6
+			if isV4 {
+				family = netlink.FAMILY_V4
+			}
+			if route.Gw, err = h.defaultGateway(ctx, link, family); err != nil {
+				return err
+			}
+		}
+		if device == chained && route.Gw == nil {
+			route.Scope = netlink.SCOPE_LINK
 		}
 
-		if err = netlink.RouteAdd(route); err != nil && !os.IsExist(err) {
-			logger.Error("failed to RouteAdd", zap.String("route", route.String()), zap.Error(err))
+		if err = h.begin(ctx); err != nil {
 			return err
 		}
+		// a custom route wins over the route of the same dst in the table, like an excluded cluster CIDR
+		if err = h.nl.RouteReplace(route); err != nil {
+			h.logger.Error("failed to RouteReplace", zap.String("route", route.String()), zap.Error(err))
+			return cnierrors.IO(err, "failed to RouteReplace %s", route.String())
+		}
 	}
 	return nil
 }
 
-func GetGatewayIP(addrs []netlink.Addr) (v4Gw, v6Gw net.IP, err error) {
+// defaultGateway returns the gateway of the default route via the link in any table, nil if not found
+func (h *Handle) defaultGateway(ctx context.Context, link netlink.Link, family int) (net.IP, error) {
+	if err := h.begin(ctx); err != nil {
+		return nil, err
+	}
+	routes, err := h.nl.RouteListFiltered(family, &netlink.Route{LinkIndex: link.Attrs().Index, Table: unix.RT_TABLE_UNSPEC},
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, cnierrors.IO(err, "failed to list routes of %s", link.Attrs().Name)
+	}
+
+	var gw net.IP
+	for _, route := range routes {
+		if route.Gw == nil || (route.Dst != nil && !isDefaultDst(route.Dst)) {
+			continue
+		}
+		// prefer the default route in table main
+		if route.Table == unix.RT_TABLE_MAIN {
+			return route.Gw, nil
+		}
+		if gw == nil {
+			gw = route.Gw
+		}
+	}
+	return gw, nil
+}
+
+func isDefaultDst(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// CountHostPodRoutes returns the number of routes to pods via the host veths in table main,
+// the ones via the excluded host veths aren't counted.
+func (h *Handle) CountHostPodRoutes(ctx context.Context, hostVethPrefix string, excludes ...string) (int, error) {
+	if err := h.begin(ctx); err != nil {
+		return 0, err
+	}
+	links, err := h.nl.LinkList()
+	if err != nil {
+		return 0, cnierrors.IO(err, "failed to list links")
+	}
+
+	excluded := make(map[string]struct{}, len(excludes))
+	for _, name := range excludes {
+		excluded[name] = struct{}{}
+	}
+	vethIndexes := make(map[int]struct{})
+	for _, link := range links {
+		if _, ok := excluded[link.Attrs().Name]; !ok && strings.HasPrefix(link.Attrs().Name, hostVethPrefix) {
+			vethIndexes[link.Attrs().Index] = struct{}{}
+		}
+	}
+
+	if err = h.begin(ctx); err != nil {
+		return 0, err
+	}
+	routes, err := h.nl.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, cnierrors.IO(err, "failed to list routes")
+	}
+
+	count := 0
+	for _, route := range routes {
+		// netlink since v1.3.0 lists the default route with the dst 0.0.0.0/0 or ::/0 instead of nil
+		if _, ok := vethIndexes[route.LinkIndex]; ok && route.Dst != nil && !isDefaultDst(route.Dst) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// SelectSourceIPs returns the first address of each family in addrs as the src of routes.
+// If a CIDR is given for the family, the first address in it is selected.
+func SelectSourceIPs(addrs []netlink.Addr, v4CIDR, v6CIDR string) (v4Src, v6Src net.IP, err error) {
+	var v4Net, v6Net *net.IPNet
+	if v4CIDR != "" {
+		if _, v4Net, err = net.ParseCIDR(v4CIDR); err != nil {
+			return nil, nil, cnierrors.InvalidConfig(err, "invalid source CIDR %s", v4CIDR)
+		}
+	}
+	if v6CIDR != "" {
+		if _, v6Net, err = net.ParseCIDR(v6CIDR); err != nil {
+			return nil, nil, cnierrors.InvalidConfig(err, "invalid source CIDR %s", v6CIDR)
+		}
+	}
+
 	for _, addr := range addrs {
-		routes, err := netlink.RouteGet(addr.IP)
+		if addr.IP.To4() != nil {
+			if v4Src == nil && (v4Net == nil || v4Net.Contains(addr.IP)) {
+				v4Src = addr.IP
+			}
+		} else if v6Src == nil && (v6Net == nil || v6Net.Contains(addr.IP)) {
+			v6Src = addr.IP
+		}
+	}
+
+	if v4Net != nil && v4Src == nil {
+		return nil, nil, cnierrors.InvalidConfig(nil, "no address of the interface is in the source CIDR %s", v4CIDR)
+	}
+	if v6Net != nil && v6Src == nil {
+		return nil, nil, cnierrors.InvalidConfig(nil, "no address of the interface is in the source CIDR %s", v6CIDR)
+	}
+	return v4Src, v6Src, nil
+}
+
+// GetGatewayIP returns the source addresses of the routes to the given addresses, by family
+func (h *Handle) GetGatewayIP(ctx context.Context, addrs []netlink.Addr) (v4Gw, v6Gw net.IP, err error) {
+	for _, addr := range addrs {
+		if err = h.begin(ctx); err != nil {
+			return nil, nil, err
+		}
+		routes, err := h.nl.RouteGet(addr.IP)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to RouteGet Pod IP(%s): %v", addr.IP.String(), err)
+			return nil, nil, cnierrors.IO(err, "failed to RouteGet Pod IP(%s)", addr.IP.String())
 		}
 
 		if len(routes) > 0 {
@@ -1,39 +1,123 @@
 package networking
 
 import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
 )
 
-// AddToRuleTable
-func AddToRuleTable(preInterfaceIPAddress []netlink.Addr, ruleTable int) error {
+// AddToRuleTable make sure that the traffic to the given addresses lookup the table
+// Equivalent to: `ip rule add to <ip> lookup <ruleTable>`
+func (h *Handle) AddToRuleTable(ctx context.Context, preInterfaceIPAddress []netlink.Addr, ruleTable int) error {
 	for _, ipAddress := range preInterfaceIPAddress {
 		rule := netlink.NewRule()
 		rule.Table = ruleTable
 		rule.Dst = ipAddress.IPNet
-		if err := netlink.RuleAdd(rule); err != nil {
+		if err := h.begin(ctx); err != nil {
 			return err
 		}
+		if err := h.nl.RuleAdd(rule); err != nil {
+			return cnierrors.IO(err, "failed to add rule %s", rule.String())
+		}
 	}
 	return nil
 }
 
 // AddFromRuleTable add route rule for calico/cilium cidr(ipv4 and ipv6)
 // Equivalent to: `ip rule add from <cidr> `
-func AddFromRuleTable(logger *zap.Logger, ipAddrs []netlink.Addr, ruleTable int) error {
-	logger.Debug("Add FromRule Table in Pod Netns")
+func (h *Handle) AddFromRuleTable(ctx context.Context, ipAddrs []netlink.Addr, ruleTable int) error {
+	h.logger.Debug("Add FromRule Table in Pod Netns")
 	for _, ipAddr := range ipAddrs {
 		rule := netlink.NewRule()
 		rule.Table = ruleTable
 		rule.Src = ipAddr.IPNet
-		logger.Debug("Netlink RuleAdd", zap.String("Rule", rule.String()))
-		if err := netlink.RuleAdd(rule); err != nil {
-			logger.Error(err.Error())
+		h.logger.Debug("Netlink RuleAdd", zap.String("Rule", rule.String()))
+		if err := h.begin(ctx); err != nil {
 			return err
 		}
+		if err := h.nl.RuleAdd(rule); err != nil {
+			h.logger.Error(err.Error())
+			return cnierrors.IO(err, "failed to add rule %s", rule.String())
+		}
 	}
 	// we should add rule route table, just like `ip route add default via 169.254.1.1 table 100`
 	// but we don't know what's the default route If it has been deleted.
 	// so we should add this route rule table before removing the default route
 	return nil
 }
+
+// addRulesOnce adds the rules which don't exist, the kernel doesn't reject a duplicate rule.
+// The family of every rule must be set.
+func (h *Handle) addRulesOnce(ctx context.Context, rules []*netlink.Rule) error {
+	existing := make(map[int][]netlink.Rule)
+	for _, rule := range rules {
+		if _, ok := existing[rule.Family]; !ok {
+			if err := h.begin(ctx); err != nil {
+				return err
+			}
+			list, err := h.nl.RuleList(rule.Family)
+			if err != nil {
+				return cnierrors.IO(err, "failed to list rules")
+			}
+			existing[rule.Family] = list
+		}
+		if hasRule(existing[rule.Family], rule) {
+			continue
+		}
+
+		h.logger.Debug("Netlink RuleAdd", zap.String("Rule", rule.String()))
+		if err := h.begin(ctx); err != nil {
+			return err
+		}
+		if err := h.nl.RuleAdd(rule); err != nil && !os.IsExist(err) {
+			return cnierrors.IO(err, "failed to add rule %s", rule.String())
+		}
+	}
+	return nil
+}
+
+func hasRule(rules []netlink.Rule, rule *netlink.Rule) bool {
+	for _, r := range rules {
+		if r.Table == rule.Table && r.Mark == rule.Mark && maskOf(r.Mask) == maskOf(rule.Mask) && ipNetString(r.Src) == ipNetString(rule.Src) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskOf returns the fwmark mask of a rule, a nil mask is 0 which the kernel treats as 0xffffffff
+func maskOf(mask *uint32) uint32 {
+	if mask == nil {
+		return 0
+	}
+	return *mask
+}
+
+// markRule returns the rule `fwmark <mark>/<mark> lookup <table>` of the family
+func markRule(mark, table, family int) *netlink.Rule {
+	rule := netlink.NewRule()
+	mask := uint32(mark)
+	rule.Mark = uint32(mark)
+	rule.Mask = &mask
+	rule.Table = table
+	rule.Family = family
+	return rule
+}
+
+func familyOf(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+	return ipNet.String()
+}
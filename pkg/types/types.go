@@ -22,17 +22,267 @@ type Veth struct {
 	ServiceCIDR    []string `json:"service_cidr,omitempty"`
 	AdditionalCIDR []string `json:"additional_cidr,omitempty"`
 	// RpFilter
-	RPFilter   *RPFilter      `json:"rp_filter,omitempty" `
-	MoveRoutes MoveRouteValue `json:"move_routes,omitempty"`
-	LogOptions *LogOptions    `json:"log_options,omitempty"`
+	RPFilter   *RPFilter       `json:"rp_filter,omitempty" `
+	MoveRoutes MoveRouteValue  `json:"move_routes,omitempty"`
+	LogOptions *LogOptions     `json:"log_options,omitempty"`
+	Metrics    *MetricsOptions `json:"metrics,omitempty"`
+	// LinkLocalGateway routes the node addresses and cluster CIDRs via a link-local gateway on veth0,
+	// instead of a static neighbor entry in the pod for every node address
+	LinkLocalGateway bool `json:"link_local_gateway,omitempty"`
+	// Routes are the custom routes in the pod, via veth0 or the chained interface
+	Routes []Route `json:"routes,omitempty"`
+	// RouteSource selects the pod addresses used as src of the routes via veth0
+	RouteSource *RouteSource `json:"route_source,omitempty"`
+	// HostGateway is the gateway of the routes via veth0, default to the source address of the host route to the pod
+	HostGateway *HostGateway `json:"host_gateway,omitempty"`
+	// EgressViaHost sends the default egress of the pod via the node
+	EgressViaHost *EgressViaHost `json:"egress_via_host,omitempty"`
+	// ReplyViaVeth sends the replies of the connections entering the pod via veth0 back via veth0
+	ReplyViaVeth *ReplyViaVeth `json:"reply_via_veth,omitempty"`
+	// HostFilter filters the traffic from the pod on its host veth
+	HostFilter *HostFilter `json:"host_filter,omitempty"`
+	// ConntrackCleanup flushes the conntrack entries of the pod addresses on the node on ADD and DEL
+	ConntrackCleanup *ConntrackCleanup `json:"conntrack_cleanup,omitempty"`
+	// Offload tunes the offloads of veth0 and the host veth
+	Offload *Offload `json:"offload,omitempty"`
+	// EBPFRedirect redirects the packets the node routes to the pod straight into it by tc programs
+	EBPFRedirect *EBPFRedirect `json:"ebpf_redirect,omitempty"`
+	// Bandwidth shapes the traffic of the pod on the host veth, the one of runtimeConfig wins
+	Bandwidth *Bandwidth `json:"bandwidth,omitempty"`
+	// PodOverrides allows the pods to override some options by their annotations
+	PodOverrides *PodOverrides `json:"pod_overrides,omitempty"`
+	// IPv6 tunes the handling of the pods with IPv6 addresses
+	IPv6 *IPv6 `json:"ipv6,omitempty"`
+	// StrictDualStack fails a dual-stack pod if IPv6 is disabled on the node, instead of setting up only its IPv4
+	StrictDualStack bool `json:"strict_dual_stack,omitempty"`
+	// NodeOverrides merges the annotation veth.spidernet.io/node-config of the node on top of the config
+	NodeOverrides *NodeOverrides `json:"node_overrides,omitempty"`
+	// FirewallBackend installs the rules of egress_via_host, reply_via_veth and host_filter, auto(default), iptables or nftables
+	FirewallBackend string `json:"firewall_backend,omitempty"`
+	// DeviceType is the device pair between the pod and the host, veth(default) or netkit
+	DeviceType string `json:"device_type,omitempty"`
+	// DeviceFallback creates veth if the kernel doesn't support device_type, otherwise the pod fails
+	DeviceFallback bool `json:"device_fallback,omitempty"`
+	// LockTimeout is the seconds an invocation waits for the locks of pod netns and host, default to 30
+	LockTimeout *int `json:"lock_timeout,omitempty"`
+	// RuntimeConfig is passed by the runtime for the capabilities enabled in the config
+	RuntimeConfig *RuntimeConfig `json:"runtimeConfig,omitempty"`
 }
 
+// RuntimeConfig is the dynamic config of the capabilities, see CONVENTIONS.md of CNI
+type RuntimeConfig struct {
+	// Bandwidth is converted by the runtime from the annotations kubernetes.io/ingress-bandwidth
+	// and kubernetes.io/egress-bandwidth of the pod
+	Bandwidth *RuntimeBandwidth `json:"bandwidth,omitempty"`
+	// PodAnnotations are the annotations of the pod passed by containerd
+	PodAnnotations map[string]string `json:"io.kubernetes.cri.pod-annotations,omitempty"`
+	// Mac is the hardware address of the chained interface, like the mac of a network-selection element of multus.
+	// It wins over hardware_prefix.
+	Mac string `json:"mac,omitempty"`
+	// Routes are added to the pod via veth0, in the format of the routes of the CNI result
+	Routes []types.Route `json:"routes,omitempty"`
+}
+
+// RuntimeBandwidth is the bandwidth capability, the rates are in bits per second and the bursts in bits
+type RuntimeBandwidth struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+// MetricsOptions configures the metrics written to a node-exporter textfile collector directory
+type MetricsOptions struct {
+	Enable bool `json:"enabled,omitempty"`
+	// TextfileDir is the directory of textfile collector, default to /var/lib/node_exporter/textfile_collector
+	TextfileDir string `json:"textfile_dir,omitempty"`
+}
+
+// The devices of custom routes
+const (
+	RouteDevVeth    = "veth0"
+	RouteDevChained = "chained"
+)
+
+// Route is a custom route in the pod
+type Route struct {
+	// Dst is the destination CIDR
+	Dst string `json:"dst"`
+	// Dev is veth0(default) to send the traffic via the host, or chained to keep it on the chained interface
+	Dev string `json:"dev,omitempty"`
+	// Via is the gateway, default to the host gateway for veth0, no gateway for the chained interface
+	Via string `json:"via,omitempty"`
+	// Metric is the priority of the route
+	Metric int `json:"metric,omitempty"`
+	// Table is the route table, default to the table of the chained interface
+	Table *int `json:"table,omitempty"`
+	// MTU of the route, 0 means the MTU of the device
+	MTU int `json:"mtu,omitempty"`
+	// Exclude keeps dst on the chained interface, via its default gateway if via isn't given.
+	// It's used to exclude a destination from the CIDRs routed via veth0.
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// RouteSource selects the pod addresses used as src of the routes via veth0
+type RouteSource struct {
+	// Enable sets src of the routes, default to true. If it's false, src is left unset and the kernel selects it.
+	Enable *bool `json:"enabled,omitempty"`
+	// IPv4CIDR selects the first IPv4 address of the chained interface in it, default to the first IPv4 address
+	IPv4CIDR string `json:"ipv4_cidr,omitempty"`
+	// IPv6CIDR selects the first IPv6 address of the chained interface in it, default to the first IPv6 address
+	IPv6CIDR string `json:"ipv6_cidr,omitempty"`
+}
+
+// HostGateway is the host address of each family used as the gateway of the routes via veth0
+type HostGateway struct {
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+// EgressViaHost routes the default egress of the pod via veth0, the node forwards and masquerades it.
+// The connections from the chained interface are marked, their replies are still sent via
+// the chained interface by the rule `from <pod ip> fwmark <mark> lookup <table>`.
+type EgressViaHost struct {
+	Enable bool `json:"enabled,omitempty"`
+	// Table keeps the default routes of the chained interface, default to 99
+	Table *int `json:"table,omitempty"`
+	// Mark is the connmark of the connections from the chained interface, default to 0x20000
+	Mark *int `json:"mark,omitempty"`
+}
+
+// ReplyViaVeth keeps the return path of the connections entering the pod via veth0 symmetric, like
+// the NodePort traffic DNATed to the pod by kube-proxy. They are marked, and their replies lookup
+// the table by the rule `fwmark <mark> lookup <table>`, which has the default route via veth0.
+type ReplyViaVeth struct {
+	Enable bool `json:"enabled,omitempty"`
+	// Table has the default route via veth0, default to 98
+	Table *int `json:"table,omitempty"`
+	// Mark is the connmark of the connections from veth0, default to 0x10000
+	Mark *int `json:"mark,omitempty"`
+}
+
+// HostFilter drops the traffic from the host veth of the pod whose source isn't an address of the pod.
+// Optionally the forwarded traffic is restricted to the cluster, service and additional CIDRs and the
+// node addresses, and the traffic to the node is restricted to the allowed ports.
+type HostFilter struct {
+	Enable bool `json:"enabled,omitempty"`
+	// RestrictDestinations drops the forwarded traffic to other destinations
+	RestrictDestinations bool `json:"restrict_destinations,omitempty"`
+	// AllowedPorts are the ports of the node the pod could access, like tcp/10250 or udp/30000-32767,
+	// the node isn't restricted if it's empty
+	AllowedPorts []string `json:"allowed_ports,omitempty"`
+}
+
+// ConntrackCleanup flushes the conntrack entries on the node whose original or reply tuple has an
+// address of the pod, the stale ones of a former pod using the same address steer the flows wrong.
+type ConntrackCleanup struct {
+	Enable bool `json:"enabled,omitempty"`
+	// Zones only flushes the entries in the zones, default to all zones
+	Zones []int `json:"zones,omitempty"`
+	// Protocols only flushes the entries of the protocols, any of tcp, udp, sctp, icmp and icmpv6, default to all
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// Offload changes the ethtool features of both ends of the veth pair when it's created, the unset ones
+// keep the defaults of the kernel. The veth pair has no GRO by default, the traffic through the node,
+// especially UDP, costs more CPU without it.
+type Offload struct {
+	// Checksum is the tx and rx checksum offload
+	Checksum *bool `json:"checksum,omitempty"`
+	// TSO is the TCP segmentation offload of IPv4 and IPv6, it requires the checksum offload
+	TSO *bool `json:"tso,omitempty"`
+	// GSO is the generic segmentation offload
+	GSO *bool `json:"gso,omitempty"`
+	// GRO is the generic receive offload, a veth receives the packets by NAPI with it since kernel 5.13
+	GRO *bool `json:"gro,omitempty"`
+	// UDPGROForwarding aggregates the forwarded UDP packets by GRO
+	UDPGROForwarding *bool `json:"udp_gro_forwarding,omitempty"`
+	// XDPGRO attaches an XDP program passing every packet to both ends, which enables the NAPI and GRO
+	// of veth on the kernels before 5.13
+	XDPGRO bool `json:"xdp_gro,omitempty"`
+	// Restore restores the features on DEL if the veth pair still exists
+	Restore bool `json:"restore,omitempty"`
+}
+
+// EBPFRedirect attaches tc programs to the ingress of the node devices, shared by all pods, which redirect the
+// packets routed to the addresses of the pod into veth0 by bpf_redirect_peer, or onto the host veth by
+// bpf_redirect_neigh, skipping the routing and the netfilter of the node. The packets from veth0 to the node
+// addresses are redirected into the devices holding them. The pod falls back to the normal path if the kernel
+// lacks both helpers.
+type EBPFRedirect struct {
+	Enable bool `json:"enabled,omitempty"`
+	// Interfaces are the node devices the programs are attached to, default to the ones holding the node addresses
+	Interfaces []string `json:"interfaces,omitempty"`
+}
+
+// Bandwidth limits the traffic of the pod through the veth pair, the ingress is the traffic to the pod and the
+// egress is the traffic from it. The rates are in bits per second and the bursts in bits, a direction without
+// a rate isn't limited.
+type Bandwidth struct {
+	IngressRate  uint64 `json:"ingress_rate,omitempty"`
+	IngressBurst uint64 `json:"ingress_burst,omitempty"`
+	EgressRate   uint64 `json:"egress_rate,omitempty"`
+	EgressBurst  uint64 `json:"egress_burst,omitempty"`
+}
+
+// PodOverrides lists the options the pods may override by the annotations veth.spidernet.io/<option>. The
+// annotations are taken from runtimeConfig if the runtime passes them, otherwise from the API server.
+type PodOverrides struct {
+	// Allowed are the options the pods may override, any of disabled, additional_cidr, move_routes, mac and rp_filter
+	Allowed []string `json:"allowed,omitempty"`
+	// Kubeconfig is used to get the annotations of the pod from the API server
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+}
+
+// NodeOverrides gets the annotations of the node from the API server, they are cached on the node
+type NodeOverrides struct {
+	// Kubeconfig is used to get the node from the API server
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// NodeName is the name of the node, default to the hostname
+	NodeName string `json:"node_name,omitempty"`
+	// CacheTTL is the seconds the annotations are cached before asking the API server again, default to 60
+	CacheTTL *int `json:"cache_ttl,omitempty"`
+}
+
+// IPv6 tunes the handling of the pods with IPv6 addresses
+type IPv6 struct {
+	// HostForwarding is done if net.ipv6.conf.all.forwarding of the node is off, warn(default), fail or enable
+	HostForwarding string `json:"host_forwarding,omitempty"`
+	// AcceptRADefaultRoute keeps the default routes learned from router advertisements on the chained interface,
+	// by default they are dropped if they fight the policy routing of veth
+	AcceptRADefaultRoute bool `json:"accept_ra_default_route,omitempty"`
+}
+
+// The actions on the node whose IPv6 forwarding is off
+const (
+	HostForwardingWarn   = "warn"
+	HostForwardingFail   = "fail"
+	HostForwardingEnable = "enable"
+)
+
+// The device types between the pod and the host
+const (
+	DeviceTypeVeth   = "veth"
+	DeviceTypeNetkit = "netkit"
+)
+
+// The backends of firewall rules
+const (
+	FirewallBackendAuto     = "auto"
+	FirewallBackendIPTables = "iptables"
+	FirewallBackendNFTables = "nftables"
+)
+
 type LogOptions struct {
 	LogLevel        string `json:"log_level"`
 	LogFilePath     string `json:"log_file"`
 	LogFileMaxSize  *int   `json:"log_max_size"`
 	LogFileMaxAge   *int   `json:"log_max_age"`
 	LogFileMaxCount *int   `json:"log_max_count"`
+	// LogSinks is where the logs go, any of file/stderr/syslog, default to file
+	LogSinks []string `json:"log_sinks,omitempty"`
+	// LogFormat is json or console, default to json
+	LogFormat string `json:"log_format,omitempty"`
 }
 
 type RPFilter struct {
@@ -58,4 +308,9 @@ const (
 	LogDefaultMaxSize        = 100 // megabytes
 	LogDefaultMaxAge         = 5   // days
 	LogDefaultMaxBackups     = 5
+
+	EgressDefaultTable = 99
+	EgressDefaultMark  = 0x20000
+	ReplyDefaultTable  = 98
+	ReplyDefaultMark   = 0x10000
 )
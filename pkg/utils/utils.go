@@ -3,6 +3,8 @@ package utils
 import (
 	"strconv"
 	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
 var (
@@ -28,6 +30,12 @@ func GetRuleNumber(iface string) int {
 	return overlayRouteTable + num - 1
 }
 
+// IsReservedTable returns true if the given table is reserved by kernel(compat, default, main and local),
+// it can't be used as the policy routing table of an interface.
+func IsReservedTable(table int) bool {
+	return table >= unix.RT_TABLE_COMPAT && table <= unix.RT_TABLE_LOCAL
+}
+
 // CompareInterfaceName compare name from given current and prev by directory order
 // example:
 // net1 > eth0, true
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ValidatePath is the path of the validating webhook in the http server
+const ValidatePath = "/validate-network-attachment-definition"
+
+// maxRequestBytes limits the size of the AdmissionReview we read
+const maxRequestBytes = 3 * 1024 * 1024
+
+var nadGroupKind = schema.GroupKind{Group: "k8s.cni.cncf.io", Kind: "NetworkAttachmentDefinition"}
+
+// NewHandler returns the http handler serving the validating webhook
+func NewHandler(logger *zap.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(ValidatePath, &validateHandler{logger: logger})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+type validateHandler struct {
+	logger *zap.Logger
+}
+
+func (h *validateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "AdmissionReview has no request", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = h.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	resp, err := json.Marshal(review)
+	if err != nil {
+		h.logger.Error("failed to encode AdmissionReview", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to encode AdmissionReview: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		h.logger.Error("failed to write response", zap.Error(err))
+	}
+}
+
+// review validates the NetworkAttachmentDefinition in the admission request
+func (h *validateHandler) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	logger := h.logger.With(zap.String("UID", string(req.UID)),
+		zap.String("Operation", string(req.Operation)),
+		zap.String("Namespace", req.Namespace),
+		zap.String("Name", req.Name))
+
+	// nothing to validate when the object is deleted
+	if req.Operation == admissionv1.Delete || len(req.Object.Raw) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	nad := &netv1.NetworkAttachmentDefinition{}
+	if err := json.Unmarshal(req.Object.Raw, nad); err != nil {
+		logger.Error("failed to decode NetworkAttachmentDefinition", zap.Error(err))
+		status := apierrors.NewBadRequest(fmt.Sprintf("failed to decode NetworkAttachmentDefinition: %v", err)).ErrStatus
+		return &admissionv1.AdmissionResponse{Allowed: false, Result: &status}
+	}
+
+	errs, warnings := ValidateNetworkAttachmentDefinition(nad)
+	if len(errs) == 0 {
+		logger.Debug("NetworkAttachmentDefinition is valid", zap.Strings("warnings", warnings))
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+	}
+
+	logger.Info("Reject invalid NetworkAttachmentDefinition", zap.Error(errs.ToAggregate()))
+	status := apierrors.NewInvalid(nadGroupKind, nad.Name, errs).ErrStatus
+	return &admissionv1.AdmissionResponse{Allowed: false, Result: &status, Warnings: warnings}
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned"
+	"github.com/spidernet-io/plugins/pkg/config"
+	"github.com/spidernet-io/plugins/pkg/types"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// VethPluginType is the type of the veth plugin in a CNI config
+const VethPluginType = "veth"
+
+// ValidateNetworkAttachmentDefinition decodes spec.config of the given NAD, and
+// runs the veth config validation on every plugin of type veth. Both a single
+// plugin config and a config list are supported. The warnings tell the options
+// which are valid but ignored.
+func ValidateNetworkAttachmentDefinition(nad *netv1.NetworkAttachmentDefinition) (field.ErrorList, []string) {
+	fldPath := field.NewPath("spec", "config")
+
+	// an empty config means multus reads the config from the node, we have nothing to validate
+	if strings.TrimSpace(nad.Spec.Config) == "" {
+		return nil, nil
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(nad.Spec.Config), &raw); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, nad.Spec.Config, fmt.Sprintf("failed to decode config: %v", err))}, nil
+	}
+
+	plugins, ok := raw["plugins"]
+	if !ok {
+		return validatePlugin([]byte(nad.Spec.Config), fldPath)
+	}
+
+	var pluginList []json.RawMessage
+	if err := json.Unmarshal(plugins, &pluginList); err != nil {
+		return field.ErrorList{field.Invalid(fldPath.Child("plugins"), string(plugins), fmt.Sprintf("failed to decode plugins: %v", err))}, nil
+	}
+
+	var allErrs field.ErrorList
+	var warnings []string
+	for idx, plugin := range pluginList {
+		errs, w := validatePlugin(plugin, fldPath.Child("plugins").Index(idx))
+		allErrs = append(allErrs, errs...)
+		warnings = append(warnings, w...)
+	}
+	return allErrs, warnings
+}
+
+// validatePlugin validates a single plugin config, plugins which aren't veth are ignored
+func validatePlugin(data []byte, fldPath *field.Path) (field.ErrorList, []string) {
+	netConf := cnitypes.NetConf{}
+	if err := json.Unmarshal(data, &netConf); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, string(data), fmt.Sprintf("failed to decode plugin: %v", err))}, nil
+	}
+
+	if netConf.Type != VethPluginType {
+		return nil, nil
+	}
+
+	conf := types.Veth{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, string(data), fmt.Sprintf("failed to decode veth config: %v", err))}, nil
+	}
+
+	allErrs := config.ValidateKnownFields(data, fldPath)
+	allErrs = append(allErrs, config.ValidateVethConfig(&conf, fldPath)...)
+
+	var warnings []string
+	for _, w := range config.VethConfigWarnings(&conf) {
+		warnings = append(warnings, fmt.Sprintf("%s: %s", fldPath.String(), w))
+	}
+	return allErrs, warnings
+}
+
+// Audit lists the existing NetworkAttachmentDefinitions in all namespaces and returns
+// the errors of the invalid ones, keyed by namespace/name. It reports the objects
+// which were created before the webhook was installed.
+func Audit(ctx context.Context, logger *zap.Logger, client versioned.Interface) (map[string]field.ErrorList, error) {
+	nadList, err := client.K8sCniCncfIoV1().NetworkAttachmentDefinitions(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NetworkAttachmentDefinitions: %v", err)
+	}
+
+	invalid := make(map[string]field.ErrorList)
+	for idx := range nadList.Items {
+		nad := &nadList.Items[idx]
+		if errs, _ := ValidateNetworkAttachmentDefinition(nad); len(errs) != 0 {
+			key := nad.Namespace + "/" + nad.Name
+			logger.Warn("Found invalid NetworkAttachmentDefinition", zap.String("NetworkAttachmentDefinition", key), zap.Error(errs.ToAggregate()))
+			invalid[key] = errs
+		}
+	}
+	return invalid, nil
+}
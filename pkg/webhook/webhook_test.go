@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	netv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned/fake"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	validConfig = `{
+  "cniVersion": "0.3.1",
+  "name": "macvlan-standalone",
+  "plugins": [
+    {"type": "macvlan", "master": "eth0", "mode": "bridge", "ipam": {"type": "spiderpool"}},
+    {"type": "veth", "service_cidr": ["10.233.0.0/18"], "cluster_cidr": ["10.233.64.0/18"], "hardware_prefix": "0a:1b"}
+  ]
+}`
+	invalidConfig = `{
+  "cniVersion": "0.3.1",
+  "name": "macvlan-standalone",
+  "plugins": [
+    {"type": "macvlan", "master": "eth0", "mode": "bridge", "ipam": {"type": "spiderpool"}},
+    {"type": "veth", "service_cidr": ["10.233.0.0/18"], "cluster_cidr": ["10.233.64.0/18", "abcd"], "hardware_prefix": "wrong mac"}
+  ]
+}`
+)
+
+func newNAD(namespace, name, config string) *netv1.NetworkAttachmentDefinition {
+	return &netv1.NetworkAttachmentDefinition{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       netv1.NetworkAttachmentDefinitionSpec{Config: config},
+	}
+}
+
+func postReview(server *httptest.Server, nad *netv1.NetworkAttachmentDefinition, operation admissionv1.Operation) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(nad)
+	Expect(err).NotTo(HaveOccurred())
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Operation: operation,
+			Namespace: nad.Namespace,
+			Name:      nad.Name,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	Expect(err).NotTo(HaveOccurred())
+
+	resp, err := http.Post(server.URL+ValidatePath, "application/json", bytes.NewReader(body))
+	Expect(err).NotTo(HaveOccurred())
+	defer resp.Body.Close()
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+	result := admissionv1.AdmissionReview{}
+	Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+	Expect(result.Response).NotTo(BeNil())
+	Expect(result.Response.UID).To(Equal(types.UID("test-uid")))
+	return result.Response
+}
+
+var _ = Describe("webhook", func() {
+	Context("Test ValidateNetworkAttachmentDefinition", func() {
+		It("valid config list", func() {
+			errs, _ := ValidateNetworkAttachmentDefinition(newNAD("kube-system", "valid", validConfig))
+			Expect(errs).To(BeEmpty())
+		})
+
+		It("report field-level errors of veth plugin", func() {
+			errs, _ := ValidateNetworkAttachmentDefinition(newNAD("kube-system", "invalid", invalidConfig))
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Field).To(Equal("spec.config.plugins[1].hardware_prefix"))
+			Expect(errs[1].Field).To(Equal("spec.config.plugins[1].cluster_cidr[1]"))
+		})
+
+		It("single plugin config", func() {
+			errs, _ := ValidateNetworkAttachmentDefinition(newNAD("kube-system", "single", `{"cniVersion": "0.3.1", "type": "veth", "additional_cidr": ["1.1.1.1"]}`))
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("spec.config.additional_cidr[0]"))
+		})
+
+		It("ignore other plugins and empty config", func() {
+			errs, _ := ValidateNetworkAttachmentDefinition(newNAD("kube-system", "macvlan", `{"type": "macvlan", "cluster_cidr": ["abcd"]}`))
+			Expect(errs).To(BeEmpty())
+			errs, _ = ValidateNetworkAttachmentDefinition(newNAD("kube-system", "empty", ""))
+			Expect(errs).To(BeEmpty())
+		})
+
+		It("reject unknown fields and return warnings", func() {
+			errs, warnings := ValidateNetworkAttachmentDefinition(newNAD("kube-system", "typo",
+				`{"cniVersion": "0.3.1", "type": "veth", "service_cidrs": ["10.233.0.0/18"], "only_hardware": true, "hardware_prefix": "0a:1b", "cluster_cidr": ["10.233.64.0/18"]}`))
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("spec.config.service_cidrs"))
+			Expect(warnings).To(HaveLen(1))
+		})
+
+		It("config is not json", func() {
+			errs, _ := ValidateNetworkAttachmentDefinition(newNAD("kube-system", "bad", "{"))
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Field).To(Equal("spec.config"))
+		})
+	})
+
+	Context("Test webhook server", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(NewHandler(zap.NewNop()))
+			DeferCleanup(server.Close)
+		})
+
+		It("allow valid NetworkAttachmentDefinition", func() {
+			resp := postReview(server, newNAD("kube-system", "valid", validConfig), admissionv1.Create)
+			Expect(resp.Allowed).To(BeTrue())
+		})
+
+		It("reject invalid NetworkAttachmentDefinition with field-level causes", func() {
+			resp := postReview(server, newNAD("kube-system", "invalid", invalidConfig), admissionv1.Update)
+			Expect(resp.Allowed).To(BeFalse())
+			Expect(resp.Result).NotTo(BeNil())
+			Expect(resp.Result.Reason).To(Equal(metav1.StatusReasonInvalid))
+			Expect(resp.Result.Details.Causes).To(HaveLen(2))
+			Expect(resp.Result.Details.Causes[1].Field).To(Equal("spec.config.plugins[1].cluster_cidr[1]"))
+		})
+
+		It("allow delete", func() {
+			resp := postReview(server, newNAD("kube-system", "invalid", invalidConfig), admissionv1.Delete)
+			Expect(resp.Allowed).To(BeTrue())
+		})
+
+		It("bad request", func() {
+			resp, err := http.Post(server.URL+ValidatePath, "application/json", bytes.NewReader([]byte("{}")))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("Test Audit", func() {
+		It("report the invalid NetworkAttachmentDefinitions", func() {
+			// objects are created through the client, since the object tracker of the
+			// fake clientset guesses a wrong resource name for NetworkAttachmentDefinition
+			client := fake.NewSimpleClientset()
+			for _, nad := range []*netv1.NetworkAttachmentDefinition{
+				newNAD("kube-system", "valid", validConfig),
+				newNAD("default", "invalid", invalidConfig),
+			} {
+				_, err := client.K8sCniCncfIoV1().NetworkAttachmentDefinitions(nad.Namespace).Create(context.TODO(), nad, metav1.CreateOptions{})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			invalid, err := Audit(context.TODO(), zap.NewNop(), client)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(invalid).To(HaveLen(1))
+			Expect(invalid).To(HaveKey("default/invalid"))
+		})
+	})
+})
@@ -11,8 +11,12 @@ import (
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	pVersion "github.com/spidernet-io/plugins/internal/version"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
 	"github.com/spidernet-io/plugins/pkg/config"
+	"github.com/spidernet-io/plugins/pkg/k8s"
+	"github.com/spidernet-io/plugins/pkg/lock"
 	"github.com/spidernet-io/plugins/pkg/logging"
+	"github.com/spidernet-io/plugins/pkg/metrics"
 	"github.com/spidernet-io/plugins/pkg/networking"
 	ptypes "github.com/spidernet-io/plugins/pkg/types"
 	ty "github.com/spidernet-io/plugins/pkg/types"
@@ -20,7 +24,10 @@ import (
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
@@ -40,7 +47,21 @@ func init() {
 var (
 	defaultMtu     = 1500
 	defaultConVeth = "veth0"
+	hostVethPrefix = "veth"
+	ifbPrefix      = "bwp"
+	lockDir        = lock.DefaultLockDir
+	stateDir       = networking.DefaultStateDir
+	nodeConfigDir  = config.DefaultNodeConfigDir
 	pluginName     = filepath.Base(os.Args[0])
+	// addTimeout bounds an ADD, so a stuck netlink request doesn't hang the runtime
+	addTimeout = 2 * time.Minute
+	// initLogger initializes the global logger once per process, the tests running invocations
+	// concurrently in one process replace it
+	initLogger = logging.InitLogger
+
+	// the link-local gateways of veth0 in link_local_gateway mode
+	linkLocalGatewayV4 = net.ParseIP("169.254.1.1")
+	linkLocalGatewayV6 = net.ParseIP("fe80::1")
 )
 
 func main() {
@@ -48,36 +69,84 @@ func main() {
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
+	if err := add(args); err != nil {
+		// map to CNI error codes, so that the runtime could tell a transient error from a permanent one
+		return cnierrors.ToCNIError(err)
+	}
+	return nil
+}
+
+func add(args *skel.CmdArgs) (err error) {
 	startTime := time.Now()
 
-	conf, err := config.ParseVethConfig(args.StdinData)
+	// the node config is merged before parsing, so it's validated along with the config
+	stdin, nodeConfigs, err := config.MergeNodeConfig(args.StdinData, nodeConfigDir)
+	if err != nil {
+		return err
+	}
+	conf, err := config.ParseVethConfig(stdin)
 	if err != nil {
 		return err
 	}
 
-	if err := logging.InitLogger(conf.LogOptions, pluginName); err != nil {
-		return fmt.Errorf("faild to init logger: %v ", err)
+	// a log failure must not break the CNI call, the sinks which work are still used
+	logErr := initLogger(conf.LogOptions, pluginName)
+	logger := logging.LoggerFile.With(zap.String("TraceID", logging.NewTraceID()),
+		zap.String("ContainerID", args.ContainerID),
+		zap.String("Netns", args.Netns))
+	if logErr != nil {
+		logger.Warn("failed to init some log sinks", zap.Error(logErr))
 	}
-	logger := logging.LoggerFile
+
+	// metrics are best-effort, they never fail the CNI call
+	rec := metrics.NewRecorder(metrics.CommandAdd, args.ContainerID, args.IfName)
+	defer func() {
+		if e := rec.Flush(conf.Metrics, err); e != nil {
+			logger.Warn("failed to write metrics", zap.Error(e))
+		}
+	}()
 
 	logger.Info("Veth starting", zap.String("Version", pVersion.GitCommit()), zap.String("Branch", pVersion.GitBranch()),
 		zap.String("Commit", pVersion.GitCommit()),
 		zap.String("Build time", pVersion.BuildDate()),
 		zap.String("Go Version", pVersion.GoString()))
 
+	if len(nodeConfigs) != 0 {
+		logger.Info("Merge node config successfully", zap.Strings("files", nodeConfigs), zap.ByteString("config", stdin))
+	}
+	if conf.NodeOverrides != nil {
+		merged, ok, err := nodeOverrides(logger, conf, stdin)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if conf, err = config.ParseVethConfig(merged); err != nil {
+				logger.Error("invalid config merged with node annotation", zap.Error(err))
+				return err
+			}
+		}
+	}
+	for _, warning := range config.VethConfigWarnings(conf) {
+		logger.Warn(warning)
+	}
+
 	k8sArgs := ty.K8sArgs{}
 	if err = types.LoadArgs(args.Args, &k8sArgs); nil != err {
-		return fmt.Errorf("failed to get pod information, error=%+v \n", err)
+		return cnierrors.New(types.ErrInvalidEnvironmentVariables, err, "failed to get pod information")
 	}
 
 	// register some args into logger
 	logger = logger.With(zap.String("Action", "Add"),
-		zap.String("ContainerID", args.ContainerID),
 		zap.String("PodUID", string(k8sArgs.K8S_POD_UID)),
 		zap.String("PodName", string(k8sArgs.K8S_POD_NAME)),
 		zap.String("PodNamespace", string(k8sArgs.K8S_POD_NAMESPACE)),
 		zap.String("IfName", args.IfName))
 
+	overrides, err := podOverrides(logger, conf, &k8sArgs)
+	if err != nil {
+		return err
+	}
+
 	ipFamily, err := networking.GetIPFamily(conf.PrevResult)
 	if err != nil {
 		logger.Error("failed to GetIPFamily", zap.Error(err))
@@ -87,70 +156,147 @@ func cmdAdd(args *skel.CmdArgs) error {
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
 		logger.Error(err.Error())
-		return fmt.Errorf("failed to GetNS %q: %v", args.Netns, err)
+		return cnierrors.New(types.ErrUnknownContainer, err, "failed to GetNS %q", args.Netns)
 	}
 	defer netns.Close()
 
-	if len(conf.HwPrefix) != 0 {
-		hwAddr, err := networking.OverrideHwAddress(logger, netns, conf.HwPrefix, args.IfName)
-		if err != nil {
-			return fmt.Errorf("failed to update hardware address for interface %s, maybe hardware_prefix(%s) is invalid: %v", args.IfName, conf.HwPrefix, err)
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), addTimeout)
+	defer cancel()
 
-		logger.Info("Override hardware address successfully", zap.String("interface", args.IfName), zap.String("hardware address", hwAddr))
+	// serialize the invocations for the same pod netns, so different interfaces of a pod
+	// don't race on checking veth0 and choosing the rule table
+	lockCtx, cancelLock := context.WithTimeout(ctx, lockTimeout(conf))
+	defer cancelLock()
+	netnsLock, err := lock.Acquire(lockCtx, lock.NetnsLockPath(lockDir, args.Netns))
+	if err != nil {
+		logger.Error("failed to lock pod netns", zap.Error(err))
+		return err
+	}
+	defer netnsLock.Release() // nolint: errcheck
+
+	// the netlink requests are sent through the handles, no need to switch netns for them
+	hostHandle, err := networking.NewHandle(logger, nil)
+	if err != nil {
+		logger.Error("failed to open netlink handle of host", zap.Error(err))
+		return err
+	}
+	defer hostHandle.Close()
+
+	podHandle, err := networking.NewHandle(logger, netns)
+	if err != nil {
+		logger.Error("failed to open netlink handle of pod", zap.Error(err))
+		return err
+	}
+	defer podHandle.Close()
+
+	hwAddr, err := setHwAddress(ctx, logger, podHandle, conf, overrides, args.IfName)
+	if err != nil {
+		return err
+	}
+	if hwAddr != nil {
+		// report the address the interface ends up with to the runtime
+		if conf.PrevResult, err = networking.SetResultHwAddress(conf.PrevResult, args.IfName, hwAddr); err != nil {
+			logger.Error("failed to update hardware address in prevResult", zap.Error(err))
+			return err
+		}
 		if conf.OnlyHardware {
 			logger.Debug("Only override hardware address, ending to call veth")
 			return types.PrintResult(conf.PrevResult, conf.CNIVersion)
 		}
 	}
 
-	isfirstInterface, e := isInterfaceExists(netns, defaultConVeth)
-	if e != nil {
-		logger.Error("failed to check if is first veth interface", zap.Error(e))
-		return fmt.Errorf("failed to check first veth interface: %v", e)
+	if overrides != nil && overrides.Disabled {
+		logger.Info("Veth is disabled by pod annotation, ending to call veth")
+		return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	}
+
+	// IPv6 of the node is checked before the veth pair is created, so the pod is never half set up
+	if ipFamily != netlink.FAMILY_V4 {
+		if ipFamily, err = hostIPFamily(logger, conf, ipFamily); err != nil {
+			return err
+		}
 	}
 
+	vethExists, err := podHandle.LinkExists(ctx, defaultConVeth)
+	if err != nil {
+		logger.Error("failed to check if is first veth interface", zap.Error(err))
+		return fmt.Errorf("failed to check first veth interface: %w", err)
+	}
+	isfirstInterface := !vethExists
+
 	if !isfirstInterface {
 		logger.Info("Calling veth plugin not for the first time", zap.Any("config", conf), zap.String("netns", netns.Path()))
 	} else {
 		logger.Info("Calling veth plugin for first time", zap.Any("config", conf), zap.String("netns", netns.Path()))
 	}
 
-	var hostVethPairName string
-	hostVethPairName, err = setupVeth(netns, isfirstInterface, args.ContainerID)
+	phaseStart := time.Now()
+	hostVethPairName, netkit, err := setupVeth(logger, netns, isfirstInterface, args.ContainerID, conf)
 	if err != nil {
 		logger.Error("failed to create veth-pair device", zap.Error(err))
 		return err
 	}
+	rec.ObservePhase(metrics.PhaseVethSetup, phaseStart)
+
+	logger.Debug("Setup veth-pair device successfully", zap.String("hostVethPairName", hostVethPairName), zap.Bool("netkit", netkit))
+
+	if isfirstInterface && conf.Offload != nil {
+		phaseStart = time.Now()
+		if err = setupOffload(logger, netns, hostVethPairName, args.ContainerID, conf); err != nil {
+			return err
+		}
+		rec.ObservePhase(metrics.PhaseOffload, phaseStart)
+	}
 
-	logger.Debug("Setup veth-pair device successfully", zap.String("hostVethPairName", hostVethPairName))
+	if bandwidth := podBandwidth(conf); bandwidth != nil {
+		if isfirstInterface {
+			phaseStart = time.Now()
+			if err = setupBandwidth(logger, hostVethPairName, args.ContainerID, bandwidth); err != nil {
+				return err
+			}
+			rec.ObservePhase(metrics.PhaseBandwidth, phaseStart)
+		} else {
+			logger.Warn("bandwidth only applies to the first interface, it's ignored")
+		}
+	}
 
 	// get all ip address on the node
-	ipAddressOnNode, err := networking.IPAddressOnNode(logger, ipFamily)
+	ipAddressOnNode, err := hostHandle.IPAddressOnNode(ctx, ipFamily)
 	if err != nil {
 		logger.Error("failed to get IPAddressOnNode", zap.Error(err))
-		return fmt.Errorf("failed to get IPAddressOnNode: %v", err)
+		return fmt.Errorf("failed to get IPAddressOnNode: %w", err)
+	}
+
+	if !conf.LinkLocalGateway {
+		ipAddressOnNode = withHostGateway(ipAddressOnNode, conf.HostGateway, ipFamily)
 	}
 
 	// get ips of this interface(preInterfaceName) from, including ipv4 and ipv6
-	preInterfaceIPAddress, err := networking.IPAddressByName(netns, args.IfName, ipFamily)
+	preInterfaceIPAddress, err := podHandle.IPAddressByName(ctx, args.IfName, ipFamily)
 	if err != nil {
 		logger.Error(err.Error())
-		return fmt.Errorf("failed to find ip from chained interface %s : %v", args.IfName, err)
+		return fmt.Errorf("failed to find ip from chained interface %s : %w", args.IfName, err)
 	}
 
 	logger.Info("Get the address of interface successfully", zap.String("interface", args.IfName), zap.Any("preInterfaceIPAddress", preInterfaceIPAddress))
 
 	if ipFamily != netlink.FAMILY_V4 {
 		// ensure ipv6 is enable
-		if err := networking.EnableIpv6Sysctl(logger, netns); err != nil {
+		if err := networking.EnableIpv6Sysctl(logger, netns, "lo", defaultConVeth, args.IfName); err != nil {
 			return err
 		}
 	}
 
-	if err = setupNeighborhood(logger, netns, hostVethPairName, isfirstInterface, ipAddressOnNode, preInterfaceIPAddress); err != nil {
-		logger.Error(err.Error())
-		return err
+	// netkit has no L2 header, a packet sent to the device is handed to the peer as is without
+	// neighbor resolution. The static neighbors and the proxy entries only exist to answer ARP/NDP
+	// between the pod and the host, there is nothing to answer on netkit.
+	if !netkit {
+		phaseStart = time.Now()
+		if err = setupNeighborhood(ctx, lockCtx, logger, hostHandle, podHandle, hostVethPairName, isfirstInterface, ipAddressOnNode, preInterfaceIPAddress, conf, ipFamily); err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+		rec.ObservePhase(metrics.PhaseNeighbor, phaseStart)
 	}
 
 	ruleTable := unix.RT_TABLE_MAIN
@@ -158,47 +304,264 @@ func cmdAdd(args *skel.CmdArgs) error {
 		ruleTable = utils.GetRuleNumber(args.IfName)
 		if ruleTable < 0 {
 			logger.Error("In multi-NIC mode, the first NIC can only be Macvlan/SR-IOV + Veth, Not Calico or CIilum")
-			return fmt.Errorf("In multi-NIC mode, the first NIC can only be Macvlan/SR-IOV + Veth, Not Calico or Ciilum")
+			return cnierrors.New(cnierrors.ErrUnsupportedFirstInterface, nil, "In multi-NIC mode, the first NIC can only be Macvlan/SR-IOV + Veth, Not Calico or Ciilum")
+		}
+		if utils.IsReservedTable(ruleTable) {
+			logger.Error("No policy routing table is left for the interface", zap.Int("ruleTable", ruleTable))
+			return cnierrors.New(cnierrors.ErrRuleTableExhausted, nil, "the policy routing table %d of interface %s is reserved by kernel", ruleTable, args.IfName)
 		}
 	}
 
-	if err = setupRoutes(logger, netns, ruleTable, hostVethPairName, ipAddressOnNode, preInterfaceIPAddress, conf); err != nil {
+	phaseStart = time.Now()
+	if err = setupRoutes(ctx, lockCtx, logger, hostHandle, podHandle, ruleTable, hostVethPairName, args.IfName, ipAddressOnNode, preInterfaceIPAddress, conf, ipFamily); err != nil {
 		logger.Error(err.Error())
 		return err
 	}
+	rec.ObservePhase(metrics.PhaseRoutes, phaseStart)
+	rec.SetPolicyTables(policyTables(conf, ruleTable))
 
 	if !isfirstInterface {
-		if err = networking.MoveRoutes(logger, netns, args.IfName, preInterfaceIPAddress, conf.MoveRoutes, ruleTable, ipFamily); err != nil {
+		phaseStart = time.Now()
+		if err = podHandle.MoveRoutes(ctx, args.IfName, preInterfaceIPAddress, conf.MoveRoutes, ruleTable, ipFamily); err != nil {
 			logger.Error(err.Error())
 			return err
 		}
+		rec.ObservePhase(metrics.PhaseMoveRoutes, phaseStart)
+	}
+
+	// the default routes of the chained interface are moved out of the main table above, the ones learned
+	// from router advertisements later would come back and fight the policy routing
+	if ipFamily != netlink.FAMILY_V4 && (!isfirstInterface || egressViaHost(conf)) && (conf.IPv6 == nil || !conf.IPv6.AcceptRADefaultRoute) {
+		err = netns.Do(func(ns.NetNS) error {
+			return networking.SuppressRADefaultRoute(args.IfName)
+		})
+		if err != nil {
+			logger.Error("failed to suppress the default routes from router advertisements", zap.Error(err))
+			return err
+		}
+	}
+
+	if isfirstInterface {
+		if err = setupConnmarks(logger, netns, args.IfName, conf, ipFamily); err != nil {
+			return err
+		}
+		if egressViaHost(conf) {
+			phaseStart = time.Now()
+			if err = setupEgress(lockCtx, logger, args.ContainerID, preInterfaceIPAddress, conf, ipFamily); err != nil {
+				return err
+			}
+			rec.ObservePhase(metrics.PhaseEgress, phaseStart)
+		}
+	} else if egressViaHost(conf) || replyViaVeth(conf) {
+		logger.Warn("egress_via_host and reply_via_veth only apply to the first interface, they are ignored")
+	}
+
+	if hostFilter(conf) {
+		phaseStart = time.Now()
+		if err = setupHostFilter(lockCtx, logger, hostVethPairName, ipAddressOnNode, preInterfaceIPAddress, conf, ipFamily); err != nil {
+			return err
+		}
+		rec.ObservePhase(metrics.PhaseHostFilter, phaseStart)
 	}
 
-	if err = networking.SysctlRPFilter(netns, conf.RPFilter); err != nil {
+	// before ebpf_redirect, which doesn't redirect the IPv4 of the node devices with strict rp_filter
+	phaseStart = time.Now()
+	err = withHostLock(lockCtx, func() error {
+		return networking.SysctlHostRPFilter(conf.RPFilter)
+	})
+	if err == nil {
+		err = networking.SysctlPodRPFilter(netns, conf.RPFilter)
+	}
+	if err != nil {
 		logger.Error("failed to SysctlRPFilter", zap.Any("rp_filter", conf.RPFilter), zap.Error(err))
 		return err
 	}
+	rec.ObservePhase(metrics.PhaseSysctl, phaseStart)
+
+	if ebpfRedirect(conf) {
+		if netkit {
+			logger.Warn("ebpf_redirect doesn't apply to netkit, it's ignored")
+		} else {
+			phaseStart = time.Now()
+			if err = setupEBPFRedirect(ctx, lockCtx, logger, hostHandle, podHandle, hostVethPairName, args.IfName, ipAddressOnNode, preInterfaceIPAddress, conf); err != nil {
+				return err
+			}
+			rec.ObservePhase(metrics.PhaseRedirect, phaseStart)
+		}
+	}
+
+	if conntrackCleanup(conf) {
+		phaseStart = time.Now()
+		flushConntrack(logger, addrsToIPs(preInterfaceIPAddress), conf.ConntrackCleanup)
+		rec.ObservePhase(metrics.PhaseConntrack, phaseStart)
+	}
+
+	if conf.Metrics != nil && conf.Metrics.Enable {
+		if n, e := hostHandle.CountHostPodRoutes(ctx, hostVethPrefix); e != nil {
+			logger.Warn("failed to count host pod routes", zap.Error(e))
+		} else {
+			rec.SetHostPodRoutes(n)
+		}
+	}
 
 	logger.Info("succeeded to call veth-plugin", zap.Int64("Time Cost", time.Since(startTime).Microseconds()))
 	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	// nothing to do
+	if err := del(args); err != nil {
+		return cnierrors.ToCNIError(err)
+	}
 	return nil
 }
 
+// del removes the host-scope state of the pod, the ones in the pod go with its netns
+func del(args *skel.CmdArgs) (err error) {
+	// a broken node config must not fail DEL, the config is used as is then
+	stdin, _, e := config.MergeNodeConfig(args.StdinData, nodeConfigDir)
+	if e != nil {
+		stdin = args.StdinData
+	}
+	conf := ptypes.Veth{}
+	if e := json.Unmarshal(stdin, &conf); e != nil {
+		// nothing is known to clean up, DEL succeeds so the runtime doesn't retry it forever
+		_ = initLogger(config.VethLogOptions(nil), pluginName)
+		logging.LoggerFile.Warn("failed to decode the config of DEL, nothing is cleaned up",
+			zap.String("ContainerID", args.ContainerID), zap.Error(e))
+		return nil
+	}
+	// DEL doesn't wait for the API server, the cached annotation of the node is used
+	if conf.NodeOverrides != nil {
+		if name, e := nodeName(conf.NodeOverrides); e == nil {
+			if annotations, _, ok := nodeCache(conf.NodeOverrides, name).Load(name); ok {
+				if merged, e := config.MergeNodeAnnotation(stdin, annotations); e == nil {
+					conf = ptypes.Veth{}
+					_ = json.Unmarshal(merged, &conf)
+				}
+			}
+		}
+	}
+	// only record metrics, DEL must not fail for it
+	defer func() {
+		rec := metrics.NewRecorder(metrics.CommandDel, args.ContainerID, args.IfName)
+		if conf.Metrics != nil && conf.Metrics.Enable {
+			// the host veth of the pod goes with its netns, its routes aren't counted
+			if n, e := countHostPodRoutes(getHostVethName(args.ContainerID)); e == nil {
+				rec.SetHostPodRoutes(n)
+			}
+		}
+		_ = rec.Flush(conf.Metrics, err)
+	}()
+
+	if !egressViaHost(&conf) && !hostFilter(&conf) && !conntrackCleanup(&conf) && !ebpfRedirect(&conf) && !offloadRestore(&conf) && podBandwidth(&conf) == nil {
+		return nil
+	}
+
+	// the ifb device isn't removed with the pod netns
+	if podBandwidth(&conf) != nil {
+		if err := networking.TeardownBandwidth(getHostVethName(args.ContainerID), getIfbName(args.ContainerID)); err != nil {
+			return err
+		}
+	}
+
+	// prevResult is optional for DEL, clean up both families without it
+	ipFamily := netlink.FAMILY_ALL
+	var ips []net.IP
+	if e := version.ParsePrevResult(&conf.NetConf); e == nil && conf.PrevResult != nil {
+		if family, e := networking.GetIPFamily(conf.PrevResult); e == nil {
+			ipFamily = family
+		}
+		ips, _ = networking.GetIPs(conf.PrevResult)
+	}
+	// ADD set up nothing of IPv6 if the kernel doesn't support it, and ip6tables fails there
+	if ipFamily != netlink.FAMILY_V4 && !networking.IPv6Supported() {
+		ipFamily = netlink.FAMILY_V4
+	}
+
+	if conntrackCleanup(&conf) || offloadRestore(&conf) {
+		// a log failure must not break DEL, the sinks which work are still used
+		_ = initLogger(config.VethLogOptions(conf.LogOptions), pluginName)
+		logger := logging.LoggerFile.With(zap.String("TraceID", logging.NewTraceID()),
+			zap.String("ContainerID", args.ContainerID))
+		if conntrackCleanup(&conf) {
+			flushConntrack(logger, ips, conf.ConntrackCleanup)
+		}
+		if offloadRestore(&conf) {
+			restoreOffload(logger, args)
+		}
+	}
+	if !egressViaHost(&conf) && !hostFilter(&conf) && !ebpfRedirect(&conf) {
+		return nil
+	}
+
+	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout(&conf))
+	defer cancel()
+	return withHostLock(lockCtx, func() error {
+		// the programs on the node devices outlive the host veth
+		if ebpfRedirect(&conf) {
+			if err := networking.TeardownPodRedirect(getHostVethName(args.ContainerID)); err != nil {
+				return err
+			}
+		}
+		if hostFilter(&conf) {
+			backend, err := networking.ResolveFirewallBackend(conf.FirewallBackend)
+			if err != nil {
+				return err
+			}
+			if err = networking.TeardownHostFilter(backend, getHostVethName(args.ContainerID), ipFamily); err != nil {
+				return err
+			}
+		}
+		if !egressViaHost(&conf) {
+			return nil
+		}
+		if err := networking.TeardownEgressMasquerade(args.ContainerID, ipFamily); err != nil {
+			return err
+		}
+		return networking.ReleaseForwarding(stateDir, args.ContainerID)
+	})
+}
+
 func cmdCheck(args *skel.CmdArgs) error {
 	// TODO
 	return fmt.Errorf("not implement it")
 }
 
-// setupVeth sets up a pair of virtual ethernet devices. move one to the host and other
-// one to container.
-func setupVeth(netns ns.NetNS, firstInvoke bool, containerID string) (string, error) {
+// setupVeth creates the device pair of device_type between the pod and the host for the first interface,
+// and returns the name of the host peer and whether it's netkit.
+func setupVeth(logger *zap.Logger, netns ns.NetNS, firstInvoke bool, containerID string, conf *ptypes.Veth) (string, bool, error) {
 	if !firstInvoke {
-		return getHostVethName(containerID), nil
+		netkit := false
+		err := netns.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(defaultConVeth)
+			if err != nil {
+				return err
+			}
+			netkit = networking.IsNetkit(link)
+			return nil
+		})
+		if err != nil {
+			return "", false, cnierrors.IO(err, "failed to find %s", defaultConVeth)
+		}
+		return getHostVethName(containerID), netkit, nil
+	}
+
+	if conf.DeviceType == ptypes.DeviceTypeNetkit {
+		var hostInterface net.Interface
+		err := netns.Do(func(hostNS ns.NetNS) error {
+			var err error
+			hostInterface, _, err = networking.SetupNetkitWithName(defaultConVeth, getHostVethName(containerID), defaultMtu, hostNS)
+			return err
+		})
+		if err == nil {
+			return hostInterface.Name, true, nil
+		}
+		if cnierrors.Code(err) != cnierrors.ErrUnsupportedDevice || !conf.DeviceFallback {
+			return "", false, err
+		}
+		logger.Warn("netkit isn't supported by the kernel, fall back to veth", zap.Error(err))
 	}
+
 	var hostInterface, containerInterface net.Interface
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		var err error
@@ -213,32 +576,36 @@ func setupVeth(netns ns.NetNS, firstInvoke bool, containerID string) (string, er
 		}
 
 		if err := netlink.LinkSetUp(link); err != nil {
-			return fmt.Errorf("failed to set %q UP: %v", containerInterface.Name, err)
+			return fmt.Errorf("failed to set %q UP: %w", containerInterface.Name, err)
 		}
 		return nil
 	})
 
 	if err != nil {
-		return "", err
+		return "", false, cnierrors.IO(err, "failed to setup veth pair")
 	}
 
-	return hostInterface.Name, nil
+	return hostInterface.Name, false, nil
 }
 
 // setupNeighborhood setup neighborhood tables for pod and host.
 // equivalent to: `ip neigh add ....`
-func setupNeighborhood(logger *zap.Logger, netns ns.NetNS, hostVethPairName string, isfirstInterface bool, ipAddressOnNode, preInterfaceIPAddress []netlink.Addr) error {
-	var err error
-	hostVethHwAddress, containerVethHwAddress, err := networking.HwAddressByName(netns, hostVethPairName)
+func setupNeighborhood(ctx, lockCtx context.Context, logger *zap.Logger, hostHandle, podHandle *networking.Handle, hostVethPairName string, isfirstInterface bool, ipAddressOnNode, preInterfaceIPAddress []netlink.Addr, conf *ptypes.Veth, ipFamily int) error {
+	hostVethHwAddress, err := hostHandle.HwAddressByName(ctx, hostVethPairName)
+	if err != nil {
+		return err
+	}
+	containerVethHwAddress, err := podHandle.HwAddressByName(ctx, defaultConVeth)
 	if err != nil {
 		return err
 	}
 
-	for _, ipAddr := range preInterfaceIPAddress {
-		if err = networking.AddNeighborTable(hostVethPairName, ipAddr.IP, containerVethHwAddress); err != nil {
-			logger.Error(err.Error())
-			return err
-		}
+	err = withHostLock(lockCtx, func() error {
+		return hostHandle.AddNeighborTable(ctx, hostVethPairName, addrsToIPs(preInterfaceIPAddress), containerVethHwAddress)
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		return err
 	}
 
 	if !isfirstInterface {
@@ -251,97 +618,807 @@ func setupNeighborhood(logger *zap.Logger, netns ns.NetNS, hostVethPairName stri
 		zap.String("hostVethHwAddress", hostVethHwAddress.String()),
 		zap.String("containerVethHwAddress", containerVethHwAddress.String()))
 
-	err = netns.Do(func(_ ns.NetNS) error {
-		for _, ipAddr := range ipAddressOnNode {
-			if err := networking.AddNeighborTable(defaultConVeth, ipAddr.IP, hostVethHwAddress); err != nil {
+	gateways := addrsToIPs(ipAddressOnNode)
+	if conf.LinkLocalGateway {
+		// a single gateway entry in the pod. The gateway isn't an address of the node, nothing would answer
+		// ARP for it once the entry is gone, and the kernel flushes even the permanent entries of veth0 if
+		// it's set down, so the host veth answers ARP for it by proxy_arp
+		gateways = linkLocalGateways(ipFamily)
+		if ipFamily != netlink.FAMILY_V6 {
+			if err = networking.EnableProxyARP(hostVethPairName); err != nil {
+				logger.Error(err.Error())
 				return err
 			}
 		}
-		return nil
-	})
-	if err != nil {
+		// the same for fe80::1, the node answers the neighbor solicitations only for the addresses on
+		// the host veth, so it's proxied by proxy_ndp and a proxy entry
+		if ipFamily != netlink.FAMILY_V4 {
+			if err = networking.EnableProxyNDP(hostVethPairName); err != nil {
+				logger.Error(err.Error())
+				return err
+			}
+			if err = hostHandle.AddNeighborProxy(ctx, hostVethPairName, gateways); err != nil {
+				logger.Error(err.Error())
+				return err
+			}
+		}
+	}
+
+	if err = podHandle.AddNeighborTable(ctx, defaultConVeth, gateways, hostVethHwAddress); err != nil {
 		logger.Error(err.Error())
 		return err
 	}
 
-	return err
+	return nil
 }
 
 // setupRoutes setup routes for pod and host
 // equivalent to: `ip route add $route`
-func setupRoutes(logger *zap.Logger, netns ns.NetNS, ruleTable int, hostVethPairName string, ipAddressOnNode, preInterfaceIPAddress []netlink.Addr, conf *ptypes.Veth) error {
-	v4Gw, v6Gw, err := networking.GetGatewayIP(preInterfaceIPAddress)
-	if err != nil {
-		logger.Error("failed to GetGatewayIP", zap.Error(err))
-		return err
+func setupRoutes(ctx, lockCtx context.Context, logger *zap.Logger, hostHandle, podHandle *networking.Handle, ruleTable int, hostVethPairName, chainedInterface string, ipAddressOnNode, preInterfaceIPAddress []netlink.Addr, conf *ptypes.Veth, ipFamily int) error {
+	// the routes via veth0 use the address of the chained interface as src,
+	// so the pods with several interfaces or addresses have a predictable one
+	var err error
+	var nexthop networking.Nexthop
+	if conf.RouteSource == nil || conf.RouteSource.Enable == nil || *conf.RouteSource.Enable {
+		source := conf.RouteSource
+		if source == nil {
+			source = &ptypes.RouteSource{}
+		}
+		nexthop.V4Src, nexthop.V6Src, err = networking.SelectSourceIPs(preInterfaceIPAddress, source.IPv4CIDR, source.IPv6CIDR)
+		if err != nil {
+			logger.Error("failed to select source address", zap.Error(err))
+			return err
+		}
 	}
+	direct := networking.Nexthop{V4Src: nexthop.V4Src, V6Src: nexthop.V6Src}
+
+	if conf.LinkLocalGateway {
+		// the cluster CIDRs below are routed via the link-local gateway, there is no route per node address,
+		// so nothing in the pod goes stale when the addresses of the node change
+		// eq: "ip r add 169.254.1.1 dev veth0 table <ruleTable>"
+		nexthop.V4Gw, nexthop.V6Gw = linkLocalGatewayV4, linkLocalGatewayV6
+		if err = podHandle.AddRouteTable(ctx, ruleTable, netlink.SCOPE_LINK, defaultConVeth, ipsToString(linkLocalGateways(ipFamily)), direct); err != nil {
+			logger.Error("failed to AddRouteTable for link-local gateway", zap.Error(err))
+			return fmt.Errorf("failed to AddRouteTable for link-local gateway: %w", err)
+		}
+	} else {
+		nexthop.V4Gw, nexthop.V6Gw, err = hostGateway(ctx, hostHandle, preInterfaceIPAddress, conf.HostGateway)
+		if err != nil {
+			logger.Error("failed to GetGatewayIP", zap.Error(err))
+			return err
+		}
 
-	err = netns.Do(func(_ ns.NetNS) error {
-		var err error
 		// traffic sent to the node is forwarded via veth0
 		// eq:  "ip r add <ipAddressOnNode> dev veth0 table <ruleTable> "
-		if err = networking.AddRouteTable(logger, ruleTable, netlink.SCOPE_LINK, defaultConVeth, networking.AddrsToString(ipAddressOnNode), nil, nil); err != nil {
+		if err = podHandle.AddRouteTable(ctx, ruleTable, netlink.SCOPE_LINK, defaultConVeth, networking.AddrsToString(ipAddressOnNode), direct); err != nil {
 			logger.Error("failed to AddRouteTable for ipAddressOnNode", zap.Error(err))
-			return fmt.Errorf("failed to AddRouteTable for ipAddressOnNode: %v", err)
+			return fmt.Errorf("failed to AddRouteTable for ipAddressOnNode: %w", err)
 		}
+	}
+
+	// make sure that veth0 forwards traffic within the cluster
+	// eq: ip route add <cluster/service cidr> dev veth0
+	localCIDRs := append(conf.ClusterCIDR, conf.ServiceCIDR...)
+	localCIDRs = append(localCIDRs, conf.AdditionalCIDR...)
+	if err = podHandle.AddRouteTable(ctx, ruleTable, netlink.SCOPE_UNIVERSE, defaultConVeth, localCIDRs, nexthop); err != nil {
+		logger.Error("failed to AddRouteTable for localCIDRs", zap.Error(err))
+		return fmt.Errorf("failed to AddRouteTable for localCIDRs: %w", err)
+	}
 
-		// make sure that veth0 forwards traffic within the cluster
-		// eq: ip route add <cluster/service cidr> dev veth0
-		localCIDRs := append(conf.ClusterCIDR, conf.ServiceCIDR...)
-		localCIDRs = append(localCIDRs, conf.AdditionalCIDR...)
-		if err = networking.AddRouteTable(logger, ruleTable, netlink.SCOPE_UNIVERSE, defaultConVeth, localCIDRs, v4Gw, v6Gw); err != nil {
-			logger.Error("failed to AddRouteTable for localCIDRs", zap.Error(err))
-			return fmt.Errorf("failed to AddRouteTable for localCIDRs: %v", err)
+	// eq: ip route add <dst> dev <veth0|chained interface> via <via> metric <metric> mtu <mtu> table <table>
+	// the routes of runtimeConfig are added along with the ones of the config
+	routes := append(append([]ptypes.Route{}, conf.Routes...), config.RuntimeRoutes(conf)...)
+	if err = podHandle.AddCustomRoutes(ctx, routes, ruleTable, defaultConVeth, chainedInterface, nexthop); err != nil {
+		logger.Error("failed to AddCustomRoutes", zap.Error(err))
+		return fmt.Errorf("failed to AddCustomRoutes: %w", err)
+	}
+
+	// the default egress is sent via veth0, the default routes of the chained interface are kept for
+	// the replies of the connections from it, see setupConnmarks
+	// eq: ip route add default via <gateway> dev veth0
+	if egressViaHost(conf) && ruleTable == unix.RT_TABLE_MAIN {
+		table, mark := egressTableAndMark(conf.EgressViaHost)
+		if err = podHandle.SetupEgressViaHost(ctx, defaultConVeth, chainedInterface, preInterfaceIPAddress, nexthop, table, mark, ipFamily); err != nil {
+			logger.Error("failed to SetupEgressViaHost", zap.Error(err))
+			return fmt.Errorf("failed to SetupEgressViaHost: %w", err)
 		}
+	}
 
-		// As for more than two macvlan interface, we need to add something like below shown:
-		// make sure that all traffic to second NIC to lookup table <<ruleTable>>
-		// eq: ip rule add to <preInterfaceIPAddress> lookup table <ruleTable>
-		if ruleTable != unix.RT_TABLE_MAIN {
-			if err = networking.AddToRuleTable(preInterfaceIPAddress, ruleTable); err != nil {
-				logger.Error("failed to AddToRuleTable", zap.Error(err))
-				return fmt.Errorf("failed to AddToRuleTable: %v", err)
-			}
+	// the replies of the connections from veth0, like NodePort traffic, are sent back via veth0, see setupConnmarks
+	// eq: ip route add default via <gateway> dev veth0 table <table>
+	if replyViaVeth(conf) && ruleTable == unix.RT_TABLE_MAIN {
+		table, mark := replyTableAndMark(conf.ReplyViaVeth)
+		if err = podHandle.SetupReplyViaVeth(ctx, defaultConVeth, nexthop, table, mark, ipFamily); err != nil {
+			logger.Error("failed to SetupReplyViaVeth", zap.Error(err))
+			return fmt.Errorf("failed to SetupReplyViaVeth: %w", err)
 		}
-		logger.Debug("AddRouteTable for localCIDRs successfully", zap.Strings("localCIDRs", localCIDRs))
-		return nil
-	})
+	}
 
-	if err != nil {
-		return err
+	// As for more than two macvlan interface, we need to add something like below shown:
+	// make sure that all traffic to second NIC to lookup table <<ruleTable>>
+	// eq: ip rule add to <preInterfaceIPAddress> lookup table <ruleTable>
+	if ruleTable != unix.RT_TABLE_MAIN {
+		if err = podHandle.AddToRuleTable(ctx, preInterfaceIPAddress, ruleTable); err != nil {
+			logger.Error("failed to AddToRuleTable", zap.Error(err))
+			return fmt.Errorf("failed to AddToRuleTable: %w", err)
+		}
 	}
+	logger.Debug("AddRouteTable for localCIDRs successfully", zap.Strings("localCIDRs", localCIDRs))
 
 	// set routes for host
 	// equivalent: ip add  <chainedIPs> dev veth-peer on host
-	if err = networking.AddRouteTable(logger, unix.RT_TABLE_MAIN, netlink.SCOPE_UNIVERSE, hostVethPairName, networking.AddrsToString(preInterfaceIPAddress),
-		nil, nil); err != nil {
+	err = withHostLock(lockCtx, func() error {
+		return hostHandle.AddRouteTable(ctx, unix.RT_TABLE_MAIN, netlink.SCOPE_UNIVERSE, hostVethPairName, networking.AddrsToString(preInterfaceIPAddress),
+			networking.Nexthop{})
+	})
+	if err != nil {
 		logger.Error("failed to AddRouteTable for preInterfaceIPAddress", zap.Error(err))
-		return fmt.Errorf("failed to AddRouteTable for preInterfaceIPAddress: %v", err)
+		return fmt.Errorf("failed to AddRouteTable for preInterfaceIPAddress: %w", err)
 	}
 
 	return err
 }
 
-// isInterfaceExists returns true by checking if the interface exists in the netns
-func isInterfaceExists(netns ns.NetNS, iface string) (bool, error) {
-	e := netns.Do(func(_ ns.NetNS) error {
-		_, err := netlink.LinkByName(iface)
+// setupConnmarks marks the connections from the chained interface for egress_via_host, and the ones
+// from veth0 for reply_via_veth, so their replies are routed back the way they came in.
+func setupConnmarks(logger *zap.Logger, netns ns.NetNS, chainedInterface string, conf *ptypes.Veth, ipFamily int) error {
+	var connmarks []networking.Connmark
+	if egressViaHost(conf) {
+		_, mark := egressTableAndMark(conf.EgressViaHost)
+		connmarks = append(connmarks, networking.Connmark{Iface: chainedInterface, Mark: mark})
+	}
+	if replyViaVeth(conf) {
+		_, mark := replyTableAndMark(conf.ReplyViaVeth)
+		connmarks = append(connmarks, networking.Connmark{Iface: defaultConVeth, Mark: mark})
+	}
+	if len(connmarks) == 0 {
+		return nil
+	}
+
+	backend, err := networking.ResolveFirewallBackend(conf.FirewallBackend)
+	if err != nil {
+		logger.Error("failed to resolve firewall backend", zap.Error(err))
+		return err
+	}
+	if err = networking.SetupConnmarks(netns, backend, connmarks, ipFamily); err != nil {
+		logger.Error("failed to SetupConnmarks", zap.String("backend", backend), zap.Error(err))
 		return err
+	}
+	logger.Debug("Setup connmarks successfully", zap.String("backend", backend), zap.Any("connmarks", connmarks))
+	return nil
+}
+
+// setupEgress enables forwarding and masquerade of the pod addresses on the host, they are removed by DEL.
+func setupEgress(lockCtx context.Context, logger *zap.Logger, containerID string, preInterfaceIPAddress []netlink.Addr, conf *ptypes.Veth, ipFamily int) error {
+	// the traffic within the cluster keeps the pod address
+	var excluded []string
+	excluded = append(excluded, conf.ClusterCIDR...)
+	excluded = append(excluded, conf.ServiceCIDR...)
+	excluded = append(excluded, conf.AdditionalCIDR...)
+	err := withHostLock(lockCtx, func() error {
+		if err := networking.AcquireForwarding(stateDir, containerID, ipFamily); err != nil {
+			return err
+		}
+		return networking.SetupEgressMasquerade(containerID, preInterfaceIPAddress, excluded, ipFamily)
 	})
+	if err != nil {
+		logger.Error("failed to setup forwarding and masquerade on host", zap.Error(err))
+		return err
+	}
+	return nil
+}
 
-	if e == nil {
-		return false, nil
+// setupHostFilter filters the traffic from the pod on the host veth, it's removed by DEL.
+func setupHostFilter(lockCtx context.Context, logger *zap.Logger, hostVethPairName string, ipAddressOnNode, preInterfaceIPAddress []netlink.Addr, conf *ptypes.Veth, ipFamily int) error {
+	filter := &networking.HostFilter{
+		HostVeth:             hostVethPairName,
+		Sources:              addrsToIPs(preInterfaceIPAddress),
+		RestrictDestinations: conf.HostFilter.RestrictDestinations,
 	}
-	if strings.EqualFold(e.Error(), ip.ErrLinkNotFound.Error()) {
-		return true, nil
-	} else {
-		return false, e
+	if filter.RestrictDestinations {
+		filter.Destinations = append(filter.Destinations, conf.ClusterCIDR...)
+		filter.Destinations = append(filter.Destinations, conf.ServiceCIDR...)
+		filter.Destinations = append(filter.Destinations, conf.AdditionalCIDR...)
+		filter.Destinations = append(filter.Destinations, networking.AddrsToString(ipAddressOnNode)...)
+	}
+	for _, port := range conf.HostFilter.AllowedPorts {
+		r, err := networking.ParsePortRange(port)
+		if err != nil {
+			return cnierrors.InvalidConfig(err, "invalid allowed port %s", port)
+		}
+		filter.Ports = append(filter.Ports, r)
+	}
+
+	backend, err := networking.ResolveFirewallBackend(conf.FirewallBackend)
+	if err != nil {
+		logger.Error("failed to resolve firewall backend", zap.Error(err))
+		return err
+	}
+	err = withHostLock(lockCtx, func() error {
+		return networking.SetupHostFilter(backend, filter, ipFamily)
+	})
+	if err != nil {
+		logger.Error("failed to SetupHostFilter", zap.String("backend", backend), zap.Error(err))
+		return err
+	}
+	logger.Debug("Setup host filter successfully", zap.String("backend", backend), zap.Any("filter", filter))
+	return nil
+}
+
+// setupOffload changes the offloads of both ends of the veth pair created for the first interface, and
+// logs the final features. The features before are saved for DEL if restore is set.
+func setupOffload(logger *zap.Logger, netns ns.NetNS, hostVethPairName, containerID string, conf *ptypes.Veth) error {
+	features := networking.OffloadFeatures(conf.Offload)
+	state := &networking.OffloadState{}
+
+	var err error
+	if state.Host, err = networking.SetFeatures(hostVethPairName, features); err != nil {
+		logger.Error("failed to set features of host veth", zap.String("hostVeth", hostVethPairName), zap.Error(err))
+		return err
+	}
+	err = netns.Do(func(ns.NetNS) error {
+		state.Pod, err = networking.SetFeatures(defaultConVeth, features)
+		return err
+	})
+	if err != nil {
+		logger.Error("failed to set features of veth0", zap.Error(err))
+		return err
+	}
+
+	if conf.Offload.XDPGRO {
+		err = networking.AttachXDPPass(hostVethPairName)
+		if err == nil {
+			err = netns.Do(func(ns.NetNS) error {
+				return networking.AttachXDPPass(defaultConVeth)
+			})
+			// XDP is recorded for both ends, don't leave it on the host end alone
+			if err != nil {
+				if e := networking.DetachXDP(hostVethPairName); e != nil {
+					logger.Error("failed to detach the XDP program of host veth", zap.Error(e))
+					return e
+				}
+			}
+		}
+		if cnierrors.Code(err) == cnierrors.ErrUnsupportedBPF {
+			logger.Warn("the kernel doesn't support XDP on veth, xdp_gro is ignored", zap.Error(err))
+		} else if err != nil {
+			logger.Error("failed to attach XDP programs for xdp_gro", zap.Error(err))
+			return err
+		} else {
+			state.XDP = true
+		}
+	}
+
+	if conf.Offload.Restore {
+		if err = networking.SaveOffloadState(stateDir, containerID, state); err != nil {
+			logger.Error("failed to save offload state", zap.Error(err))
+			return err
+		}
+	}
+
+	// the kernel may turn off the features depending on others, log the final ones
+	hostFeatures, err := networking.GetFeatures(hostVethPairName, networking.OffloadFeatureNames)
+	if err != nil {
+		logger.Warn("failed to get features of host veth", zap.Error(err))
+	}
+	var podFeatures map[string]bool
+	err = netns.Do(func(ns.NetNS) error {
+		podFeatures, err = networking.GetFeatures(defaultConVeth, networking.OffloadFeatureNames)
+		return err
+	})
+	if err != nil {
+		logger.Warn("failed to get features of veth0", zap.Error(err))
+	}
+	logger.Info("Setup offload of the veth pair successfully", zap.Any("hostFeatures", hostFeatures),
+		zap.Any("podFeatures", podFeatures), zap.Bool("xdp", state.XDP))
+	return nil
+}
+
+// restoreOffload restores the features of the veth pair saved by ADD, the pod end only if its netns
+// is given. The pair is usually gone with the pod, so a failure is only logged.
+func restoreOffload(logger *zap.Logger, args *skel.CmdArgs) {
+	var netns ns.NetNS
+	if args.Netns != "" {
+		if n, err := ns.GetNS(args.Netns); err == nil {
+			defer n.Close()
+			netns = n
+		}
+	}
+	if err := networking.RestoreOffload(stateDir, args.ContainerID, getHostVethName(args.ContainerID), defaultConVeth, netns); err != nil {
+		logger.Warn("failed to restore offload of the veth pair", zap.Error(err))
+		return
+	}
+	logger.Debug("Restore offload of the veth pair")
+}
+
+// setHwAddress changes the hardware address of the chained interface, runtimeConfig.mac wins over the pod
+// annotation, which wins over hardware_prefix. It returns nil if the address isn't changed.
+func setHwAddress(ctx context.Context, logger *zap.Logger, podHandle *networking.Handle, conf *ptypes.Veth, overrides *config.PodOverrides, iface string) (net.HardwareAddr, error) {
+	var hwAddr net.HardwareAddr
+	var source string
+	switch {
+	case conf.RuntimeConfig != nil && conf.RuntimeConfig.Mac != "":
+		// it is validated by ParseVethConfig
+		hwAddr, _ = config.ParseMAC(conf.RuntimeConfig.Mac)
+		source = "runtimeConfig"
+	case overrides != nil && overrides.MAC != nil:
+		hwAddr = overrides.MAC
+		source = "pod annotation"
+	case len(conf.HwPrefix) != 0:
+		addr, err := podHandle.OverrideHwAddress(ctx, conf.HwPrefix, iface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update hardware address for interface %s, maybe hardware_prefix(%s) is invalid: %w", iface, conf.HwPrefix, err)
+		}
+
+		logger.Info("Override hardware address successfully", zap.String("interface", iface), zap.String("hardware address", addr))
+		return net.ParseMAC(addr)
+	default:
+		return nil, nil
+	}
+
+	if err := podHandle.SetHwAddress(ctx, iface, hwAddr); err != nil {
+		return nil, fmt.Errorf("failed to pin hardware address for interface %s: %w", iface, err)
+	}
+
+	logger.Info("Pin hardware address successfully", zap.String("interface", iface), zap.String("hardware address", hwAddr.String()), zap.String("source", source))
+	return hwAddr, nil
+}
+
+// podOverrides applies the annotations of the pod allowed by pod_overrides to the config, they are taken from
+// runtimeConfig if the runtime passes them, otherwise from the API server by the kubeconfig. It's nil without
+// pod_overrides.
+func podOverrides(logger *zap.Logger, conf *ptypes.Veth, k8sArgs *ptypes.K8sArgs) (*config.PodOverrides, error) {
+	if conf.PodOverrides == nil {
+		return nil, nil
+	}
+
+	var annotations map[string]string
+	switch {
+	case conf.RuntimeConfig != nil && conf.RuntimeConfig.PodAnnotations != nil:
+		annotations = conf.RuntimeConfig.PodAnnotations
+	case conf.PodOverrides.Kubeconfig != "" && k8sArgs.K8S_POD_NAME != "":
+		client, err := k8s.NewClient(conf.PodOverrides.Kubeconfig)
+		if err != nil {
+			logger.Error("failed to create kubernetes client", zap.Error(err))
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), k8s.DefaultTimeout)
+		defer cancel()
+		annotations, err = k8s.PodAnnotations(ctx, client, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+		if err != nil {
+			logger.Error("failed to get annotations of the pod", zap.Error(err))
+			return nil, err
+		}
+	default:
+		logger.Warn("the annotations of the pod are neither in runtimeConfig nor got by kubeconfig, pod_overrides is ignored")
+		return nil, nil
+	}
+
+	overrides, err := config.ApplyPodOverrides(conf, annotations)
+	if err != nil {
+		logger.Error("failed to apply pod annotations", zap.Error(err))
+		return nil, err
+	}
+	if len(overrides.Ignored) != 0 {
+		logger.Warn("the annotations aren't allowed by pod_overrides, they are ignored", zap.Strings("annotations", overrides.Ignored))
+	}
+	if len(overrides.Applied) != 0 {
+		logger.Info("Apply pod annotations successfully", zap.Any("annotations", overrides.Applied))
+	}
+	return overrides, nil
+}
+
+// nodeOverrides merges the annotation veth.spidernet.io/node-config of the node on top of the config, it returns
+// false if the node doesn't have it. The annotations are cached on the node, if the API server fails the cached
+// ones are used however old they are, or node_overrides is skipped without them, so the node keeps creating pods
+// while the API server is unreachable.
+func nodeOverrides(logger *zap.Logger, conf *ptypes.Veth, stdin []byte) ([]byte, bool, error) {
+	name, err := nodeName(conf.NodeOverrides)
+	if err != nil {
+		logger.Warn("failed to get the node name, node_overrides is skipped", zap.Error(err))
+		return stdin, false, nil
+	}
+	logger = logger.With(zap.String("Node", name))
+
+	ctx, cancel := context.WithTimeout(context.Background(), k8s.DefaultTimeout)
+	defer cancel()
+	annotations, err := nodeCache(conf.NodeOverrides, name).Annotations(ctx, name, func() (typedcorev1.NodesGetter, error) {
+		return k8s.NewClient(conf.NodeOverrides.Kubeconfig)
+	})
+	if err != nil {
+		if annotations == nil {
+			logger.Warn("failed to get the annotations of the node and none is cached, node_overrides is skipped", zap.Error(err))
+			return stdin, false, nil
+		}
+		logger.Warn("failed to get the annotations of the node, the cached ones are used", zap.Error(err))
+	}
+	if _, ok := annotations[config.NodeConfigAnnotation]; !ok {
+		return stdin, false, nil
+	}
+
+	merged, err := config.MergeNodeAnnotation(stdin, annotations)
+	if err != nil {
+		logger.Error("failed to merge node annotation", zap.Error(err))
+		return nil, false, err
+	}
+	logger.Info("Merge node annotation successfully", zap.String("annotation", annotations[config.NodeConfigAnnotation]), zap.ByteString("config", merged))
+	return merged, true, nil
+}
+
+// nodeName returns node_name of node_overrides, or the hostname which is the node name by default of kubelet
+func nodeName(overrides *ptypes.NodeOverrides) (string, error) {
+	if overrides.NodeName != "" {
+		return overrides.NodeName, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(hostname), nil
+}
+
+// nodeCache returns the cache of the annotations of the node in stateDir
+func nodeCache(overrides *ptypes.NodeOverrides, name string) *k8s.NodeCache {
+	ttl := config.DefaultNodeCacheTTL
+	if overrides.CacheTTL != nil {
+		ttl = *overrides.CacheTTL
+	}
+	return &k8s.NodeCache{Path: filepath.Join(stateDir, "node-"+name+".json"), TTL: time.Duration(ttl) * time.Second}
+}
+
+// setupBandwidth shapes the traffic of the pod on the host veth, the ifb device is removed by DEL
+func setupBandwidth(logger *zap.Logger, hostVethPairName, containerID string, bandwidth *ptypes.Bandwidth) error {
+	if err := networking.SetupBandwidth(hostVethPairName, getIfbName(containerID), bandwidth); err != nil {
+		logger.Error("failed to SetupBandwidth", zap.Any("bandwidth", bandwidth), zap.Error(err))
+		return err
+	}
+	logger.Debug("Setup bandwidth successfully", zap.Any("bandwidth", bandwidth))
+	return nil
+}
+
+// podBandwidth returns the limits of the pod, the directions given by the bandwidth capability of
+// runtimeConfig win over the ones of the config. It's nil if no direction is limited.
+func podBandwidth(conf *ptypes.Veth) *ptypes.Bandwidth {
+	bandwidth := &ptypes.Bandwidth{}
+	if conf.Bandwidth != nil {
+		*bandwidth = *conf.Bandwidth
+	}
+	if conf.RuntimeConfig != nil && conf.RuntimeConfig.Bandwidth != nil {
+		runtime := conf.RuntimeConfig.Bandwidth
+		if runtime.IngressRate > 0 {
+			bandwidth.IngressRate, bandwidth.IngressBurst = runtime.IngressRate, runtime.IngressBurst
+		}
+		if runtime.EgressRate > 0 {
+			bandwidth.EgressRate, bandwidth.EgressBurst = runtime.EgressRate, runtime.EgressBurst
+		}
+	}
+	if bandwidth.IngressRate == 0 && bandwidth.EgressRate == 0 {
+		return nil
 	}
+	return bandwidth
+}
+
+// setupEBPFRedirect adds the addresses of the chained interface to the programs redirecting the packets the node
+// routes to them into the pod, and redirects the packets from the pod to the node addresses into the node devices,
+// they are removed by DEL. The pod keeps the normal path if the kernel lacks the helpers.
+func setupEBPFRedirect(ctx, lockCtx context.Context, logger *zap.Logger, hostHandle, podHandle *networking.Handle, hostVethPairName, chainedInterface string, ipAddressOnNode, preInterfaceIPAddress []netlink.Addr, conf *ptypes.Veth) error {
+	podMAC, err := podHandle.HwAddressByName(ctx, defaultConVeth)
+	if err != nil {
+		logger.Error("failed to get hardware address of veth0", zap.Error(err))
+		return err
+	}
+
+	devices := conf.EBPFRedirect.Interfaces
+	if len(devices) == 0 {
+		if devices, err = nodeDevices(ctx, hostHandle, ipAddressOnNode); err != nil {
+			logger.Error("failed to get the devices of the node addresses", zap.Error(err))
+			return err
+		}
+	}
+
+	redirect := &networking.PodRedirect{
+		HostVeth:  hostVethPairName,
+		Interface: chainedInterface,
+		IPs:       addrsToIPs(preInterfaceIPAddress),
+		PodMAC:    podMAC,
+	}
+	// host_filter filters the traffic from the pod to the node on the host veth, it mustn't be skipped
+	if !hostFilter(conf) {
+		redirect.NodeIPs = addrsToIPs(ipAddressOnNode)
+	}
+	var helpers map[string]string
+	err = withHostLock(lockCtx, func() error {
+		helpers, err = networking.SetupPodRedirect(redirect, devices)
+		return err
+	})
+	if cnierrors.Code(err) == cnierrors.ErrUnsupportedBPF {
+		logger.Warn("the kernel doesn't support ebpf_redirect, fall back to the normal path", zap.Error(err))
+		return nil
+	}
+	if err != nil {
+		logger.Error("failed to SetupPodRedirect", zap.Strings("devices", devices), zap.Error(err))
+		return err
+	}
+	logger.Debug("Setup ebpf redirect successfully", zap.Any("redirect", redirect), zap.Any("helpers", helpers))
+	return nil
+}
+
+// nodeDevices returns the names of the devices holding the node addresses
+func nodeDevices(ctx context.Context, hostHandle *networking.Handle, ipAddressOnNode []netlink.Addr) ([]string, error) {
+	var devices []string
+	seen := make(map[int]bool)
+	for _, addr := range ipAddressOnNode {
+		// the host gateway may not be an address of the node
+		if addr.LinkIndex == 0 || seen[addr.LinkIndex] {
+			continue
+		}
+		seen[addr.LinkIndex] = true
+
+		link, err := hostHandle.LinkByIndex(ctx, addr.LinkIndex)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, link.Attrs().Name)
+	}
+	return devices, nil
+}
+
+// flushConntrack deletes the conntrack entries of the pod addresses on the host, the stale ones
+// only expire later, so a failure is logged rather than failing the invocation.
+func flushConntrack(logger *zap.Logger, ips []net.IP, cleanup *ptypes.ConntrackCleanup) {
+	scope := networking.ConntrackScope{Protocols: cleanup.Protocols}
+	for _, zone := range cleanup.Zones {
+		scope.Zones = append(scope.Zones, uint16(zone))
+	}
+	n, err := networking.FlushConntrack(ips, scope)
+	if err != nil {
+		logger.Warn("failed to flush conntrack entries of the pod", zap.Any("ips", ips), zap.Error(err))
+		return
+	}
+	logger.Debug("Flush conntrack entries of the pod", zap.Any("ips", ips), zap.Int("deleted", n))
+}
+
+func conntrackCleanup(conf *ptypes.Veth) bool {
+	return conf.ConntrackCleanup != nil && conf.ConntrackCleanup.Enable
+}
+
+func offloadRestore(conf *ptypes.Veth) bool {
+	return conf.Offload != nil && conf.Offload.Restore
+}
+
+func ebpfRedirect(conf *ptypes.Veth) bool {
+	return conf.EBPFRedirect != nil && conf.EBPFRedirect.Enable
+}
+
+func hostFilter(conf *ptypes.Veth) bool {
+	return conf.HostFilter != nil && conf.HostFilter.Enable
+}
+
+// hostIPFamily checks IPv6 of the node for a pod with IPv6 addresses, and returns the families to set up.
+// If IPv6 is disabled on the node, an IPv6-only pod or a dual-stack one with strict_dual_stack fails, otherwise
+// the IPv6 of the config is dropped and only IPv4 is set up.
+func hostIPFamily(logger *zap.Logger, conf *ptypes.Veth, ipFamily int) (int, error) {
+	err := networking.CheckIPv6()
+	if err == nil {
+		return ipFamily, checkIPv6Forwarding(logger, conf)
+	}
+	if cnierrors.Code(err) != cnierrors.ErrIPv6Disabled {
+		logger.Error("failed to check IPv6 of the node", zap.Error(err))
+		return ipFamily, err
+	}
+	if ipFamily == netlink.FAMILY_V6 || conf.StrictDualStack {
+		logger.Error("the pod has IPv6 addresses, but IPv6 is disabled on the node", zap.Error(err))
+		return ipFamily, err
+	}
+
+	logger.Warn("IPv6 is disabled on the node, only IPv4 of the dual-stack pod is set up", zap.Error(err))
+	config.DropIPv6(conf)
+	return netlink.FAMILY_V4, nil
+}
+
+// checkIPv6Forwarding applies host_forwarding of ipv6 if IPv6 forwarding of the node is off
+func checkIPv6Forwarding(logger *zap.Logger, conf *ptypes.Veth) error {
+	forwarding, err := networking.IPv6ForwardingEnabled()
+	if err != nil || forwarding {
+		return err
+	}
+	action := ptypes.HostForwardingWarn
+	if conf.IPv6 != nil && conf.IPv6.HostForwarding != "" {
+		action = conf.IPv6.HostForwarding
+	}
+	switch action {
+	case ptypes.HostForwardingFail:
+		logger.Error("net.ipv6.conf.all.forwarding of the node is off")
+		return cnierrors.New(cnierrors.ErrIPv6ForwardingDisabled, nil, "the pod has IPv6 addresses, but net.ipv6.conf.all.forwarding of the node is off")
+	case ptypes.HostForwardingEnable:
+		if err = networking.EnableIPv6Forwarding(); err != nil {
+			logger.Error("failed to enable IPv6 forwarding of the node", zap.Error(err))
+			return err
+		}
+		logger.Info("Enable IPv6 forwarding of the node successfully")
+	default:
+		logger.Warn("net.ipv6.conf.all.forwarding of the node is off, the IPv6 traffic of the pod forwarded by the node is dropped")
+	}
+	return nil
+}
+
+func egressViaHost(conf *ptypes.Veth) bool {
+	return conf.EgressViaHost != nil && conf.EgressViaHost.Enable
+}
+
+func replyViaVeth(conf *ptypes.Veth) bool {
+	return conf.ReplyViaVeth != nil && conf.ReplyViaVeth.Enable
+}
+
+func replyTableAndMark(reply *ptypes.ReplyViaVeth) (table, mark int) {
+	table, mark = ptypes.ReplyDefaultTable, ptypes.ReplyDefaultMark
+	if reply.Table != nil {
+		table = *reply.Table
+	}
+	if reply.Mark != nil {
+		mark = *reply.Mark
+	}
+	return table, mark
+}
+
+// policyTables returns the policy routing tables set up in the pod for the interface
+// with the given rule table, the ones of egress_via_host and reply_via_veth go with the first interface.
+func policyTables(conf *ptypes.Veth, ruleTable int) []int {
+	if ruleTable != unix.RT_TABLE_MAIN {
+		return []int{ruleTable}
+	}
+	var tables []int
+	if egressViaHost(conf) {
+		table, _ := egressTableAndMark(conf.EgressViaHost)
+		tables = append(tables, table)
+	}
+	if replyViaVeth(conf) {
+		table, _ := replyTableAndMark(conf.ReplyViaVeth)
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// countHostPodRoutes returns the number of pod routes via the host veths except the given one
+func countHostPodRoutes(exclude string) (int, error) {
+	handle, err := networking.NewHandle(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+	return handle.CountHostPodRoutes(context.Background(), hostVethPrefix, exclude)
+}
+
+func egressTableAndMark(egress *ptypes.EgressViaHost) (table, mark int) {
+	table, mark = ptypes.EgressDefaultTable, ptypes.EgressDefaultMark
+	if egress.Table != nil {
+		table = *egress.Table
+	}
+	if egress.Mark != nil {
+		mark = *egress.Mark
+	}
+	return table, mark
+}
+
+// hostGateway returns the gateway of each family for the routes via veth0, the configured one
+// or the source address of the host route to the pod.
+func hostGateway(ctx context.Context, hostHandle *networking.Handle, preInterfaceIPAddress []netlink.Addr, gateway *ptypes.HostGateway) (v4Gw, v6Gw net.IP, err error) {
+	if gateway == nil {
+		return hostHandle.GetGatewayIP(ctx, preInterfaceIPAddress)
+	}
+
+	// only look up the families which aren't configured
+	v4Gw, v6Gw = net.ParseIP(gateway.IPv4), net.ParseIP(gateway.IPv6)
+	var lookup []netlink.Addr
+	for _, addr := range preInterfaceIPAddress {
+		if (addr.IP.To4() != nil && v4Gw == nil) || (addr.IP.To4() == nil && v6Gw == nil) {
+			lookup = append(lookup, addr)
+		}
+	}
+	routeV4Gw, routeV6Gw, err := hostHandle.GetGatewayIP(ctx, lookup)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v4Gw == nil {
+		v4Gw = routeV4Gw
+	}
+	if v6Gw == nil {
+		v6Gw = routeV6Gw
+	}
+	return v4Gw, v6Gw, nil
+}
+
+// withHostGateway adds the configured host gateway to the node addresses if it's missing,
+// so the pod has the route and neighbor entry to reach it.
+func withHostGateway(addrs []netlink.Addr, gateway *ptypes.HostGateway, ipFamily int) []netlink.Addr {
+	if gateway == nil {
+		return addrs
+	}
+
+	for _, gw := range []string{gateway.IPv4, gateway.IPv6} {
+		ip := net.ParseIP(gw)
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil && ipFamily == netlink.FAMILY_V6) || (ip.To4() == nil && ipFamily == netlink.FAMILY_V4) {
+			continue
+		}
+
+		found := false
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			addrs = append(addrs, netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+		}
+	}
+	return addrs
+}
+
+// withHostLock runs fn under the host-scope lock, which serializes the changes of host-wide
+// state: sysctl, routes of table main and neighbor entries on the host.
+func withHostLock(ctx context.Context, fn func() error) error {
+	hostLock, err := lock.Acquire(ctx, lock.HostLockPath(lockDir))
+	if err != nil {
+		return err
+	}
+	defer hostLock.Release() // nolint: errcheck
+	return fn()
+}
+
+func lockTimeout(conf *ptypes.Veth) time.Duration {
+	if conf.LockTimeout == nil || *conf.LockTimeout <= 0 {
+		return lock.DefaultTimeout
+	}
+	return time.Duration(*conf.LockTimeout) * time.Second
+}
+
+// linkLocalGateways returns the link-local gateways of the given family
+func linkLocalGateways(ipFamily int) []net.IP {
+	switch ipFamily {
+	case netlink.FAMILY_V4:
+		return []net.IP{linkLocalGatewayV4}
+	case netlink.FAMILY_V6:
+		return []net.IP{linkLocalGatewayV6}
+	}
+	return []net.IP{linkLocalGatewayV4, linkLocalGatewayV6}
+}
+
+func ipsToString(ips []net.IP) []string {
+	cidrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			cidrs = append(cidrs, (&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}).String())
+		} else {
+			cidrs = append(cidrs, (&net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}).String())
+		}
+	}
+	return cidrs
+}
+
+func addrsToIPs(addrs []netlink.Addr) []net.IP {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
+
+// getIfbName returns the name of the ifb device of the pod, which is named like the host veth
+func getIfbName(containerID string) string {
+	return fmt.Sprintf("%s%s", ifbPrefix, containerID[:min(len(containerID))])
 }
 
 // getHostVethName select the first 11 characters of the containerID for the host veth.
 func getHostVethName(containerID string) string {
-	return fmt.Sprintf("veth%s", containerID[:min(len(containerID))])
+	return fmt.Sprintf("%s%s", hostVethPrefix, containerID[:min(len(containerID))])
 }
 
 func min(len int) int {
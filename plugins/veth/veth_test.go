@@ -0,0 +1,1137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spidernet-io/plugins/pkg/cnierrors"
+	"github.com/spidernet-io/plugins/pkg/config"
+	k8sfake "github.com/spidernet-io/plugins/pkg/k8s/fake"
+	"github.com/spidernet-io/plugins/pkg/lock"
+	"github.com/spidernet-io/plugins/pkg/logging"
+	"github.com/spidernet-io/plugins/pkg/networking"
+	"github.com/spidernet-io/plugins/pkg/networking/fake"
+	ptypes "github.com/spidernet-io/plugins/pkg/types"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const netConfTemplate = `{
+	"cniVersion": "1.0.0",
+	"name": "macvlan",
+	"type": "veth",
+	"cluster_cidr": ["10.233.64.0/18"],
+	"service_cidr": ["10.233.0.0/18"],
+	"log_options": {"log_file": %q},%s
+	"prevResult": {
+		"cniVersion": "1.0.0",
+		"interfaces": [{"name": %q, "sandbox": %q}],
+		"ips": [{"address": %q, "interface": 0}]
+	}
+}`
+
+// addLink adds a link with the given address into the current netns, it's a bridge
+// rather than dummy which may not be built into the kernel
+func addLink(name, addr string) {
+	Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})).To(Succeed())
+	link, err := netlink.LinkByName(name)
+	Expect(err).NotTo(HaveOccurred())
+	ipNet, err := netlink.ParseIPNet(addr)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet})).To(Succeed())
+	Expect(netlink.LinkSetUp(link)).To(Succeed())
+}
+
+// newHostNS returns a netns playing the node, with the node address 10.6.0.1/16
+func newHostNS() ns.NetNS {
+	hostNS, err := testutils.NewNS()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(hostNS.Do(func(ns.NetNS) error {
+		defer GinkgoRecover()
+		addLink("ens1", "10.6.0.1/16")
+		return nil
+	})).To(Succeed())
+	return hostNS
+}
+
+// newPodNS returns the netns of the i-th pod, the k-th interface has the address 10.6.<k+1>.<i+1>/16
+func newPodNS(i int, ifaces []string) ns.NetNS {
+	netns, err := testutils.NewNS()
+	Expect(err).NotTo(HaveOccurred())
+	Expect(netns.Do(func(ns.NetNS) error {
+		defer GinkgoRecover()
+		for idx, iface := range ifaces {
+			addLink(iface, fmt.Sprintf("10.6.%d.%d/16", idx+1, i+1))
+		}
+		return nil
+	})).To(Succeed())
+	return netns
+}
+
+func closeNS(netns ns.NetNS) {
+	Expect(netns.Close()).To(Succeed())
+	Expect(testutils.UnmountNS(netns)).To(Succeed())
+}
+
+// testContainerID is the container of the pod of netnsFixture
+const testContainerID = "00000000000"
+
+// netnsFixture is a node and a pod in their own netns, with the locks and the state of the plugin
+// in a temporary directory
+type netnsFixture struct {
+	hostNS, podNS ns.NetNS
+	tmpDir        string
+}
+
+// setupNetns creates the fixture with the given interfaces in the pod, it's called by BeforeEach
+// and cleaned up after the spec. The spec is skipped without root.
+func setupNetns(ifaces ...string) *netnsFixture {
+	if os.Geteuid() != 0 {
+		Skip("requires root to create network namespaces")
+	}
+
+	env := &netnsFixture{tmpDir: GinkgoT().TempDir()}
+	lockDir = filepath.Join(env.tmpDir, "locks")
+	stateDir = filepath.Join(env.tmpDir, "state")
+	env.hostNS = newHostNS()
+	env.podNS = newPodNS(0, ifaces)
+	DeferCleanup(func() {
+		closeNS(env.podNS)
+		closeNS(env.hostNS)
+		lockDir = lock.DefaultLockDir
+		stateDir = networking.DefaultStateDir
+	})
+	return env
+}
+
+// args returns the args of the interface of the pod with the address, and the options put into netConfTemplate
+func (env *netnsFixture) args(ifName, addr, options string) *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: testContainerID,
+		Netns:       env.podNS.Path(),
+		IfName:      ifName,
+		StdinData:   []byte(fmt.Sprintf(netConfTemplate, filepath.Join(env.tmpDir, "veth.log"), options, ifName, env.podNS.Path(), addr)),
+	}
+}
+
+var _ = Describe("veth", func() {
+	Context("concurrent ADD", func() {
+		const pods = 16
+		ifaces := []string{"net1", "net2"}
+
+		var env *netnsFixture
+		var podNS []ns.NetNS
+
+		BeforeEach(func() {
+			env = setupNetns(ifaces...)
+			// the invocations run in one process, the global logger is initialized once instead of by each of them
+			Expect(logging.InitLogger(logging.InitLogOptions(&ptypes.LogOptions{LogFilePath: filepath.Join(env.tmpDir, "veth.log")}), pluginName)).To(Succeed())
+			initLogger = func(*ptypes.LogOptions, string) error { return nil }
+
+			podNS = []ns.NetNS{env.podNS}
+			for i := 1; i < pods; i++ {
+				podNS = append(podNS, newPodNS(i, ifaces))
+			}
+			DeferCleanup(func() {
+				for _, netns := range podNS[1:] {
+					closeNS(netns)
+				}
+				initLogger = logging.InitLogger
+			})
+		})
+
+		It("every interface of every pod succeeds with a single veth0", func() {
+			errs := make(chan error, pods*len(ifaces))
+			wg := sync.WaitGroup{}
+			for i, netns := range podNS {
+				for idx, iface := range ifaces {
+					args := &skel.CmdArgs{
+						ContainerID: fmt.Sprintf("%011d", i),
+						Netns:       netns.Path(),
+						IfName:      iface,
+						StdinData: []byte(fmt.Sprintf(netConfTemplate, filepath.Join(env.tmpDir, "veth.log"), "", iface, netns.Path(),
+							fmt.Sprintf("10.6.%d.%d/16", idx+1, i+1))),
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						errs <- env.hostNS.Do(func(ns.NetNS) error {
+							return cmdAdd(args)
+						})
+					}()
+				}
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			for _, netns := range podNS {
+				Expect(netns.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					links, err := netlink.LinkList()
+					Expect(err).NotTo(HaveOccurred())
+					veths := 0
+					for _, link := range links {
+						if _, ok := link.(*netlink.Veth); ok {
+							Expect(link.Attrs().Name).To(Equal(defaultConVeth))
+							veths++
+						}
+					}
+					Expect(veths).To(Equal(1))
+					return nil
+				})).To(Succeed())
+			}
+
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				for i := range podNS {
+					link, err := netlink.LinkByName(getHostVethName(fmt.Sprintf("%011d", i)))
+					Expect(err).NotTo(HaveOccurred())
+					routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(routes).To(HaveLen(len(ifaces)))
+					for _, route := range routes {
+						Expect(route.Dst.Mask).To(Equal(net.CIDRMask(32, 32)))
+					}
+				}
+				return nil
+			})).To(Succeed())
+		})
+	})
+	Context("link_local_gateway", func() {
+		var env *netnsFixture
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+
+		})
+
+		It("route via a single link-local gateway", func() {
+			args := env.args("net1", "10.6.1.1/16", `"link_local_gateway": true,`)
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})).To(Succeed())
+
+			var hostVethHwAddress net.HardwareAddr
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(getHostVethName(args.ContainerID))
+				Expect(err).NotTo(HaveOccurred())
+				hostVethHwAddress = link.Attrs().HardwareAddr
+
+				proxyARP, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", link.Attrs().Name))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(proxyARP).To(Equal("1"))
+				return nil
+			})).To(Succeed())
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+
+				neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(neighs).To(HaveLen(1))
+				Expect(neighs[0].IP.Equal(linkLocalGatewayV4)).To(BeTrue())
+				Expect(neighs[0].HardwareAddr).To(Equal(hostVethHwAddress))
+
+				routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				gateways := map[string]string{}
+				for _, route := range routes {
+					gateways[route.Dst.String()] = route.Gw.String()
+					// the address of the chained interface is the src by default
+					Expect(route.Src.String()).To(Equal("10.6.1.1"))
+				}
+				// no route per node address
+				Expect(gateways).NotTo(HaveKey("10.6.0.1/32"))
+				Expect(gateways).To(HaveKeyWithValue("10.233.64.0/18", linkLocalGatewayV4.String()))
+				Expect(gateways).To(HaveKeyWithValue("10.233.0.0/18", linkLocalGatewayV4.String()))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("leave src of the routes to the kernel by route_source", func() {
+			args := env.args("net1", "10.6.1.1/16", `"link_local_gateway": true, "route_source": {"enabled": false},`)
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})).To(Succeed())
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+				routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).NotTo(BeEmpty())
+				for _, route := range routes {
+					Expect(route.Src).To(BeNil())
+				}
+				return nil
+			})).To(Succeed())
+		})
+	})
+	Context("ipv6", func() {
+		const dualStackConfTemplate = `{
+			"cniVersion": "1.0.0",
+			"name": "macvlan",
+			"type": "veth",
+			"cluster_cidr": ["10.233.64.0/18", "fd00:233::/64"],
+			"log_options": {"log_file": %q},%s
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [{"name": %q, "sandbox": %q}],
+				"ips": [{"address": %q, "interface": 0}, {"address": %q, "interface": 0}]
+			}
+		}`
+
+		var env *netnsFixture
+		var result types.Result
+
+		// addAddrV6 adds the IPv6 address to the link of the current netns, without DAD so it's usable at once
+		addAddrV6 := func(name, addr string) {
+			link, err := netlink.LinkByName(name)
+			Expect(err).NotTo(HaveOccurred())
+			ipNet, err := netlink.ParseIPNet(addr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet, Flags: unix.IFA_F_NODAD})).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			env = setupNetns("net1", "net2")
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				addAddrV6("ens1", "fd00:6::1/64")
+				return nil
+			})).To(Succeed())
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				addAddrV6("net1", "fd00:6::101/64")
+				addAddrV6("net2", "fd00:6::201/64")
+				return nil
+			})).To(Succeed())
+		})
+
+		add := func(iface, options string) error {
+			addrs := map[string][]string{"net1": {"10.6.1.1/16", "fd00:6::101/64"}, "net2": {"10.6.2.1/16", "fd00:6::201/64"}}[iface]
+			args := &skel.CmdArgs{
+				ContainerID: testContainerID,
+				Netns:       env.podNS.Path(),
+				IfName:      iface,
+				StdinData:   []byte(fmt.Sprintf(dualStackConfTemplate, filepath.Join(env.tmpDir, "veth.log"), options, iface, env.podNS.Path(), addrs[0], addrs[1])),
+			}
+			return env.hostNS.Do(func(ns.NetNS) error {
+				var err error
+				result, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+		}
+
+		hostSysctl := func(name string) string {
+			var value string
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				var err error
+				value, err = sysctl.Sysctl(name)
+				return err
+			})).To(Succeed())
+			return value
+		}
+
+		// proxies returns the IPv6 proxy entries on the host veth
+		proxies := func() []string {
+			var ips []string
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(getHostVethName(testContainerID))
+				Expect(err).NotTo(HaveOccurred())
+				list, err := netlink.NeighProxyList(link.Attrs().Index, netlink.FAMILY_V6)
+				Expect(err).NotTo(HaveOccurred())
+				for _, neigh := range list {
+					ips = append(ips, neigh.IP.String())
+				}
+				return nil
+			})).To(Succeed())
+			return ips
+		}
+
+		It("set up both families with the static neighbors of the node addresses", func() {
+			Expect(add("net1", "")).To(Succeed())
+
+			// the node addresses aren't proxied by the host veth
+			hostVeth := getHostVethName(testContainerID)
+			Expect(hostSysctl(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", hostVeth))).To(Equal("0"))
+			Expect(proxies()).To(BeEmpty())
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+				neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V6)
+				Expect(err).NotTo(HaveOccurred())
+				var ips []string
+				for _, neigh := range neighs {
+					ips = append(ips, neigh.IP.String())
+				}
+				Expect(ips).To(ContainElement("fd00:6::1"))
+
+				routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+				Expect(err).NotTo(HaveOccurred())
+				var dsts []string
+				for _, route := range routes {
+					if route.Dst != nil {
+						dsts = append(dsts, route.Dst.String())
+					}
+				}
+				Expect(dsts).To(ContainElements("10.6.0.1/32", "fd00:6::1/128", "10.233.64.0/18", "fd00:233::/64"))
+				return nil
+			})).To(Succeed())
+
+			// the default routes from router advertisements are only suppressed for the second interface
+			Expect(add("net2", "")).To(Succeed())
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				Expect(sysctl.Sysctl("net/ipv6/conf/net1/accept_ra_defrtr")).To(Equal("1"))
+				Expect(sysctl.Sysctl("net/ipv6/conf/net2/accept_ra_defrtr")).To(Equal("0"))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("proxy the link-local gateway on the host veth", func() {
+			Expect(add("net1", `"link_local_gateway": true,`)).To(Succeed())
+
+			hostVeth := getHostVethName(testContainerID)
+			Expect(hostSysctl(fmt.Sprintf("net/ipv6/conf/%s/proxy_ndp", hostVeth))).To(Equal("1"))
+			Expect(proxies()).To(Equal([]string{"fe80::1"}))
+		})
+
+		It("check the IPv6 forwarding of the node", func() {
+			Expect(hostSysctl("net/ipv6/conf/all/forwarding")).To(Equal("0"))
+			Expect(cnierrors.Code(add("net1", `"ipv6": {"host_forwarding": "fail"},`))).To(Equal(cnierrors.ErrIPv6ForwardingDisabled))
+
+			// ens1 learned the default route from router advertisements
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName("ens1")
+				if err != nil {
+					return err
+				}
+				_, dst, _ := net.ParseCIDR("::/0")
+				if err = netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.ParseIP("fd00:6::fe"), Protocol: unix.RTPROT_RA}); err != nil {
+					return err
+				}
+				for _, iface := range []string{"ens1", "default"} {
+					if _, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", iface), "1"); err != nil {
+						return err
+					}
+				}
+				return nil
+			})).To(Succeed())
+			Expect(add("net1", `"ipv6": {"host_forwarding": "enable"},`)).To(Succeed())
+			Expect(hostSysctl("net/ipv6/conf/all/forwarding")).To(Equal("1"))
+			// the node keeps learning from router advertisements, the host veths don't
+			Expect(hostSysctl("net/ipv6/conf/ens1/accept_ra")).To(Equal("2"))
+			Expect(hostSysctl("net/ipv6/conf/default/accept_ra")).To(Equal("1"))
+			Expect(hostSysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", getHostVethName(testContainerID)))).NotTo(Equal("2"))
+		})
+
+		Context("IPv6 disabled on the node", func() {
+			BeforeEach(func() {
+				Expect(env.hostNS.Do(func(ns.NetNS) error {
+					_, err := sysctl.Sysctl("net/ipv6/conf/default/disable_ipv6", "1")
+					return err
+				})).To(Succeed())
+			})
+
+			It("fail with a precise error by strict_dual_stack and leave the pod untouched", func() {
+				err := add("net1", `"strict_dual_stack": true,`)
+				Expect(cnierrors.Code(err)).To(Equal(cnierrors.ErrIPv6Disabled))
+				Expect(err.Error()).To(ContainSubstring("net.ipv6.conf.default.disable_ipv6=1"))
+
+				Expect(env.podNS.Do(func(ns.NetNS) error {
+					_, err := netlink.LinkByName(defaultConVeth)
+					Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+					return nil
+				})).To(Succeed())
+			})
+
+			It("only set up IPv4 of the dual-stack pod", func() {
+				Expect(add("net1", `"routes": [{"dst": "fd00:7::/64"}, {"dst": "10.7.0.0/16"}],`)).To(Succeed())
+
+				// the IPv6 address allocated is still reported
+				r, err := current.GetResult(result)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.IPs).To(HaveLen(2))
+
+				Expect(env.podNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					link, err := netlink.LinkByName(defaultConVeth)
+					Expect(err).NotTo(HaveOccurred())
+					routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+					Expect(err).NotTo(HaveOccurred())
+					var dsts []string
+					for _, route := range routes {
+						if route.Dst != nil && !route.Dst.IP.IsLinkLocalUnicast() {
+							dsts = append(dsts, route.Dst.String())
+						}
+					}
+					Expect(dsts).To(ConsistOf("10.6.0.1/32", "10.233.64.0/18", "10.7.0.0/16"))
+					return nil
+				})).To(Succeed())
+
+				Expect(env.hostNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					link, err := netlink.LinkByName(getHostVethName(testContainerID))
+					Expect(err).NotTo(HaveOccurred())
+					routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(routes).To(BeEmpty())
+					return nil
+				})).To(Succeed())
+			})
+		})
+	})
+	Context("egress_via_host", func() {
+		var env *netnsFixture
+		var fakes map[iptables.Protocol]*fake.IPTables
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName("net1")
+				if err != nil {
+					return err
+				}
+				return netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("10.6.0.254")})
+			})).To(Succeed())
+
+			fakes = map[iptables.Protocol]*fake.IPTables{
+				iptables.ProtocolIPv4: fake.NewIPTables(),
+				iptables.ProtocolIPv6: fake.NewIPTables(),
+			}
+			newIPTables := networking.NewIPTables
+			networking.NewIPTables = func(proto iptables.Protocol) (networking.IPTables, error) {
+				return fakes[proto], nil
+			}
+
+			DeferCleanup(func() {
+				networking.NewIPTables = newIPTables
+			})
+		})
+
+		It("route the default egress via the host and clean up the host on DEL", func() {
+			args := env.args("net1", "10.6.1.1/16", `"egress_via_host": {"enabled": true}, "firewall_backend": "iptables",`)
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})).To(Succeed())
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				veth0, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+				Expect(err).NotTo(HaveOccurred())
+				defaults := map[int]string{}
+				for _, route := range routes {
+					// the default route has no dst or the dst of prefix length 0
+					if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" {
+						defaults[route.Table] = route.Gw.String()
+						if route.Table == unix.RT_TABLE_MAIN {
+							Expect(route.LinkIndex).To(Equal(veth0.Attrs().Index))
+						}
+					}
+				}
+				Expect(defaults).To(Equal(map[int]string{
+					unix.RT_TABLE_MAIN:        "10.6.0.1",
+					ptypes.EgressDefaultTable: "10.6.0.254",
+				}))
+				return nil
+			})).To(Succeed())
+
+			chain := networking.EgressChainName(args.ContainerID)
+			Expect(fakes[iptables.ProtocolIPv4].Rules("nat", chain)).To(Equal([]string{
+				"-d 10.233.64.0/18 -j RETURN", "-d 10.233.0.0/18 -j RETURN", "-j MASQUERADE",
+			}))
+			Expect(fakes[iptables.ProtocolIPv4].Rules("mangle", "PREROUTING")).To(HaveLen(2))
+
+			forward := func() string {
+				var value string
+				Expect(env.hostNS.Do(func(ns.NetNS) error {
+					var err error
+					value, err = sysctl.Sysctl("net/ipv4/ip_forward")
+					return err
+				})).To(Succeed())
+				return value
+			}
+			Expect(forward()).To(Equal("1"))
+
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(fakes[iptables.ProtocolIPv4].Rules("nat", "POSTROUTING")).To(BeEmpty())
+			exists, err := fakes[iptables.ProtocolIPv4].ChainExists("nat", chain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			// veth enabled forwarding for the pod only
+			Expect(forward()).To(Equal("0"))
+		})
+	})
+	Context("device_type", func() {
+		var env *netnsFixture
+
+		BeforeEach(func() {
+			env = setupNetns("net1", "net2")
+		})
+
+		add := func(ifName, addr, options string) error {
+			args := env.args(ifName, addr, options)
+			return env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})
+		}
+
+		// netkitSupported creates a netkit pair to probe the kernel
+		netkitSupported := func() bool {
+			probeNS, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer closeNS(probeNS)
+			err = probeNS.Do(func(ns.NetNS) error {
+				_, _, err := networking.SetupNetkitWithName("nk0", "nk1", 1500, probeNS)
+				return err
+			})
+			return cnierrors.Code(err) != cnierrors.ErrUnsupportedDevice
+		}
+
+		It("fail cleanly without netkit, or route via netkit without neighbor entries", func() {
+			err := add("net1", "10.6.1.1/16", `"device_type": "netkit",`)
+			if !netkitSupported() {
+				Expect(cnierrors.Code(err)).To(Equal(cnierrors.ErrUnsupportedDevice))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(add("net2", "10.6.2.1/16", `"device_type": "netkit",`)).To(Succeed())
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				veth0, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(networking.IsNetkit(veth0)).To(BeTrue())
+				neighs, err := netlink.NeighList(veth0.Attrs().Index, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(neighs).To(BeEmpty())
+				routes, err := netlink.RouteList(veth0, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).NotTo(BeEmpty())
+				return nil
+			})).To(Succeed())
+		})
+
+		It("fall back to veth without netkit", func() {
+			Expect(add("net1", "10.6.1.1/16", `"device_type": "netkit", "device_fallback": true,`)).To(Succeed())
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				veth0, err := netlink.LinkByName(defaultConVeth)
+				if err != nil {
+					return err
+				}
+				if networking.IsNetkit(veth0) != netkitSupported() {
+					return fmt.Errorf("unexpected device %s", veth0.Type())
+				}
+				return nil
+			})).To(Succeed())
+		})
+	})
+	Context("offload", func() {
+		var env *netnsFixture
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+		})
+
+		// features returns the gro and udp gro forwarding of the link in the netns
+		features := func(netns ns.NetNS, iface string) map[string]bool {
+			var current map[string]bool
+			Expect(netns.Do(func(ns.NetNS) error {
+				var err error
+				current, err = networking.GetFeatures(iface, []string{"rx-gro", "rx-udp-gro-forwarding"})
+				return err
+			})).To(Succeed())
+			return current
+		}
+
+		It("change the offloads of both ends and restore them on DEL", func() {
+			args := env.args("net1", "10.6.1.1/16", `"offload": {"gro": true, "udp_gro_forwarding": true, "restore": true},`)
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})).To(Succeed())
+
+			hostVeth := getHostVethName(args.ContainerID)
+			enabled := map[string]bool{"rx-gro": true, "rx-udp-gro-forwarding": true}
+			Expect(features(env.hostNS, hostVeth)).To(Equal(enabled))
+			Expect(features(env.podNS, defaultConVeth)).To(Equal(enabled))
+			Expect(filepath.Join(stateDir, "offload", args.ContainerID+".json")).To(BeAnExistingFile())
+
+			// the pod is still running, like the attachment is removed by multus
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdDel(args)
+			})).To(Succeed())
+			disabled := map[string]bool{"rx-gro": false, "rx-udp-gro-forwarding": false}
+			Expect(features(env.hostNS, hostVeth)).To(Equal(disabled))
+			Expect(features(env.podNS, defaultConVeth)).To(Equal(disabled))
+			Expect(filepath.Join(stateDir, "offload", args.ContainerID+".json")).NotTo(BeAnExistingFile())
+		})
+	})
+	Context("pod_overrides", func() {
+		var env *netnsFixture
+		var server *k8sfake.APIServer
+		var kubeconfig string
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+			server = k8sfake.NewAPIServer()
+			kubeconfig = filepath.Join(env.tmpDir, "kubeconfig")
+			Expect(server.WriteKubeconfig(kubeconfig)).To(Succeed())
+			DeferCleanup(func() {
+				server.Close()
+			})
+		})
+
+		add := func(options string) error {
+			args := env.args("net1", "10.6.1.1/16", options)
+			args.Args = "K8S_POD_NAMESPACE=default;K8S_POD_NAME=nginx"
+			return env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})
+		}
+
+		It("apply the allowed annotations got from the API server", func() {
+			server.AddPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "nginx",
+				Annotations: map[string]string{
+					"veth.spidernet.io/additional_cidr": "10.7.0.0/16",
+					"veth.spidernet.io/mac":             "0a:1b:0a:06:01:01",
+					"veth.spidernet.io/disabled":        "true",
+				},
+			}})
+			Expect(add(fmt.Sprintf(`"hardware_prefix": "0a:1c", "pod_overrides": {"allowed": ["additional_cidr", "mac"], "kubeconfig": %q},`, kubeconfig))).To(Succeed())
+			Expect(server.Requests()).To(Equal(1))
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				net1, err := netlink.LinkByName("net1")
+				Expect(err).NotTo(HaveOccurred())
+				// the mac wins over hardware_prefix
+				Expect(net1.Attrs().HardwareAddr.String()).To(Equal("0a:1b:0a:06:01:01"))
+
+				veth0, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+				routes, err := netlink.RouteList(veth0, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				var dsts []string
+				for _, route := range routes {
+					if route.Dst != nil {
+						dsts = append(dsts, route.Dst.String())
+					}
+				}
+				Expect(dsts).To(ContainElement("10.7.0.0/16"))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("opt out of veth by the annotations of runtimeConfig", func() {
+			Expect(add(`"pod_overrides": {"allowed": ["disabled"], "kubeconfig": "/nonexistent"},
+				"runtimeConfig": {"io.kubernetes.cri.pod-annotations": {"veth.spidernet.io/disabled": "true"}},`)).To(Succeed())
+			Expect(server.Requests()).To(BeZero())
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(defaultConVeth)
+				return err
+			})).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+		})
+
+		It("fail with an invalid annotation or try again if the pod isn't found", func() {
+			options := fmt.Sprintf(`"pod_overrides": {"allowed": ["rp_filter"], "kubeconfig": %q},`, kubeconfig)
+			Expect(cnierrors.Code(add(options))).To(Equal(types.ErrTryAgainLater))
+
+			server.AddPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "nginx",
+				Annotations: map[string]string{"veth.spidernet.io/rp_filter": "strict"},
+			}})
+			Expect(cnierrors.Code(add(options))).To(Equal(types.ErrInvalidNetworkConfig))
+		})
+	})
+	Context("runtimeConfig", func() {
+		var env *netnsFixture
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+		})
+
+		It("pin the mac and add the routes via veth0", func() {
+			args := env.args("net1", "10.6.1.1/16", `"hardware_prefix": "0a:1c",
+				"capabilities": {"mac": true, "routes": true},
+				"runtimeConfig": {"mac": "0a:1b:0a:06:01:02", "routes": [{"dst": "10.8.0.0/16"}]},`)
+			var r types.Result
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				var err error
+				r, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})).To(Succeed())
+
+			// the result reports the mac pinned
+			result, err := current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces).To(HaveLen(1))
+			Expect(result.Interfaces[0].Mac).To(Equal("0a:1b:0a:06:01:02"))
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				net1, err := netlink.LinkByName("net1")
+				Expect(err).NotTo(HaveOccurred())
+				// the mac wins over hardware_prefix
+				Expect(net1.Attrs().HardwareAddr.String()).To(Equal("0a:1b:0a:06:01:02"))
+
+				veth0, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+				routes, err := netlink.RouteList(veth0, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				var dsts []string
+				for _, route := range routes {
+					if route.Dst != nil {
+						dsts = append(dsts, route.Dst.String())
+					}
+				}
+				Expect(dsts).To(ContainElement("10.8.0.0/16"))
+				return nil
+			})).To(Succeed())
+		})
+	})
+	Context("node config", func() {
+		var env *netnsFixture
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+			nodeConfigDir = filepath.Join(env.tmpDir, "veth.d")
+			Expect(os.Mkdir(nodeConfigDir, 0o755)).To(Succeed())
+			DeferCleanup(func() {
+				nodeConfigDir = config.DefaultNodeConfigDir
+			})
+		})
+
+		add := func() error {
+			args := env.args("net1", "10.6.1.1/16", `"additional_cidr": ["10.7.0.0/16"],`)
+			return env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})
+		}
+
+		It("merge the node config on top of the config", func() {
+			Expect(os.WriteFile(filepath.Join(nodeConfigDir, "10-dns.json"), []byte(`{"additional_cidr": ["169.254.20.10/32"]}`), 0o644)).To(Succeed())
+			Expect(add()).To(Succeed())
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				veth0, err := netlink.LinkByName(defaultConVeth)
+				Expect(err).NotTo(HaveOccurred())
+				routes, err := netlink.RouteList(veth0, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				var dsts []string
+				for _, route := range routes {
+					if route.Dst != nil {
+						dsts = append(dsts, route.Dst.String())
+					}
+				}
+				Expect(dsts).To(ContainElement("169.254.20.10/32"))
+				Expect(dsts).NotTo(ContainElement("10.7.0.0/16"))
+				return nil
+			})).To(Succeed())
+		})
+
+		It("fail with an unknown key of the node config", func() {
+			Expect(os.WriteFile(filepath.Join(nodeConfigDir, "10-dns.json"), []byte(`{"additional_cidrs": ["169.254.20.10/32"]}`), 0o644)).To(Succeed())
+			Expect(cnierrors.Code(add())).To(Equal(types.ErrInvalidNetworkConfig))
+		})
+	})
+	Context("node_overrides", func() {
+		var env *netnsFixture
+		var server *k8sfake.APIServer
+		var kubeconfig string
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+			server = k8sfake.NewAPIServer()
+			kubeconfig = filepath.Join(env.tmpDir, "kubeconfig")
+			Expect(server.WriteKubeconfig(kubeconfig)).To(Succeed())
+			DeferCleanup(func() {
+				server.Close()
+			})
+		})
+
+		add := func() error {
+			args := env.args("net1", "10.6.1.1/16", fmt.Sprintf(`"node_overrides": {"kubeconfig": %q, "node_name": "worker1"},`, kubeconfig))
+			return env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})
+		}
+
+		// veth0Routes returns the destinations routed via veth0 in the pod
+		veth0Routes := func() []string {
+			var dsts []string
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				veth0, err := netlink.LinkByName(defaultConVeth)
+				if err != nil {
+					return err
+				}
+				routes, err := netlink.RouteList(veth0, netlink.FAMILY_V4)
+				for _, route := range routes {
+					if route.Dst != nil {
+						dsts = append(dsts, route.Dst.String())
+					}
+				}
+				return err
+			})).To(Succeed())
+			return dsts
+		}
+
+		It("merge the annotation of the node", func() {
+			server.AddNode(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name:        "worker1",
+				Annotations: map[string]string{"veth.spidernet.io/node-config": `{"additional_cidr": ["10.7.0.0/16"]}`},
+			}})
+			Expect(add()).To(Succeed())
+			Expect(veth0Routes()).To(ContainElement("10.7.0.0/16"))
+			// the annotations are cached on the node
+			Expect(filepath.Join(stateDir, "node-worker1.json")).To(BeARegularFile())
+			Expect(server.Requests()).To(Equal(1))
+		})
+
+		It("skip the annotation if the API server is unreachable", func() {
+			server.SetStatus(http.StatusServiceUnavailable)
+			Expect(add()).To(Succeed())
+			Expect(veth0Routes()).NotTo(ContainElement("10.7.0.0/16"))
+		})
+	})
+	Context("bandwidth", func() {
+		var env *netnsFixture
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+		})
+
+		// rootTBF returns the rate in bytes of the root tbf qdisc of the link on the host, 0 if there is none
+		rootTBF := func(name string) uint64 {
+			var rate uint64
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName(name)
+				if err != nil {
+					return err
+				}
+				qdiscs, err := netlink.QdiscList(link)
+				if err != nil {
+					return err
+				}
+				for _, qdisc := range qdiscs {
+					if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+						rate = tbf.Rate
+					}
+				}
+				return nil
+			})).To(Succeed())
+			return rate
+		}
+
+		It("shape the traffic on the host veth by the config and runtimeConfig and remove it on DEL", func() {
+			args := env.args("net1", "10.6.1.1/16", `"bandwidth": {"ingress_rate": 8000000, "ingress_burst": 800000, "egress_rate": 8000000, "egress_burst": 800000},
+					"runtimeConfig": {"bandwidth": {"egressRate": 16000000, "egressBurst": 4294967295}},`)
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})).To(Succeed())
+
+			hostVeth, ifb := getHostVethName(args.ContainerID), getIfbName(args.ContainerID)
+			Expect(rootTBF(hostVeth)).To(Equal(uint64(1000000)))
+			// the egress of runtimeConfig wins
+			Expect(rootTBF(ifb)).To(Equal(uint64(2000000)))
+
+			// the pod is still running, like the attachment is removed by multus
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(rootTBF(hostVeth)).To(BeZero())
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(ifb)
+				return err
+			})).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+		})
+	})
+	Context("ebpf_redirect", func() {
+		var env *netnsFixture
+
+		BeforeEach(func() {
+			env = setupNetns("net1", "net2")
+		})
+
+		args := func(ifName, addr string) *skel.CmdArgs {
+			return env.args(ifName, addr, `"ebpf_redirect": {"enabled": true},`)
+		}
+
+		// filters returns the names of the bpf filters on the ingress of the device
+		filters := func(device string) []string {
+			var names []string
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName(device)
+				if err != nil {
+					return err
+				}
+				list, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+				if err != nil {
+					// no clsact without the redirect
+					return nil
+				}
+				for _, filter := range list {
+					if bpf, ok := filter.(*netlink.BpfFilter); ok {
+						names = append(names, bpf.Name)
+					}
+				}
+				return nil
+			})).To(Succeed())
+			return names
+		}
+
+		It("attach the programs to the node devices and detach them on DEL", func() {
+			for _, a := range []*skel.CmdArgs{args("net1", "10.6.1.1/16"), args("net2", "10.6.2.1/16")} {
+				Expect(env.hostNS.Do(func(ns.NetNS) error {
+					return cmdAdd(a)
+				})).To(Succeed())
+			}
+
+			hostVeth := getHostVethName(testContainerID)
+			names := filters("ens1")
+			// the kernel lacks the helpers, the pod falls back to the normal path
+			if len(names) == 0 {
+				Skip("the redirect helpers aren't supported by the kernel")
+			}
+			// both interfaces share the program of the device
+			Expect(names).To(Equal([]string{"spider-veth:to-pod"}))
+			Expect(filters(hostVeth)).To(Equal([]string{"spider-veth:to-host"}))
+
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdDel(args("net1", "10.6.1.1/16"))
+			})).To(Succeed())
+			Expect(filters("ens1")).To(BeEmpty())
+			Expect(filters(hostVeth)).To(BeEmpty())
+		})
+	})
+	Context("host_filter", func() {
+		var env *netnsFixture
+		var fakes map[iptables.Protocol]*fake.IPTables
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+
+			fakes = map[iptables.Protocol]*fake.IPTables{
+				iptables.ProtocolIPv4: fake.NewIPTables(),
+				iptables.ProtocolIPv6: fake.NewIPTables(),
+			}
+			newIPTables := networking.NewIPTables
+			networking.NewIPTables = func(proto iptables.Protocol) (networking.IPTables, error) {
+				return fakes[proto], nil
+			}
+
+			DeferCleanup(func() {
+				networking.NewIPTables = newIPTables
+			})
+		})
+
+		It("filter the traffic from the pod on the host veth and remove it on DEL", func() {
+			args := env.args("net1", "10.6.1.1/16", `"host_filter": {"enabled": true, "restrict_destinations": true, "allowed_ports": ["tcp/10250"]}, "firewall_backend": "iptables",`)
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})).To(Succeed())
+
+			ipt := fakes[iptables.ProtocolIPv4]
+			hostVeth := getHostVethName(args.ContainerID)
+			Expect(ipt.Rules("raw", "PREROUTING")).To(HaveLen(1))
+			Expect(ipt.Rules("raw", "PREROUTING")[0]).To(HavePrefix("-i " + hostVeth + " -j SPIDER-SPOOF-"))
+			Expect(ipt.Rules("filter", "FORWARD")).To(HaveLen(1))
+			forward := ipt.Rules("filter", "FORWARD")[0][len("-i "+hostVeth+" -j "):]
+			Expect(ipt.Rules("filter", forward)).To(ContainElements("-d 10.233.64.0/18 -j RETURN", "-d 10.233.0.0/18 -j RETURN", "-d 10.6.0.1/32 -j RETURN", "-j DROP"))
+			Expect(ipt.Rules("filter", "INPUT")).To(HaveLen(1))
+
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(ipt.Rules("raw", "PREROUTING")).To(BeEmpty())
+			Expect(ipt.Rules("filter", "FORWARD")).To(BeEmpty())
+			Expect(ipt.Rules("filter", "INPUT")).To(BeEmpty())
+		})
+	})
+	Context("reply_via_veth", func() {
+		var env *netnsFixture
+		var scripts []string
+
+		BeforeEach(func() {
+			env = setupNetns("net1")
+
+			scripts = nil
+			nftRun := networking.NftRun
+			networking.NftRun = func(script string) error {
+				scripts = append(scripts, script)
+				return nil
+			}
+
+			DeferCleanup(func() {
+				networking.NftRun = nftRun
+			})
+		})
+
+		It("send the replies of the connections from veth0 back via veth0", func() {
+			args := env.args("net1", "10.6.1.1/16", `"reply_via_veth": {"enabled": true}, "firewall_backend": "nftables",`)
+			Expect(env.hostNS.Do(func(ns.NetNS) error {
+				return cmdAdd(args)
+			})).To(Succeed())
+
+			Expect(scripts).To(HaveLen(1))
+			Expect(scripts[0]).To(ContainSubstring(`iifname "veth0" ct state new ct mark set ct mark or 0x10000`))
+
+			Expect(env.podNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: ptypes.ReplyDefaultTable}, netlink.RT_FILTER_TABLE)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(routes).To(HaveLen(1))
+				Expect(routes[0].Gw.String()).To(Equal("10.6.0.1"))
+
+				rules, err := netlink.RuleList(netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				found := false
+				for _, rule := range rules {
+					if rule.Table == ptypes.ReplyDefaultTable {
+						Expect(rule.Mark).To(BeEquivalentTo(ptypes.ReplyDefaultMark))
+						found = true
+					}
+				}
+				Expect(found).To(BeTrue())
+				return nil
+			})).To(Succeed())
+		})
+	})
+})